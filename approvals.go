@@ -0,0 +1,138 @@
+package timecapsule
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"time"
+)
+
+// AttributeApprovals holds the approval policy and approvals of a capsule
+// stored with WithApprovals
+const AttributeApprovals = AttributePrefix + "approvals"
+
+// Approval errors
+var (
+	ErrApprovalRequired    = errors.New("capsule is unlocked but awaiting approval")
+	ErrApproverNotAllowed  = errors.New("approver is not allowed to approve this capsule")
+	ErrInvalidApprovalRule = errors.New("required approvals must be between 1 and the number of approvers")
+)
+
+// Approvals is the approval state of a capsule stored with WithApprovals.
+// Once its unlock time has passed, the capsule stays locked until Required
+// of Approvers have approved it.
+type Approvals struct {
+	Required  int                  `json:"required"`
+	Approvers []string             `json:"approvers"`
+	Granted   map[string]time.Time `json:"granted,omitempty"`
+}
+
+// Approved reports whether enough approvers have approved
+func (a Approvals) Approved() bool {
+	return len(a.Granted) >= a.Required
+}
+
+// Pending returns the approvers who have not approved yet, in order
+func (a Approvals) Pending() []string {
+	var pending []string
+	for _, approver := range a.Approvers {
+		if _, ok := a.Granted[approver]; !ok {
+			pending = append(pending, approver)
+		}
+	}
+	return pending
+}
+
+// Approvals returns the approval state of a capsule stored with
+// WithApprovals, and false for capsules without an approval policy
+func (m Metadata) Approvals() (Approvals, bool) {
+	approvals, ok, err := parseApprovals(m.Attributes)
+	return approvals, ok && err == nil
+}
+
+// WithApprovals keeps the capsule locked after its unlock time until
+// required of the named approvers have called Approve
+func WithApprovals(required int, approvers ...string) StoreOption {
+	return func(o *StoreOptions) {
+		o.approvals = &Approvals{Required: required, Approvers: approvers}
+	}
+}
+
+// validate checks an approval policy given to WithApprovals
+func (a Approvals) validate() error {
+	unique := slices.Compact(slices.Sorted(slices.Values(a.Approvers)))
+	if a.Required < 1 || a.Required > len(a.Approvers) || len(unique) != len(a.Approvers) || slices.Contains(unique, "") {
+		return ErrInvalidApprovalRule
+	}
+	return nil
+}
+
+// encode stores the approval state in the attribute map
+func (a Approvals) encode(attributes map[string]string) error {
+	data, err := json.Marshal(a)
+	if err != nil {
+		return fmt.Errorf("timecapsule: encode approvals: %w", err)
+	}
+	attributes[AttributeApprovals] = string(data)
+	return nil
+}
+
+// parseApprovals reads the approval state from capsule attributes
+func parseApprovals(attributes map[string]string) (Approvals, bool, error) {
+	data, ok := attributes[AttributeApprovals]
+	if !ok {
+		return Approvals{}, false, nil
+	}
+
+	var approvals Approvals
+	if err := json.Unmarshal([]byte(data), &approvals); err != nil {
+		return Approvals{}, true, fmt.Errorf("timecapsule: decode approvals: %w", err)
+	}
+	return approvals, true, nil
+}
+
+// checkApprovals returns ErrApprovalRequired while a capsule with an
+// approval policy lacks approvals. Unreadable policies keep it locked.
+func checkApprovals(attributes map[string]string) error {
+	approvals, ok, err := parseApprovals(attributes)
+	if !ok {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrApprovalRequired, err)
+	}
+
+	if !approvals.Approved() {
+		return fmt.Errorf("timecapsule: %d of %d approvals: %w", len(approvals.Granted), approvals.Required, ErrApprovalRequired)
+	}
+	return nil
+}
+
+// approve records approver's approval at now in a copy of attributes.
+// Approving again keeps the original approval time.
+func approve(attributes map[string]string, approver string, now time.Time) (map[string]string, error) {
+	approvals, ok, err := parseApprovals(attributes)
+	if err != nil {
+		return nil, err
+	}
+	if !ok || !slices.Contains(approvals.Approvers, approver) {
+		return nil, fmt.Errorf("timecapsule: approver %q: %w", approver, ErrApproverNotAllowed)
+	}
+
+	if _, approved := approvals.Granted[approver]; approved {
+		return nil, nil
+	}
+
+	if approvals.Granted == nil {
+		approvals.Granted = make(map[string]time.Time)
+	}
+	approvals.Granted[approver] = now
+
+	updated := maps.Clone(attributes)
+	if err := approvals.encode(updated); err != nil {
+		return nil, err
+	}
+	return updated, nil
+}
@@ -0,0 +1,177 @@
+package timecapsule
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testStorageApprovals checks that a Storage updates attributes in place and
+// keeps capsules awaiting approval locked
+func testStorageApprovals(t *testing.T, storage fullStorage) {
+	t.Helper()
+	ctx := context.Background()
+
+	require.NoError(t, storage.StoreWithOptions(ctx, "gated", []byte("v"), time.Now().Add(-time.Second),
+		WithAttributes(map[string]string{"owner": "ops"}), WithApprovals(1, "alice")))
+
+	_, err := storage.Open(ctx, "gated")
+	assert.ErrorIs(t, err, ErrApprovalRequired)
+
+	err = storage.UpdateAttributes(ctx, "missing", func(map[string]string) (map[string]string, error) {
+		return map[string]string{}, nil
+	})
+	assert.ErrorIs(t, err, ErrCapsuleNotFound)
+
+	// Errors and nil maps leave the attributes unchanged
+	failure := errors.New("failure")
+	err = storage.UpdateAttributes(ctx, "gated", func(map[string]string) (map[string]string, error) {
+		return nil, failure
+	})
+	assert.ErrorIs(t, err, failure)
+	require.NoError(t, storage.UpdateAttributes(ctx, "gated", func(map[string]string) (map[string]string, error) {
+		return nil, nil
+	}))
+
+	require.NoError(t, storage.UpdateAttributes(ctx, "gated", func(attributes map[string]string) (map[string]string, error) {
+		assert.Equal(t, "ops", attributes["owner"])
+		return approve(attributes, "alice", time.Now())
+	}))
+
+	value, err := storage.Open(ctx, "gated")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("v"), value)
+
+	metadata, err := storage.Peek(ctx, "gated")
+	require.NoError(t, err)
+	assert.Equal(t, "ops", metadata.Attributes["owner"])
+	approvals, ok := metadata.Approvals()
+	require.True(t, ok)
+	assert.Contains(t, approvals.Granted, "alice")
+}
+
+func TestApprovals(t *testing.T) {
+	storage, err := NewFileStorage(t.TempDir())
+	require.NoError(t, err)
+	defer storage.Close()
+
+	capsules := map[string]testCapsule[string]{
+		"memory":     New[string](),
+		"persistent": NewWithStorage(storage, NewJSONCodec[string]()),
+	}
+
+	for name, capsule := range capsules {
+		t.Run(name, func(t *testing.T) {
+			defer capsule.Close()
+			ctx := context.Background()
+
+			for _, invalid := range []StoreOption{
+				WithApprovals(0, "alice"),
+				WithApprovals(2, "alice"),
+				WithApprovals(1, "alice", "alice"),
+				WithApprovals(1, ""),
+			} {
+				assert.ErrorIs(t, capsule.StoreWithOptions(ctx, "bad", "x", time.Now(), invalid), ErrInvalidApprovalRule)
+			}
+
+			require.NoError(t, capsule.StoreWithOptions(ctx, "release", "launch-codes", time.Now().Add(time.Hour),
+				WithApprovals(2, "alice", "bob", "carol")))
+
+			// Approving early does not bypass the unlock time
+			require.NoError(t, capsule.Approve(ctx, "release", "alice"))
+			_, err := capsule.Open(ctx, "release")
+			assert.ErrorIs(t, err, ErrCapsuleLocked)
+
+			require.NoError(t, capsule.Delay(ctx, "release", -time.Second))
+			_, err = capsule.Open(ctx, "release")
+			assert.ErrorIs(t, err, ErrApprovalRequired)
+			_, err = capsule.WaitForUnlock(ctx, "release")
+			assert.ErrorIs(t, err, ErrApprovalRequired)
+
+			assert.ErrorIs(t, capsule.Approve(ctx, "release", "mallory"), ErrApproverNotAllowed)
+			assert.ErrorIs(t, capsule.Approve(ctx, "missing", "alice"), ErrCapsuleNotFound)
+
+			// Approving twice counts once and keeps the first approval time
+			metadata, err := capsule.Peek(ctx, "release")
+			require.NoError(t, err)
+			first, _ := metadata.Approvals()
+			require.NoError(t, capsule.Approve(ctx, "release", "alice"))
+			_, err = capsule.Open(ctx, "release")
+			assert.ErrorIs(t, err, ErrApprovalRequired)
+
+			metadata, err = capsule.Peek(ctx, "release")
+			require.NoError(t, err)
+			approvals, ok := metadata.Approvals()
+			require.True(t, ok)
+			assert.Equal(t, first, approvals)
+			assert.False(t, approvals.Approved())
+			assert.Equal(t, []string{"bob", "carol"}, approvals.Pending())
+
+			require.NoError(t, capsule.Approve(ctx, "release", "carol"))
+			value, err := capsule.Open(ctx, "release")
+			require.NoError(t, err)
+			assert.Equal(t, "launch-codes", value)
+
+			metadata, err = capsule.Peek(ctx, "release")
+			require.NoError(t, err)
+			approvals, _ = metadata.Approvals()
+			assert.True(t, approvals.Approved())
+			assert.Equal(t, []string{"bob"}, approvals.Pending())
+
+			// Capsules without a policy cannot be approved
+			require.NoError(t, capsule.Store(ctx, "plain", "x", time.Now()))
+			assert.ErrorIs(t, capsule.Approve(ctx, "plain", "alice"), ErrApproverNotAllowed)
+			_, ok = Metadata{}.Approvals()
+			assert.False(t, ok)
+		})
+	}
+}
+
+func TestApprovalsCorruptPolicy(t *testing.T) {
+	capsule := New[string]()
+	defer capsule.Close()
+	ctx := context.Background()
+
+	// Unreadable policies keep the capsule locked
+	require.NoError(t, capsule.StoreWithOptions(ctx, "key", "v", time.Now(),
+		WithAttributes(map[string]string{AttributeApprovals: "{"})))
+	_, err := capsule.Open(ctx, "key")
+	assert.ErrorIs(t, err, ErrApprovalRequired)
+}
+
+func TestApprovalEvents(t *testing.T) {
+	capsule := New[string]()
+	defer capsule.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	events, err := capsule.Subscribe(ctx, SubscribeOptions{})
+	require.NoError(t, err)
+
+	require.NoError(t, capsule.StoreWithOptions(ctx, "key", "v", time.Now().Add(-time.Second), WithApprovals(1, "alice")))
+	require.NoError(t, capsule.Approve(ctx, "key", "alice"))
+
+	var types []EventType
+	for len(types) < 3 {
+		select {
+		case event := <-events:
+			types = append(types, event.Type)
+		case <-time.After(time.Second):
+			t.Fatalf("missing events, got %v", types)
+		}
+	}
+	assert.ElementsMatch(t, []EventType{EventStored, EventUnlocked, EventApproved}, types)
+
+	// Approving an unlocked capsule does not unlock it again
+	select {
+	case event := <-events:
+		t.Fatalf("unexpected event %v", event.Type)
+	case <-time.After(50 * time.Millisecond):
+	}
+	assert.Equal(t, "approved", EventApproved.String())
+}
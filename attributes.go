@@ -0,0 +1,49 @@
+package timecapsule
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+)
+
+// AttributePrefix is reserved for attributes managed by this package
+const AttributePrefix = "timecapsule."
+
+// WithAttributes attaches attributes to the capsule, returned in its
+// Metadata. Attributes are stored in the clear next to the capsule, even
+// when its value is encrypted, so they must not hold secrets.
+func WithAttributes(attributes map[string]string) StoreOption {
+	return func(o *StoreOptions) {
+		if o.Attributes == nil {
+			o.Attributes = make(map[string]string, len(attributes))
+		}
+		maps.Copy(o.Attributes, attributes)
+	}
+}
+
+// encodeAttributes serializes attributes for storage backends without a
+// native map type, mapping no attributes to the empty string
+func encodeAttributes(attributes map[string]string) (string, error) {
+	if len(attributes) == 0 {
+		return "", nil
+	}
+
+	data, err := json.Marshal(attributes)
+	if err != nil {
+		return "", fmt.Errorf("timecapsule: encode attributes: %w", err)
+	}
+	return string(data), nil
+}
+
+// decodeAttributes is the inverse of encodeAttributes
+func decodeAttributes(data string) (map[string]string, error) {
+	if data == "" {
+		return nil, nil
+	}
+
+	var attributes map[string]string
+	if err := json.Unmarshal([]byte(data), &attributes); err != nil {
+		return nil, fmt.Errorf("timecapsule: decode attributes: %w", err)
+	}
+	return attributes, nil
+}
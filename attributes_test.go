@@ -0,0 +1,63 @@
+package timecapsule
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testStorageAttributes checks that a Storage persists capsule attributes
+func testStorageAttributes(t *testing.T, storage fullStorage) {
+	t.Helper()
+	ctx := context.Background()
+
+	attributes := map[string]string{"owner": "ops", "ticket": "INC-1"}
+	require.NoError(t, storage.StoreWithOptions(ctx, "tagged", []byte("v"), time.Now().Add(time.Hour), WithAttributes(attributes)))
+	require.NoError(t, storage.Store(ctx, "plain", []byte("v"), time.Now().Add(time.Hour)))
+
+	metadata, err := storage.Peek(ctx, "tagged")
+	require.NoError(t, err)
+	assert.Equal(t, attributes, metadata.Attributes)
+
+	metadata, err = storage.Peek(ctx, "plain")
+	require.NoError(t, err)
+	assert.Empty(t, metadata.Attributes)
+
+	// Attributes survive unlock-time and value updates and appear in List
+	require.NoError(t, storage.SetUnlockTime(ctx, "tagged", time.Now().Add(-time.Second)))
+	require.NoError(t, storage.Rewrite(ctx, "tagged", func([]byte) ([]byte, error) { return []byte("w"), nil }))
+
+	page, err := storage.List(ctx, ListOptions{State: StateUnlocked})
+	require.NoError(t, err)
+	require.Len(t, page.Items, 1)
+	assert.Equal(t, attributes, page.Items[0].Metadata.Attributes)
+
+	// Replacing a capsule replaces its attributes
+	require.NoError(t, storage.Store(ctx, "tagged", []byte("v"), time.Now()))
+	metadata, err = storage.Peek(ctx, "tagged")
+	require.NoError(t, err)
+	assert.Empty(t, metadata.Attributes)
+}
+
+func TestAttributes(t *testing.T) {
+	capsule := New[string]()
+	defer capsule.Close()
+	ctx := context.Background()
+
+	attributes := map[string]string{"owner": "ops"}
+	require.NoError(t, capsule.StoreWithOptions(ctx, "key", "v", time.Now(), WithAttributes(attributes)))
+	attributes["owner"] = "changed"
+
+	metadata, err := capsule.Peek(ctx, "key")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"owner": "ops"}, metadata.Attributes)
+
+	// Metadata holds a copy of the stored attributes
+	metadata.Attributes["owner"] = "changed"
+	metadata, err = capsule.Peek(ctx, "key")
+	require.NoError(t, err)
+	assert.Equal(t, "ops", metadata.Attributes["owner"])
+}
@@ -0,0 +1,443 @@
+package timecapsule
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"sync"
+	"time"
+)
+
+// DefaultAuditPrefix prefixes the keys under which a StorageAuditSink stores
+// audit entries when no prefix is given
+const DefaultAuditPrefix = "audit/"
+
+// auditHashDomain separates audit entry hashes from other SHA-256 uses
+const auditHashDomain = "timecapsule audit v1\n"
+
+// auditEpoch is the unlock time of stored audit entries, so they are always
+// unlocked and listed in key order
+var auditEpoch = time.Unix(0, 0).UTC()
+
+// Audit log errors
+var (
+	ErrAuditTampered  = errors.New("audit log has been tampered with")
+	ErrAuditTruncated = errors.New("audit log has been truncated")
+)
+
+// AuditOperation names an audited capsule operation
+type AuditOperation string
+
+// Audited operations
+const (
+	AuditStore     AuditOperation = "store"
+	AuditOpen      AuditOperation = "open"
+	AuditOpenEarly AuditOperation = "open_early"
+	AuditDelay     AuditOperation = "delay"
+	AuditApprove   AuditOperation = "approve"
+	AuditDelete    AuditOperation = "delete"
+	AuditPurge     AuditOperation = "purge"
+)
+
+// AuditRecord describes one audited capsule operation
+type AuditRecord struct {
+	Time       time.Time      `json:"time"`
+	Operation  AuditOperation `json:"operation"`
+	Key        string         `json:"key,omitempty"`
+	Actor      string         `json:"actor,omitempty"`
+	Reason     string         `json:"reason,omitempty"`
+	UnlockTime time.Time      `json:"unlock_time,omitzero"`
+	Count      int            `json:"count,omitempty"`
+}
+
+// Auditor records audited capsule operations. An operation that cannot be
+// recorded fails.
+type Auditor interface {
+	Record(ctx context.Context, record AuditRecord) error
+}
+
+// audit records an operation with auditor, if one is configured
+func audit(ctx context.Context, auditor Auditor, record AuditRecord) error {
+	if auditor == nil {
+		return nil
+	}
+
+	if err := auditor.Record(ctx, record); err != nil {
+		return fmt.Errorf("timecapsule: audit %s of %q: %w", record.Operation, record.Key, err)
+	}
+	return nil
+}
+
+// AuditEntry is an AuditRecord chained into an audit log. Hash commits to
+// the entry and, through Previous, to every entry before it.
+type AuditEntry struct {
+	Sequence uint64 `json:"sequence"`
+	AuditRecord
+	Previous string `json:"previous"`
+	Hash     string `json:"hash"`
+}
+
+// digest computes the hash of an entry, ignoring its Hash field. It fails
+// for entries that cannot be encoded, such as times past year 9999.
+func (e AuditEntry) digest() (string, error) {
+	e.Hash = ""
+	data, err := json.Marshal(e)
+	if err != nil {
+		return "", fmt.Errorf("timecapsule: encode audit entry: %w", err)
+	}
+
+	sum := sha256.Sum256(append([]byte(auditHashDomain), data...))
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// AuditCheckpoint identifies the head of an audit log. Keeping the latest
+// checkpoint outside the log lets VerifyAuditLog detect a truncated tail.
+type AuditCheckpoint struct {
+	Sequence uint64 `json:"sequence"`
+	Hash     string `json:"hash"`
+}
+
+// AuditSink durably stores the entries of an audit log
+type AuditSink interface {
+	// Append adds entry to the end of the log
+	Append(ctx context.Context, entry AuditEntry) error
+
+	// Replay calls fn with every entry in order, stopping at the first error
+	Replay(ctx context.Context, fn func(AuditEntry) error) error
+}
+
+// AuditLog is an append-only, hash-chained Auditor writing to a sink. Each
+// entry commits to the one before it, so editing, removing or reordering
+// entries is detected by VerifyAuditLog.
+type AuditLog struct {
+	sink  AuditSink
+	clock Clock
+	mu    sync.Mutex
+	head  AuditCheckpoint
+}
+
+// NewAuditLog verifies the entries already in sink and returns a log that
+// appends to them
+func NewAuditLog(ctx context.Context, sink AuditSink, opts ...Option) (*AuditLog, error) {
+	head, err := VerifyAuditLog(ctx, sink, AuditCheckpoint{})
+	if err != nil {
+		return nil, err
+	}
+
+	o := newOptions(opts...)
+	return &AuditLog{sink: sink, clock: o.clock, head: head}, nil
+}
+
+// Record appends record to the log, timestamping it if its Time is zero
+func (l *AuditLog) Record(ctx context.Context, record AuditRecord) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if record.Time.IsZero() {
+		record.Time = l.clock.Now()
+	}
+	record.Time = record.Time.UTC()
+	if !record.UnlockTime.IsZero() {
+		record.UnlockTime = record.UnlockTime.UTC()
+	}
+
+	entry := AuditEntry{
+		Sequence:    l.head.Sequence + 1,
+		AuditRecord: record,
+		Previous:    l.head.Hash,
+	}
+
+	hash, err := entry.digest()
+	if err != nil {
+		return err
+	}
+	entry.Hash = hash
+
+	if err := l.sink.Append(ctx, entry); err != nil {
+		return err
+	}
+
+	l.head = AuditCheckpoint{Sequence: entry.Sequence, Hash: entry.Hash}
+	return nil
+}
+
+// Head returns the checkpoint of the latest entry
+func (l *AuditLog) Head() AuditCheckpoint {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.head
+}
+
+// ReplayAuditLog calls fn with every entry in sink in order, verifying the
+// chain as it goes. It returns ErrAuditTampered at the first edited,
+// removed or reordered entry and ErrAuditTruncated if leading entries are
+// missing.
+func ReplayAuditLog(ctx context.Context, sink AuditSink, fn func(AuditEntry) error) error {
+	var head AuditCheckpoint
+	return sink.Replay(ctx, func(entry AuditEntry) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		hash, err := entry.digest()
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case head.Sequence == 0 && entry.Sequence != 1:
+			return fmt.Errorf("timecapsule: audit log starts at entry %d: %w", entry.Sequence, ErrAuditTruncated)
+		case entry.Sequence != head.Sequence+1 || entry.Previous != head.Hash:
+			return fmt.Errorf("timecapsule: audit entry %d does not follow entry %d: %w", entry.Sequence, head.Sequence, ErrAuditTampered)
+		case entry.Hash != hash:
+			return fmt.Errorf("timecapsule: audit entry %d: %w", entry.Sequence, ErrAuditTampered)
+		}
+
+		head = AuditCheckpoint{Sequence: entry.Sequence, Hash: entry.Hash}
+		return fn(entry)
+	})
+}
+
+// VerifyAuditLog verifies every entry in sink and returns the checkpoint of
+// the latest one. A non-zero checkpoint saved earlier must still be part of
+// the log, or ErrAuditTruncated or ErrAuditTampered is returned.
+func VerifyAuditLog(ctx context.Context, sink AuditSink, checkpoint AuditCheckpoint) (AuditCheckpoint, error) {
+	var head AuditCheckpoint
+	err := ReplayAuditLog(ctx, sink, func(entry AuditEntry) error {
+		if entry.Sequence == checkpoint.Sequence && entry.Hash != checkpoint.Hash {
+			return fmt.Errorf("timecapsule: audit entry %d differs from checkpoint: %w", entry.Sequence, ErrAuditTampered)
+		}
+		head = AuditCheckpoint{Sequence: entry.Sequence, Hash: entry.Hash}
+		return nil
+	})
+	if err != nil {
+		return AuditCheckpoint{}, err
+	}
+
+	if head.Sequence < checkpoint.Sequence {
+		return AuditCheckpoint{}, fmt.Errorf("timecapsule: audit log ends at entry %d before checkpoint %d: %w", head.Sequence, checkpoint.Sequence, ErrAuditTruncated)
+	}
+
+	return head, nil
+}
+
+// FileAuditSink appends audit entries to a file as JSON lines, syncing
+// after every entry
+type FileAuditSink struct {
+	path string
+	mu   sync.Mutex
+	file *os.File
+}
+
+// NewFileAuditSink opens or creates the audit log file at path. A last line
+// left without its newline by an interrupted write is truncated, since its
+// entry was never acknowledged.
+func NewFileAuditSink(path string) (*FileAuditSink, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, fileRecordPerm)
+	if err != nil {
+		return nil, fmt.Errorf("timecapsule: open audit log: %w", err)
+	}
+
+	if err := truncateTornLine(file); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("timecapsule: repair audit log: %w", err)
+	}
+
+	return &FileAuditSink{path: path, file: file}, nil
+}
+
+// truncateTornLine cuts file back to just after its last newline
+func truncateTornLine(file *os.File) error {
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, 4096)
+	for end := info.Size(); end > 0; {
+		start := max(end-int64(len(buf)), 0)
+		chunk := buf[:end-start]
+		if _, err := file.ReadAt(chunk, start); err != nil {
+			return err
+		}
+
+		if i := bytes.LastIndexByte(chunk, '\n'); i >= 0 {
+			if size := start + int64(i) + 1; size < info.Size() {
+				return file.Truncate(size)
+			}
+			return nil
+		}
+		end = start
+	}
+
+	if info.Size() > 0 {
+		return file.Truncate(0)
+	}
+	return nil
+}
+
+// Append writes entry as one line and syncs the file
+func (s *FileAuditSink) Append(ctx context.Context, entry AuditEntry) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("timecapsule: encode audit entry: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.file == nil {
+		return ErrStorageClosed
+	}
+
+	if _, err := s.file.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("timecapsule: write audit log: %w", err)
+	}
+
+	if err := s.file.Sync(); err != nil {
+		return fmt.Errorf("timecapsule: sync audit log: %w", err)
+	}
+
+	return nil
+}
+
+// Replay reads the file from the start, treating an undecodable line as
+// tampering. A last line without its newline is an unfinished write and is
+// skipped.
+func (s *FileAuditSink) Replay(ctx context.Context, fn func(AuditEntry) error) error {
+	file, err := os.Open(s.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("timecapsule: open audit log: %w", err)
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	for line := 1; ; line++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		data, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("timecapsule: read audit log: %w", err)
+		}
+
+		var entry AuditEntry
+		if err := json.Unmarshal(data, &entry); err != nil {
+			return fmt.Errorf("timecapsule: audit log line %d: %w", line, ErrAuditTampered)
+		}
+
+		if err := fn(entry); err != nil {
+			return err
+		}
+	}
+}
+
+// Close closes the audit log file
+func (s *FileAuditSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.file == nil {
+		return nil
+	}
+
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
+
+// StorageAuditSink stores audit entries as capsules in a Storage, one per
+// entry, under a key prefix. Entries are stored unlocked.
+type StorageAuditSink struct {
+	storage Storage
+	prefix  string
+}
+
+// NewStorageAuditSink returns a sink storing entries in storage under
+// prefix, or DefaultAuditPrefix if prefix is empty. The storage is kept apart
+// from the audited capsules, and replaying requires it to implement
+// ListStorage.
+func NewStorageAuditSink(storage Storage, prefix string) *StorageAuditSink {
+	if prefix == "" {
+		prefix = DefaultAuditPrefix
+	}
+
+	return &StorageAuditSink{storage: storage, prefix: prefix}
+}
+
+// Append stores entry under its sequence number, refusing to overwrite an
+// existing entry
+func (s *StorageAuditSink) Append(ctx context.Context, entry AuditEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("timecapsule: encode audit entry: %w", err)
+	}
+
+	key := s.key(entry.Sequence)
+	if s.storage.Exists(ctx, key) {
+		return fmt.Errorf("timecapsule: audit entry %d already exists", entry.Sequence)
+	}
+
+	return s.storage.Store(ctx, key, data, auditEpoch)
+}
+
+// Replay lists the stored entries in sequence order
+func (s *StorageAuditSink) Replay(ctx context.Context, fn func(AuditEntry) error) error {
+	opts := ListOptions{Prefix: s.prefix}
+	for {
+		page, err := listStorage(ctx, s.storage, opts)
+		if err != nil {
+			return err
+		}
+
+		for _, item := range page.Items {
+			data, err := s.storage.Open(ctx, item.Key)
+			if err != nil {
+				return err
+			}
+
+			var entry AuditEntry
+			if err := json.Unmarshal(data, &entry); err != nil || item.Key != s.key(entry.Sequence) {
+				return fmt.Errorf("timecapsule: audit entry %q: %w", item.Key, ErrAuditTampered)
+			}
+
+			if err := fn(entry); err != nil {
+				return err
+			}
+		}
+
+		if page.NextCursor == "" {
+			return nil
+		}
+		opts.Cursor = page.NextCursor
+	}
+}
+
+// key returns the storage key of the entry with the given sequence number,
+// zero-padded so keys sort in sequence order
+func (s *StorageAuditSink) key(sequence uint64) string {
+	return fmt.Sprintf("%s%020d", s.prefix, sequence)
+}
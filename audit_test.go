@@ -0,0 +1,323 @@
+package timecapsule
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// auditOperations replays sink and returns the operation and key of every entry
+func auditOperations(t *testing.T, sink AuditSink) []string {
+	t.Helper()
+
+	var operations []string
+	err := ReplayAuditLog(context.Background(), sink, func(entry AuditEntry) error {
+		operations = append(operations, string(entry.Operation)+" "+entry.Key)
+		return nil
+	})
+	require.NoError(t, err)
+	return operations
+}
+
+func TestAuditLogCapsules(t *testing.T) {
+	storage, err := NewFileStorage(t.TempDir())
+	require.NoError(t, err)
+	defer storage.Close()
+	ctx := context.Background()
+
+	for name, newCapsule := range map[string]func(Auditor) testCapsule[string]{
+		"memory": func(auditor Auditor) testCapsule[string] { return New[string](WithAuditor(auditor)) },
+		"persistent": func(auditor Auditor) testCapsule[string] {
+			return NewWithStorage(storage, NewJSONCodec[string](), WithAuditor(auditor))
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			sink, err := NewFileAuditSink(filepath.Join(t.TempDir(), "audit.log"))
+			require.NoError(t, err)
+			defer sink.Close()
+
+			log, err := NewAuditLog(ctx, sink)
+			require.NoError(t, err)
+
+			capsule := newCapsule(log)
+			defer capsule.Close()
+
+			unlockTime := time.Now().Add(time.Hour)
+			require.NoError(t, capsule.StoreWithOptions(ctx, "report", "v", unlockTime, WithApprovals(1, "alice")))
+
+			// Failed operations are not audited
+			_, err = capsule.Open(ctx, "report")
+			assert.ErrorIs(t, err, ErrCapsuleLocked)
+
+			require.NoError(t, capsule.Delay(ctx, "report", -time.Second))
+			require.NoError(t, capsule.Approve(ctx, "report", "alice"))
+			_, err = capsule.Open(ctx, "report")
+			require.NoError(t, err)
+			require.NoError(t, capsule.Delete(ctx, "report"))
+
+			require.NoError(t, capsule.StoreWithOptions(ctx, "stale", "v", time.Now().Add(-time.Hour), WithExpiry(time.Now().Add(-time.Minute))))
+			purged, err := capsule.Purge(ctx)
+			require.NoError(t, err)
+			assert.Equal(t, 1, purged)
+
+			assert.Equal(t, []string{
+				"store report",
+				"delay report",
+				"approve report",
+				"open report",
+				"delete report",
+				"store stale",
+				"purge ",
+			}, auditOperations(t, sink))
+
+			var entries []AuditEntry
+			require.NoError(t, sink.Replay(ctx, func(entry AuditEntry) error {
+				entries = append(entries, entry)
+				return nil
+			}))
+			assert.True(t, unlockTime.Equal(entries[0].UnlockTime))
+			assert.Equal(t, "alice", entries[2].Actor)
+			assert.Equal(t, 1, entries[6].Count)
+
+			head, err := VerifyAuditLog(ctx, sink, AuditCheckpoint{})
+			require.NoError(t, err)
+			assert.Equal(t, log.Head(), head)
+			assert.Equal(t, uint64(7), head.Sequence)
+		})
+	}
+}
+
+func TestAuditLogFailure(t *testing.T) {
+	ctx := context.Background()
+	storage, err := NewFileStorage(t.TempDir())
+	require.NoError(t, err)
+	defer storage.Close()
+
+	for name, newCapsule := range map[string]func(Auditor) testCapsule[string]{
+		"memory": func(auditor Auditor) testCapsule[string] { return New[string](WithAuditor(auditor)) },
+		"persistent": func(auditor Auditor) testCapsule[string] {
+			return NewWithStorage(storage, NewJSONCodec[string](), WithAuditor(auditor))
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			auditor := &testAuditor{err: assert.AnError}
+			capsule := newCapsule(auditor)
+			defer capsule.Close()
+
+			// A capsule is not kept without being audited
+			assert.ErrorIs(t, capsule.Store(ctx, "key", "v", time.Now()), assert.AnError)
+			assert.False(t, capsule.Exists(ctx, "key"))
+
+			// and its value is never returned without being audited
+			auditor.err = nil
+			require.NoError(t, capsule.Store(ctx, "key", "v", time.Now()))
+			auditor.err = assert.AnError
+			_, err := capsule.Open(ctx, "key")
+			assert.ErrorIs(t, err, assert.AnError)
+
+			auditor.err = nil
+			value, err := capsule.Open(ctx, "key")
+			require.NoError(t, err)
+			assert.Equal(t, "v", value)
+
+			// Changes that cannot be audited are neither applied nor published
+			require.NoError(t, capsule.StoreWithOptions(ctx, "gated", "v", time.Now(), WithApprovals(1, "alice")))
+			events, err := capsule.Subscribe(ctx, SubscribeOptions{Types: []EventType{EventDelayed, EventApproved, EventDeleted}})
+			require.NoError(t, err)
+
+			auditor.err = assert.AnError
+			assert.ErrorIs(t, capsule.Delay(ctx, "key", time.Hour), assert.AnError)
+			assert.ErrorIs(t, capsule.Approve(ctx, "gated", "alice"), assert.AnError)
+			assert.ErrorIs(t, capsule.Delete(ctx, "key"), assert.AnError)
+			auditor.err = nil
+
+			_, err = capsule.Open(ctx, "key")
+			require.NoError(t, err)
+			_, err = capsule.Open(ctx, "gated")
+			assert.ErrorIs(t, err, ErrApprovalRequired)
+			select {
+			case event := <-events:
+				t.Fatalf("unexpected event %v", event.Type)
+			case <-time.After(50 * time.Millisecond):
+			}
+		})
+	}
+
+	// Records that cannot be encoded fail without panicking
+	sink, err := NewFileAuditSink(filepath.Join(t.TempDir(), "audit.log"))
+	require.NoError(t, err)
+	defer sink.Close()
+	log, err := NewAuditLog(ctx, sink)
+	require.NoError(t, err)
+
+	logged := New[string](WithAuditor(log))
+	defer logged.Close()
+	assert.Error(t, logged.Store(ctx, "key", "v", time.Date(10000, 1, 1, 0, 0, 0, 0, time.UTC)))
+	assert.Equal(t, AuditCheckpoint{}, log.Head())
+}
+
+func TestFileAuditSinkTampering(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "audit.log")
+
+	sink, err := NewFileAuditSink(path)
+	require.NoError(t, err)
+	log, err := NewAuditLog(ctx, sink)
+	require.NoError(t, err)
+	for _, key := range []string{"a", "b", "c", "d"} {
+		require.NoError(t, log.Record(ctx, AuditRecord{Operation: AuditStore, Key: key}))
+	}
+	checkpoint := log.Head()
+	require.NoError(t, sink.Close())
+
+	// Reopening continues the chain
+	sink, err = NewFileAuditSink(path)
+	require.NoError(t, err)
+	defer sink.Close()
+	log, err = NewAuditLog(ctx, sink)
+	require.NoError(t, err)
+	assert.Equal(t, checkpoint, log.Head())
+	require.NoError(t, log.Record(ctx, AuditRecord{Operation: AuditDelete, Key: "a"}))
+	checkpoint = log.Head()
+
+	original, err := os.ReadFile(path)
+	require.NoError(t, err)
+	lines := strings.SplitAfter(strings.TrimSuffix(string(original), "\n"), "\n")
+	require.Len(t, lines, 5)
+
+	edited := strings.Replace(lines[1], `"key":"b"`, `"key":"x"`, 1)
+	var rehashed AuditEntry
+	require.NoError(t, json.Unmarshal([]byte(edited), &rehashed))
+	rehashed.Hash, err = rehashed.digest()
+	require.NoError(t, err)
+	data, err := json.Marshal(rehashed)
+	require.NoError(t, err)
+
+	cases := []struct {
+		name  string
+		lines []string
+		err   error
+	}{
+		{"edited", []string{lines[0], edited, lines[2], lines[3], lines[4]}, ErrAuditTampered},
+		{"rehashed", []string{lines[0], string(data) + "\n", lines[2], lines[3], lines[4]}, ErrAuditTampered},
+		{"removed", []string{lines[0], lines[2], lines[3], lines[4]}, ErrAuditTampered},
+		{"reordered", []string{lines[0], lines[2], lines[1], lines[3], lines[4]}, ErrAuditTampered},
+		{"head truncated", lines[1:], ErrAuditTruncated},
+		{"tail truncated", lines[:3], ErrAuditTruncated},
+		{"garbage", append(lines[:5:5], "{not json\n"), ErrAuditTampered},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			require.NoError(t, os.WriteFile(path, []byte(strings.Join(tc.lines, "")), 0o600))
+			_, err := VerifyAuditLog(ctx, sink, checkpoint)
+			assert.ErrorIs(t, err, tc.err)
+		})
+	}
+
+	// Without a checkpoint a truncated tail is indistinguishable from a
+	// shorter log
+	require.NoError(t, os.WriteFile(path, []byte(strings.Join(lines[:3], "")), 0o600))
+	head, err := VerifyAuditLog(ctx, sink, AuditCheckpoint{})
+	require.NoError(t, err)
+	assert.Equal(t, uint64(3), head.Sequence)
+
+	// A tampered log cannot be appended to
+	require.NoError(t, os.WriteFile(path, []byte(strings.Join(lines[1:], "")), 0o600))
+	_, err = NewAuditLog(ctx, sink)
+	assert.ErrorIs(t, err, ErrAuditTruncated)
+}
+
+func TestFileAuditSinkTornWrite(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "audit.log")
+
+	sink, err := NewFileAuditSink(path)
+	require.NoError(t, err)
+	log, err := NewAuditLog(ctx, sink)
+	require.NoError(t, err)
+	for _, key := range []string{"a", "b"} {
+		require.NoError(t, log.Record(ctx, AuditRecord{Operation: AuditStore, Key: key}))
+	}
+	checkpoint := log.Head()
+	require.NoError(t, sink.Close())
+
+	// A crash mid-write leaves the last line without its newline
+	complete, err := os.ReadFile(path)
+	require.NoError(t, err)
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	require.NoError(t, err)
+	_, err = file.WriteString(`{"sequence":3,"operation":"st`)
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	head, err := VerifyAuditLog(ctx, sink, checkpoint)
+	require.NoError(t, err)
+	assert.Equal(t, checkpoint, head)
+
+	// Reopening drops the unfinished line and continues the chain
+	sink, err = NewFileAuditSink(path)
+	require.NoError(t, err)
+	defer sink.Close()
+	repaired, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, complete, repaired)
+
+	log, err = NewAuditLog(ctx, sink)
+	require.NoError(t, err)
+	require.NoError(t, log.Record(ctx, AuditRecord{Operation: AuditStore, Key: "c"}))
+	head, err = VerifyAuditLog(ctx, sink, log.Head())
+	require.NoError(t, err)
+	assert.Equal(t, uint64(3), head.Sequence)
+}
+
+func TestStorageAuditSink(t *testing.T) {
+	storage, err := NewFileStorage(t.TempDir())
+	require.NoError(t, err)
+	defer storage.Close()
+	ctx := context.Background()
+
+	sink := NewStorageAuditSink(storage, "")
+	log, err := NewAuditLog(ctx, sink)
+	require.NoError(t, err)
+
+	for i := 0; i < DefaultListLimit+5; i++ {
+		require.NoError(t, log.Record(ctx, AuditRecord{Operation: AuditOpen, Key: "k"}))
+	}
+
+	// Entries replay in sequence order, past the first page
+	var sequences []uint64
+	require.NoError(t, ReplayAuditLog(ctx, sink, func(entry AuditEntry) error {
+		sequences = append(sequences, entry.Sequence)
+		return nil
+	}))
+	require.Len(t, sequences, DefaultListLimit+5)
+	assert.Equal(t, uint64(DefaultListLimit+1), sequences[DefaultListLimit])
+
+	checkpoint := log.Head()
+	_, err = VerifyAuditLog(ctx, sink, checkpoint)
+	require.NoError(t, err)
+
+	// Entries cannot be overwritten through the sink
+	entry := AuditEntry{Sequence: 3}
+	assert.Error(t, sink.Append(ctx, entry))
+
+	// Editing or deleting stored entries is detected
+	raw, err := storage.Open(ctx, sink.key(3))
+	require.NoError(t, err)
+	require.NoError(t, storage.Store(ctx, sink.key(3), []byte(strings.Replace(string(raw), `"open"`, `"delete"`, 1)), auditEpoch))
+	_, err = VerifyAuditLog(ctx, sink, checkpoint)
+	assert.ErrorIs(t, err, ErrAuditTampered)
+
+	require.NoError(t, storage.Store(ctx, sink.key(3), raw, auditEpoch))
+	require.NoError(t, storage.Delete(ctx, sink.key(DefaultListLimit+5)))
+	_, err = VerifyAuditLog(ctx, sink, checkpoint)
+	assert.ErrorIs(t, err, ErrAuditTruncated)
+}
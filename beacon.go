@@ -0,0 +1,273 @@
+package timecapsule
+
+import (
+	"context"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// beaconRecordVersion is the first byte of every beacon-encrypted value
+const beaconRecordVersion = 1
+
+// ErrRoundNotReached is returned when a beacon round has not been published yet
+var ErrRoundNotReached = errors.New("beacon round not yet published")
+
+// Beacon is a public randomness beacon, such as drand, that publishes a
+// signature for every round at a fixed period. Values are encrypted to a
+// future round using only public information and can be decrypted by anyone
+// once that round's signature is published, and by nobody before.
+type Beacon interface {
+	// Schedule returns when the beacon publishes its rounds
+	Schedule() BeaconSchedule
+
+	// Encapsulate returns a fresh data key and its encryption to round
+	Encapsulate(ctx context.Context, round uint64) (dataKey, encapsulated []byte, err error)
+
+	// Signature returns the published signature of round, or
+	// ErrRoundNotReached if it has not been published yet
+	Signature(ctx context.Context, round uint64) ([]byte, error)
+
+	// Decapsulate recovers a data key encrypted to round using the round's
+	// signature
+	Decapsulate(ctx context.Context, round uint64, signature, encapsulated []byte) ([]byte, error)
+}
+
+// BeaconSchedule maps beacon rounds to time. Round 1 is published at
+// Genesis and every following round one Period later.
+type BeaconSchedule struct {
+	Genesis time.Time
+	Period  time.Duration
+}
+
+// RoundTime returns when round is published
+func (s BeaconSchedule) RoundTime(round uint64) time.Time {
+	if round == 0 {
+		return s.Genesis
+	}
+	return s.Genesis.Add(time.Duration(round-1) * s.Period)
+}
+
+// RoundAt returns the latest round published at t, or 0 before genesis
+func (s BeaconSchedule) RoundAt(t time.Time) uint64 {
+	if t.Before(s.Genesis) {
+		return 0
+	}
+	return uint64(t.Sub(s.Genesis)/s.Period) + 1
+}
+
+// RoundFor returns the first round published at or after t, which is the
+// round capsules unlocking at t are encrypted to
+func (s BeaconSchedule) RoundFor(t time.Time) uint64 {
+	round := s.RoundAt(t)
+	if round == 0 {
+		return 1
+	}
+	if s.RoundTime(round).Before(t) {
+		round++
+	}
+	return round
+}
+
+// sealBeacon encrypts value to the beacon round published at or after
+// unlockTime. The layout is version, round (8 bytes), encapsulated key length
+// (2 bytes), encapsulated key, nonce and ciphertext; the header and capsule
+// key are authenticated.
+func sealBeacon(ctx context.Context, beacon Beacon, key string, value []byte, unlockTime time.Time) ([]byte, error) {
+	round := beacon.Schedule().RoundFor(unlockTime)
+
+	dataKey, encapsulated, err := beacon.Encapsulate(ctx, round)
+	if err != nil {
+		return nil, fmt.Errorf("timecapsule: encrypt to beacon round %d: %w", round, err)
+	}
+	defer clear(dataKey)
+	if len(encapsulated) > 0xffff {
+		return nil, errors.New("timecapsule: encapsulated data key too large")
+	}
+
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 11, 11+len(encapsulated))
+	header[0] = beaconRecordVersion
+	binary.BigEndian.PutUint64(header[1:], round)
+	binary.BigEndian.PutUint16(header[9:], uint16(len(encapsulated)))
+	header = append(header, encapsulated...)
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	record := append(append([]byte{}, header...), nonce...)
+	return aead.Seal(record, nonce, value, recordAAD(header, []byte(key))), nil
+}
+
+// openBeacon decrypts a value sealed by sealBeacon, returning
+// ErrCapsuleLocked until its round is published
+func openBeacon(ctx context.Context, beacon Beacon, key string, record []byte) ([]byte, error) {
+	if len(record) < 11 || record[0] != beaconRecordVersion {
+		return nil, ErrInvalidRecord
+	}
+
+	round := binary.BigEndian.Uint64(record[1:])
+	headerSize := 11 + int(binary.BigEndian.Uint16(record[9:]))
+	if len(record) < headerSize {
+		return nil, ErrInvalidRecord
+	}
+
+	signature, err := beacon.Signature(ctx, round)
+	if errors.Is(err, ErrRoundNotReached) {
+		return nil, fmt.Errorf("timecapsule: beacon round %d: %w", round, ErrCapsuleLocked)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("timecapsule: beacon round %d: %w", round, err)
+	}
+
+	dataKey, err := beacon.Decapsulate(ctx, round, signature, record[11:headerSize])
+	if err != nil {
+		return nil, fmt.Errorf("timecapsule: decrypt from beacon round %d: %w", round, err)
+	}
+	defer clear(dataKey)
+
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(record) < headerSize+aead.NonceSize()+aead.Overhead() {
+		return nil, ErrInvalidRecord
+	}
+
+	nonce := record[headerSize : headerSize+aead.NonceSize()]
+	value, err := aead.Open(nil, nonce, record[headerSize+aead.NonceSize():], recordAAD(record[:headerSize], []byte(key)))
+	if err != nil {
+		return nil, ErrDecryptFailed
+	}
+
+	return value, nil
+}
+
+// LocalBeacon is an in-process Beacon for tests and development. Round
+// signatures are derived from a secret seed and released by its clock on
+// schedule. Unlike a threshold beacon such as drand, it holds the secret that
+// produces every signature, so it protects nothing from its own process.
+type LocalBeacon struct {
+	schedule BeaconSchedule
+	clock    Clock
+	seed     []byte
+}
+
+// NewLocalBeacon creates a beacon publishing a round every period from
+// genesis. WithClock controls when rounds are published.
+func NewLocalBeacon(genesis time.Time, period time.Duration, opts ...Option) (*LocalBeacon, error) {
+	if period <= 0 {
+		return nil, errors.New("timecapsule: beacon period must be positive")
+	}
+
+	o := newOptions(opts...)
+	b := &LocalBeacon{
+		schedule: BeaconSchedule{Genesis: genesis, Period: period},
+		clock:    o.clock,
+		seed:     make([]byte, 32),
+	}
+	if _, err := rand.Read(b.seed); err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// Schedule returns when the beacon publishes its rounds
+func (b *LocalBeacon) Schedule() BeaconSchedule {
+	return b.schedule
+}
+
+// Encapsulate returns a fresh data key encrypted under the key derived from
+// round's future signature
+func (b *LocalBeacon) Encapsulate(ctx context.Context, round uint64) ([]byte, []byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	aead, err := beaconRoundGCM(b.sign(round))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	dataKey := make([]byte, dataKeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, nil, err
+	}
+
+	return dataKey, aead.Seal(nonce, nonce, dataKey, beaconRoundBytes(round)), nil
+}
+
+// Signature returns the signature of round once the clock reaches its
+// publication time
+func (b *LocalBeacon) Signature(ctx context.Context, round uint64) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if round == 0 || b.schedule.RoundAt(b.clock.Now()) < round {
+		return nil, ErrRoundNotReached
+	}
+
+	return b.sign(round), nil
+}
+
+// Decapsulate recovers a data key using round's signature
+func (b *LocalBeacon) Decapsulate(ctx context.Context, round uint64, signature, encapsulated []byte) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	aead, err := beaconRoundGCM(signature)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(encapsulated) < aead.NonceSize()+aead.Overhead() {
+		return nil, ErrInvalidRecord
+	}
+
+	dataKey, err := aead.Open(nil, encapsulated[:aead.NonceSize()], encapsulated[aead.NonceSize():], beaconRoundBytes(round))
+	if err != nil {
+		return nil, ErrDecryptFailed
+	}
+
+	return dataKey, nil
+}
+
+// sign derives the signature of round from the seed
+func (b *LocalBeacon) sign(round uint64) []byte {
+	mac := hmac.New(sha256.New, b.seed)
+	mac.Write(beaconRoundBytes(round))
+	return mac.Sum(nil)
+}
+
+// beaconRoundGCM derives the AEAD protecting data keys encrypted to a round
+// from the round's signature
+func beaconRoundGCM(signature []byte) (cipher.AEAD, error) {
+	key := sha256.Sum256(signature)
+	defer clear(key[:])
+	return newGCM(key[:])
+}
+
+// beaconRoundBytes encodes a round number
+func beaconRoundBytes(round uint64) []byte {
+	return binary.BigEndian.AppendUint64(nil, round)
+}
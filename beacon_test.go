@@ -0,0 +1,85 @@
+package timecapsule
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBeaconSchedule(t *testing.T) {
+	genesis := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	schedule := BeaconSchedule{Genesis: genesis, Period: 30 * time.Second}
+
+	assert.Equal(t, genesis, schedule.RoundTime(1))
+	assert.Equal(t, genesis.Add(time.Minute), schedule.RoundTime(3))
+
+	assert.Equal(t, uint64(0), schedule.RoundAt(genesis.Add(-time.Second)))
+	assert.Equal(t, uint64(1), schedule.RoundAt(genesis))
+	assert.Equal(t, uint64(2), schedule.RoundAt(genesis.Add(59*time.Second)))
+
+	assert.Equal(t, uint64(1), schedule.RoundFor(genesis.Add(-time.Hour)))
+	assert.Equal(t, uint64(3), schedule.RoundFor(genesis.Add(time.Minute)))
+	assert.Equal(t, uint64(4), schedule.RoundFor(genesis.Add(time.Minute+time.Nanosecond)))
+}
+
+func TestLocalBeacon(t *testing.T) {
+	ctx := context.Background()
+
+	beacon, err := NewLocalBeacon(time.Now().Add(-time.Minute), time.Second)
+	require.NoError(t, err)
+
+	current := beacon.Schedule().RoundAt(time.Now())
+	dataKey, encapsulated, err := beacon.Encapsulate(ctx, current+60)
+	require.NoError(t, err)
+
+	_, err = beacon.Signature(ctx, current+60)
+	assert.ErrorIs(t, err, ErrRoundNotReached)
+
+	// A published signature only opens keys encrypted to its own round
+	signature, err := beacon.Signature(ctx, current)
+	require.NoError(t, err)
+	_, err = beacon.Decapsulate(ctx, current+60, signature, encapsulated)
+	assert.ErrorIs(t, err, ErrDecryptFailed)
+
+	_, err = NewLocalBeacon(time.Now(), 0)
+	assert.Error(t, err)
+
+	assert.Len(t, dataKey, dataKeySize)
+}
+
+func TestBeaconEncryption(t *testing.T) {
+	storage, err := NewFileStorage(t.TempDir())
+	require.NoError(t, err)
+	defer storage.Close()
+	ctx := context.Background()
+
+	beacon, err := NewLocalBeacon(time.Now(), 50*time.Millisecond)
+	require.NoError(t, err)
+
+	capsule := NewWithStorage(storage, NewJSONCodec[string](), WithBeacon(beacon))
+
+	unlockTime := time.Now().Add(75 * time.Millisecond)
+	require.NoError(t, capsule.Store(ctx, "round", "tamper-proof", unlockTime))
+	require.NoError(t, capsule.Store(ctx, "forced", "tamper-proof", time.Now().Add(time.Hour)))
+
+	// Bypassing the unlock check does not help before the round is published
+	require.NoError(t, storage.SetUnlockTime(ctx, "forced", time.Now()))
+	_, err = capsule.Open(ctx, "forced")
+	assert.ErrorIs(t, err, ErrCapsuleLocked)
+
+	// WaitForUnlock waits for the round after the unlock time
+	value, err := capsule.WaitForUnlock(ctx, "round")
+	require.NoError(t, err)
+	assert.Equal(t, "tamper-proof", value)
+	assert.False(t, time.Now().Before(beacon.Schedule().RoundTime(beacon.Schedule().RoundFor(unlockTime))))
+
+	// Records are bound to their capsule key
+	raw, err := storage.Open(ctx, "round")
+	require.NoError(t, err)
+	require.NoError(t, storage.Store(ctx, "copy", raw, time.Now()))
+	_, err = capsule.Open(ctx, "copy")
+	assert.ErrorIs(t, err, ErrDecryptFailed)
+}
@@ -0,0 +1,128 @@
+package timecapsule
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"strings"
+	"time"
+)
+
+// AttributeEarlyOpenings records every early opening of a capsule
+const AttributeEarlyOpenings = AttributePrefix + "early_openings"
+
+// Break-glass errors
+var (
+	ErrBreakGlassDisabled = errors.New("early opening is not enabled")
+	ErrBreakGlassDenied   = errors.New("early opening was not authorized")
+	ErrReasonRequired     = errors.New("early opening requires a reason")
+)
+
+// BreakGlassRequest describes an early opening awaiting authorization
+type BreakGlassRequest struct {
+	Key      string
+	Reason   string
+	Metadata Metadata
+}
+
+// BreakGlassAuthorizer decides whether a capsule may be opened early. It
+// returns who the capsule is opened by, or an error to refuse.
+type BreakGlassAuthorizer func(ctx context.Context, request BreakGlassRequest) (actor string, err error)
+
+// EarlyOpening records who opened a capsule early, why and when
+type EarlyOpening struct {
+	Actor  string    `json:"actor"`
+	Reason string    `json:"reason"`
+	Time   time.Time `json:"time"`
+}
+
+// EarlyOpenings returns every early opening of the capsule, oldest first
+func (m Metadata) EarlyOpenings() []EarlyOpening {
+	openings, _ := parseEarlyOpenings(m.Attributes)
+	return openings
+}
+
+// parseEarlyOpenings reads the early openings from capsule attributes
+func parseEarlyOpenings(attributes map[string]string) ([]EarlyOpening, error) {
+	data, ok := attributes[AttributeEarlyOpenings]
+	if !ok {
+		return nil, nil
+	}
+
+	var openings []EarlyOpening
+	if err := json.Unmarshal([]byte(data), &openings); err != nil {
+		return nil, fmt.Errorf("timecapsule: decode early openings: %w", err)
+	}
+	return openings, nil
+}
+
+// checkBreakGlass checks an early opening before asking for authorization:
+// break glass must be enabled and the reason given. Expired capsules and
+// capsules stored with shares cannot be opened early.
+func checkBreakGlass(authorize BreakGlassAuthorizer, auditor Auditor, reason string, metadata Metadata) error {
+	if authorize == nil || auditor == nil {
+		return ErrBreakGlassDisabled
+	}
+
+	if strings.TrimSpace(reason) == "" {
+		return ErrReasonRequired
+	}
+
+	if metadata.IsExpired {
+		return ErrCapsuleExpired
+	}
+
+	if requiresShares(metadata.Attributes) {
+		return ErrSharesRequired
+	}
+
+	return nil
+}
+
+// authorizeBreakGlass asks authorize whether key may be opened early and
+// returns who it is opened by
+func authorizeBreakGlass(ctx context.Context, authorize BreakGlassAuthorizer, request BreakGlassRequest) (string, error) {
+	actor, err := authorize(ctx, request)
+	if err != nil {
+		return "", fmt.Errorf("timecapsule: open %q early: %w: %w", request.Key, ErrBreakGlassDenied, err)
+	}
+
+	if actor == "" {
+		return "", fmt.Errorf("timecapsule: open %q early: %w: no actor", request.Key, ErrBreakGlassDenied)
+	}
+
+	return actor, nil
+}
+
+// auditEarlyOpening records an early opening with auditor
+func auditEarlyOpening(ctx context.Context, auditor Auditor, key string, opening EarlyOpening) error {
+	return audit(ctx, auditor, AuditRecord{
+		Time:      opening.Time,
+		Operation: AuditOpenEarly,
+		Key:       key,
+		Actor:     opening.Actor,
+		Reason:    opening.Reason,
+	})
+}
+
+// recordEarlyOpening appends opening to a copy of attributes
+func recordEarlyOpening(attributes map[string]string, opening EarlyOpening) (map[string]string, error) {
+	openings, err := parseEarlyOpenings(attributes)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := json.Marshal(append(openings, opening))
+	if err != nil {
+		return nil, fmt.Errorf("timecapsule: encode early openings: %w", err)
+	}
+
+	updated := maps.Clone(attributes)
+	if updated == nil {
+		updated = make(map[string]string, 1)
+	}
+	updated[AttributeEarlyOpenings] = string(data)
+	return updated, nil
+}
@@ -0,0 +1,191 @@
+package timecapsule
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testAuditor keeps audit records in memory, failing while err is set
+type testAuditor struct {
+	mu      sync.Mutex
+	records []AuditRecord
+	err     error
+}
+
+func (a *testAuditor) Record(_ context.Context, record AuditRecord) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.err != nil {
+		return a.err
+	}
+	a.records = append(a.records, record)
+	return nil
+}
+
+func TestOpenEarly(t *testing.T) {
+	storage, err := NewFileStorage(t.TempDir())
+	require.NoError(t, err)
+	defer storage.Close()
+
+	// Only the incident commander may break the glass
+	authorize := func(ctx context.Context, request BreakGlassRequest) (string, error) {
+		actor, _ := ctx.Value(actorKey{}).(string)
+		if actor != "commander" {
+			return "", errors.New("not on call")
+		}
+		return actor, nil
+	}
+
+	auditors := map[string]*testAuditor{"memory": {}, "persistent": {}}
+	capsules := map[string]testCapsule[string]{
+		"memory": New[string](WithBreakGlass(authorize), WithAuditor(auditors["memory"])),
+		"persistent": NewWithStorage(storage, NewJSONCodec[string](),
+			WithBreakGlass(authorize), WithAuditor(auditors["persistent"])),
+	}
+
+	for name, capsule := range capsules {
+		t.Run(name, func(t *testing.T) {
+			defer capsule.Close()
+			auditor := auditors[name]
+			ctx := context.Background()
+			commander := context.WithValue(ctx, actorKey{}, "commander")
+
+			require.NoError(t, capsule.Store(ctx, "db-password", "hunter2", time.Now().Add(time.Hour)))
+
+			_, err := capsule.OpenEarly(commander, "db-password", " ")
+			assert.ErrorIs(t, err, ErrReasonRequired)
+
+			_, err = capsule.OpenEarly(ctx, "db-password", "outage")
+			assert.ErrorIs(t, err, ErrBreakGlassDenied)
+			assert.ErrorContains(t, err, "not on call")
+
+			_, err = capsule.OpenEarly(commander, "missing", "outage")
+			assert.ErrorIs(t, err, ErrCapsuleNotFound)
+
+			// Nothing is opened unless the opening can be audited
+			auditor.err = errors.New("audit log unavailable")
+			_, err = capsule.OpenEarly(commander, "db-password", "outage")
+			assert.ErrorIs(t, err, auditor.err)
+			auditor.err = nil
+
+			metadata, err := capsule.Peek(ctx, "db-password")
+			require.NoError(t, err)
+			assert.Empty(t, metadata.EarlyOpenings())
+
+			value, err := capsule.OpenEarly(commander, "db-password", "INC-42 primary database down")
+			require.NoError(t, err)
+			assert.Equal(t, "hunter2", value)
+
+			// Opening early does not unlock the capsule for everyone else
+			_, err = capsule.Open(ctx, "db-password")
+			assert.ErrorIs(t, err, ErrCapsuleLocked)
+
+			// The store and the early opening are audited
+			require.Len(t, auditor.records, 2)
+			record := auditor.records[1]
+			assert.Equal(t, AuditOpenEarly, record.Operation)
+			assert.Equal(t, "db-password", record.Key)
+			assert.Equal(t, "commander", record.Actor)
+			assert.Equal(t, "INC-42 primary database down", record.Reason)
+
+			// The opening stays visible through later changes
+			require.NoError(t, capsule.Delay(ctx, "db-password", -time.Second))
+			metadata, err = capsule.Peek(ctx, "db-password")
+			require.NoError(t, err)
+			openings := metadata.EarlyOpenings()
+			require.Len(t, openings, 1)
+			assert.Equal(t, "commander", openings[0].Actor)
+			assert.Equal(t, "INC-42 primary database down", openings[0].Reason)
+			assert.True(t, record.Time.Equal(openings[0].Time))
+
+			// Missing approvals can be overridden too
+			require.NoError(t, capsule.StoreWithOptions(ctx, "gated", "v", time.Now(), WithApprovals(1, "alice")))
+			value, err = capsule.OpenEarly(commander, "gated", "approver unreachable")
+			require.NoError(t, err)
+			assert.Equal(t, "v", value)
+			require.NoError(t, capsule.Approve(ctx, "gated", "alice"))
+			metadata, err = capsule.Peek(ctx, "gated")
+			require.NoError(t, err)
+			assert.Len(t, metadata.EarlyOpenings(), 1)
+
+			// Expiry and shares are not overridden
+			require.NoError(t, capsule.StoreWithOptions(ctx, "expired", "v", time.Now().Add(-time.Hour), WithExpiry(time.Now().Add(-time.Minute))))
+			_, err = capsule.OpenEarly(commander, "expired", "outage")
+			assert.ErrorIs(t, err, ErrCapsuleExpired)
+
+			_, err = capsule.StoreWithShares(ctx, "escrow", "v", time.Now().Add(time.Hour), 2, 3)
+			require.NoError(t, err)
+			_, err = capsule.OpenEarly(commander, "escrow", "outage")
+			assert.ErrorIs(t, err, ErrSharesRequired)
+		})
+	}
+}
+
+func TestOpenEarlyPersistent(t *testing.T) {
+	storage, err := NewFileStorage(t.TempDir())
+	require.NoError(t, err)
+	defer storage.Close()
+	ctx := context.Background()
+
+	// The authorizer replaces the capsule before it is read
+	var capsule *PersistentTimeCapsule[string]
+	replace := func(ctx context.Context, request BreakGlassRequest) (string, error) {
+		err := capsule.StoreWithOptions(ctx, request.Key, "replacement", time.Now().Add(time.Hour),
+			WithCreatedAt(request.Metadata.CreatedAt.Add(time.Second)))
+		return "commander", err
+	}
+	capsule = NewWithStorage(storage, NewJSONCodec[string](), WithBreakGlass(replace), WithAuditor(&testAuditor{}))
+	defer capsule.Close()
+
+	require.NoError(t, capsule.Store(ctx, "key", "original", time.Now().Add(time.Hour)))
+	_, err = capsule.OpenEarly(ctx, "key", "outage")
+	assert.ErrorContains(t, err, "replaced")
+	metadata, err := capsule.Peek(ctx, "key")
+	require.NoError(t, err)
+	assert.Empty(t, metadata.EarlyOpenings())
+
+	// Locked capsules can only be read from a RewriteStorage
+	allow := func(context.Context, BreakGlassRequest) (string, error) { return "commander", nil }
+	basic := NewWithStorage(basicStorage{storage}, NewJSONCodec[string](), WithBreakGlass(allow), WithAuditor(&testAuditor{}))
+	defer basic.Close()
+	_, err = basic.OpenEarly(ctx, "key", "outage")
+	assert.ErrorIs(t, err, errors.ErrUnsupported)
+}
+
+func TestOpenEarlyDisabled(t *testing.T) {
+	ctx := context.Background()
+	allow := func(context.Context, BreakGlassRequest) (string, error) { return "anyone", nil }
+
+	for _, opts := range [][]Option{
+		nil,
+		{WithBreakGlass(allow)},
+		{WithAuditor(&testAuditor{})},
+	} {
+		capsule := New[string](opts...)
+		require.NoError(t, capsule.Store(ctx, "key", "v", time.Now().Add(time.Hour)))
+
+		_, err := capsule.OpenEarly(ctx, "key", "outage")
+		assert.ErrorIs(t, err, ErrBreakGlassDisabled)
+		require.NoError(t, capsule.Close())
+	}
+
+	// An authorizer must say who is opening the capsule
+	capsule := New[string](WithBreakGlass(func(context.Context, BreakGlassRequest) (string, error) {
+		return "", nil
+	}), WithAuditor(&testAuditor{}))
+	defer capsule.Close()
+
+	require.NoError(t, capsule.Store(ctx, "key", "v", time.Now().Add(time.Hour)))
+	_, err := capsule.OpenEarly(ctx, "key", "outage")
+	assert.ErrorIs(t, err, ErrBreakGlassDenied)
+}
+
+// actorKey carries the caller's identity in test contexts
+type actorKey struct{}
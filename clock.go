@@ -0,0 +1,40 @@
+package timecapsule
+
+import "time"
+
+// Clock abstracts the passage of time so that unlock checks and waits can be
+// driven by something other than the system clock, such as a fake clock in
+// tests
+type Clock interface {
+	// Now returns the current time
+	Now() time.Time
+
+	// NewTimer creates a timer that fires once after duration d
+	NewTimer(d time.Duration) Timer
+}
+
+// Timer is a one-shot timer created by a Clock
+type Timer interface {
+	// C returns the channel on which the fire time is delivered
+	C() <-chan time.Time
+
+	// Stop prevents the timer from firing, reporting whether it was active
+	Stop() bool
+}
+
+// SystemClock returns a Clock backed by the time package
+func SystemClock() Clock {
+	return systemClock{}
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+func (systemClock) NewTimer(d time.Duration) Timer { return systemTimer{time.NewTimer(d)} }
+
+type systemTimer struct{ t *time.Timer }
+
+func (t systemTimer) C() <-chan time.Time { return t.t.C }
+
+func (t systemTimer) Stop() bool { return t.t.Stop() }
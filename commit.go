@@ -0,0 +1,186 @@
+package timecapsule
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"iter"
+)
+
+// AttributeCommitment holds the hex-encoded commitment of a capsule stored
+// with WithCommitment
+const AttributeCommitment = AttributePrefix + "commitment"
+
+// commitSaltSize is the size of the random salt hiding a committed value
+const commitSaltSize = 32
+
+// commitDomain separates commitments from other hashes of the same value
+const commitDomain = "timecapsule commitment v1\x00"
+
+// commitRecordPrefix marks a stored value carrying its commitment salt
+var commitRecordPrefix = []byte("\x00timecapsule-commit-v1\x00")
+
+// Commit-reveal errors
+var (
+	ErrNotCommitted       = errors.New("capsule was not stored with a commitment")
+	ErrCommitmentMismatch = errors.New("revealed value does not match its commitment")
+)
+
+// WithCommitment stores the capsule in commit-reveal mode. A salted SHA-256
+// commitment to the value is published in its metadata, where Peek and List
+// show it before the unlock time; Reveal returns the value with its salt
+// once the capsule is unlocked.
+func WithCommitment() StoreOption {
+	return func(o *StoreOptions) {
+		o.commit = true
+	}
+}
+
+// Reveal is an opened commit-reveal capsule with everything needed to check
+// it against the commitment published before its unlock time
+type Reveal[T any] struct {
+	Key        string `json:"key"`
+	Value      T      `json:"value"`
+	Salt       []byte `json:"salt"`
+	Commitment []byte `json:"commitment"`
+}
+
+// Verify checks the reveal against commitment, which should be the
+// commitment recorded from the capsule's metadata before it unlocked
+func (r Reveal[T]) Verify(commitment []byte) error {
+	return VerifyCommitment(commitment, r.Key, r.Value, r.Salt)
+}
+
+// VerifyCommitment checks that commitment was made to value under key with
+// salt, returning ErrCommitmentMismatch if it was not
+func VerifyCommitment[T any](commitment []byte, key string, value T, salt []byte) error {
+	expected, err := commit(key, value, salt)
+	if err != nil {
+		return err
+	}
+
+	if subtle.ConstantTimeCompare(expected, commitment) != 1 {
+		return fmt.Errorf("timecapsule: reveal of %q: %w", key, ErrCommitmentMismatch)
+	}
+	return nil
+}
+
+// Commitment returns the commitment of a capsule stored with WithCommitment,
+// or nil for other capsules
+func (m Metadata) Commitment() []byte {
+	commitment, err := hex.DecodeString(m.Attributes[AttributeCommitment])
+	if err != nil || len(commitment) == 0 {
+		return nil
+	}
+	return commitment
+}
+
+// Revealer lists capsules and reveals commit-reveal capsules, as
+// MemoryTimeCapsule and PersistentTimeCapsule do
+type Revealer[T any] interface {
+	All(ctx context.Context, opts ListOptions) iter.Seq2[string, Metadata]
+	Reveal(ctx context.Context, key string) (Reveal[T], error)
+}
+
+// RevealAll reveals every unlocked commit-reveal capsule under prefix,
+// verifying each against the commitment in its metadata. Capsules that
+// cannot be revealed yet, such as those awaiting approval, are skipped.
+// Failed reveals are left out of the result and reported together in the
+// returned error.
+func RevealAll[T any](ctx context.Context, tc Revealer[T], prefix string) ([]Reveal[T], error) {
+	var reveals []Reveal[T]
+	var errs []error
+
+	for key, metadata := range tc.All(ctx, ListOptions{Prefix: prefix, State: StateUnlocked}) {
+		if metadata.Commitment() == nil {
+			continue
+		}
+
+		reveal, err := tc.Reveal(ctx, key)
+		switch {
+		case err == nil:
+			reveals = append(reveals, reveal)
+		case errors.Is(err, ErrCapsuleNotFound), errors.Is(err, ErrCapsuleLocked),
+			errors.Is(err, ErrCapsuleExpired), errors.Is(err, ErrApprovalRequired):
+		default:
+			errs = append(errs, fmt.Errorf("timecapsule: reveal %q: %w", key, err))
+		}
+	}
+
+	if err := ctx.Err(); err != nil {
+		errs = append(errs, err)
+	}
+
+	return reveals, errors.Join(errs...)
+}
+
+// commit returns the commitment to value under key with salt: the SHA-256
+// of the key, the salt and the value's JSON encoding
+func commit[T any](key string, value T, salt []byte) ([]byte, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, fmt.Errorf("timecapsule: encode value: %w", err)
+	}
+
+	hash := sha256.New()
+	hash.Write([]byte(commitDomain))
+	writeField(hash, []byte(key))
+	writeField(hash, salt)
+	hash.Write(data)
+	return hash.Sum(nil), nil
+}
+
+// newCommitment draws a salt for value and returns it with the attribute
+// publishing the commitment
+func newCommitment[T any](key string, value T) ([]byte, map[string]string, error) {
+	salt := make([]byte, commitSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, nil, fmt.Errorf("timecapsule: generate salt: %w", err)
+	}
+
+	commitment, err := commit(key, value, salt)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return salt, map[string]string{AttributeCommitment: hex.EncodeToString(commitment)}, nil
+}
+
+// revealed builds the reveal of a capsule and verifies it against the
+// commitment in attributes
+func revealed[T any](key string, value T, salt []byte, attributes map[string]string) (Reveal[T], error) {
+	commitment := Metadata{Attributes: attributes}.Commitment()
+	if commitment == nil || salt == nil {
+		return Reveal[T]{}, ErrNotCommitted
+	}
+
+	reveal := Reveal[T]{Key: key, Value: value, Salt: bytes.Clone(salt), Commitment: commitment}
+	if err := reveal.Verify(commitment); err != nil {
+		return Reveal[T]{}, err
+	}
+	return reveal, nil
+}
+
+// sealCommitment prefixes encoded with the salt of its commitment
+func sealCommitment(salt, encoded []byte) []byte {
+	record := make([]byte, 0, len(commitRecordPrefix)+len(salt)+len(encoded))
+	record = append(record, commitRecordPrefix...)
+	record = append(record, salt...)
+	return append(record, encoded...)
+}
+
+// openCommitment splits a record sealed by sealCommitment into its salt and
+// encoded value, returning ErrNotCommitted if it carries no salt
+func openCommitment(record []byte) (salt, encoded []byte, err error) {
+	rest, ok := bytes.CutPrefix(record, commitRecordPrefix)
+	if !ok || len(rest) < commitSaltSize {
+		return nil, nil, ErrNotCommitted
+	}
+	return rest[:commitSaltSize], rest[commitSaltSize:], nil
+}
@@ -0,0 +1,109 @@
+package timecapsule
+
+import (
+	"context"
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCommitReveal(t *testing.T) {
+	storage, err := NewFileStorage(t.TempDir())
+	require.NoError(t, err)
+	defer storage.Close()
+
+	capsules := map[string]testCapsule[bid]{
+		"memory":     New[bid](),
+		"persistent": NewWithStorage(storage, NewJSONCodec[bid]()),
+	}
+
+	for name, capsule := range capsules {
+		t.Run(name, func(t *testing.T) {
+			defer capsule.Close()
+			ctx := context.Background()
+			deadline := time.Now().Add(time.Hour)
+
+			value := bid{Bidder: "acme", Amount: 1200}
+			require.NoError(t, capsule.StoreWithOptions(ctx, "bids/acme", value, deadline, WithCommitment()))
+
+			// Only the commitment is visible before the deadline
+			metadata, err := capsule.Peek(ctx, "bids/acme")
+			require.NoError(t, err)
+			commitment := metadata.Commitment()
+			assert.Len(t, commitment, 32)
+
+			_, err = capsule.Reveal(ctx, "bids/acme")
+			assert.ErrorIs(t, err, ErrCapsuleLocked)
+
+			require.NoError(t, capsule.Delay(ctx, "bids/acme", -2*time.Hour))
+			reveal, err := capsule.Reveal(ctx, "bids/acme")
+			require.NoError(t, err)
+			assert.Equal(t, value, reveal.Value)
+			assert.Equal(t, commitment, reveal.Commitment)
+			require.NoError(t, reveal.Verify(commitment))
+			require.NoError(t, VerifyCommitment(commitment, "bids/acme", value, reveal.Salt))
+
+			// The commitment binds the value, the salt and the key
+			assert.ErrorIs(t, VerifyCommitment(commitment, "bids/acme", bid{Bidder: "acme", Amount: 1300}, reveal.Salt), ErrCommitmentMismatch)
+			assert.ErrorIs(t, VerifyCommitment(commitment, "bids/acme", value, make([]byte, len(reveal.Salt))), ErrCommitmentMismatch)
+			assert.ErrorIs(t, VerifyCommitment(commitment, "bids/other", value, reveal.Salt), ErrCommitmentMismatch)
+
+			// Equal values get unrelated commitments
+			require.NoError(t, capsule.StoreWithOptions(ctx, "bids/globex", value, deadline, WithCommitment()))
+			metadata, err = capsule.Peek(ctx, "bids/globex")
+			require.NoError(t, err)
+			assert.NotEqual(t, commitment, metadata.Commitment())
+
+			// Open still returns the plain value
+			opened, err := capsule.Open(ctx, "bids/acme")
+			require.NoError(t, err)
+			assert.Equal(t, value, opened)
+
+			require.NoError(t, capsule.Store(ctx, "plain", value, time.Now()))
+			_, err = capsule.Reveal(ctx, "plain")
+			assert.ErrorIs(t, err, ErrNotCommitted)
+		})
+	}
+}
+
+func TestRevealAll(t *testing.T) {
+	storage, err := NewFileStorage(t.TempDir())
+	require.NoError(t, err)
+	defer storage.Close()
+	ctx := context.Background()
+
+	capsule := NewWithStorage(storage, NewJSONCodec[bid]())
+	defer capsule.Close()
+
+	past := time.Now().Add(-time.Minute)
+	require.NoError(t, capsule.StoreWithOptions(ctx, "bids/acme", bid{Bidder: "acme", Amount: 1200}, past, WithCommitment()))
+	require.NoError(t, capsule.StoreWithOptions(ctx, "bids/globex", bid{Bidder: "globex", Amount: 900}, past, WithCommitment()))
+	require.NoError(t, capsule.StoreWithOptions(ctx, "bids/initech", bid{Bidder: "initech", Amount: 1500}, time.Now().Add(time.Hour), WithCommitment()))
+	require.NoError(t, capsule.StoreWithOptions(ctx, "bids/pending", bid{Bidder: "pending", Amount: 1}, past, WithCommitment(), WithApprovals(1, "auctioneer")))
+	require.NoError(t, capsule.Store(ctx, "bids/plain", bid{Bidder: "plain"}, past))
+	require.NoError(t, capsule.StoreWithOptions(ctx, "asks/hooli", bid{Bidder: "hooli"}, past, WithCommitment()))
+
+	reveals, err := RevealAll(ctx, capsule, "bids/")
+	require.NoError(t, err)
+	require.Len(t, reveals, 2)
+	for _, reveal := range reveals {
+		assert.NoError(t, reveal.Verify(reveal.Commitment))
+	}
+	assert.ElementsMatch(t, []string{"bids/acme", "bids/globex"}, []string{reveals[0].Key, reveals[1].Key})
+
+	// A commitment swapped after the fact is reported without hiding the
+	// other reveals
+	require.NoError(t, storage.UpdateAttributes(ctx, "bids/globex", func(attributes map[string]string) (map[string]string, error) {
+		attributes[AttributeCommitment] = hex.EncodeToString(make([]byte, 32))
+		return attributes, nil
+	}))
+
+	reveals, err = RevealAll(ctx, capsule, "bids/")
+	assert.ErrorIs(t, err, ErrCommitmentMismatch)
+	assert.ErrorContains(t, err, "bids/globex")
+	require.Len(t, reveals, 1)
+	assert.Equal(t, "bids/acme", reveals[0].Key)
+}
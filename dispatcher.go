@@ -0,0 +1,486 @@
+package timecapsule
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Dispatcher defaults used when the corresponding DispatcherOptions field is zero
+const (
+	DefaultDispatchWorkers     = 4
+	DefaultDispatchMaxAttempts = 5
+	DefaultDispatchBaseBackoff = time.Second
+	DefaultDispatchMaxBackoff  = time.Minute
+)
+
+// DispatcherWatermarkPrefix prefixes the key under which a dispatcher stores
+// its watermark in DispatcherOptions.Watermarks
+const DispatcherWatermarkPrefix = "dispatcher/"
+
+// ErrDispatcherRunning is returned when Run is called on a running Dispatcher
+var ErrDispatcherRunning = errors.New("dispatcher is already running")
+
+// MisfirePolicy decides which capsules that unlocked while no dispatcher was
+// running are dispatched when Run starts
+type MisfirePolicy int
+
+const (
+	// MisfireFireAll dispatches every missed capsule
+	MisfireFireAll MisfirePolicy = iota
+	// MisfireFireLatest dispatches only the most recently unlocked missed
+	// capsule of each handler prefix
+	MisfireFireLatest
+	// MisfireSkipOlder dispatches missed capsules that unlocked within
+	// MisfireThreshold of startup and skips older ones
+	MisfireSkipOlder
+)
+
+// Handler processes the value of a capsule once it unlocks. Returning an
+// error schedules a retry.
+type Handler[T any] func(ctx context.Context, key string, value T) error
+
+// DispatcherOptions configures a Dispatcher
+type DispatcherOptions struct {
+	// Workers bounds how many handlers run at once; defaults to
+	// DefaultDispatchWorkers
+	Workers int
+
+	// MaxAttempts is how many times a handler is called before the capsule is
+	// dead-lettered; defaults to DefaultDispatchMaxAttempts
+	MaxAttempts int
+
+	// BaseBackoff is the delay before the first retry, doubled on each
+	// further retry up to MaxBackoff
+	BaseBackoff time.Duration
+	MaxBackoff  time.Duration
+
+	// Clock drives retry backoff and misfire thresholds; defaults to
+	// SystemClock
+	Clock Clock
+
+	// Watermarks persists how far the dispatcher has progressed so that Run
+	// can catch up on capsules that unlocked while it was stopped. It must
+	// not be the capsule's own Storage. Nil disables catch-up.
+	Watermarks Storage
+
+	// Name distinguishes the watermarks of dispatchers sharing a Storage
+	Name string
+
+	// Misfire selects which missed capsules are dispatched on startup
+	Misfire MisfirePolicy
+
+	// MisfireThreshold is the maximum age of a missed capsule dispatched
+	// under MisfireSkipOlder
+	MisfireThreshold time.Duration
+}
+
+// DeadLetter records a capsule whose handler kept failing
+type DeadLetter struct {
+	Key      string    `json:"key"`
+	Attempts int       `json:"attempts"`
+	Err      error     `json:"-"`
+	FailedAt time.Time `json:"failed_at"`
+
+	// id keeps the capsule in flight so the watermark does not pass it
+	id int64
+}
+
+// route binds a handler to a key prefix
+type route[T any] struct {
+	prefix  string
+	handler Handler[T]
+}
+
+// DispatchSource is the part of a capsule a Dispatcher reads, implemented by
+// MemoryTimeCapsule and PersistentTimeCapsule
+type DispatchSource[T any] interface {
+	Open(ctx context.Context, key string) (T, error)
+	List(ctx context.Context, opts ListOptions) (ListPage, error)
+	Subscribe(ctx context.Context, opts SubscribeOptions) (<-chan Event, error)
+}
+
+// Dispatcher calls registered handlers with the decoded value of capsules as
+// they unlock. Handlers are chosen by the longest matching key prefix, run on
+// a bounded pool of workers and retried with exponential backoff; capsules
+// that exhaust their attempts are moved to the dead letters.
+type Dispatcher[T any] struct {
+	capsule DispatchSource[T]
+	opts    DispatcherOptions
+
+	mu          sync.Mutex
+	routes      []route[T]
+	deadLetters map[string]DeadLetter
+	running     bool
+	watermark   *watermark
+}
+
+// NewDispatcher creates a dispatcher for capsule
+func NewDispatcher[T any](capsule DispatchSource[T], opts DispatcherOptions) *Dispatcher[T] {
+	if opts.Workers <= 0 {
+		opts.Workers = DefaultDispatchWorkers
+	}
+	if opts.MaxAttempts <= 0 {
+		opts.MaxAttempts = DefaultDispatchMaxAttempts
+	}
+	if opts.BaseBackoff <= 0 {
+		opts.BaseBackoff = DefaultDispatchBaseBackoff
+	}
+	if opts.MaxBackoff <= 0 {
+		opts.MaxBackoff = DefaultDispatchMaxBackoff
+	}
+	if opts.Clock == nil {
+		opts.Clock = SystemClock()
+	}
+
+	return &Dispatcher[T]{
+		capsule:     capsule,
+		opts:        opts,
+		deadLetters: make(map[string]DeadLetter),
+		watermark:   newWatermark(opts.Watermarks, DispatcherWatermarkPrefix+opts.Name),
+	}
+}
+
+// Handle registers handler for keys starting with prefix, replacing any
+// handler already registered for it. An empty prefix matches every key.
+func (d *Dispatcher[T]) Handle(prefix string, handler Handler[T]) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.routes = slices.DeleteFunc(d.routes, func(r route[T]) bool { return r.prefix == prefix })
+	d.routes = append(d.routes, route[T]{prefix: prefix, handler: handler})
+
+	// Longest prefix first so the most specific handler wins
+	slices.SortFunc(d.routes, func(a, b route[T]) int { return len(b.prefix) - len(a.prefix) })
+}
+
+// handler returns the handler registered for key, or nil
+func (d *Dispatcher[T]) handler(key string) Handler[T] {
+	r, _ := d.route(key)
+	return r.handler
+}
+
+// route returns the route matching key
+func (d *Dispatcher[T]) route(key string) (route[T], bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, r := range d.routes {
+		if strings.HasPrefix(key, r.prefix) {
+			return r, true
+		}
+	}
+	return route[T]{}, false
+}
+
+// dispatchJob is a capsule queued for a worker
+type dispatchJob struct {
+	key string
+	id  int64
+}
+
+// Run dispatches unlocked capsules until ctx is done or the capsule is
+// closed, then waits for in-flight handlers to return. With Watermarks set it
+// first dispatches the capsules that unlocked since the last run, filtered by
+// the Misfire policy.
+func (d *Dispatcher[T]) Run(ctx context.Context) error {
+	d.mu.Lock()
+	if d.running {
+		d.mu.Unlock()
+		return ErrDispatcherRunning
+	}
+	d.running = true
+	d.mu.Unlock()
+
+	defer func() {
+		d.mu.Lock()
+		d.running = false
+		d.mu.Unlock()
+	}()
+
+	// The subscription ends with Run, including when catching up fails
+	subscription, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	events, err := d.capsule.Subscribe(subscription, SubscribeOptions{Types: []EventType{EventUnlocked, EventApproved}})
+	if err != nil {
+		return err
+	}
+
+	jobs := make(chan dispatchJob)
+	var wg sync.WaitGroup
+	for i := 0; i < d.opts.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				// Cancelled and dead-lettered jobs stay in flight so the
+				// watermark never passes them
+				if err := d.dispatch(ctx, job); err == nil {
+					d.watermark.finish(ctx, job.id)
+				}
+			}
+		}()
+	}
+
+	enqueue := func(job dispatchJob) {
+		select {
+		case jobs <- job:
+		case <-ctx.Done():
+		}
+	}
+
+	missed, err := d.missed(ctx)
+	if err == nil {
+		// Every missed capsule is in flight before any of them can finish, so
+		// the watermark cannot pass one that has yet to be queued
+		queued := make([]dispatchJob, len(missed))
+		caughtUp := make(map[string]time.Time, len(missed))
+		for i, item := range missed {
+			queued[i] = dispatchJob{key: item.Key, id: d.watermark.begin(item.Metadata.UnlockTime)}
+			caughtUp[item.Key] = item.Metadata.UnlockTime
+		}
+		d.watermark.save(ctx)
+
+		for _, job := range queued {
+			enqueue(job)
+		}
+
+		for event := range events {
+			if _, ok := d.route(event.Key); !ok {
+				continue
+			}
+
+			// An approval only matters once it completes an unlocked capsule
+			if event.Type == EventApproved {
+				approvals, _ := event.Metadata.Approvals()
+				if event.Metadata.IsLocked || !approvals.Approved() {
+					continue
+				}
+			}
+
+			// The subscription may also report an unlock caught up above
+			if unlockTime, ok := caughtUp[event.Key]; ok && unlockTime.Equal(event.Metadata.UnlockTime) {
+				delete(caughtUp, event.Key)
+				continue
+			}
+
+			enqueue(dispatchJob{key: event.Key, id: d.watermark.begin(event.Metadata.UnlockTime)})
+		}
+	}
+
+	close(jobs)
+	wg.Wait()
+
+	if err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return ErrClosed
+}
+
+// missed lists the capsules that unlocked between the stored watermark and
+// now, applying the misfire policy. Skipped capsules advance the watermark
+// once saved, without being dispatched.
+func (d *Dispatcher[T]) missed(ctx context.Context) ([]ListItem, error) {
+	if d.watermark == nil {
+		return nil, nil
+	}
+
+	since, err := d.watermark.load(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	now := d.opts.Clock.Now()
+	opts := ListOptions{State: StateUnlocked, UnlockAfter: since, UnlockBefore: now}
+
+	var items []ListItem
+	latest := make(map[string]int)
+	for {
+		page, err := d.capsule.List(ctx, opts)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, item := range page.Items {
+			r, ok := d.route(item.Key)
+			switch {
+			case !ok:
+				continue
+			case d.opts.Misfire == MisfireSkipOlder && now.Sub(item.Metadata.UnlockTime) > d.opts.MisfireThreshold:
+				d.watermark.skip(item.Metadata.UnlockTime)
+			case d.opts.Misfire == MisfireFireLatest:
+				// Items arrive in unlock order, so a later one replaces the earlier
+				if i, ok := latest[r.prefix]; ok {
+					d.watermark.skip(items[i].Metadata.UnlockTime)
+					items[i] = item
+				} else {
+					latest[r.prefix] = len(items)
+					items = append(items, item)
+				}
+			default:
+				items = append(items, item)
+			}
+		}
+
+		if page.NextCursor == "" {
+			break
+		}
+		opts.Cursor = page.NextCursor
+	}
+
+	// Keep dispatch in unlock order after FireLatest replacements
+	slices.SortStableFunc(items, func(a, b ListItem) int {
+		return a.Metadata.UnlockTime.Compare(b.Metadata.UnlockTime)
+	})
+
+	return items, nil
+}
+
+// dispatch opens a capsule and calls its handler, retrying with backoff and
+// dead-lettering the capsule once every attempt has failed. Capsules that
+// were deleted or expired in the meantime are skipped, as are capsules
+// awaiting approval, which are dispatched again on their final approval.
+// Capsules that need shares are dead-lettered without retrying.
+func (d *Dispatcher[T]) dispatch(ctx context.Context, job dispatchJob) error {
+	key := job.key
+	handler := d.handler(key)
+	if handler == nil {
+		return nil
+	}
+
+	var err error
+	attempts := 0
+	for attempt := 1; attempt <= d.opts.MaxAttempts; attempt++ {
+		attempts = attempt
+		if attempt > 1 {
+			if err := d.sleep(ctx, d.backoff(attempt-1)); err != nil {
+				return err
+			}
+		}
+
+		var value T
+		value, err = d.capsule.Open(ctx, key)
+		if errors.Is(err, ErrCapsuleNotFound) || errors.Is(err, ErrCapsuleExpired) || errors.Is(err, ErrApprovalRequired) {
+			return nil
+		}
+		if errors.Is(err, ErrSharesRequired) {
+			break
+		}
+		if err == nil {
+			err = callHandler(ctx, handler, key, value)
+		}
+		if err == nil {
+			d.mu.Lock()
+			letter, ok := d.deadLetters[key]
+			delete(d.deadLetters, key)
+			d.mu.Unlock()
+
+			// An earlier failure of the capsule no longer holds the watermark
+			if ok && letter.id != job.id {
+				d.watermark.finish(ctx, letter.id)
+			}
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+
+	d.mu.Lock()
+	letter, ok := d.deadLetters[key]
+	d.deadLetters[key] = DeadLetter{
+		Key:      key,
+		Attempts: attempts,
+		Err:      err,
+		FailedAt: d.opts.Clock.Now(),
+		id:       job.id,
+	}
+	d.mu.Unlock()
+
+	// The capsule is held back by its latest failure only
+	if ok && letter.id != job.id {
+		d.watermark.finish(ctx, letter.id)
+	}
+	return err
+}
+
+// callHandler runs handler, turning a panic into an error
+func callHandler[T any](ctx context.Context, handler Handler[T], key string, value T) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("timecapsule: handler for %q panicked: %v", key, r)
+		}
+	}()
+
+	return handler(ctx, key, value)
+}
+
+// backoff returns the delay before the given retry
+func (d *Dispatcher[T]) backoff(retry int) time.Duration {
+	delay := d.opts.BaseBackoff
+	for i := 1; i < retry && delay < d.opts.MaxBackoff; i++ {
+		delay *= 2
+	}
+	return min(delay, d.opts.MaxBackoff)
+}
+
+// sleep waits for delay on the dispatcher's clock or until ctx is done
+func (d *Dispatcher[T]) sleep(ctx context.Context, delay time.Duration) error {
+	timer := d.opts.Clock.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C():
+		return nil
+	}
+}
+
+// DeadLetters returns the capsules whose handlers kept failing, ordered by
+// key. Dead letters are kept in memory only, but with Watermarks set the
+// watermark does not pass them, so they are dispatched again after a restart.
+func (d *Dispatcher[T]) DeadLetters() []DeadLetter {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	letters := make([]DeadLetter, 0, len(d.deadLetters))
+	for _, letter := range d.deadLetters {
+		letters = append(letters, letter)
+	}
+	slices.SortFunc(letters, func(a, b DeadLetter) int { return strings.Compare(a.Key, b.Key) })
+	return letters
+}
+
+// Redrive removes a capsule from the dead letters and dispatches it again,
+// returning the final handler error. A capsule that fails again is
+// dead-lettered again.
+func (d *Dispatcher[T]) Redrive(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	letter, ok := d.deadLetters[key]
+	delete(d.deadLetters, key)
+	d.mu.Unlock()
+
+	if !ok {
+		return ErrCapsuleNotFound
+	}
+
+	if err := d.dispatch(ctx, dispatchJob{key: key, id: letter.id}); err != nil {
+		return err
+	}
+
+	d.watermark.finish(ctx, letter.id)
+	return nil
+}
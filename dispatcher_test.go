@@ -0,0 +1,327 @@
+package timecapsule
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDispatcher(t *testing.T) {
+	capsule := New[string]()
+	defer capsule.Close()
+
+	dispatcher := NewDispatcher(capsule, DispatcherOptions{BaseBackoff: time.Millisecond})
+
+	var mu sync.Mutex
+	handled := make(map[string]string)
+	done := make(chan struct{}, 10)
+	record := func(name string) Handler[string] {
+		return func(_ context.Context, key, value string) error {
+			mu.Lock()
+			handled[key] = name + ":" + value
+			mu.Unlock()
+			done <- struct{}{}
+			return nil
+		}
+	}
+	dispatcher.Handle("", record("default"))
+	dispatcher.Handle("email-", record("email"))
+	dispatcher.Handle("email-vip-", record("vip"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error)
+	go func() { result <- dispatcher.Run(ctx) }()
+
+	// Locked capsules are picked up whether stored before or after Run subscribes
+	unlockTime := time.Now().Add(50 * time.Millisecond)
+	require.NoError(t, capsule.Store(ctx, "email-1", "a", unlockTime))
+	require.NoError(t, capsule.Store(ctx, "email-vip-1", "b", unlockTime))
+	require.NoError(t, capsule.Store(ctx, "sms-1", "c", unlockTime))
+
+	require.Eventually(t, func() bool {
+		dispatcher.mu.Lock()
+		defer dispatcher.mu.Unlock()
+		return dispatcher.running
+	}, time.Second, time.Millisecond)
+	assert.ErrorIs(t, dispatcher.Run(ctx), ErrDispatcherRunning)
+
+	for i := 0; i < 3; i++ {
+		<-done
+	}
+
+	mu.Lock()
+	assert.Equal(t, map[string]string{
+		"email-1":     "email:a",
+		"email-vip-1": "vip:b",
+		"sms-1":       "default:c",
+	}, handled)
+	mu.Unlock()
+
+	cancel()
+	assert.ErrorIs(t, <-result, context.Canceled)
+}
+
+func TestDispatcherRetries(t *testing.T) {
+	capsule := New[int]()
+	defer capsule.Close()
+	ctx := context.Background()
+
+	dispatcher := NewDispatcher(capsule, DispatcherOptions{MaxAttempts: 3, BaseBackoff: time.Millisecond})
+
+	var calls atomic.Int32
+	dispatcher.Handle("flaky-", func(context.Context, string, int) error {
+		if calls.Add(1) < 3 {
+			return errors.New("temporary")
+		}
+		return nil
+	})
+	dispatcher.Handle("broken-", func(context.Context, string, int) error {
+		panic("boom")
+	})
+
+	require.NoError(t, capsule.Store(ctx, "flaky-1", 1, time.Now()))
+	require.NoError(t, dispatcher.dispatch(ctx, dispatchJob{key: "flaky-1"}))
+	assert.Equal(t, int32(3), calls.Load())
+
+	require.NoError(t, capsule.Store(ctx, "broken-1", 2, time.Now()))
+	err := dispatcher.dispatch(ctx, dispatchJob{key: "broken-1"})
+	assert.ErrorContains(t, err, "panicked: boom")
+
+	letters := dispatcher.DeadLetters()
+	require.Len(t, letters, 1)
+	assert.Equal(t, "broken-1", letters[0].Key)
+	assert.Equal(t, 3, letters[0].Attempts)
+
+	// Redriving after the handler is fixed clears the dead letter
+	dispatcher.Handle("broken-", func(context.Context, string, int) error { return nil })
+	require.NoError(t, dispatcher.Redrive(ctx, "broken-1"))
+	assert.Empty(t, dispatcher.DeadLetters())
+	assert.ErrorIs(t, dispatcher.Redrive(ctx, "broken-1"), ErrCapsuleNotFound)
+
+	// Deleted capsules are skipped rather than retried
+	require.NoError(t, dispatcher.dispatch(ctx, dispatchJob{key: "missing"}))
+}
+
+func TestDispatcherApprovals(t *testing.T) {
+	capsule := New[string]()
+	defer capsule.Close()
+
+	dispatcher := NewDispatcher(capsule, DispatcherOptions{BaseBackoff: time.Millisecond})
+
+	handled := make(chan string, 10)
+	dispatcher.Handle("", func(_ context.Context, key, _ string) error {
+		handled <- key
+		return nil
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error)
+	go func() { result <- dispatcher.Run(ctx) }()
+
+	require.Eventually(t, func() bool {
+		dispatcher.mu.Lock()
+		defer dispatcher.mu.Unlock()
+		return dispatcher.running
+	}, time.Second, time.Millisecond)
+
+	// Unlocked capsules awaiting approval are skipped until the final approval
+	require.NoError(t, capsule.StoreWithOptions(ctx, "release", "v", time.Now(), WithApprovals(2, "alice", "bob")))
+	require.NoError(t, capsule.Approve(ctx, "release", "alice"))
+
+	select {
+	case key := <-handled:
+		t.Fatalf("dispatched %q before approval", key)
+	case <-time.After(50 * time.Millisecond):
+	}
+	assert.Empty(t, dispatcher.DeadLetters())
+
+	require.NoError(t, capsule.Approve(ctx, "release", "bob"))
+	select {
+	case key := <-handled:
+		assert.Equal(t, "release", key)
+	case <-time.After(time.Second):
+		t.Fatal("approved capsule was not dispatched")
+	}
+
+	cancel()
+	assert.ErrorIs(t, <-result, context.Canceled)
+}
+
+func TestDispatcherBackoff(t *testing.T) {
+	dispatcher := NewDispatcher(New[int](), DispatcherOptions{BaseBackoff: time.Second, MaxBackoff: 5 * time.Second})
+
+	assert.Equal(t, time.Second, dispatcher.backoff(1))
+	assert.Equal(t, 2*time.Second, dispatcher.backoff(2))
+	assert.Equal(t, 4*time.Second, dispatcher.backoff(3))
+	assert.Equal(t, 5*time.Second, dispatcher.backoff(4))
+	assert.Equal(t, 5*time.Second, dispatcher.backoff(40))
+}
+
+// runCatchUp runs a dispatcher until it has caught up on missed capsules and
+// returns the keys it handled in order
+func runCatchUp(t *testing.T, capsule testCapsule[string], opts DispatcherOptions) []string {
+	t.Helper()
+
+	dispatcher := NewDispatcher(capsule, opts)
+
+	var mu sync.Mutex
+	var keys []string
+	dispatcher.Handle("", func(_ context.Context, key, _ string) error {
+		mu.Lock()
+		keys = append(keys, key)
+		mu.Unlock()
+		return nil
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error)
+	go func() { result <- dispatcher.Run(ctx) }()
+
+	// Catch-up is finished once the watermark passes the latest unlocked capsule
+	var latest time.Time
+	for _, metadata := range capsule.All(ctx, ListOptions{State: StateUnlocked}) {
+		latest = metadata.UnlockTime
+	}
+	require.Eventually(t, func() bool {
+		metadata, err := opts.Watermarks.Peek(ctx, DispatcherWatermarkPrefix+opts.Name)
+		return err == nil && metadata.UnlockTime.After(latest)
+	}, 5*time.Second, time.Millisecond)
+
+	cancel()
+	assert.ErrorIs(t, <-result, context.Canceled)
+
+	mu.Lock()
+	defer mu.Unlock()
+	return keys
+}
+
+func TestDispatcherCatchUp(t *testing.T) {
+	storage, err := NewFileStorage(t.TempDir())
+	require.NoError(t, err)
+	defer storage.Close()
+
+	watermarks, err := NewFileStorage(t.TempDir())
+	require.NoError(t, err)
+	defer watermarks.Close()
+
+	capsule := NewWithStorage(storage, NewJSONCodec[string]())
+	defer capsule.Close()
+	ctx := context.Background()
+
+	// Capsules that unlocked while no dispatcher was running
+	now := time.Now()
+	for i, age := range []time.Duration{3 * time.Hour, 2 * time.Hour, time.Minute} {
+		key := fmt.Sprintf("job-%d", i)
+		require.NoError(t, capsule.Store(ctx, key, key, now.Add(-age)))
+	}
+
+	opts := DispatcherOptions{Workers: 1, Watermarks: watermarks, Name: "all"}
+	assert.Equal(t, []string{"job-0", "job-1", "job-2"}, runCatchUp(t, capsule, opts))
+
+	// The watermark prevents dispatching them again
+	require.NoError(t, capsule.Store(ctx, "job-3", "job-3", time.Now().Add(-time.Millisecond)))
+	assert.Equal(t, []string{"job-3"}, runCatchUp(t, capsule, opts))
+
+	// Each policy starts from its own watermark
+	opts = DispatcherOptions{Workers: 1, Watermarks: watermarks, Name: "latest", Misfire: MisfireFireLatest}
+	assert.Equal(t, []string{"job-3"}, runCatchUp(t, capsule, opts))
+
+	opts = DispatcherOptions{Workers: 1, Watermarks: watermarks, Name: "recent", Misfire: MisfireSkipOlder, MisfireThreshold: time.Hour}
+	assert.Equal(t, []string{"job-2", "job-3"}, runCatchUp(t, capsule, opts))
+}
+
+func TestDispatcherDeadLetterWatermark(t *testing.T) {
+	storage, err := NewFileStorage(t.TempDir())
+	require.NoError(t, err)
+	defer storage.Close()
+
+	watermarks, err := NewFileStorage(t.TempDir())
+	require.NoError(t, err)
+	defer watermarks.Close()
+
+	capsule := NewWithStorage(storage, NewJSONCodec[string]())
+	defer capsule.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	opts := DispatcherOptions{Workers: 1, MaxAttempts: 1, Watermarks: watermarks, Name: "dead"}
+	dispatcher := NewDispatcher(capsule, opts)
+
+	var fixed atomic.Bool
+	dispatcher.Handle("", func(context.Context, string, string) error {
+		if !fixed.Load() {
+			return errors.New("broken")
+		}
+		return nil
+	})
+
+	unlockTime := time.Now().Add(-time.Minute)
+	require.NoError(t, capsule.Store(ctx, "job", "v", unlockTime))
+	go dispatcher.Run(ctx)
+
+	require.Eventually(t, func() bool { return len(dispatcher.DeadLetters()) == 1 }, 5*time.Second, time.Millisecond)
+
+	// The dead letter holds the watermark so a restart dispatches it again
+	metadata, err := watermarks.Peek(ctx, DispatcherWatermarkPrefix+opts.Name)
+	require.NoError(t, err)
+	assert.False(t, metadata.UnlockTime.After(unlockTime))
+
+	// A successful redrive releases it
+	fixed.Store(true)
+	require.NoError(t, dispatcher.Redrive(ctx, "job"))
+	metadata, err = watermarks.Peek(ctx, DispatcherWatermarkPrefix+opts.Name)
+	require.NoError(t, err)
+	assert.True(t, metadata.UnlockTime.After(unlockTime))
+}
+
+func TestDispatcherCatchUpFailure(t *testing.T) {
+	capsule := New[string]()
+	defer capsule.Close()
+
+	watermarks, err := NewFileStorage(t.TempDir())
+	require.NoError(t, err)
+	require.NoError(t, watermarks.Close())
+
+	dispatcher := NewDispatcher(capsule, DispatcherOptions{Watermarks: watermarks, Name: "closed"})
+	dispatcher.Handle("", func(context.Context, string, string) error { return nil })
+	assert.ErrorIs(t, dispatcher.Run(context.Background()), ErrStorageClosed)
+
+	// The subscription ends with Run
+	require.Eventually(t, func() bool {
+		capsule.events.mu.Lock()
+		defer capsule.events.mu.Unlock()
+		return len(capsule.events.subscribers) == 0
+	}, time.Second, time.Millisecond)
+}
+
+func TestDispatcherSharesRequired(t *testing.T) {
+	capsule := New[int]()
+	defer capsule.Close()
+	ctx := context.Background()
+
+	dispatcher := NewDispatcher(capsule, DispatcherOptions{MaxAttempts: 3, BaseBackoff: time.Millisecond})
+
+	var calls atomic.Int32
+	dispatcher.Handle("", func(context.Context, string, int) error {
+		calls.Add(1)
+		return nil
+	})
+
+	// Capsules that need shares are dead-lettered without retrying
+	_, err := capsule.StoreWithShares(ctx, "shared", 1, time.Now(), 2, 3)
+	require.NoError(t, err)
+	assert.ErrorIs(t, dispatcher.dispatch(ctx, dispatchJob{key: "shared"}), ErrSharesRequired)
+	assert.Zero(t, calls.Load())
+
+	letters := dispatcher.DeadLetters()
+	require.Len(t, letters, 1)
+	assert.Equal(t, "shared", letters[0].Key)
+	assert.Equal(t, 1, letters[0].Attempts)
+}
@@ -0,0 +1,367 @@
+package timecapsule
+
+import (
+	"context"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+)
+
+// encryptedRecordVersion is the first byte of every encrypted record
+const encryptedRecordVersion = 1
+
+// Encryption errors
+var (
+	ErrUnknownKey      = errors.New("encryption key not found in keyring")
+	ErrInvalidRecord   = errors.New("invalid encrypted record")
+	ErrDecryptFailed   = errors.New("decryption failed")
+	ErrInvalidKeySize  = errors.New("encryption key must be 16, 24 or 32 bytes")
+	ErrInvalidKeyID    = errors.New("key ID must be 1 to 255 bytes")
+	ErrPrimaryKeyInUse = errors.New("cannot remove the primary key")
+)
+
+// Keyring holds the AES keys used to encrypt capsules, identified by key ID.
+// New records are sealed with the primary key; records sealed with any key
+// still in the keyring can be opened, so keys can be rotated without
+// rewriting existing capsules first.
+type Keyring struct {
+	mu      sync.RWMutex
+	keys    map[string]cipher.AEAD
+	primary string
+}
+
+// NewKeyring creates a keyring whose primary key is key, identified by id
+func NewKeyring(id string, key []byte) (*Keyring, error) {
+	k := &Keyring{keys: make(map[string]cipher.AEAD)}
+	if err := k.Rotate(id, key); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// Add makes key available for decryption under id without changing the
+// primary key
+func (k *Keyring) Add(id string, key []byte) error {
+	if id == "" || len(id) > 255 {
+		return ErrInvalidKeyID
+	}
+
+	switch len(key) {
+	case 16, 24, 32:
+	default:
+		return ErrInvalidKeySize
+	}
+
+	aead, err := newGCM(key)
+	if err != nil {
+		return err
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.keys[id] = aead
+	return nil
+}
+
+// Rotate adds key under id and makes it the primary key
+func (k *Keyring) Rotate(id string, key []byte) error {
+	if err := k.Add(id, key); err != nil {
+		return err
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.primary = id
+	return nil
+}
+
+// Remove drops a retired key. Records still sealed with it can no longer be
+// opened, so re-encrypt them first.
+func (k *Keyring) Remove(id string) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if id == k.primary {
+		return ErrPrimaryKeyInUse
+	}
+
+	delete(k.keys, id)
+	return nil
+}
+
+// Primary returns the ID of the key used for new records
+func (k *Keyring) Primary() string {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.primary
+}
+
+// KeyIDs returns the IDs of every key in the keyring, sorted
+func (k *Keyring) KeyIDs() []string {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return slices.Sorted(maps.Keys(k.keys))
+}
+
+// seal encrypts plaintext with the primary key. The record layout is
+// version, key ID length, key ID, nonce and ciphertext; the version and key
+// ID are authenticated together with aad.
+func (k *Keyring) seal(plaintext, aad []byte) ([]byte, error) {
+	k.mu.RLock()
+	id, aead := k.primary, k.keys[k.primary]
+	k.mu.RUnlock()
+
+	header := make([]byte, 0, 2+len(id)+aead.NonceSize())
+	header = append(header, encryptedRecordVersion, byte(len(id)))
+	header = append(header, id...)
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	record := append(header, nonce...)
+	return aead.Seal(record, nonce, plaintext, recordAAD(header, aad)), nil
+}
+
+// open decrypts a record produced by seal
+func (k *Keyring) open(record, aad []byte) ([]byte, error) {
+	id, err := recordKeyID(record)
+	if err != nil {
+		return nil, err
+	}
+
+	k.mu.RLock()
+	aead, ok := k.keys[id]
+	k.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("timecapsule: key %q: %w", id, ErrUnknownKey)
+	}
+
+	headerSize := 2 + len(id)
+	if len(record) < headerSize+aead.NonceSize()+aead.Overhead() {
+		return nil, ErrInvalidRecord
+	}
+
+	header := record[:headerSize]
+	nonce := record[headerSize : headerSize+aead.NonceSize()]
+	plaintext, err := aead.Open(nil, nonce, record[headerSize+aead.NonceSize():], recordAAD(header, aad))
+	if err != nil {
+		return nil, ErrDecryptFailed
+	}
+
+	return plaintext, nil
+}
+
+// recordKeyID returns the ID of the key an encrypted record was sealed with
+func recordKeyID(record []byte) (string, error) {
+	if len(record) < 2 || record[0] != encryptedRecordVersion || len(record) < 2+int(record[1]) {
+		return "", ErrInvalidRecord
+	}
+	return string(record[2 : 2+int(record[1])]), nil
+}
+
+// recordAAD joins the record header with the caller's additional data in a
+// fresh slice, since AEAD additional data must not overlap the output
+func recordAAD(header, aad []byte) []byte {
+	joined := make([]byte, 0, len(header)+len(aad))
+	joined = append(joined, header...)
+	return append(joined, aad...)
+}
+
+// EncryptedCodec wraps a Codec, sealing encoded values with a Keyring.
+// Records are not bound to their capsule key, so prefer EncryptedStorage
+// when the storage itself is untrusted.
+type EncryptedCodec[T any] struct {
+	codec   Codec[T]
+	keyring *Keyring
+}
+
+// NewEncryptedCodec creates a codec that encrypts the output of codec
+func NewEncryptedCodec[T any](codec Codec[T], keyring *Keyring) *EncryptedCodec[T] {
+	return &EncryptedCodec[T]{codec: codec, keyring: keyring}
+}
+
+// Encode encodes and encrypts a value
+func (c *EncryptedCodec[T]) Encode(value T) ([]byte, error) {
+	data, err := c.codec.Encode(value)
+	if err != nil {
+		return nil, err
+	}
+	return c.keyring.seal(data, nil)
+}
+
+// Decode decrypts and decodes a value
+func (c *EncryptedCodec[T]) Decode(data []byte) (T, error) {
+	plaintext, err := c.keyring.open(data, nil)
+	if err != nil {
+		var zero T
+		return zero, err
+	}
+	return c.codec.Decode(plaintext)
+}
+
+// EncryptedStorage wraps a Storage, encrypting values with AES-GCM before
+// they reach it. Each record is tagged with the ID of the key that sealed it
+// and bound to its capsule key, so ciphertexts cannot be swapped between
+// capsules.
+type EncryptedStorage struct {
+	Storage
+	keyring *Keyring
+}
+
+// NewEncryptedStorage wraps storage with encryption under keyring
+func NewEncryptedStorage(storage Storage, keyring *Keyring) *EncryptedStorage {
+	return &EncryptedStorage{Storage: storage, keyring: keyring}
+}
+
+// Store encrypts the value with the primary key and stores it
+func (s *EncryptedStorage) Store(ctx context.Context, key string, value []byte, unlockTime time.Time) error {
+	return s.StoreWithOptions(ctx, key, value, unlockTime)
+}
+
+// StoreWithOptions encrypts the value with the primary key and stores it
+// with opts
+func (s *EncryptedStorage) StoreWithOptions(ctx context.Context, key string, value []byte, unlockTime time.Time, opts ...StoreOption) error {
+	if key == "" {
+		return ErrInvalidKey
+	}
+
+	record, err := s.keyring.seal(value, []byte(key))
+	if err != nil {
+		return err
+	}
+
+	return storeWith(ctx, s.Storage, key, record, unlockTime, opts...)
+}
+
+// Open reads and decrypts the value if it's unlocked
+func (s *EncryptedStorage) Open(ctx context.Context, key string) ([]byte, error) {
+	record, err := s.Storage.Open(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.keyring.open(record, []byte(key))
+}
+
+// Rewrite decrypts the value for rewrite and encrypts its result
+func (s *EncryptedStorage) Rewrite(ctx context.Context, key string, rewrite func(value []byte) ([]byte, error)) error {
+	return rewriteValue(ctx, s.Storage, key, func(record []byte) ([]byte, error) {
+		value, err := s.keyring.open(record, []byte(key))
+		if err != nil {
+			return nil, err
+		}
+
+		value, err = rewrite(value)
+		if err != nil || value == nil {
+			return nil, err
+		}
+
+		return s.keyring.seal(value, []byte(key))
+	})
+}
+
+// SetUnlockTime changes the unlock time in the underlying storage
+func (s *EncryptedStorage) SetUnlockTime(ctx context.Context, key string, unlockTime time.Time) error {
+	return setUnlockTime(ctx, s.Storage, key, unlockTime)
+}
+
+// UpdateAttributes changes the attributes in the underlying storage, which
+// are not encrypted
+func (s *EncryptedStorage) UpdateAttributes(ctx context.Context, key string, update func(attributes map[string]string) (map[string]string, error)) error {
+	return updateAttributes(ctx, s.Storage, key, update)
+}
+
+// List returns one page of capsules from the underlying storage
+func (s *EncryptedStorage) List(ctx context.Context, opts ListOptions) (ListPage, error) {
+	return listStorage(ctx, s.Storage, opts)
+}
+
+// Purge removes expired capsules from the underlying storage
+func (s *EncryptedStorage) Purge(ctx context.Context) (int, error) {
+	return purgeStorage(ctx, s.Storage)
+}
+
+// Reencrypt re-seals every capsule not yet encrypted with the primary key
+// and returns how many were rewritten. It can run in the background while
+// the storage is in use; each capsule is rewritten atomically. Capsules that
+// are not encrypted records or that the keyring cannot decrypt are skipped
+// and reported together in the returned error, wrapping ErrInvalidRecord,
+// ErrUnknownKey or ErrDecryptFailed.
+func (s *EncryptedStorage) Reencrypt(ctx context.Context) (int, error) {
+	return reencrypt(ctx, s.Storage, s.keyring, func(key string) []byte { return []byte(key) })
+}
+
+// Reencrypt re-seals every capsule in storage written by an EncryptedCodec
+// using keyring and not yet encrypted with its primary key, returning how
+// many were rewritten. Capsules that are not encrypted records or cannot be
+// decrypted are skipped as with EncryptedStorage.Reencrypt.
+func Reencrypt(ctx context.Context, storage Storage, keyring *Keyring) (int, error) {
+	return reencrypt(ctx, storage, keyring, func(string) []byte { return nil })
+}
+
+// reencrypt walks every capsule in storage, rewriting records sealed with a
+// key other than the primary and skipping those it cannot decrypt, such as
+// plaintext values that happen to start like an encrypted header
+func reencrypt(ctx context.Context, storage Storage, keyring *Keyring, aadFor func(key string) []byte) (int, error) {
+	rewritten := 0
+	var skipped []error
+	opts := ListOptions{}
+	for {
+		page, err := listStorage(ctx, storage, opts)
+		if err != nil {
+			return rewritten, errors.Join(append(skipped, err)...)
+		}
+
+		for _, item := range page.Items {
+			changed := false
+			var skip error
+			err := rewriteValue(ctx, storage, item.Key, func(record []byte) ([]byte, error) {
+				changed, skip = false, nil
+
+				id, err := recordKeyID(record)
+				if err != nil {
+					skip = err
+					return nil, nil
+				}
+				if id == keyring.Primary() {
+					return nil, nil
+				}
+
+				aad := aadFor(item.Key)
+				value, err := keyring.open(record, aad)
+				if err != nil {
+					skip = err
+					return nil, nil
+				}
+
+				changed = true
+				return keyring.seal(value, aad)
+			})
+			if errors.Is(err, ErrCapsuleNotFound) {
+				continue
+			}
+			if err != nil {
+				err = fmt.Errorf("timecapsule: re-encrypt %q: %w", item.Key, err)
+				return rewritten, errors.Join(append(skipped, err)...)
+			}
+			if skip != nil {
+				skipped = append(skipped, fmt.Errorf("timecapsule: re-encrypt %q: %w", item.Key, skip))
+			}
+			if changed {
+				rewritten++
+			}
+		}
+
+		if page.NextCursor == "" {
+			return rewritten, errors.Join(skipped...)
+		}
+		opts.Cursor = page.NextCursor
+	}
+}
@@ -0,0 +1,164 @@
+package timecapsule
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testKey returns a deterministic AES-256 key
+func testKey(seed byte) []byte {
+	return bytes.Repeat([]byte{seed}, 32)
+}
+
+func TestKeyring(t *testing.T) {
+	_, err := NewKeyring("k1", []byte("short"))
+	assert.ErrorIs(t, err, ErrInvalidKeySize)
+
+	_, err = NewKeyring("", testKey(1))
+	assert.ErrorIs(t, err, ErrInvalidKeyID)
+
+	keyring, err := NewKeyring("k1", testKey(1))
+	require.NoError(t, err)
+
+	record, err := keyring.seal([]byte("secret"), []byte("key"))
+	require.NoError(t, err)
+	assert.NotContains(t, string(record), "secret")
+
+	id, err := recordKeyID(record)
+	require.NoError(t, err)
+	assert.Equal(t, "k1", id)
+
+	// Rotation keeps old records readable until the old key is removed
+	require.NoError(t, keyring.Rotate("k2", testKey(2)))
+	assert.Equal(t, "k2", keyring.Primary())
+	assert.Equal(t, []string{"k1", "k2"}, keyring.KeyIDs())
+
+	plaintext, err := keyring.open(record, []byte("key"))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("secret"), plaintext)
+
+	_, err = keyring.open(record, []byte("other"))
+	assert.ErrorIs(t, err, ErrDecryptFailed)
+
+	assert.ErrorIs(t, keyring.Remove("k2"), ErrPrimaryKeyInUse)
+	require.NoError(t, keyring.Remove("k1"))
+	_, err = keyring.open(record, []byte("key"))
+	assert.ErrorIs(t, err, ErrUnknownKey)
+
+	_, err = keyring.open([]byte("plaintext"), nil)
+	assert.ErrorIs(t, err, ErrInvalidRecord)
+}
+
+// testStorageEncryption exercises EncryptedStorage, Rewrite and key rotation
+// against a backend
+func testStorageEncryption(t *testing.T, storage fullStorage) {
+	t.Helper()
+	ctx := context.Background()
+
+	keyring, err := NewKeyring("k1", testKey(1))
+	require.NoError(t, err)
+	encrypted := NewEncryptedStorage(storage, keyring)
+
+	require.NoError(t, encrypted.Store(ctx, "open", []byte("hello"), time.Now().Add(-time.Second)))
+	require.NoError(t, encrypted.Store(ctx, "locked", []byte("later"), time.Now().Add(time.Hour)))
+
+	value, err := encrypted.Open(ctx, "open")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("hello"), value)
+
+	// The backend only ever sees ciphertext
+	raw, err := storage.Open(ctx, "open")
+	require.NoError(t, err)
+	assert.NotContains(t, string(raw), "hello")
+
+	// Ciphertexts are bound to their capsule key
+	require.NoError(t, storage.Store(ctx, "swapped", raw, time.Now().Add(-time.Second)))
+	_, err = encrypted.Open(ctx, "swapped")
+	assert.ErrorIs(t, err, ErrDecryptFailed)
+	require.NoError(t, storage.Delete(ctx, "swapped"))
+
+	// Re-encryption rewrites locked capsules too, keeping their metadata
+	before, err := storage.Peek(ctx, "locked")
+	require.NoError(t, err)
+
+	require.NoError(t, keyring.Rotate("k2", testKey(2)))
+	rewritten, err := encrypted.Reencrypt(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 2, rewritten)
+
+	rewritten, err = encrypted.Reencrypt(ctx)
+	require.NoError(t, err)
+	assert.Zero(t, rewritten)
+
+	after, err := storage.Peek(ctx, "locked")
+	require.NoError(t, err)
+	assert.True(t, before.UnlockTime.Equal(after.UnlockTime))
+	assert.True(t, after.IsLocked)
+
+	require.NoError(t, keyring.Remove("k1"))
+	value, err = encrypted.Open(ctx, "open")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("hello"), value)
+
+	// Rewrite sees plaintext through the wrapper
+	require.NoError(t, encrypted.Rewrite(ctx, "open", func(value []byte) ([]byte, error) {
+		return append(value, '!'), nil
+	}))
+	value, err = encrypted.Open(ctx, "open")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("hello!"), value)
+
+	err = storage.Rewrite(ctx, "missing", func(value []byte) ([]byte, error) { return value, nil })
+	assert.ErrorIs(t, err, ErrCapsuleNotFound)
+}
+
+func TestEncryptedCodec(t *testing.T) {
+	storage, err := NewFileStorage(t.TempDir())
+	require.NoError(t, err)
+	defer storage.Close()
+	ctx := context.Background()
+
+	keyring, err := NewKeyring("k1", testKey(1))
+	require.NoError(t, err)
+
+	capsule := NewWithStorage(storage, NewEncryptedCodec(NewJSONCodec[string](), keyring))
+	require.NoError(t, capsule.Store(ctx, "test", "secret", time.Now().Add(-time.Second)))
+
+	raw, err := storage.Open(ctx, "test")
+	require.NoError(t, err)
+	assert.NotContains(t, string(raw), "secret")
+
+	// Records that are not encrypted are skipped and reported
+	require.NoError(t, storage.Store(ctx, "plain", []byte(`"visible"`), time.Now().Add(-time.Second)))
+
+	// Nor are plaintext values that start like an encrypted header, even when
+	// listed before the records to migrate
+	lookalike := append([]byte{encryptedRecordVersion, 2, 'k', '1'}, bytes.Repeat([]byte("x"), 64)...)
+	require.NoError(t, storage.Store(ctx, "lookalike", lookalike, time.Now().Add(-time.Hour)))
+
+	require.NoError(t, keyring.Rotate("k2", testKey(2)))
+	rewritten, err := Reencrypt(ctx, storage, keyring)
+	assert.ErrorIs(t, err, ErrInvalidRecord)
+	assert.ErrorIs(t, err, ErrDecryptFailed)
+	assert.ErrorContains(t, err, `"plain"`)
+	assert.ErrorContains(t, err, `"lookalike"`)
+	assert.Equal(t, 1, rewritten)
+
+	raw, err = storage.Open(ctx, "lookalike")
+	require.NoError(t, err)
+	assert.Equal(t, lookalike, raw)
+
+	raw, err = storage.Open(ctx, "plain")
+	require.NoError(t, err)
+	assert.Equal(t, []byte(`"visible"`), raw)
+
+	require.NoError(t, keyring.Remove("k1"))
+	value, err := capsule.Open(ctx, "test")
+	require.NoError(t, err)
+	assert.Equal(t, "secret", value)
+}
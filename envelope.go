@@ -0,0 +1,279 @@
+package timecapsule
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// envelopeVersion is the first byte of every envelope-encrypted value
+const envelopeVersion = 1
+
+// dataKeySize is the size of the per-capsule AES-256 data keys
+const dataKeySize = 32
+
+// KeyManager wraps and unwraps per-capsule data keys with master keys it
+// holds, such as a cloud KMS or an HSM. Wrapped keys must identify the
+// master key that wrapped them.
+type KeyManager interface {
+	// WrapKey encrypts a data key under the current master key
+	WrapKey(ctx context.Context, dataKey []byte) ([]byte, error)
+
+	// UnwrapKey decrypts a data key returned by WrapKey
+	UnwrapKey(ctx context.Context, wrapped []byte) ([]byte, error)
+}
+
+// sealEnvelope encrypts value with a fresh data key wrapped by keys. The
+// layout is version, wrapped key length (2 bytes), wrapped key, nonce and
+// ciphertext; the header and capsule key are authenticated.
+func sealEnvelope(ctx context.Context, keys KeyManager, key string, value []byte) ([]byte, error) {
+	dataKey := make([]byte, dataKeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+	defer clear(dataKey)
+
+	wrapped, err := keys.WrapKey(ctx, dataKey)
+	if err != nil {
+		return nil, fmt.Errorf("timecapsule: wrap data key: %w", err)
+	}
+	if len(wrapped) > 0xffff {
+		return nil, errors.New("timecapsule: wrapped data key too large")
+	}
+
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 3, 3+len(wrapped))
+	header[0] = envelopeVersion
+	binary.BigEndian.PutUint16(header[1:], uint16(len(wrapped)))
+	header = append(header, wrapped...)
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	record := append(append([]byte{}, header...), nonce...)
+	return aead.Seal(record, nonce, value, recordAAD(header, []byte(key))), nil
+}
+
+// openEnvelope unwraps the data key of a sealed value and decrypts it
+func openEnvelope(ctx context.Context, keys KeyManager, key string, record []byte) ([]byte, error) {
+	if len(record) < 3 || record[0] != envelopeVersion {
+		return nil, ErrInvalidRecord
+	}
+
+	headerSize := 3 + int(binary.BigEndian.Uint16(record[1:]))
+	if len(record) < headerSize {
+		return nil, ErrInvalidRecord
+	}
+
+	dataKey, err := keys.UnwrapKey(ctx, record[3:headerSize])
+	if err != nil {
+		return nil, fmt.Errorf("timecapsule: unwrap data key: %w", err)
+	}
+	defer clear(dataKey)
+
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(record) < headerSize+aead.NonceSize()+aead.Overhead() {
+		return nil, ErrInvalidRecord
+	}
+
+	nonce := record[headerSize : headerSize+aead.NonceSize()]
+	value, err := aead.Open(nil, nonce, record[headerSize+aead.NonceSize():], recordAAD(record[:headerSize], []byte(key)))
+	if err != nil {
+		return nil, ErrDecryptFailed
+	}
+
+	return value, nil
+}
+
+// newGCM creates an AES-GCM AEAD for key
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// localKeyFile is the on-disk representation of a LocalKeyManager
+type localKeyFile struct {
+	Primary string            `json:"primary"`
+	Keys    map[string]string `json:"keys"`
+}
+
+// LocalKeyManager is a KeyManager keeping AES-256 master keys in a local
+// JSON file. It is meant for development and tests; production deployments
+// should keep master keys in a KMS or HSM.
+type LocalKeyManager struct {
+	path string
+
+	mu      sync.RWMutex
+	keys    map[string]cipher.AEAD
+	primary string
+	file    localKeyFile
+}
+
+// NewLocalKeyManager loads the master keys in path, creating the file with a
+// new master key if it does not exist
+func NewLocalKeyManager(path string) (*LocalKeyManager, error) {
+	m := &LocalKeyManager{
+		path: path,
+		keys: make(map[string]cipher.AEAD),
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		m.file.Keys = make(map[string]string)
+		if err := m.Rotate(); err != nil {
+			return nil, err
+		}
+		return m, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("timecapsule: read key file: %w", err)
+	}
+
+	if err := json.Unmarshal(data, &m.file); err != nil {
+		return nil, fmt.Errorf("timecapsule: decode key file: %w", err)
+	}
+
+	for id, encoded := range m.file.Keys {
+		key, err := hex.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("timecapsule: decode master key %q: %w", id, err)
+		}
+
+		aead, err := newGCM(key)
+		clear(key)
+		if err != nil {
+			return nil, fmt.Errorf("timecapsule: master key %q: %w", id, err)
+		}
+		m.keys[id] = aead
+	}
+
+	if _, ok := m.keys[m.file.Primary]; !ok {
+		return nil, fmt.Errorf("timecapsule: primary master key %q: %w", m.file.Primary, ErrUnknownKey)
+	}
+	m.primary = m.file.Primary
+
+	return m, nil
+}
+
+// Rotate generates a new primary master key and saves it to the key file.
+// Earlier master keys are kept so existing capsules can still be opened.
+func (m *LocalKeyManager) Rotate() error {
+	key := make([]byte, dataKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+	defer clear(key)
+
+	aead, err := newGCM(key)
+	if err != nil {
+		return err
+	}
+
+	sum := sha256.Sum256(key)
+	id := hex.EncodeToString(sum[:8])
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	file := localKeyFile{Primary: id, Keys: make(map[string]string, len(m.file.Keys)+1)}
+	for existing, encoded := range m.file.Keys {
+		file.Keys[existing] = encoded
+	}
+	file.Keys[id] = hex.EncodeToString(key)
+
+	data, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(m.path, data); err != nil {
+		return fmt.Errorf("timecapsule: write key file: %w", err)
+	}
+
+	m.file = file
+	m.keys[id] = aead
+	m.primary = id
+	return nil
+}
+
+// Primary returns the ID of the master key used by WrapKey
+func (m *LocalKeyManager) Primary() string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.primary
+}
+
+// WrapKey encrypts a data key under the primary master key. The wrapped key
+// is the master key ID length, the ID, a nonce and the ciphertext.
+func (m *LocalKeyManager) WrapKey(ctx context.Context, dataKey []byte) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m.mu.RLock()
+	id, aead := m.primary, m.keys[m.primary]
+	m.mu.RUnlock()
+
+	header := append([]byte{byte(len(id))}, id...)
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	wrapped := append(append([]byte{}, header...), nonce...)
+	return aead.Seal(wrapped, nonce, dataKey, header), nil
+}
+
+// UnwrapKey decrypts a data key wrapped by any master key in the file
+func (m *LocalKeyManager) UnwrapKey(ctx context.Context, wrapped []byte) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(wrapped) < 1 || len(wrapped) < 1+int(wrapped[0]) {
+		return nil, ErrInvalidRecord
+	}
+
+	headerSize := 1 + int(wrapped[0])
+	id := string(wrapped[1:headerSize])
+
+	m.mu.RLock()
+	aead, ok := m.keys[id]
+	m.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("timecapsule: master key %q: %w", id, ErrUnknownKey)
+	}
+
+	if len(wrapped) < headerSize+aead.NonceSize()+aead.Overhead() {
+		return nil, ErrInvalidRecord
+	}
+
+	nonce := wrapped[headerSize : headerSize+aead.NonceSize()]
+	dataKey, err := aead.Open(nil, nonce, wrapped[headerSize+aead.NonceSize():], wrapped[:headerSize])
+	if err != nil {
+		return nil, ErrDecryptFailed
+	}
+
+	return dataKey, nil
+}
@@ -0,0 +1,90 @@
+package timecapsule
+
+import (
+	"context"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// countingKeyManager records how often data keys are unwrapped
+type countingKeyManager struct {
+	KeyManager
+	unwraps atomic.Int32
+}
+
+func (m *countingKeyManager) UnwrapKey(ctx context.Context, wrapped []byte) ([]byte, error) {
+	m.unwraps.Add(1)
+	return m.KeyManager.UnwrapKey(ctx, wrapped)
+}
+
+func TestLocalKeyManager(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.json")
+	ctx := context.Background()
+
+	keys, err := NewLocalKeyManager(path)
+	require.NoError(t, err)
+	first := keys.Primary()
+
+	dataKey := []byte("0123456789abcdef0123456789abcdef")
+	wrapped, err := keys.WrapKey(ctx, dataKey)
+	require.NoError(t, err)
+	assert.NotContains(t, string(wrapped), string(dataKey))
+
+	// Rotated and reloaded keys still unwrap older data keys
+	require.NoError(t, keys.Rotate())
+	assert.NotEqual(t, first, keys.Primary())
+
+	reloaded, err := NewLocalKeyManager(path)
+	require.NoError(t, err)
+	assert.Equal(t, keys.Primary(), reloaded.Primary())
+
+	unwrapped, err := reloaded.UnwrapKey(ctx, wrapped)
+	require.NoError(t, err)
+	assert.Equal(t, dataKey, unwrapped)
+
+	wrapped[len(wrapped)-1] ^= 1
+	_, err = reloaded.UnwrapKey(ctx, wrapped)
+	assert.ErrorIs(t, err, ErrDecryptFailed)
+}
+
+func TestEnvelopeEncryption(t *testing.T) {
+	storage, err := NewFileStorage(t.TempDir())
+	require.NoError(t, err)
+	defer storage.Close()
+	ctx := context.Background()
+
+	local, err := NewLocalKeyManager(filepath.Join(t.TempDir(), "keys.json"))
+	require.NoError(t, err)
+	keys := &countingKeyManager{KeyManager: local}
+
+	capsule := NewWithStorage(storage, NewJSONCodec[string](), WithKeyManager(keys))
+
+	require.NoError(t, capsule.Store(ctx, "locked", "later", time.Now().Add(time.Hour)))
+	require.NoError(t, capsule.Store(ctx, "open", "now", time.Now().Add(-time.Second)))
+
+	raw, err := storage.Open(ctx, "open")
+	require.NoError(t, err)
+	assert.NotContains(t, string(raw), "now")
+
+	// Locked capsules never reach the key manager
+	_, err = capsule.Open(ctx, "locked")
+	assert.ErrorIs(t, err, ErrCapsuleLocked)
+	_, err = capsule.Peek(ctx, "locked")
+	require.NoError(t, err)
+	assert.Zero(t, keys.unwraps.Load())
+
+	value, err := capsule.Open(ctx, "open")
+	require.NoError(t, err)
+	assert.Equal(t, "now", value)
+	assert.Equal(t, int32(1), keys.unwraps.Load())
+
+	// Each capsule gets its own data key and is bound to its key
+	require.NoError(t, storage.Store(ctx, "copy", raw, time.Now().Add(-time.Second)))
+	_, err = capsule.Open(ctx, "copy")
+	assert.ErrorIs(t, err, ErrDecryptFailed)
+}
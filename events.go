@@ -0,0 +1,525 @@
+package timecapsule
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// eventRetryDelay is how long the scheduler waits before retrying a capsule
+// whose metadata could not be read
+const eventRetryDelay = time.Second
+
+// EventType identifies what happened to a capsule
+type EventType int
+
+const (
+	// EventStored is published when a capsule is stored or replaced
+	EventStored EventType = iota + 1
+	// EventDelayed is published when a capsule's unlock time changes
+	EventDelayed
+	// EventUnlocked is published when a capsule's unlock time passes
+	EventUnlocked
+	// EventDeleted is published when a capsule is deleted
+	EventDeleted
+	// EventExpired is published when a capsule's expiry passes
+	EventExpired
+	// EventApproved is published when an approver approves a capsule
+	EventApproved
+)
+
+// String returns the lower-case name of the event type
+func (t EventType) String() string {
+	switch t {
+	case EventStored:
+		return "stored"
+	case EventDelayed:
+		return "delayed"
+	case EventUnlocked:
+		return "unlocked"
+	case EventDeleted:
+		return "deleted"
+	case EventExpired:
+		return "expired"
+	case EventApproved:
+		return "approved"
+	}
+	return "unknown"
+}
+
+// Event describes a change to a capsule
+type Event struct {
+	Type     EventType `json:"type"`
+	Key      string    `json:"key"`
+	Metadata Metadata  `json:"metadata"`
+	Time     time.Time `json:"time"`
+}
+
+// SubscribeOptions filters the events delivered to a subscription
+type SubscribeOptions struct {
+	// Prefix restricts events to keys starting with it
+	Prefix string
+
+	// Types restricts events to the listed types; empty means all types
+	Types []EventType
+}
+
+// matches reports whether an event passes the prefix and type filters
+func (o SubscribeOptions) matches(event Event) bool {
+	if !strings.HasPrefix(event.Key, o.Prefix) {
+		return false
+	}
+	return len(o.Types) == 0 || slices.Contains(o.Types, event.Type)
+}
+
+// scheduleItem is a pending unlock or expiry of a tracked capsule
+type scheduleItem struct {
+	at    time.Time
+	key   string
+	event EventType
+	index int
+}
+
+// scheduleQueue is a min-heap of pending items ordered by time
+type scheduleQueue []*scheduleItem
+
+func (q scheduleQueue) Len() int           { return len(q) }
+func (q scheduleQueue) Less(i, j int) bool { return q[i].at.Before(q[j].at) }
+
+func (q scheduleQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *scheduleQueue) Push(x any) {
+	item := x.(*scheduleItem)
+	item.index = len(*q)
+	*q = append(*q, item)
+}
+
+func (q *scheduleQueue) Pop() any {
+	old := *q
+	item := old[len(old)-1]
+	old[len(old)-1] = nil
+	*q = old[:len(old)-1]
+	item.index = -1
+	return item
+}
+
+// trackedCapsule is the scheduler's view of a capsule with pending events
+type trackedCapsule struct {
+	metadata Metadata
+	unlock   *scheduleItem
+	expire   *scheduleItem
+}
+
+// eventHub fans capsule events out to subscribers. Unlock and expiry events
+// come from a single scheduler goroutine that keeps one timer armed for the
+// earliest pending capsule, started by the first subscription.
+type eventHub struct {
+	clock Clock
+	peek  func(context.Context, string) (Metadata, error)
+	list  func(context.Context, ListOptions) (ListPage, error)
+
+	mu          sync.Mutex
+	subscribers map[*subscriber]struct{}
+	tracked     map[string]*trackedCapsule
+	queue       scheduleQueue
+	wake        chan struct{}
+	started     bool
+	seeded      bool
+	closed      bool
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// newEventHub creates a hub reading capsule state through peek and list
+func newEventHub(clock Clock, peek func(context.Context, string) (Metadata, error), list func(context.Context, ListOptions) (ListPage, error)) *eventHub {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &eventHub{
+		clock:       clock,
+		peek:        peek,
+		list:        list,
+		subscribers: make(map[*subscriber]struct{}),
+		tracked:     make(map[string]*trackedCapsule),
+		wake:        make(chan struct{}, 1),
+		ctx:         ctx,
+		cancel:      cancel,
+		done:        make(chan struct{}),
+	}
+}
+
+// subscribe registers a subscriber until ctx is done or the hub is closed.
+// The first subscription starts the scheduler, and subscriptions seed it with
+// every capsule that has yet to unlock or expire until a seed succeeds.
+func (h *eventHub) subscribe(ctx context.Context, opts SubscribeOptions) (<-chan Event, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	h.mu.Lock()
+	if h.closed {
+		h.mu.Unlock()
+		return nil, ErrClosed
+	}
+
+	sub := &subscriber{
+		opts:   opts,
+		out:    make(chan Event),
+		notify: make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+	h.subscribers[sub] = struct{}{}
+
+	if !h.started {
+		h.started = true
+		go h.run()
+	}
+	seed := !h.seeded
+	h.mu.Unlock()
+
+	go func() {
+		sub.run(ctx)
+		h.unsubscribe(sub)
+	}()
+
+	if seed {
+		if err := h.seed(ctx); err != nil {
+			h.unsubscribe(sub)
+			return nil, err
+		}
+
+		h.mu.Lock()
+		h.seeded = true
+		h.mu.Unlock()
+	}
+
+	return sub.out, nil
+}
+
+// seed tracks every capsule that is still locked or has yet to expire.
+// Capsules already tracked are kept, so concurrent or repeated seeds are
+// harmless.
+func (h *eventHub) seed(ctx context.Context) error {
+	opts := ListOptions{}
+	for {
+		page, err := h.list(ctx, opts)
+		if err != nil {
+			return err
+		}
+
+		h.mu.Lock()
+		for _, item := range page.Items {
+			if _, ok := h.tracked[item.Key]; !ok {
+				h.trackLocked(item.Key, item.Metadata, item.Metadata.IsLocked)
+			}
+		}
+		h.mu.Unlock()
+
+		if page.NextCursor == "" {
+			return nil
+		}
+		opts.Cursor = page.NextCursor
+	}
+}
+
+// unsubscribe removes a subscriber and stops its delivery goroutine
+func (h *eventHub) unsubscribe(sub *subscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, ok := h.subscribers[sub]; ok {
+		delete(h.subscribers, sub)
+		close(sub.done)
+	}
+}
+
+// active reports whether events are being recorded
+func (h *eventHub) active() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.started && !h.closed
+}
+
+// record publishes a stored, delayed, approved or deleted event and updates
+// the schedule. It is a no-op until the first subscription.
+func (h *eventHub) record(eventType EventType, key string, metadata Metadata) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if !h.started || h.closed {
+		return
+	}
+
+	h.publishLocked(eventType, key, metadata)
+	switch eventType {
+	case EventDeleted:
+		h.untrackLocked(key)
+	case EventApproved:
+		// Approvals leave the unlock time and expiry as scheduled
+		if tracked, ok := h.tracked[key]; ok {
+			tracked.metadata = metadata
+		}
+	default:
+		h.trackLocked(key, metadata, true)
+	}
+}
+
+// publishLocked delivers an event to every matching subscriber; the caller
+// must hold h.mu
+func (h *eventHub) publishLocked(eventType EventType, key string, metadata Metadata) {
+	event := Event{
+		Type:     eventType,
+		Key:      key,
+		Metadata: metadata,
+		Time:     h.clock.Now(),
+	}
+
+	for sub := range h.subscribers {
+		if sub.opts.matches(event) {
+			sub.push(event)
+		}
+	}
+}
+
+// trackLocked replaces the pending events of a capsule, scheduling its
+// unlock when unlock is set and its expiry if it has one; the caller must
+// hold h.mu
+func (h *eventHub) trackLocked(key string, metadata Metadata, unlock bool) {
+	h.untrackLocked(key)
+
+	tracked := &trackedCapsule{metadata: metadata}
+	if unlock {
+		tracked.unlock = h.scheduleLocked(metadata.UnlockTime, key, EventUnlocked)
+	}
+	if !metadata.ExpiresAt.IsZero() && !metadata.IsExpired {
+		tracked.expire = h.scheduleLocked(metadata.ExpiresAt, key, EventExpired)
+	}
+
+	if tracked.unlock != nil || tracked.expire != nil {
+		h.tracked[key] = tracked
+	}
+}
+
+// untrackLocked drops the pending events of a capsule; the caller must hold
+// h.mu
+func (h *eventHub) untrackLocked(key string) {
+	tracked, ok := h.tracked[key]
+	if !ok {
+		return
+	}
+
+	for _, item := range []*scheduleItem{tracked.unlock, tracked.expire} {
+		if item != nil && item.index >= 0 {
+			heap.Remove(&h.queue, item.index)
+		}
+	}
+	delete(h.tracked, key)
+}
+
+// scheduleLocked queues an event and wakes the scheduler; the caller must
+// hold h.mu
+func (h *eventHub) scheduleLocked(at time.Time, key string, eventType EventType) *scheduleItem {
+	item := &scheduleItem{at: at, key: key, event: eventType}
+	heap.Push(&h.queue, item)
+
+	select {
+	case h.wake <- struct{}{}:
+	default:
+	}
+
+	return item
+}
+
+// run is the scheduler loop. It sleeps until the earliest pending item is
+// due or the schedule changes, then fires every due item.
+func (h *eventHub) run() {
+	defer close(h.done)
+
+	for {
+		h.mu.Lock()
+		var fire <-chan time.Time
+		var timer Timer
+		if len(h.queue) > 0 {
+			timer = h.clock.NewTimer(h.queue[0].at.Sub(h.clock.Now()))
+			fire = timer.C()
+		}
+		h.mu.Unlock()
+
+		select {
+		case <-h.ctx.Done():
+			if timer != nil {
+				timer.Stop()
+			}
+			return
+		case <-h.wake:
+		case <-fire:
+		}
+
+		if timer != nil {
+			timer.Stop()
+		}
+		h.fireDue()
+	}
+}
+
+// fireDue pops every due item and publishes its event after confirming the
+// capsule's current state
+func (h *eventHub) fireDue() {
+	now := h.clock.Now()
+
+	h.mu.Lock()
+	var due []*scheduleItem
+	for len(h.queue) > 0 && !h.queue[0].at.After(now) {
+		due = append(due, heap.Pop(&h.queue).(*scheduleItem))
+	}
+	h.mu.Unlock()
+
+	for _, item := range due {
+		metadata, err := h.peek(h.ctx, item.key)
+
+		h.mu.Lock()
+		tracked, ok := h.tracked[item.key]
+		if ok && (tracked.unlock == item || tracked.expire == item) {
+			h.fireLocked(tracked, item, metadata, err)
+		}
+		h.mu.Unlock()
+	}
+}
+
+// fireLocked publishes or reschedules a due item; the caller must hold h.mu
+func (h *eventHub) fireLocked(tracked *trackedCapsule, item *scheduleItem, metadata Metadata, err error) {
+	switch {
+	case errors.Is(err, ErrCapsuleNotFound) && item.event == EventExpired:
+		// Purged after expiring; report it with the last known metadata
+		metadata = tracked.metadata
+		metadata.IsExpired = true
+	case errors.Is(err, ErrCapsuleNotFound):
+		metadata, err = Metadata{}, nil
+	case err != nil:
+		if h.ctx.Err() == nil {
+			h.replaceLocked(tracked, item, h.scheduleLocked(h.clock.Now().Add(eventRetryDelay), item.key, item.event))
+		}
+		return
+	}
+
+	if item.event == EventUnlocked {
+		tracked.unlock = nil
+		switch {
+		case metadata.UnlockTime.IsZero():
+		case metadata.IsLocked:
+			// Moved later by another writer
+			tracked.unlock = h.scheduleLocked(metadata.UnlockTime, item.key, EventUnlocked)
+		case !metadata.IsExpired:
+			h.publishLocked(EventUnlocked, item.key, metadata)
+		}
+	} else {
+		tracked.expire = nil
+		switch {
+		case metadata.ExpiresAt.IsZero():
+		case !metadata.IsExpired:
+			tracked.expire = h.scheduleLocked(metadata.ExpiresAt, item.key, EventExpired)
+		default:
+			h.publishLocked(EventExpired, item.key, metadata)
+		}
+	}
+
+	if tracked.unlock == nil && tracked.expire == nil {
+		delete(h.tracked, item.key)
+	}
+}
+
+// replaceLocked swaps a fired item for its replacement; the caller must hold
+// h.mu
+func (h *eventHub) replaceLocked(tracked *trackedCapsule, old, item *scheduleItem) {
+	if tracked.unlock == old {
+		tracked.unlock = item
+	} else {
+		tracked.expire = item
+	}
+}
+
+// close stops the scheduler and ends every subscription
+func (h *eventHub) close() {
+	h.mu.Lock()
+	if h.closed {
+		h.mu.Unlock()
+		return
+	}
+	h.closed = true
+	started := h.started
+	for sub := range h.subscribers {
+		delete(h.subscribers, sub)
+		close(sub.done)
+	}
+	h.mu.Unlock()
+
+	h.cancel()
+	if started {
+		<-h.done
+	}
+}
+
+// subscriber buffers events for one subscription so that a slow reader
+// never blocks publishers or the scheduler. The buffer is unbounded; a
+// subscription that is no longer read must be cancelled to release it.
+type subscriber struct {
+	opts   SubscribeOptions
+	out    chan Event
+	notify chan struct{}
+	done   chan struct{}
+
+	mu    sync.Mutex
+	queue []Event
+}
+
+// push appends an event to the subscriber's buffer
+func (s *subscriber) push(event Event) {
+	s.mu.Lock()
+	s.queue = append(s.queue, event)
+	s.mu.Unlock()
+
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+// run delivers buffered events in order until ctx is done or the
+// subscription ends, then closes the output channel
+func (s *subscriber) run(ctx context.Context) {
+	defer close(s.out)
+
+	for {
+		s.mu.Lock()
+		if len(s.queue) == 0 {
+			s.mu.Unlock()
+			select {
+			case <-s.notify:
+				continue
+			case <-ctx.Done():
+				return
+			case <-s.done:
+				return
+			}
+		}
+		event := s.queue[0]
+		s.queue = s.queue[1:]
+		s.mu.Unlock()
+
+		select {
+		case s.out <- event:
+		case <-ctx.Done():
+			return
+		case <-s.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package timecapsule
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// nextEvent receives one event or fails the test after a timeout
+func nextEvent(t *testing.T, events <-chan Event) Event {
+	t.Helper()
+
+	select {
+	case event, ok := <-events:
+		require.True(t, ok, "event channel closed")
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for event")
+		return Event{}
+	}
+}
+
+func TestEventTypeString(t *testing.T) {
+	assert.Equal(t, "stored", EventStored.String())
+	assert.Equal(t, "expired", EventExpired.String())
+	assert.Equal(t, "unknown", EventType(0).String())
+}
+
+func TestSubscribe(t *testing.T) {
+	capsule := New[string]()
+	defer capsule.Close()
+	ctx := context.Background()
+
+	events, err := capsule.Subscribe(ctx, SubscribeOptions{})
+	require.NoError(t, err)
+
+	require.NoError(t, capsule.StoreWithOptions(ctx, "soon", "hello", time.Now().Add(50*time.Millisecond), WithValidFor(50*time.Millisecond)))
+	event := nextEvent(t, events)
+	assert.Equal(t, EventStored, event.Type)
+	assert.Equal(t, "soon", event.Key)
+	assert.True(t, event.Metadata.IsLocked)
+
+	event = nextEvent(t, events)
+	assert.Equal(t, EventUnlocked, event.Type)
+	assert.False(t, event.Metadata.IsLocked)
+
+	event = nextEvent(t, events)
+	assert.Equal(t, EventExpired, event.Type)
+	assert.True(t, event.Metadata.IsExpired)
+
+	// Delaying reschedules the unlock and deleting cancels it
+	require.NoError(t, capsule.Store(ctx, "later", "x", time.Now().Add(time.Hour)))
+	require.NoError(t, capsule.Delay(ctx, "later", 2*time.Hour))
+	require.NoError(t, capsule.Delete(ctx, "later"))
+
+	for _, eventType := range []EventType{EventStored, EventDelayed, EventDeleted} {
+		event := nextEvent(t, events)
+		assert.Equal(t, eventType, event.Type)
+		assert.Equal(t, "later", event.Key)
+	}
+
+	// Closing the capsule ends the subscription
+	require.NoError(t, capsule.Close())
+	_, ok := <-events
+	assert.False(t, ok)
+
+	_, err = capsule.Subscribe(ctx, SubscribeOptions{})
+	assert.ErrorIs(t, err, ErrClosed)
+}
+
+func TestSubscribeFilters(t *testing.T) {
+	capsule := New[string]()
+	defer capsule.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+
+	events, err := capsule.Subscribe(ctx, SubscribeOptions{Prefix: "email-", Types: []EventType{EventUnlocked}})
+	require.NoError(t, err)
+
+	require.NoError(t, capsule.Store(ctx, "sms-1", "x", time.Now()))
+	require.NoError(t, capsule.Store(ctx, "email-1", "y", time.Now()))
+
+	event := nextEvent(t, events)
+	assert.Equal(t, EventUnlocked, event.Type)
+	assert.Equal(t, "email-1", event.Key)
+
+	// Cancelling the context ends the subscription
+	cancel()
+	for range events {
+	}
+}
+
+func TestPersistentSubscribe(t *testing.T) {
+	storage, err := NewFileStorage(t.TempDir())
+	require.NoError(t, err)
+	defer storage.Close()
+	ctx := context.Background()
+
+	// Capsules stored before the first subscription are scheduled too
+	require.NoError(t, storage.Store(ctx, "existing", []byte(`"a"`), time.Now().Add(50*time.Millisecond)))
+	require.NoError(t, storage.Store(ctx, "opened", []byte(`"b"`), time.Now().Add(-time.Hour)))
+
+	capsule := NewWithStorage(storage, NewJSONCodec[string]())
+	defer capsule.Close()
+
+	events, err := capsule.Subscribe(ctx, SubscribeOptions{})
+	require.NoError(t, err)
+
+	event := nextEvent(t, events)
+	assert.Equal(t, EventUnlocked, event.Type)
+	assert.Equal(t, "existing", event.Key)
+
+	require.NoError(t, capsule.Store(ctx, "new", "c", time.Now().Add(-time.Second)))
+	event = nextEvent(t, events)
+	assert.Equal(t, EventStored, event.Type)
+	assert.False(t, event.Metadata.CreatedAt.IsZero())
+
+	event = nextEvent(t, events)
+	assert.Equal(t, EventUnlocked, event.Type)
+	assert.Equal(t, "new", event.Key)
+
+	require.NoError(t, capsule.Delete(ctx, "new"))
+	event = nextEvent(t, events)
+	assert.Equal(t, EventDeleted, event.Type)
+	assert.False(t, event.Metadata.UnlockTime.IsZero())
+}
+
+func TestSubscribeRetriesSeed(t *testing.T) {
+	ctx := context.Background()
+	unlockTime := time.Now().Add(20 * time.Millisecond)
+
+	var listed atomic.Int32
+	list := func(context.Context, ListOptions) (ListPage, error) {
+		if listed.Add(1) == 1 {
+			return ListPage{}, assert.AnError
+		}
+		metadata := newMetadata(unlockTime, time.Time{}, time.Time{}, time.Now(), nil)
+		return ListPage{Items: []ListItem{{Key: "later", Metadata: metadata}}}, nil
+	}
+	peek := func(context.Context, string) (Metadata, error) {
+		return newMetadata(unlockTime, time.Time{}, time.Time{}, time.Now(), nil), nil
+	}
+
+	hub := newEventHub(SystemClock(), peek, list)
+	defer hub.close()
+
+	// A failed seed is retried by the next subscription
+	_, err := hub.subscribe(ctx, SubscribeOptions{})
+	assert.ErrorIs(t, err, assert.AnError)
+
+	events, err := hub.subscribe(ctx, SubscribeOptions{})
+	require.NoError(t, err)
+	event := nextEvent(t, events)
+	assert.Equal(t, EventUnlocked, event.Type)
+	assert.Equal(t, "later", event.Key)
+
+	// Once seeded, later subscriptions do not list again
+	_, err = hub.subscribe(ctx, SubscribeOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, int32(2), listed.Load())
+}
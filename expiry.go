@@ -0,0 +1,146 @@
+package timecapsule
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// StoreOption configures a single Store call
+type StoreOption func(*StoreOptions)
+
+// StoreOptions is the resolved form of the StoreOption values passed to
+// Store. Storage implementations receive the raw options and resolve them
+// with ApplyStoreOptions.
+type StoreOptions struct {
+	// ExpiresAt closes the window in which the capsule can be opened; the
+	// zero value means the capsule never expires
+	ExpiresAt time.Time
+
+	// Attributes are stored with the capsule and returned in its Metadata
+	Attributes map[string]string
+
+	// CreatedAt overrides the creation time of the capsule; the zero value
+	// means the time of the Store call
+	CreatedAt time.Time
+
+	approvals   *Approvals
+	commit      bool
+	oneShot     bool
+	validFor    time.Duration
+	hasValidFor bool
+}
+
+// ApplyStoreOptions resolves opts for a capsule unlocking at unlockTime and
+// validates the resulting window
+func ApplyStoreOptions(unlockTime time.Time, opts ...StoreOption) (StoreOptions, error) {
+	var o StoreOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	if o.hasValidFor {
+		o.ExpiresAt = unlockTime.Add(o.validFor)
+	}
+
+	if !o.ExpiresAt.IsZero() && !o.ExpiresAt.After(unlockTime) {
+		return StoreOptions{}, ErrInvalidWindow
+	}
+
+	if o.approvals != nil {
+		if err := o.approvals.validate(); err != nil {
+			return StoreOptions{}, err
+		}
+		if o.Attributes == nil {
+			o.Attributes = make(map[string]string)
+		}
+		if err := o.approvals.encode(o.Attributes); err != nil {
+			return StoreOptions{}, err
+		}
+	}
+
+	return o, nil
+}
+
+// WithExpiry makes the capsule expire at expiresAt, after which Open returns
+// ErrCapsuleExpired. It must be after the unlock time.
+func WithExpiry(expiresAt time.Time) StoreOption {
+	return func(o *StoreOptions) {
+		o.ExpiresAt = expiresAt
+		o.hasValidFor = false
+	}
+}
+
+// createdAt returns the creation time to store, defaulting to now
+func (o StoreOptions) createdAt(now time.Time) time.Time {
+	if o.CreatedAt.IsZero() {
+		return now
+	}
+	return o.CreatedAt
+}
+
+// WithCreatedAt records createdAt as the creation time of the capsule
+// instead of the time of the Store call, for example when copying capsules
+// between storages
+func WithCreatedAt(createdAt time.Time) StoreOption {
+	return func(o *StoreOptions) {
+		o.CreatedAt = createdAt
+	}
+}
+
+// WithValidFor makes the capsule expire d after its unlock time
+func WithValidFor(d time.Duration) StoreOption {
+	return func(o *StoreOptions) {
+		o.validFor = d
+		o.hasValidFor = true
+	}
+}
+
+// purger periodically removes expired capsules in the background
+type purger struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+	once   sync.Once
+}
+
+// startPurger runs purge every interval until stopped. It returns nil when
+// interval is not positive.
+func startPurger(clock Clock, interval time.Duration, purge func(context.Context) (int, error)) *purger {
+	if interval <= 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &purger{
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+
+	go func() {
+		defer close(p.done)
+
+		for {
+			timer := clock.NewTimer(interval)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case <-timer.C():
+				// Failures are retried on the next tick
+				_, _ = purge(ctx)
+			}
+		}
+	}()
+
+	return p
+}
+
+// stop halts the purger and waits for it to exit; it is safe on a nil purger
+func (p *purger) stop() {
+	if p == nil {
+		return
+	}
+
+	p.once.Do(p.cancel)
+	<-p.done
+}
@@ -0,0 +1,123 @@
+package timecapsule
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestApplyStoreOptions(t *testing.T) {
+	unlockTime := time.Now()
+
+	o, err := ApplyStoreOptions(unlockTime)
+	require.NoError(t, err)
+	assert.True(t, o.ExpiresAt.IsZero())
+
+	o, err = ApplyStoreOptions(unlockTime, WithValidFor(time.Hour))
+	require.NoError(t, err)
+	assert.True(t, o.ExpiresAt.Equal(unlockTime.Add(time.Hour)))
+
+	// The last option wins
+	expiresAt := unlockTime.Add(time.Minute)
+	o, err = ApplyStoreOptions(unlockTime, WithValidFor(time.Hour), WithExpiry(expiresAt))
+	require.NoError(t, err)
+	assert.True(t, o.ExpiresAt.Equal(expiresAt))
+
+	_, err = ApplyStoreOptions(unlockTime, WithExpiry(unlockTime))
+	assert.ErrorIs(t, err, ErrInvalidWindow)
+
+	_, err = ApplyStoreOptions(unlockTime, WithValidFor(-time.Second))
+	assert.ErrorIs(t, err, ErrInvalidWindow)
+}
+
+func TestExpiry(t *testing.T) {
+	capsule := New[string]()
+	defer capsule.Close()
+	ctx := context.Background()
+
+	require.NoError(t, capsule.StoreWithOptions(ctx, "open", "hello", time.Now().Add(-time.Second), WithValidFor(time.Hour)))
+	value, err := capsule.Open(ctx, "open")
+	require.NoError(t, err)
+	assert.Equal(t, "hello", value)
+
+	require.NoError(t, capsule.StoreWithOptions(ctx, "expired", "gone", time.Now().Add(-time.Hour), WithExpiry(time.Now().Add(-time.Second))))
+	_, err = capsule.Open(ctx, "expired")
+	assert.ErrorIs(t, err, ErrCapsuleExpired)
+
+	metadata, err := capsule.Peek(ctx, "expired")
+	require.NoError(t, err)
+	assert.False(t, metadata.IsLocked)
+	assert.True(t, metadata.IsExpired)
+
+	err = capsule.StoreWithOptions(ctx, "invalid", "x", time.Now(), WithValidFor(0))
+	assert.ErrorIs(t, err, ErrInvalidWindow)
+	assert.False(t, capsule.Exists(ctx, "invalid"))
+
+	// Delay cannot push the unlock time past the expiry
+	assert.ErrorIs(t, capsule.Delay(ctx, "open", 2*time.Hour), ErrInvalidWindow)
+	require.NoError(t, capsule.Delay(ctx, "open", time.Minute))
+
+	page, err := capsule.List(ctx, ListOptions{State: StateExpired})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"expired"}, collectKeys(page))
+
+	purged, err := capsule.Purge(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, purged)
+	assert.False(t, capsule.Exists(ctx, "expired"))
+	assert.True(t, capsule.Exists(ctx, "open"))
+}
+
+// testStorageExpiry exercises the unlock window and Purge against a backend
+func testStorageExpiry(t *testing.T, storage fullStorage) {
+	t.Helper()
+	ctx := context.Background()
+	now := time.Now()
+
+	require.NoError(t, storage.StoreWithOptions(ctx, "open", []byte("1"), now.Add(-time.Hour), WithExpiry(now.Add(time.Hour))))
+	require.NoError(t, storage.StoreWithOptions(ctx, "expired", []byte("2"), now.Add(-time.Hour), WithValidFor(time.Minute)))
+	require.NoError(t, storage.Store(ctx, "forever", []byte("3"), now.Add(-time.Hour)))
+
+	value, err := storage.Open(ctx, "open")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("1"), value)
+
+	_, err = storage.Open(ctx, "expired")
+	assert.ErrorIs(t, err, ErrCapsuleExpired)
+
+	metadata, err := storage.Peek(ctx, "expired")
+	require.NoError(t, err)
+	assert.True(t, metadata.IsExpired)
+	assert.True(t, metadata.ExpiresAt.Equal(now.Add(-time.Hour+time.Minute)))
+
+	err = storage.StoreWithOptions(ctx, "invalid", []byte("4"), now, WithExpiry(now.Add(-time.Second)))
+	assert.ErrorIs(t, err, ErrInvalidWindow)
+	assert.False(t, storage.Exists(ctx, "invalid"))
+
+	// The unlock time cannot be moved to or past the expiry
+	assert.ErrorIs(t, storage.SetUnlockTime(ctx, "open", now.Add(time.Hour)), ErrInvalidWindow)
+	require.NoError(t, storage.SetUnlockTime(ctx, "open", now.Add(time.Minute)))
+	require.NoError(t, storage.SetUnlockTime(ctx, "forever", now.Add(24*time.Hour)))
+
+	page, err := storage.List(ctx, ListOptions{State: StateExpired})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"expired"}, collectKeys(page))
+
+	page, err = storage.List(ctx, ListOptions{State: StateUnlocked})
+	require.NoError(t, err)
+	assert.Empty(t, page.Items)
+
+	purged, err := storage.Purge(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, purged)
+	assert.False(t, storage.Exists(ctx, "expired"))
+	assert.True(t, storage.Exists(ctx, "open"))
+	assert.True(t, storage.Exists(ctx, "forever"))
+
+	purged, err = storage.Purge(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 0, purged)
+}
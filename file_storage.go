@@ -0,0 +1,679 @@
+package timecapsule
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	fileCapsuleDir    = "capsules"
+	fileCapsuleExt    = ".capsule"
+	fileIndexName     = "index.json"
+	fileTempPrefix    = ".tmp-"
+	fileDirPerm       = 0o700
+	fileRecordPerm    = 0o600
+	fileIndexVersion  = 1
+	fileRecordVersion = 1
+)
+
+// fileRecord is the on-disk representation of a single capsule
+type fileRecord struct {
+	Version    int               `json:"version"`
+	Key        string            `json:"key"`
+	Value      []byte            `json:"value"`
+	UnlockTime time.Time         `json:"unlock_time"`
+	CreatedAt  time.Time         `json:"created_at"`
+	ExpiresAt  time.Time         `json:"expires_at,omitzero"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+}
+
+// fileIndexEntry caches the metadata of a capsule file so that Peek and
+// Exists never have to read the payload
+type fileIndexEntry struct {
+	File       string            `json:"file"`
+	UnlockTime time.Time         `json:"unlock_time"`
+	CreatedAt  time.Time         `json:"created_at"`
+	ExpiresAt  time.Time         `json:"expires_at,omitzero"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+	Size       int64             `json:"size"`
+	ModTime    time.Time         `json:"mod_time"`
+}
+
+// newFileIndexEntry builds the index entry for a capsule file
+func newFileIndexEntry(name string, record fileRecord, info fs.FileInfo) fileIndexEntry {
+	return fileIndexEntry{
+		File:       name,
+		UnlockTime: record.UnlockTime,
+		CreatedAt:  record.CreatedAt,
+		ExpiresAt:  record.ExpiresAt,
+		Attributes: record.Attributes,
+		Size:       info.Size(),
+		ModTime:    info.ModTime(),
+	}
+}
+
+// metadata returns the capsule metadata as seen at now
+func (e fileIndexEntry) metadata(now time.Time) Metadata {
+	return newMetadata(e.UnlockTime, e.CreatedAt, e.ExpiresAt, now, e.Attributes)
+}
+
+// fileIndex is the on-disk representation of the unlock-time index
+type fileIndex struct {
+	Version  int                       `json:"version"`
+	Capsules map[string]fileIndexEntry `json:"capsules"`
+}
+
+// FileStorage implements Storage on a local directory.
+//
+// Every capsule is written to its own file under <dir>/capsules and an index
+// of unlock times is kept in memory. All writes go to a temporary file that
+// is fsynced and atomically renamed into place, followed by an fsync of the
+// parent directory, so a crash never leaves a partially written capsule
+// behind.
+//
+// Capsule files are the source of truth. The index is only saved to
+// <dir>/index.json by Close, so writes cost the same however many capsules
+// are stored, and it is removed again when the storage is opened, so after a
+// crash every capsule file is read to rebuild it. A saved index entry is
+// trusted without reading its file while the file's size and modification
+// time are unchanged; a file edited by hand that keeps both is not noticed
+// until it is next written.
+type FileStorage struct {
+	dir    string
+	index  map[string]fileIndexEntry
+	clock  Clock
+	mu     sync.RWMutex
+	closed bool
+}
+
+// NewFileStorage opens (or creates) a file-system storage rooted at dir
+func NewFileStorage(dir string, opts ...Option) (*FileStorage, error) {
+	if dir == "" {
+		return nil, errors.New("timecapsule: file storage directory is required")
+	}
+
+	if err := os.MkdirAll(filepath.Join(dir, fileCapsuleDir), fileDirPerm); err != nil {
+		return nil, fmt.Errorf("timecapsule: create storage directory: %w", err)
+	}
+
+	o := newOptions(opts...)
+	s := &FileStorage{
+		dir:   dir,
+		index: make(map[string]fileIndexEntry),
+		clock: o.clock,
+	}
+
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Store writes a capsule file and records its unlock time in the index
+func (s *FileStorage) Store(ctx context.Context, key string, value []byte, unlockTime time.Time) error {
+	return s.StoreWithOptions(ctx, key, value, unlockTime)
+}
+
+// StoreWithOptions writes a capsule file with opts and records its unlock
+// time in the index
+func (s *FileStorage) StoreWithOptions(ctx context.Context, key string, value []byte, unlockTime time.Time, opts ...StoreOption) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if key == "" {
+		return ErrInvalidKey
+	}
+
+	o, err := ApplyStoreOptions(unlockTime, opts...)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return ErrStorageClosed
+	}
+
+	record := fileRecord{
+		Version:    fileRecordVersion,
+		Key:        key,
+		Value:      value,
+		UnlockTime: unlockTime,
+		CreatedAt:  o.createdAt(s.clock.Now()),
+		ExpiresAt:  o.ExpiresAt,
+		Attributes: o.Attributes,
+	}
+
+	return s.writeRecord(record)
+}
+
+// Open reads the capsule payload if it's unlocked
+func (s *FileStorage) Open(ctx context.Context, key string) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if key == "" {
+		return nil, ErrInvalidKey
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.closed {
+		return nil, ErrStorageClosed
+	}
+
+	entry, exists := s.index[key]
+	if !exists {
+		return nil, ErrCapsuleNotFound
+	}
+
+	if err := checkWindow(entry.UnlockTime, entry.ExpiresAt, s.clock.Now(), entry.Attributes); err != nil {
+		return nil, err
+	}
+
+	record, err := s.readRecord(entry.File)
+	if err != nil {
+		return nil, err
+	}
+
+	return record.Value, nil
+}
+
+// Peek returns metadata about a capsule from the index
+func (s *FileStorage) Peek(ctx context.Context, key string) (Metadata, error) {
+	if err := ctx.Err(); err != nil {
+		return Metadata{}, err
+	}
+
+	if key == "" {
+		return Metadata{}, ErrInvalidKey
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.closed {
+		return Metadata{}, ErrStorageClosed
+	}
+
+	entry, exists := s.index[key]
+	if !exists {
+		return Metadata{}, ErrCapsuleNotFound
+	}
+
+	return entry.metadata(s.clock.Now()), nil
+}
+
+// SetUnlockTime rewrites the capsule file with a new unlock time
+func (s *FileStorage) SetUnlockTime(ctx context.Context, key string, unlockTime time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if key == "" {
+		return ErrInvalidKey
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return ErrStorageClosed
+	}
+
+	entry, exists := s.index[key]
+	if !exists {
+		return ErrCapsuleNotFound
+	}
+
+	if !entry.ExpiresAt.IsZero() && !unlockTime.Before(entry.ExpiresAt) {
+		return ErrInvalidWindow
+	}
+
+	record, err := s.readRecord(entry.File)
+	if err != nil {
+		return err
+	}
+
+	record.UnlockTime = unlockTime
+	return s.writeRecord(record)
+}
+
+// Rewrite replaces the value in the capsule file under the write lock
+func (s *FileStorage) Rewrite(ctx context.Context, key string, rewrite func(value []byte) ([]byte, error)) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if key == "" {
+		return ErrInvalidKey
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return ErrStorageClosed
+	}
+
+	entry, exists := s.index[key]
+	if !exists {
+		return ErrCapsuleNotFound
+	}
+
+	record, err := s.readRecord(entry.File)
+	if err != nil {
+		return err
+	}
+
+	value, err := rewrite(record.Value)
+	if err != nil || value == nil {
+		return err
+	}
+
+	record.Value = value
+	return s.writeRecord(record)
+}
+
+// UpdateAttributes replaces the attributes in the capsule file under the
+// write lock
+func (s *FileStorage) UpdateAttributes(ctx context.Context, key string, update func(attributes map[string]string) (map[string]string, error)) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if key == "" {
+		return ErrInvalidKey
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return ErrStorageClosed
+	}
+
+	entry, exists := s.index[key]
+	if !exists {
+		return ErrCapsuleNotFound
+	}
+
+	record, err := s.readRecord(entry.File)
+	if err != nil {
+		return err
+	}
+
+	attributes, err := update(record.Attributes)
+	if err != nil || attributes == nil {
+		return err
+	}
+
+	record.Attributes = attributes
+	return s.writeRecord(record)
+}
+
+// Delete removes a capsule file and its index entry
+func (s *FileStorage) Delete(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if key == "" {
+		return ErrInvalidKey
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return ErrStorageClosed
+	}
+
+	entry, exists := s.index[key]
+	if !exists {
+		return ErrCapsuleNotFound
+	}
+
+	if err := os.Remove(s.capsulePath(entry.File)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("timecapsule: remove capsule file: %w", err)
+	}
+
+	if err := syncDir(filepath.Join(s.dir, fileCapsuleDir)); err != nil {
+		return err
+	}
+
+	delete(s.index, key)
+	return nil
+}
+
+// Exists checks if a capsule exists
+func (s *FileStorage) Exists(ctx context.Context, key string) bool {
+	if err := ctx.Err(); err != nil {
+		return false
+	}
+
+	if key == "" {
+		return false
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.closed {
+		return false
+	}
+
+	_, exists := s.index[key]
+	return exists
+}
+
+// List returns one page of capsules matching opts from the index
+func (s *FileStorage) List(ctx context.Context, opts ListOptions) (ListPage, error) {
+	if err := ctx.Err(); err != nil {
+		return ListPage{}, err
+	}
+
+	now := s.clock.Now()
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.closed {
+		return ListPage{}, ErrStorageClosed
+	}
+
+	var items []ListItem
+	for key, entry := range s.index {
+		metadata := entry.metadata(now)
+		if opts.matches(key, metadata) {
+			items = append(items, ListItem{Key: key, Metadata: metadata})
+		}
+	}
+
+	return paginate(items, opts)
+}
+
+// Purge removes every expired capsule file
+func (s *FileStorage) Purge(ctx context.Context) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	now := s.clock.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return 0, ErrStorageClosed
+	}
+
+	purged := 0
+	for key, entry := range s.index {
+		if !isExpired(entry.ExpiresAt, now) {
+			continue
+		}
+
+		if err := os.Remove(s.capsulePath(entry.File)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return purged, fmt.Errorf("timecapsule: remove capsule file: %w", err)
+		}
+
+		delete(s.index, key)
+		purged++
+	}
+
+	if purged == 0 {
+		return 0, nil
+	}
+
+	return purged, syncDir(filepath.Join(s.dir, fileCapsuleDir))
+}
+
+// Close saves the index and releases the storage
+func (s *FileStorage) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil
+	}
+
+	s.closed = true
+	return s.writeIndex()
+}
+
+// load reads the index saved by Close and reconciles it with the capsule
+// files on disk. The saved index is removed, so that it is never trusted
+// after writes it does not record.
+func (s *FileStorage) load() error {
+	// Leftovers from an interrupted write are never visible to readers
+	for _, dir := range []string{s.dir, filepath.Join(s.dir, fileCapsuleDir)} {
+		if err := removeTempFiles(dir); err != nil {
+			return err
+		}
+	}
+
+	var index fileIndex
+	indexPath := filepath.Join(s.dir, fileIndexName)
+	data, err := os.ReadFile(indexPath)
+	switch {
+	case err == nil:
+		// A corrupt index is not fatal; it is rebuilt from the capsule files
+		if jsonErr := json.Unmarshal(data, &index); jsonErr != nil || index.Version != fileIndexVersion {
+			index = fileIndex{}
+		}
+
+		if err := os.Remove(indexPath); err != nil {
+			return fmt.Errorf("timecapsule: remove index: %w", err)
+		}
+		if err := syncDir(s.dir); err != nil {
+			return err
+		}
+	case errors.Is(err, fs.ErrNotExist):
+	default:
+		return fmt.Errorf("timecapsule: read index: %w", err)
+	}
+
+	// Index entries are keyed by file name so they can be matched against the
+	// directory listing; entries whose key no longer maps to the file are dropped
+	type cachedEntry struct {
+		key   string
+		entry fileIndexEntry
+	}
+	cached := make(map[string]cachedEntry, len(index.Capsules))
+	for key, entry := range index.Capsules {
+		if entry.File == fileNameForKey(key) {
+			cached[entry.File] = cachedEntry{key: key, entry: entry}
+		}
+	}
+
+	entries, err := os.ReadDir(filepath.Join(s.dir, fileCapsuleDir))
+	if err != nil {
+		return fmt.Errorf("timecapsule: read capsule directory: %w", err)
+	}
+
+	for _, dirEntry := range entries {
+		name := dirEntry.Name()
+		if !strings.HasSuffix(name, fileCapsuleExt) {
+			continue
+		}
+
+		info, err := dirEntry.Info()
+		if err != nil {
+			return fmt.Errorf("timecapsule: stat capsule file: %w", err)
+		}
+
+		if c, ok := cached[name]; ok && c.entry.Size == info.Size() && c.entry.ModTime.Equal(info.ModTime()) {
+			s.index[c.key] = c.entry
+			continue
+		}
+
+		record, err := s.readRecord(name)
+		if err != nil {
+			return err
+		}
+
+		s.index[record.Key] = newFileIndexEntry(name, record, info)
+	}
+
+	return nil
+}
+
+// removeTempFiles removes the temporary files left in dir by interrupted
+// atomic writes
+func removeTempFiles(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("timecapsule: read storage directory: %w", err)
+	}
+
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), fileTempPrefix) {
+			_ = os.Remove(filepath.Join(dir, entry.Name()))
+		}
+	}
+
+	return nil
+}
+
+// writeRecord atomically replaces the capsule file for record.Key and updates
+// the in-memory index. The caller must hold the write lock.
+func (s *FileStorage) writeRecord(record fileRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("timecapsule: encode capsule: %w", err)
+	}
+
+	name := fileNameForKey(record.Key)
+	path := s.capsulePath(name)
+	if err := writeFileAtomic(path, data); err != nil {
+		return err
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("timecapsule: stat capsule file: %w", err)
+	}
+
+	s.index[record.Key] = newFileIndexEntry(name, record, info)
+	return nil
+}
+
+// readRecord reads and decodes a capsule file
+func (s *FileStorage) readRecord(name string) (fileRecord, error) {
+	data, err := os.ReadFile(s.capsulePath(name))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return fileRecord{}, ErrCapsuleNotFound
+		}
+		return fileRecord{}, fmt.Errorf("timecapsule: read capsule file: %w", err)
+	}
+
+	var record fileRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		return fileRecord{}, fmt.Errorf("timecapsule: decode capsule file %s: %w", name, err)
+	}
+
+	return record, nil
+}
+
+// writeIndex atomically persists the index. The caller must hold the write lock.
+func (s *FileStorage) writeIndex() error {
+	data, err := json.Marshal(fileIndex{
+		Version:  fileIndexVersion,
+		Capsules: s.index,
+	})
+	if err != nil {
+		return fmt.Errorf("timecapsule: encode index: %w", err)
+	}
+
+	return writeFileAtomic(filepath.Join(s.dir, fileIndexName), data)
+}
+
+// capsulePath returns the full path of a capsule file
+func (s *FileStorage) capsulePath(name string) string {
+	return filepath.Join(s.dir, fileCapsuleDir, name)
+}
+
+// fileNameForKey maps an arbitrary key to a safe, fixed-length file name
+func fileNameForKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:]) + fileCapsuleExt
+}
+
+// writeFileAtomic writes data to a temporary file in the same directory,
+// fsyncs it, renames it over path and fsyncs the directory
+func writeFileAtomic(path string, data []byte) error {
+	dir := filepath.Dir(path)
+
+	tmp, err := os.CreateTemp(dir, fileTempPrefix+"*")
+	if err != nil {
+		return fmt.Errorf("timecapsule: create temp file: %w", err)
+	}
+	tmpName := tmp.Name()
+
+	// Clean up the temp file on any failure before the rename
+	renamed := false
+	defer func() {
+		if !renamed {
+			_ = os.Remove(tmpName)
+		}
+	}()
+
+	if err := tmp.Chmod(fileRecordPerm); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("timecapsule: chmod temp file: %w", err)
+	}
+
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("timecapsule: write temp file: %w", err)
+	}
+
+	if err := tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("timecapsule: sync temp file: %w", err)
+	}
+
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("timecapsule: close temp file: %w", err)
+	}
+
+	if err := os.Rename(tmpName, path); err != nil {
+		return fmt.Errorf("timecapsule: rename temp file: %w", err)
+	}
+	renamed = true
+
+	return syncDir(dir)
+}
+
+// syncDir fsyncs a directory so that renames and removals within it are durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("timecapsule: open directory: %w", err)
+	}
+	defer d.Close()
+
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("timecapsule: sync directory: %w", err)
+	}
+
+	return nil
+}
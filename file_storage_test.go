@@ -0,0 +1,275 @@
+package timecapsule
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileStorageStoreAndOpen(t *testing.T) {
+	storage, err := NewFileStorage(t.TempDir())
+	require.NoError(t, err)
+	defer storage.Close()
+	ctx := context.Background()
+
+	// Locked capsule
+	err = storage.Store(ctx, "locked", []byte("later"), time.Now().Add(time.Hour))
+	require.NoError(t, err)
+
+	_, err = storage.Open(ctx, "locked")
+	assert.ErrorIs(t, err, ErrCapsuleLocked)
+
+	metadata, err := storage.Peek(ctx, "locked")
+	require.NoError(t, err)
+	assert.True(t, metadata.IsLocked)
+
+	// Unlocked capsule
+	err = storage.Store(ctx, "open", []byte("now"), time.Now().Add(-time.Second))
+	require.NoError(t, err)
+
+	value, err := storage.Open(ctx, "open")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("now"), value)
+
+	// Missing and invalid keys
+	_, err = storage.Open(ctx, "missing")
+	assert.ErrorIs(t, err, ErrCapsuleNotFound)
+
+	err = storage.Store(ctx, "", []byte("x"), time.Now())
+	assert.ErrorIs(t, err, ErrInvalidKey)
+}
+
+func TestFileStorageSetUnlockTime(t *testing.T) {
+	dir := t.TempDir()
+	storage, err := NewFileStorage(dir)
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	require.NoError(t, storage.Store(ctx, "test", []byte("hello"), time.Now().Add(time.Hour)))
+	require.NoError(t, storage.SetUnlockTime(ctx, "test", time.Now().Add(-time.Second)))
+
+	value, err := storage.Open(ctx, "test")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("hello"), value)
+
+	assert.ErrorIs(t, storage.SetUnlockTime(ctx, "missing", time.Now()), ErrCapsuleNotFound)
+	require.NoError(t, storage.Close())
+
+	// The new unlock time survives a reopen
+	reopened, err := NewFileStorage(dir)
+	require.NoError(t, err)
+	defer reopened.Close()
+
+	metadata, err := reopened.Peek(ctx, "test")
+	require.NoError(t, err)
+	assert.False(t, metadata.IsLocked)
+}
+
+func TestFileStorageList(t *testing.T) {
+	storage, err := NewFileStorage(t.TempDir())
+	require.NoError(t, err)
+	defer storage.Close()
+
+	testStorageList(t, storage)
+}
+
+func TestFileStorageExpiry(t *testing.T) {
+	dir := t.TempDir()
+	storage, err := NewFileStorage(dir)
+	require.NoError(t, err)
+
+	testStorageExpiry(t, storage)
+	require.NoError(t, storage.Close())
+
+	// The expiry survives a reopen
+	reopened, err := NewFileStorage(dir)
+	require.NoError(t, err)
+	defer reopened.Close()
+
+	metadata, err := reopened.Peek(context.Background(), "open")
+	require.NoError(t, err)
+	assert.False(t, metadata.ExpiresAt.IsZero())
+}
+
+func TestFileStorageEncryption(t *testing.T) {
+	storage, err := NewFileStorage(t.TempDir())
+	require.NoError(t, err)
+	defer storage.Close()
+
+	testStorageEncryption(t, storage)
+}
+
+func TestFileStorageAttributes(t *testing.T) {
+	dir := t.TempDir()
+	storage, err := NewFileStorage(dir)
+	require.NoError(t, err)
+
+	testStorageAttributes(t, storage)
+	require.NoError(t, storage.StoreWithOptions(context.Background(), "kept", []byte("v"), time.Now(), WithAttributes(map[string]string{"a": "b"})))
+	require.NoError(t, storage.Close())
+
+	// Attributes are rebuilt into the index from the capsule files
+	require.NoError(t, os.Remove(filepath.Join(dir, fileIndexName)))
+	reopened, err := NewFileStorage(dir)
+	require.NoError(t, err)
+	defer reopened.Close()
+
+	metadata, err := reopened.Peek(context.Background(), "kept")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"a": "b"}, metadata.Attributes)
+}
+
+func TestFileStorageApprovals(t *testing.T) {
+	storage, err := NewFileStorage(t.TempDir())
+	require.NoError(t, err)
+	defer storage.Close()
+
+	testStorageApprovals(t, storage)
+}
+
+func TestFileStorageIntegrity(t *testing.T) {
+	storage, err := NewFileStorage(t.TempDir())
+	require.NoError(t, err)
+	defer storage.Close()
+
+	testStorageIntegrity(t, storage)
+}
+
+func TestFileStorageDelete(t *testing.T) {
+	dir := t.TempDir()
+	storage, err := NewFileStorage(dir)
+	require.NoError(t, err)
+	defer storage.Close()
+	ctx := context.Background()
+
+	err = storage.Store(ctx, "test", []byte("hello"), time.Now())
+	require.NoError(t, err)
+	assert.True(t, storage.Exists(ctx, "test"))
+
+	err = storage.Delete(ctx, "test")
+	require.NoError(t, err)
+	assert.False(t, storage.Exists(ctx, "test"))
+
+	_, err = os.Stat(filepath.Join(dir, fileCapsuleDir, fileNameForKey("test")))
+	assert.True(t, os.IsNotExist(err))
+
+	err = storage.Delete(ctx, "test")
+	assert.ErrorIs(t, err, ErrCapsuleNotFound)
+}
+
+func TestFileStorageReopen(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+	unlockTime := time.Now().Add(time.Hour)
+
+	storage, err := NewFileStorage(dir)
+	require.NoError(t, err)
+	require.NoError(t, storage.Store(ctx, "a", []byte("1"), unlockTime))
+	require.NoError(t, storage.Store(ctx, "b", []byte("2"), time.Now().Add(-time.Hour)))
+	require.NoError(t, storage.Close())
+
+	// Operations on a closed storage fail
+	err = storage.Store(ctx, "c", []byte("3"), unlockTime)
+	assert.ErrorIs(t, err, ErrStorageClosed)
+
+	reopened, err := NewFileStorage(dir)
+	require.NoError(t, err)
+	defer reopened.Close()
+
+	metadata, err := reopened.Peek(ctx, "a")
+	require.NoError(t, err)
+	assert.True(t, metadata.UnlockTime.Equal(unlockTime))
+
+	value, err := reopened.Open(ctx, "b")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("2"), value)
+}
+
+func TestFileStorageRecoversIndex(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+
+	storage, err := NewFileStorage(dir)
+	require.NoError(t, err)
+	require.NoError(t, storage.Store(ctx, "a", []byte("1"), time.Now().Add(-time.Hour)))
+	require.NoError(t, storage.Close())
+
+	// Simulate a crash that left a corrupt index and half-written temp files
+	require.NoError(t, os.WriteFile(filepath.Join(dir, fileIndexName), []byte("{corrupt"), 0o600))
+	temps := []string{
+		filepath.Join(dir, fileCapsuleDir, fileTempPrefix+"123"),
+		filepath.Join(dir, fileTempPrefix+"456"),
+	}
+	for _, tmp := range temps {
+		require.NoError(t, os.WriteFile(tmp, []byte("partial"), 0o600))
+	}
+
+	reopened, err := NewFileStorage(dir)
+	require.NoError(t, err)
+
+	value, err := reopened.Open(ctx, "a")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("1"), value)
+
+	for _, tmp := range temps {
+		_, err = os.Stat(tmp)
+		assert.True(t, os.IsNotExist(err))
+	}
+
+	// The index is only saved on Close, so writes after a crash are not hidden
+	// behind a stale index
+	_, err = os.Stat(filepath.Join(dir, fileIndexName))
+	assert.True(t, os.IsNotExist(err))
+	unlockTime := time.Now().Add(time.Hour)
+	require.NoError(t, reopened.SetUnlockTime(ctx, "a", unlockTime))
+
+	recovered, err := NewFileStorage(dir)
+	require.NoError(t, err)
+	defer recovered.Close()
+
+	metadata, err := recovered.Peek(ctx, "a")
+	require.NoError(t, err)
+	assert.True(t, metadata.UnlockTime.Equal(unlockTime))
+}
+
+func TestFileStorageWithPersistentTimeCapsule(t *testing.T) {
+	storage, err := NewFileStorage(t.TempDir())
+	require.NoError(t, err)
+	defer storage.Close()
+
+	type Promo struct {
+		Code     string `json:"code"`
+		Discount int    `json:"discount"`
+	}
+
+	capsule := NewWithStorage(storage, NewJSONCodec[Promo]())
+	ctx := context.Background()
+
+	promo := Promo{Code: "HOLIDAY50", Discount: 50}
+	err = capsule.Store(ctx, "promo", promo, time.Now().Add(-time.Second))
+	require.NoError(t, err)
+
+	value, err := capsule.Open(ctx, "promo")
+	require.NoError(t, err)
+	assert.Equal(t, promo, value)
+
+	// Delaying a locked capsule must not require opening it
+	err = capsule.Store(ctx, "locked", promo, time.Now().Add(time.Hour))
+	require.NoError(t, err)
+
+	err = capsule.Delay(ctx, "locked", 2*time.Hour)
+	require.NoError(t, err)
+
+	metadata, err := capsule.Peek(ctx, "locked")
+	require.NoError(t, err)
+	assert.True(t, metadata.IsLocked)
+	assert.WithinDuration(t, time.Now().Add(2*time.Hour), metadata.UnlockTime, time.Minute)
+
+	err = capsule.Delay(ctx, "missing", time.Hour)
+	assert.ErrorIs(t, err, ErrCapsuleNotFound)
+}
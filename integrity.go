@@ -0,0 +1,468 @@
+package timecapsule
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+)
+
+// AttributeIntegrity holds the MAC an IntegrityStorage keeps over a
+// capsule's times and attributes. IntegrityStorage hides it from Metadata.
+const AttributeIntegrity = AttributePrefix + "integrity"
+
+// MinIntegrityKeySize is the minimum size of an IntegrityStorage key
+const MinIntegrityKeySize = 32
+
+// integrityValueVersion is the first byte of every authenticated value
+const integrityValueVersion = 1
+
+// Domain separators for the metadata and value MACs
+const (
+	integrityMetadataDomain = "timecapsule integrity metadata v1\x00"
+	integrityValueDomain    = "timecapsule integrity value v1\x00"
+)
+
+// Integrity errors
+var (
+	ErrIntegrityViolation  = errors.New("capsule record failed integrity check")
+	ErrInvalidIntegrityKey = errors.New("integrity key must be at least 32 bytes")
+)
+
+// integrityRecord is the authenticated copy of a capsule's times, stored in
+// AttributeIntegrity. Pending is the unlock time SetUnlockTime is moving to,
+// accepted alongside UnlockTime until the move completes or, if it was
+// interrupted, until the next Peek or SetUnlockTime settles it.
+type integrityRecord struct {
+	UnlockTime int64  `json:"unlock"`
+	Pending    int64  `json:"pending,omitempty"`
+	CreatedAt  int64  `json:"created"`
+	ExpiresAt  int64  `json:"expires,omitempty"`
+	MAC        string `json:"mac"`
+}
+
+// IntegrityStorage wraps a Storage, authenticating every record with
+// HMAC-SHA256 so edits made directly to the underlying storage are
+// detected. The MAC over a capsule's unlock time, creation time, expiry and
+// attributes is kept in its attributes; the value carries its own MAC, bound
+// to the capsule key. Open, Peek and List return ErrIntegrityViolation for
+// tampered records, including records written without the wrapper.
+type IntegrityStorage struct {
+	Storage
+	key   []byte
+	clock Clock
+	locks keyLocks
+}
+
+// NewIntegrityStorage wraps storage with integrity protection under key,
+// which must be at least MinIntegrityKeySize bytes and kept secret
+func NewIntegrityStorage(storage Storage, key []byte, opts ...Option) (*IntegrityStorage, error) {
+	if len(key) < MinIntegrityKeySize {
+		return nil, ErrInvalidIntegrityKey
+	}
+
+	o := newOptions(opts...)
+	return &IntegrityStorage{Storage: storage, key: bytes.Clone(key), clock: o.clock}, nil
+}
+
+// Store authenticates the capsule and stores it
+func (s *IntegrityStorage) Store(ctx context.Context, key string, value []byte, unlockTime time.Time) error {
+	return s.StoreWithOptions(ctx, key, value, unlockTime)
+}
+
+// StoreWithOptions authenticates the capsule and stores it with opts,
+// recording its creation time so the MAC matches what the underlying storage
+// keeps. The underlying storage must implement OptionStorage.
+func (s *IntegrityStorage) StoreWithOptions(ctx context.Context, key string, value []byte, unlockTime time.Time, opts ...StoreOption) error {
+	if key == "" {
+		return ErrInvalidKey
+	}
+
+	o, err := ApplyStoreOptions(unlockTime, opts...)
+	if err != nil {
+		return err
+	}
+
+	attributes := maps.Clone(o.Attributes)
+	delete(attributes, AttributeIntegrity)
+
+	record := integrityRecord{
+		UnlockTime: unlockTime.UnixNano(),
+		CreatedAt:  o.createdAt(s.clock.Now()).UnixNano(),
+		ExpiresAt:  sqlTime(o.ExpiresAt),
+	}
+	encoded, err := s.seal(key, record, attributes)
+	if err != nil {
+		return err
+	}
+
+	opts = append(opts, WithCreatedAt(time.Unix(0, record.CreatedAt)), WithAttributes(map[string]string{AttributeIntegrity: encoded}))
+	return storeWith(ctx, s.Storage, key, s.sealValue(key, value), unlockTime, opts...)
+}
+
+// Open verifies the capsule's metadata, checks the unlock window against it
+// and returns the verified value
+func (s *IntegrityStorage) Open(ctx context.Context, key string) ([]byte, error) {
+	metadata, err := s.Peek(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkWindow(metadata.UnlockTime, metadata.ExpiresAt, s.clock.Now(), metadata.Attributes); err != nil {
+		return nil, err
+	}
+
+	record, err := s.Storage.Open(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.openValue(key, record)
+}
+
+// Peek returns the capsule's metadata once it is verified, settling an
+// unlock time change left pending by an interrupted SetUnlockTime
+func (s *IntegrityStorage) Peek(ctx context.Context, key string) (Metadata, error) {
+	metadata, err := s.Storage.Peek(ctx, key)
+	if err != nil {
+		return Metadata{}, err
+	}
+
+	metadata, pending, err := s.verify(key, metadata)
+	if err != nil {
+		return Metadata{}, err
+	}
+
+	if pending {
+		// The metadata is already verified, so a failure to settle is left
+		// for a later call
+		unlock := s.locks.lock(key)
+		_ = s.settle(ctx, key)
+		unlock()
+	}
+	return metadata, nil
+}
+
+// SetUnlockTime changes the unlock time and its MAC. The new time is first
+// authenticated as pending, so the record verifies throughout the change.
+// Changes to the same capsule are serialized, since the record has a single
+// pending slot; processes sharing the underlying storage must not change the
+// unlock time of one capsule concurrently.
+func (s *IntegrityStorage) SetUnlockTime(ctx context.Context, key string, unlockTime time.Time) error {
+	unlock := s.locks.lock(key)
+	defer unlock()
+
+	if err := s.settle(ctx, key); err != nil {
+		return err
+	}
+
+	pending := unlockTime.UnixNano()
+	err := s.updateRecord(ctx, key, func(record *integrityRecord) error {
+		if record.ExpiresAt != 0 && pending >= record.ExpiresAt {
+			return ErrInvalidWindow
+		}
+		record.Pending = pending
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	setErr := setUnlockTime(ctx, s.Storage, key, unlockTime)
+	err = s.updateRecord(ctx, key, func(record *integrityRecord) error {
+		if setErr == nil {
+			record.UnlockTime = pending
+		}
+		if record.Pending == pending {
+			record.Pending = 0
+		}
+		return nil
+	})
+	return errors.Join(setErr, err)
+}
+
+// Rewrite verifies the value before rewrite sees it and authenticates its
+// result
+func (s *IntegrityStorage) Rewrite(ctx context.Context, key string, rewrite func(value []byte) ([]byte, error)) error {
+	return rewriteValue(ctx, s.Storage, key, func(record []byte) ([]byte, error) {
+		value, err := s.openValue(key, record)
+		if err != nil {
+			return nil, err
+		}
+
+		value, err = rewrite(value)
+		if err != nil || value == nil {
+			return nil, err
+		}
+
+		return s.sealValue(key, value), nil
+	})
+}
+
+// UpdateAttributes verifies the attributes before update sees them and
+// authenticates its result
+func (s *IntegrityStorage) UpdateAttributes(ctx context.Context, key string, update func(attributes map[string]string) (map[string]string, error)) error {
+	return updateAttributes(ctx, s.Storage, key, func(attributes map[string]string) (map[string]string, error) {
+		record, stripped, err := s.open(key, attributes)
+		if err != nil {
+			return nil, err
+		}
+
+		updated, err := update(stripped)
+		if err != nil || updated == nil {
+			return nil, err
+		}
+
+		updated = maps.Clone(updated)
+		delete(updated, AttributeIntegrity)
+		encoded, err := s.seal(key, record, updated)
+		if err != nil {
+			return nil, err
+		}
+
+		updated[AttributeIntegrity] = encoded
+		return updated, nil
+	})
+}
+
+// List returns one page of capsules, verifying each of them
+func (s *IntegrityStorage) List(ctx context.Context, opts ListOptions) (ListPage, error) {
+	page, err := listStorage(ctx, s.Storage, opts)
+	if err != nil {
+		return ListPage{}, err
+	}
+
+	for i, item := range page.Items {
+		if page.Items[i].Metadata, _, err = s.verify(item.Key, item.Metadata); err != nil {
+			return ListPage{}, err
+		}
+	}
+
+	return page, nil
+}
+
+// Purge removes expired capsules from the underlying storage
+func (s *IntegrityStorage) Purge(ctx context.Context) (int, error) {
+	return purgeStorage(ctx, s.Storage)
+}
+
+// updateRecord changes the authenticated times of a capsule, keeping its
+// attributes
+func (s *IntegrityStorage) updateRecord(ctx context.Context, key string, change func(record *integrityRecord) error) error {
+	return updateAttributes(ctx, s.Storage, key, func(attributes map[string]string) (map[string]string, error) {
+		record, stripped, err := s.open(key, attributes)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := change(&record); err != nil {
+			return nil, err
+		}
+
+		encoded, err := s.seal(key, record, stripped)
+		if err != nil {
+			return nil, err
+		}
+
+		updated := maps.Clone(attributes)
+		updated[AttributeIntegrity] = encoded
+		return updated, nil
+	})
+}
+
+// settle resolves a pending unlock time by re-signing the record with the
+// unlock time the underlying storage reports. The caller holds the key's
+// lock.
+func (s *IntegrityStorage) settle(ctx context.Context, key string) error {
+	metadata, err := s.Storage.Peek(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	record, _, err := s.open(key, metadata.Attributes)
+	if err != nil || record.Pending == 0 {
+		return err
+	}
+
+	reported := metadata.UnlockTime.UnixNano()
+	return s.updateRecord(ctx, key, func(record *integrityRecord) error {
+		switch reported {
+		case record.UnlockTime:
+		case record.Pending:
+			record.UnlockTime = reported
+		default:
+			return fmt.Errorf("timecapsule: times of %q do not match their MAC: %w", key, ErrIntegrityViolation)
+		}
+		record.Pending = 0
+		return nil
+	})
+}
+
+// verify checks the metadata of the capsule stored under key against its
+// MAC and returns it without the MAC attribute, reporting whether the record
+// has a pending unlock time
+func (s *IntegrityStorage) verify(key string, metadata Metadata) (Metadata, bool, error) {
+	record, stripped, err := s.open(key, metadata.Attributes)
+	if err != nil {
+		return Metadata{}, false, err
+	}
+
+	unlockTime := metadata.UnlockTime.UnixNano()
+	if unlockTime != record.UnlockTime && (record.Pending == 0 || unlockTime != record.Pending) ||
+		metadata.CreatedAt.UnixNano() != record.CreatedAt ||
+		sqlTime(metadata.ExpiresAt) != record.ExpiresAt {
+		return Metadata{}, false, fmt.Errorf("timecapsule: times of %q do not match their MAC: %w", key, ErrIntegrityViolation)
+	}
+
+	metadata.Attributes = stripped
+	return metadata, record.Pending != 0, nil
+}
+
+// open verifies the MAC in attributes and returns the authenticated times
+// and the remaining attributes
+func (s *IntegrityStorage) open(key string, attributes map[string]string) (integrityRecord, map[string]string, error) {
+	data, ok := attributes[AttributeIntegrity]
+	if !ok {
+		return integrityRecord{}, nil, fmt.Errorf("timecapsule: %q has no MAC: %w", key, ErrIntegrityViolation)
+	}
+
+	var record integrityRecord
+	if err := json.Unmarshal([]byte(data), &record); err != nil {
+		return integrityRecord{}, nil, fmt.Errorf("timecapsule: MAC of %q: %w", key, ErrIntegrityViolation)
+	}
+
+	stripped := maps.Clone(attributes)
+	delete(stripped, AttributeIntegrity)
+	if len(stripped) == 0 {
+		stripped = nil
+	}
+
+	mac, err := hex.DecodeString(record.MAC)
+	if err != nil || !hmac.Equal(mac, s.metadataMAC(key, record, stripped)) {
+		return integrityRecord{}, nil, fmt.Errorf("timecapsule: metadata of %q: %w", key, ErrIntegrityViolation)
+	}
+
+	return record, stripped, nil
+}
+
+// seal computes the MAC of record over attributes and encodes it for
+// AttributeIntegrity
+func (s *IntegrityStorage) seal(key string, record integrityRecord, attributes map[string]string) (string, error) {
+	record.MAC = hex.EncodeToString(s.metadataMAC(key, record, attributes))
+	data, err := json.Marshal(record)
+	if err != nil {
+		return "", fmt.Errorf("timecapsule: encode MAC: %w", err)
+	}
+	return string(data), nil
+}
+
+// metadataMAC authenticates the capsule key, the times in record and every
+// attribute, in sorted order
+func (s *IntegrityStorage) metadataMAC(key string, record integrityRecord, attributes map[string]string) []byte {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(integrityMetadataDomain))
+	writeField(mac, []byte(key))
+
+	var times [32]byte
+	binary.BigEndian.PutUint64(times[0:], uint64(record.UnlockTime))
+	binary.BigEndian.PutUint64(times[8:], uint64(record.Pending))
+	binary.BigEndian.PutUint64(times[16:], uint64(record.CreatedAt))
+	binary.BigEndian.PutUint64(times[24:], uint64(record.ExpiresAt))
+	mac.Write(times[:])
+
+	for _, name := range slices.Sorted(maps.Keys(attributes)) {
+		writeField(mac, []byte(name))
+		writeField(mac, []byte(attributes[name]))
+	}
+	return mac.Sum(nil)
+}
+
+// sealValue prefixes value with its version and MAC
+func (s *IntegrityStorage) sealValue(key string, value []byte) []byte {
+	record := make([]byte, 0, 1+sha256.Size+len(value))
+	record = append(record, integrityValueVersion)
+	record = append(record, s.valueMAC(key, value)...)
+	return append(record, value...)
+}
+
+// openValue verifies a value sealed by sealValue and returns it
+func (s *IntegrityStorage) openValue(key string, record []byte) ([]byte, error) {
+	if len(record) < 1+sha256.Size || record[0] != integrityValueVersion {
+		return nil, fmt.Errorf("timecapsule: value of %q: %w", key, ErrIntegrityViolation)
+	}
+
+	value := record[1+sha256.Size:]
+	if !hmac.Equal(record[1:1+sha256.Size], s.valueMAC(key, value)) {
+		return nil, fmt.Errorf("timecapsule: value of %q: %w", key, ErrIntegrityViolation)
+	}
+
+	return value, nil
+}
+
+// valueMAC authenticates a value bound to its capsule key
+func (s *IntegrityStorage) valueMAC(key string, value []byte) []byte {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(integrityValueDomain))
+	writeField(mac, []byte(key))
+	mac.Write(value)
+	return mac.Sum(nil)
+}
+
+// keyLocks serializes operations on the same key. The zero value is ready
+// to use.
+type keyLocks struct {
+	mu    sync.Mutex
+	locks map[string]*keyLock
+}
+
+// keyLock is the lock of one key and the number of callers holding or
+// waiting for it
+type keyLock struct {
+	mu   sync.Mutex
+	refs int
+}
+
+// lock locks key and returns the function that unlocks it
+func (l *keyLocks) lock(key string) func() {
+	l.mu.Lock()
+	if l.locks == nil {
+		l.locks = make(map[string]*keyLock)
+	}
+	lock, ok := l.locks[key]
+	if !ok {
+		lock = &keyLock{}
+		l.locks[key] = lock
+	}
+	lock.refs++
+	l.mu.Unlock()
+
+	lock.mu.Lock()
+	return func() {
+		lock.mu.Unlock()
+
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if lock.refs--; lock.refs == 0 {
+			delete(l.locks, key)
+		}
+	}
+}
+
+// writeField writes a length-prefixed field so adjacent fields cannot be
+// shifted into each other
+func writeField(w io.Writer, field []byte) {
+	var size [4]byte
+	binary.BigEndian.PutUint32(size[:], uint32(len(field)))
+	w.Write(size[:])
+	w.Write(field)
+}
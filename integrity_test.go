@@ -0,0 +1,264 @@
+package timecapsule
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testIntegrityKey is a fixed key for integrity tests
+var testIntegrityKey = bytes.Repeat([]byte{7}, MinIntegrityKeySize)
+
+// testStorageIntegrity checks that an IntegrityStorage over inner detects
+// records edited directly in inner
+func testStorageIntegrity(t *testing.T, inner fullStorage) {
+	t.Helper()
+	ctx := context.Background()
+
+	storage, err := NewIntegrityStorage(inner, testIntegrityKey)
+	require.NoError(t, err)
+
+	capsule := NewWithStorage(storage, NewJSONCodec[string]())
+	defer capsule.Close()
+
+	unlockTime := time.Now().Add(time.Hour)
+	store := func(key string) {
+		t.Helper()
+		require.NoError(t, capsule.StoreWithOptions(ctx, key, "secret", unlockTime,
+			WithValidFor(time.Hour), WithApprovals(1, "alice"), WithAttributes(map[string]string{"owner": "ops"})))
+	}
+	rejected := func(key string) {
+		t.Helper()
+		_, err := storage.Peek(ctx, key)
+		assert.ErrorIs(t, err, ErrIntegrityViolation, "peek %s", key)
+		_, err = storage.Open(ctx, key)
+		assert.ErrorIs(t, err, ErrIntegrityViolation, "open %s", key)
+	}
+
+	// Legitimate changes through the wrapper keep verifying
+	store("capsule")
+	require.NoError(t, capsule.Delay(ctx, "capsule", -time.Second))
+	require.NoError(t, capsule.Approve(ctx, "capsule", "alice"))
+	value, err := capsule.Open(ctx, "capsule")
+	require.NoError(t, err)
+	assert.Equal(t, "secret", value)
+
+	metadata, err := capsule.Peek(ctx, "capsule")
+	require.NoError(t, err)
+	assert.Equal(t, "ops", metadata.Attributes["owner"])
+	assert.NotContains(t, metadata.Attributes, AttributeIntegrity)
+
+	page, err := storage.List(ctx, ListOptions{})
+	require.NoError(t, err)
+	assert.Len(t, page.Items, 1)
+
+	assert.ErrorIs(t, capsule.Delay(ctx, "capsule", 3*time.Hour), ErrInvalidWindow)
+	_, err = capsule.Open(ctx, "capsule")
+	require.NoError(t, err)
+
+	// Moving the unlock time into the past
+	store("unlock")
+	require.NoError(t, inner.SetUnlockTime(ctx, "unlock", time.Now().Add(-time.Minute)))
+	rejected("unlock")
+
+	// Editing the value
+	store("value")
+	require.NoError(t, inner.Rewrite(ctx, "value", func(record []byte) ([]byte, error) {
+		record = bytes.Clone(record)
+		record[len(record)-2] ^= 1
+		return record, nil
+	}))
+	require.NoError(t, capsule.Delay(ctx, "value", -2*time.Hour))
+	require.NoError(t, capsule.Approve(ctx, "value", "alice"))
+	_, err = storage.Open(ctx, "value")
+	assert.ErrorIs(t, err, ErrIntegrityViolation)
+
+	// Forging an approval
+	store("approval")
+	require.NoError(t, inner.UpdateAttributes(ctx, "approval", func(attributes map[string]string) (map[string]string, error) {
+		return approve(attributes, "alice", time.Now())
+	}))
+	rejected("approval")
+
+	// Rewriting the creation time or moving the record to another key
+	store("created")
+	original, err := inner.Peek(ctx, "created")
+	require.NoError(t, err)
+	var record []byte
+	require.NoError(t, inner.Rewrite(ctx, "created", func(value []byte) ([]byte, error) {
+		record = bytes.Clone(value)
+		return nil, nil
+	}))
+	require.NoError(t, inner.StoreWithOptions(ctx, "created", record, original.UnlockTime, WithExpiry(original.ExpiresAt),
+		WithCreatedAt(original.CreatedAt.Add(-24*time.Hour)), WithAttributes(original.Attributes)))
+	rejected("created")
+
+	require.NoError(t, inner.StoreWithOptions(ctx, "moved", record, original.UnlockTime, WithExpiry(original.ExpiresAt),
+		WithCreatedAt(original.CreatedAt), WithAttributes(original.Attributes)))
+	rejected("moved")
+
+	// Records written without the wrapper have no MAC
+	require.NoError(t, inner.Store(ctx, "unprotected", []byte(`"x"`), time.Now()))
+	rejected("unprotected")
+
+	_, err = storage.List(ctx, ListOptions{})
+	assert.ErrorIs(t, err, ErrIntegrityViolation)
+}
+
+func TestIntegrityStorageKeys(t *testing.T) {
+	inner, err := NewFileStorage(t.TempDir())
+	require.NoError(t, err)
+	defer inner.Close()
+	ctx := context.Background()
+
+	_, err = NewIntegrityStorage(inner, make([]byte, MinIntegrityKeySize-1))
+	assert.ErrorIs(t, err, ErrInvalidIntegrityKey)
+
+	storage, err := NewIntegrityStorage(inner, testIntegrityKey)
+	require.NoError(t, err)
+	require.NoError(t, storage.Store(ctx, "key", []byte("v"), time.Now()))
+
+	// Records only verify under the key that wrote them
+	other, err := NewIntegrityStorage(inner, bytes.Repeat([]byte{8}, MinIntegrityKeySize))
+	require.NoError(t, err)
+	_, err = other.Peek(ctx, "key")
+	assert.ErrorIs(t, err, ErrIntegrityViolation)
+
+	// Encryption and re-encryption compose with integrity protection
+	require.NoError(t, storage.Delete(ctx, "key"))
+	keyring, err := NewKeyring("old", bytes.Repeat([]byte{1}, 32))
+	require.NoError(t, err)
+	encrypted := NewEncryptedStorage(storage, keyring)
+	require.NoError(t, encrypted.Store(ctx, "sealed", []byte("v"), time.Now()))
+	require.NoError(t, keyring.Rotate("new", bytes.Repeat([]byte{2}, 32)))
+	rewritten, err := encrypted.Reencrypt(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, rewritten)
+
+	value, err := encrypted.Open(ctx, "sealed")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("v"), value)
+}
+
+// stallingStorage pauses after the first SetUnlockTime so a concurrent one
+// can run in between
+type stallingStorage struct {
+	fullStorage
+	stalled atomic.Bool
+}
+
+func (s *stallingStorage) SetUnlockTime(ctx context.Context, key string, unlockTime time.Time) error {
+	err := s.fullStorage.SetUnlockTime(ctx, key, unlockTime)
+	if s.stalled.CompareAndSwap(false, true) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	return err
+}
+
+func TestIntegrityStorageConcurrentDelay(t *testing.T) {
+	ctx := context.Background()
+	inner, err := NewFileStorage(t.TempDir())
+	require.NoError(t, err)
+	defer inner.Close()
+
+	storage, err := NewIntegrityStorage(&stallingStorage{fullStorage: inner}, testIntegrityKey)
+	require.NoError(t, err)
+	capsule := NewWithStorage(storage, NewJSONCodec[string]())
+	defer capsule.Close()
+
+	require.NoError(t, capsule.Store(ctx, "capsule", "secret", time.Now().Add(time.Hour)))
+
+	var wg sync.WaitGroup
+	for i := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, capsule.Delay(ctx, "capsule", time.Duration(i+1)*time.Minute))
+		}()
+	}
+	wg.Wait()
+
+	// The record still verifies and authenticates the time that was stored
+	_, err = capsule.Peek(ctx, "capsule")
+	require.NoError(t, err)
+	require.NoError(t, capsule.Delay(ctx, "capsule", -time.Second))
+	value, err := capsule.Open(ctx, "capsule")
+	require.NoError(t, err)
+	assert.Equal(t, "secret", value)
+}
+
+// interruptedStorage fails every attribute update once SetUnlockTime has
+// run, standing in for a crash in the middle of IntegrityStorage.SetUnlockTime
+type interruptedStorage struct {
+	fullStorage
+	apply       bool
+	interrupted bool
+}
+
+func (s *interruptedStorage) SetUnlockTime(ctx context.Context, key string, unlockTime time.Time) error {
+	s.interrupted = true
+	if !s.apply {
+		return errors.New("interrupted")
+	}
+	return s.fullStorage.SetUnlockTime(ctx, key, unlockTime)
+}
+
+func (s *interruptedStorage) UpdateAttributes(ctx context.Context, key string, update func(attributes map[string]string) (map[string]string, error)) error {
+	if s.interrupted {
+		return errors.New("interrupted")
+	}
+	return s.fullStorage.UpdateAttributes(ctx, key, update)
+}
+
+func TestIntegrityStoragePendingUnlockTime(t *testing.T) {
+	ctx := context.Background()
+
+	for _, apply := range []bool{true, false} {
+		inner, err := NewFileStorage(t.TempDir())
+		require.NoError(t, err)
+		defer inner.Close()
+
+		interrupted := &interruptedStorage{fullStorage: inner, apply: apply}
+		storage, err := NewIntegrityStorage(interrupted, testIntegrityKey)
+		require.NoError(t, err)
+
+		original := time.Now().Add(time.Hour)
+		moved := original.Add(time.Hour)
+		require.NoError(t, storage.Store(ctx, "capsule", []byte("v"), original))
+		assert.Error(t, storage.SetUnlockTime(ctx, "capsule", moved))
+
+		record := func() integrityRecord {
+			t.Helper()
+			metadata, err := inner.Peek(ctx, "capsule")
+			require.NoError(t, err)
+			record, _, err := storage.open("capsule", metadata.Attributes)
+			require.NoError(t, err)
+			return record
+		}
+		require.Equal(t, moved.UnixNano(), record().Pending)
+
+		// The next read settles the record on the time the storage reports
+		interrupted.interrupted = false
+		metadata, err := storage.Peek(ctx, "capsule")
+		require.NoError(t, err)
+
+		settled, other := original, moved
+		if apply {
+			settled, other = moved, original
+		}
+		assert.True(t, metadata.UnlockTime.Equal(settled))
+		assert.Equal(t, integrityRecord{UnlockTime: settled.UnixNano(), CreatedAt: record().CreatedAt, MAC: record().MAC}, record())
+
+		// The other time is no longer accepted
+		require.NoError(t, inner.SetUnlockTime(ctx, "capsule", other))
+		_, err = storage.Peek(ctx, "capsule")
+		assert.ErrorIs(t, err, ErrIntegrityViolation, "apply %v", apply)
+	}
+}
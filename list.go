@@ -0,0 +1,218 @@
+package timecapsule
+
+import (
+	"cmp"
+	"context"
+	"encoding/base64"
+	"errors"
+	"iter"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultListLimit is the page size used when ListOptions.Limit is zero
+const DefaultListLimit = 100
+
+// ErrInvalidCursor is returned when a List cursor cannot be decoded
+var ErrInvalidCursor = errors.New("invalid list cursor")
+
+// State selects capsules by whether they are locked, unlocked or expired
+type State int
+
+const (
+	// StateAny matches every capsule
+	StateAny State = iota
+	// StateLocked matches capsules whose unlock time has not passed
+	StateLocked
+	// StateUnlocked matches capsules that can currently be opened
+	StateUnlocked
+	// StateExpired matches capsules whose expiry has passed
+	StateExpired
+)
+
+// ListOptions filters and paginates List results. Capsules are returned in
+// ascending unlock-time order, ties broken by key. Unlock times outside the
+// range of Unix nanoseconds, roughly the years 1678 to 2262, are ordered as if
+// at the nearest end of it.
+type ListOptions struct {
+	// Prefix restricts results to keys starting with it
+	Prefix string
+
+	// State restricts results to locked, unlocked or expired capsules
+	State State
+
+	// UnlockAfter, when set, excludes capsules unlocking before it (inclusive bound)
+	UnlockAfter time.Time
+
+	// UnlockBefore, when set, excludes capsules unlocking at or after it (exclusive bound)
+	UnlockBefore time.Time
+
+	// Cursor resumes listing after the last item of a previous page
+	Cursor string
+
+	// Limit is the maximum number of items per page; defaults to DefaultListLimit
+	Limit int
+}
+
+// ListItem is a single capsule returned by List
+type ListItem struct {
+	Key      string   `json:"key"`
+	Metadata Metadata `json:"metadata"`
+}
+
+// ListPage is one page of List results
+type ListPage struct {
+	Items []ListItem `json:"items"`
+
+	// NextCursor is passed as ListOptions.Cursor to fetch the next page; it is
+	// empty on the last page
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// limit returns the effective page size
+func (o ListOptions) limit() int {
+	if o.Limit <= 0 {
+		return DefaultListLimit
+	}
+	return o.Limit
+}
+
+// matches reports whether a capsule passes the key, time and state filters
+func (o ListOptions) matches(key string, metadata Metadata) bool {
+	if !strings.HasPrefix(key, o.Prefix) {
+		return false
+	}
+
+	if !o.UnlockAfter.IsZero() && metadata.UnlockTime.Before(o.UnlockAfter) {
+		return false
+	}
+
+	if !o.UnlockBefore.IsZero() && !metadata.UnlockTime.Before(o.UnlockBefore) {
+		return false
+	}
+
+	switch o.State {
+	case StateLocked:
+		return metadata.IsLocked
+	case StateUnlocked:
+		return !metadata.IsLocked && !metadata.IsExpired
+	case StateExpired:
+		return metadata.IsExpired
+	}
+
+	return true
+}
+
+// listCursor is the decoded position of the last item of a page. The unlock
+// position is in the unit the storage orders unlock times by: nanoseconds,
+// or the millisecond score for RedisStorage.
+type listCursor struct {
+	unlock int64
+	key    string
+}
+
+// after reports whether the (unlock, key) position sorts after the cursor
+func (c listCursor) after(unlock int64, key string) bool {
+	if unlock != c.unlock {
+		return unlock > c.unlock
+	}
+	return key > c.key
+}
+
+// encodeCursor returns the opaque cursor for an item position
+func encodeCursor(unlock int64, key string) string {
+	raw := strconv.FormatInt(unlock, 10) + ":" + key
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+// decodeCursor parses an opaque cursor; an empty cursor decodes to nil
+func decodeCursor(cursor string) (*listCursor, error) {
+	if cursor == "" {
+		return nil, nil
+	}
+
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	position, key, ok := strings.Cut(string(raw), ":")
+	if !ok {
+		return nil, ErrInvalidCursor
+	}
+
+	unlock, err := strconv.ParseInt(position, 10, 64)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	return &listCursor{unlock: unlock, key: key}, nil
+}
+
+// paginate sorts candidate items, applies the cursor and cuts one page
+func paginate(items []ListItem, opts ListOptions) (ListPage, error) {
+	cursor, err := decodeCursor(opts.Cursor)
+	if err != nil {
+		return ListPage{}, err
+	}
+
+	// Items are ordered by their cursor position so that out-of-range times,
+	// which share a clamped position, are resumed consistently
+	slices.SortFunc(items, func(a, b ListItem) int {
+		if c := cmp.Compare(clampNano(a.Metadata.UnlockTime), clampNano(b.Metadata.UnlockTime)); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.Key, b.Key)
+	})
+
+	if cursor != nil {
+		start := sort.Search(len(items), func(i int) bool {
+			return cursor.after(clampNano(items[i].Metadata.UnlockTime), items[i].Key)
+		})
+		items = items[start:]
+	}
+
+	return cutPage(items, opts.limit(), func(item ListItem) string {
+		return encodeCursor(clampNano(item.Metadata.UnlockTime), item.Key)
+	}), nil
+}
+
+// cutPage trims items to limit, setting NextCursor when more items remain
+func cutPage(items []ListItem, limit int, cursorFor func(ListItem) string) ListPage {
+	if len(items) <= limit {
+		return ListPage{Items: items}
+	}
+
+	items = items[:limit]
+	return ListPage{
+		Items:      items,
+		NextCursor: cursorFor(items[len(items)-1]),
+	}
+}
+
+// listAll walks every page of list, yielding each capsule. Iteration stops
+// early on the first error; use List directly to observe it.
+func listAll(ctx context.Context, opts ListOptions, list func(context.Context, ListOptions) (ListPage, error)) iter.Seq2[string, Metadata] {
+	return func(yield func(string, Metadata) bool) {
+		for {
+			page, err := list(ctx, opts)
+			if err != nil {
+				return
+			}
+
+			for _, item := range page.Items {
+				if !yield(item.Key, item.Metadata) {
+					return
+				}
+			}
+
+			if page.NextCursor == "" {
+				return
+			}
+			opts.Cursor = page.NextCursor
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package timecapsule
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// listFixture stores capsules unlocking one minute apart around now: keys
+// job-0..job-4 unlocked in the past and job-5..job-9 unlock in the future,
+// plus a single capsule under a different prefix
+func listFixture(t *testing.T, store func(key string, unlockTime time.Time) error) time.Time {
+	t.Helper()
+
+	base := time.Now().Add(-5*time.Minute + 30*time.Second)
+	for i := 0; i < 10; i++ {
+		require.NoError(t, store(fmt.Sprintf("job-%d", i), base.Add(time.Duration(i)*time.Minute)))
+	}
+	require.NoError(t, store("other", base))
+
+	return base
+}
+
+// collectKeys returns the keys of a page
+func collectKeys(page ListPage) []string {
+	keys := make([]string, len(page.Items))
+	for i, item := range page.Items {
+		keys[i] = item.Key
+	}
+	return keys
+}
+
+// testStorageList exercises List filters and pagination against a backend
+func testStorageList(t *testing.T, storage fullStorage) {
+	t.Helper()
+	ctx := context.Background()
+
+	base := listFixture(t, func(key string, unlockTime time.Time) error {
+		return storage.Store(ctx, key, []byte(key), unlockTime)
+	})
+
+	// Everything, ordered by unlock time then key
+	page, err := storage.List(ctx, ListOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"job-0", "other", "job-1", "job-2", "job-3", "job-4",
+		"job-5", "job-6", "job-7", "job-8", "job-9"}, collectKeys(page))
+	assert.Empty(t, page.NextCursor)
+
+	// Prefix and state filters
+	page, err = storage.List(ctx, ListOptions{Prefix: "job-", State: StateUnlocked})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"job-0", "job-1", "job-2", "job-3", "job-4"}, collectKeys(page))
+	for _, item := range page.Items {
+		assert.False(t, item.Metadata.IsLocked)
+	}
+
+	page, err = storage.List(ctx, ListOptions{State: StateLocked})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"job-5", "job-6", "job-7", "job-8", "job-9"}, collectKeys(page))
+
+	// Unlock-time range is inclusive at the start and exclusive at the end
+	page, err = storage.List(ctx, ListOptions{
+		Prefix:       "job-",
+		UnlockAfter:  base.Add(2 * time.Minute),
+		UnlockBefore: base.Add(4 * time.Minute),
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"job-2", "job-3"}, collectKeys(page))
+
+	// Cursor pagination visits every capsule exactly once
+	var keys []string
+	opts := ListOptions{Prefix: "job-", Limit: 3}
+	for {
+		page, err := storage.List(ctx, opts)
+		require.NoError(t, err)
+		assert.LessOrEqual(t, len(page.Items), 3)
+		keys = append(keys, collectKeys(page)...)
+		if page.NextCursor == "" {
+			break
+		}
+		opts.Cursor = page.NextCursor
+	}
+	assert.Equal(t, []string{"job-0", "job-1", "job-2", "job-3", "job-4",
+		"job-5", "job-6", "job-7", "job-8", "job-9"}, keys)
+
+	_, err = storage.List(ctx, ListOptions{Cursor: "!!"})
+	assert.ErrorIs(t, err, ErrInvalidCursor)
+}
+
+func TestList(t *testing.T) {
+	capsule := New[string]()
+	ctx := context.Background()
+
+	listFixture(t, func(key string, unlockTime time.Time) error {
+		return capsule.Store(ctx, key, key, unlockTime)
+	})
+
+	page, err := capsule.List(ctx, ListOptions{Prefix: "job-", State: StateLocked, Limit: 2})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"job-5", "job-6"}, collectKeys(page))
+	assert.NotEmpty(t, page.NextCursor)
+
+	page, err = capsule.List(ctx, ListOptions{Prefix: "job-", State: StateLocked, Limit: 2, Cursor: page.NextCursor})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"job-7", "job-8"}, collectKeys(page))
+}
+
+func TestAll(t *testing.T) {
+	capsule := New[string]()
+	ctx := context.Background()
+
+	listFixture(t, func(key string, unlockTime time.Time) error {
+		return capsule.Store(ctx, key, key, unlockTime)
+	})
+
+	var keys []string
+	for key, metadata := range capsule.All(ctx, ListOptions{Prefix: "job-", State: StateUnlocked, Limit: 2}) {
+		assert.False(t, metadata.IsLocked)
+		keys = append(keys, key)
+	}
+	assert.Equal(t, []string{"job-0", "job-1", "job-2", "job-3", "job-4"}, keys)
+
+	// Breaking out of the loop stops iteration
+	count := 0
+	for range capsule.All(ctx, ListOptions{}) {
+		count++
+		break
+	}
+	assert.Equal(t, 1, count)
+}
+
+func TestListTimeRange(t *testing.T) {
+	capsule := New[string]()
+	ctx := context.Background()
+
+	// Times beyond UnixNano's range share a clamped position, ordered by key
+	require.NoError(t, capsule.Store(ctx, "ancient-b", "v", time.Date(1000, 1, 1, 0, 0, 0, 0, time.UTC)))
+	require.NoError(t, capsule.Store(ctx, "ancient-a", "v", time.Date(1600, 1, 1, 0, 0, 0, 0, time.UTC)))
+	require.NoError(t, capsule.Store(ctx, "zero", "v", time.Time{}))
+	require.NoError(t, capsule.Store(ctx, "now", "v", time.Now()))
+	require.NoError(t, capsule.Store(ctx, "future-b", "v", time.Date(2300, 1, 1, 0, 0, 0, 0, time.UTC)))
+	require.NoError(t, capsule.Store(ctx, "future-a", "v", time.Date(3000, 1, 1, 0, 0, 0, 0, time.UTC)))
+
+	var keys []string
+	for key := range capsule.All(ctx, ListOptions{Limit: 1}) {
+		keys = append(keys, key)
+	}
+	assert.Equal(t, []string{"ancient-a", "ancient-b", "zero", "now", "future-a", "future-b"}, keys)
+}
+
+func TestPersistentList(t *testing.T) {
+	storage, err := NewFileStorage(t.TempDir())
+	require.NoError(t, err)
+	defer storage.Close()
+
+	capsule := NewWithStorage(storage, NewJSONCodec[string]())
+	ctx := context.Background()
+
+	listFixture(t, func(key string, unlockTime time.Time) error {
+		return capsule.Store(ctx, key, key, unlockTime)
+	})
+
+	var keys []string
+	for key := range capsule.All(ctx, ListOptions{Prefix: "job-", Limit: 4}) {
+		keys = append(keys, key)
+	}
+	assert.Len(t, keys, 10)
+}
@@ -0,0 +1,161 @@
+package timecapsule
+
+import (
+	"crypto/ed25519"
+	"time"
+)
+
+// Option configures a time capsule or storage backend. Options that do not
+// apply to the value being constructed are ignored.
+type Option func(*options)
+
+// options holds the resolved configuration
+type options struct {
+	clock         Clock
+	purgeInterval time.Duration
+	keyManager    KeyManager
+	timeLock      *TimeLock
+	beacon        Beacon
+	breakGlass    BreakGlassAuthorizer
+	auditor       Auditor
+	receiptKey    ed25519.PrivateKey
+	transparency  *TransparencyLog
+	timestamps    TimestampAuthority
+	timeSource    TimeSource
+	timeTolerance time.Duration
+	secretValues  bool
+}
+
+// newOptions applies opts over the defaults
+func newOptions(opts ...Option) options {
+	o := options{
+		clock: SystemClock(),
+	}
+
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	return o
+}
+
+// WithClock sets the clock used for creation times, unlock checks and
+// waiting. Capsules and the storage backing them should share one clock.
+func WithClock(clock Clock) Option {
+	return func(o *options) {
+		if clock != nil {
+			o.clock = clock
+		}
+	}
+}
+
+// WithPurgeInterval makes a time capsule remove expired capsules every
+// interval in the background until Close is called
+func WithPurgeInterval(interval time.Duration) Option {
+	return func(o *options) {
+		o.purgeInterval = interval
+	}
+}
+
+// WithKeyManager makes a persistent time capsule seal every value with its
+// own data key, wrapped by keys. Data keys are unwrapped only when Open
+// succeeds, after the unlock check. In-memory capsules ignore it.
+func WithKeyManager(keys KeyManager) Option {
+	return func(o *options) {
+		o.keyManager = keys
+	}
+}
+
+// WithTimeLock makes a persistent time capsule lock every value inside a
+// time-lock puzzle calibrated to its unlock time, so it cannot be read early
+// even with direct access to the storage. Open solves the puzzle after the
+// unlock check; WaitForUnlock starts solving while it waits when the storage
+// implements RewriteStorage. Puzzles are bound to their capsule key, and
+// Delay is not supported. In-memory capsules ignore it.
+func WithTimeLock(lock TimeLock) Option {
+	return func(o *options) {
+		o.timeLock = &lock
+	}
+}
+
+// WithBeacon makes a persistent time capsule encrypt every value to the
+// beacon round published at or after its unlock time, so it can only be
+// decrypted once that round's signature is public. In-memory capsules
+// ignore it.
+func WithBeacon(beacon Beacon) Option {
+	return func(o *options) {
+		o.beacon = beacon
+	}
+}
+
+// WithBreakGlass enables OpenEarly, which opens a capsule before its unlock
+// time or approvals once authorize agrees. OpenEarly also needs an Auditor
+// set with WithAuditor and is disabled without one.
+func WithBreakGlass(authorize BreakGlassAuthorizer) Option {
+	return func(o *options) {
+		o.breakGlass = authorize
+	}
+}
+
+// WithAuditor makes a time capsule record audited operations with auditor
+func WithAuditor(auditor Auditor) Option {
+	return func(o *options) {
+		o.auditor = auditor
+	}
+}
+
+// WithReceiptKey enables StoreWithReceipt, which signs a Receipt for every
+// capsule it stores with key
+func WithReceiptKey(key ed25519.PrivateKey) Option {
+	return func(o *options) {
+		o.receiptKey = key
+	}
+}
+
+// WithTransparencyLog makes a time capsule append every capsule it stores
+// to log. Capsules are stored with WithCommitment so the log holds only
+// their commitments. A Store whose leaf cannot be appended fails.
+func WithTransparencyLog(log *TransparencyLog) Option {
+	return func(o *options) {
+		o.transparency = log
+	}
+}
+
+// WithTimestampAuthority makes a time capsule back the creation time of
+// every capsule it stores with a timestamp token from tsa. Capsules are
+// stored with WithCommitment and the token covers their key, creation time
+// and commitment. Peek verifies the token and fails with ErrInvalidTimestamp
+// for capsules with a commitment but no token, including capsules committed
+// before tsa was configured. Capsules with neither are accepted.
+func WithTimestampAuthority(tsa TimestampAuthority) Option {
+	return func(o *options) {
+		o.timestamps = tsa
+	}
+}
+
+// WithTrustedTime makes a time capsule check every unlock against source as
+// well as its clock. A capsule opens only once both agree it is unlocked and
+// unexpired; if the clock and source differ by more than tolerance, or the
+// source goes backwards, opening fails with ErrClockSkew or
+// ErrClockRollback. Peek, List and events still follow the clock.
+func WithTrustedTime(source TimeSource, tolerance time.Duration) Option {
+	return func(o *options) {
+		o.timeSource = source
+		o.timeTolerance = tolerance
+	}
+}
+
+// WithSecretValues makes a time capsule treat values as secrets. Persistent
+// time capsules clear every buffer holding an encoded value once it has been
+// stored or decoded, so their Codec must not return values sharing memory
+// with the data it decodes, and their Storage must not keep the slices it is
+// given or returns. In-memory capsules wipe []byte values and values
+// implementing Wiper when their capsule is deleted, purged, closed or
+// replaced by another Store. Open returns the stored value itself, not a
+// copy, so a slice or Wiper it returned is wiped along with the capsule;
+// copy it to keep it, or use WithOneShot to hand it over instead.
+func WithSecretValues() Option {
+	return func(o *options) {
+		o.secretValues = true
+	}
+}
@@ -0,0 +1,105 @@
+package timecapsule
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// receiptDomain separates receipt signatures from other uses of the key
+const receiptDomain = "timecapsule receipt v1\x00"
+
+// Receipt errors
+var (
+	ErrReceiptsDisabled = errors.New("receipts require WithReceiptKey")
+	ErrInvalidReceipt   = errors.New("receipt does not match")
+)
+
+// Receipt is signed proof that a value was stored under Key at CreatedAt,
+// to be unlocked at UnlockTime. ValueHash is the SHA-256 of the value's JSON
+// encoding, so anyone holding the signer's public key can check a revealed
+// value against the receipt without access to the storage.
+type Receipt struct {
+	Key        string    `json:"key"`
+	ValueHash  []byte    `json:"value_hash"`
+	CreatedAt  time.Time `json:"created_at"`
+	UnlockTime time.Time `json:"unlock_time"`
+	Signature  []byte    `json:"signature"`
+}
+
+// Verify checks the receipt's signature under publicKey and that data, the
+// JSON encoding of the revealed value, is the value it was issued for
+func (r Receipt) Verify(publicKey ed25519.PublicKey, data []byte) error {
+	if len(publicKey) != ed25519.PublicKeySize || !ed25519.Verify(publicKey, r.message(), r.Signature) {
+		return fmt.Errorf("timecapsule: receipt for %q: bad signature: %w", r.Key, ErrInvalidReceipt)
+	}
+
+	hash := sha256.Sum256(data)
+	if !bytes.Equal(hash[:], r.ValueHash) {
+		return fmt.Errorf("timecapsule: receipt for %q: value differs: %w", r.Key, ErrInvalidReceipt)
+	}
+
+	return nil
+}
+
+// VerifyReceipt checks that receipt was signed by publicKey for value
+func VerifyReceipt[T any](publicKey ed25519.PublicKey, receipt Receipt, value T) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("timecapsule: encode value: %w", err)
+	}
+
+	return receipt.Verify(publicKey, data)
+}
+
+// message returns the bytes a receipt's signature covers
+func (r Receipt) message() []byte {
+	var buf bytes.Buffer
+	buf.WriteString(receiptDomain)
+	writeField(&buf, []byte(r.Key))
+	writeField(&buf, r.ValueHash)
+
+	var times [16]byte
+	binary.BigEndian.PutUint64(times[0:], uint64(r.CreatedAt.UnixNano()))
+	binary.BigEndian.PutUint64(times[8:], uint64(r.UnlockTime.UnixNano()))
+	buf.Write(times[:])
+	return buf.Bytes()
+}
+
+// signReceipt issues a receipt for value stored under key
+func signReceipt[T any](signer ed25519.PrivateKey, key string, value T, createdAt, unlockTime time.Time) (Receipt, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return Receipt{}, fmt.Errorf("timecapsule: encode value: %w", err)
+	}
+
+	hash := sha256.Sum256(data)
+	receipt := Receipt{
+		Key:        key,
+		ValueHash:  hash[:],
+		CreatedAt:  createdAt.UTC(),
+		UnlockTime: unlockTime.UTC(),
+	}
+	receipt.Signature = ed25519.Sign(signer, receipt.message())
+	return receipt, nil
+}
+
+// prepareReceipt checks that receipts are enabled and resolves the creation
+// time a receipt for opts will carry
+func prepareReceipt(signer ed25519.PrivateKey, clock Clock, unlockTime time.Time, opts []StoreOption) (time.Time, error) {
+	if len(signer) != ed25519.PrivateKeySize {
+		return time.Time{}, ErrReceiptsDisabled
+	}
+
+	o, err := ApplyStoreOptions(unlockTime, opts...)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return o.createdAt(clock.Now()), nil
+}
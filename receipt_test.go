@@ -0,0 +1,100 @@
+package timecapsule
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type bid struct {
+	Bidder string `json:"bidder"`
+	Amount int    `json:"amount"`
+}
+
+func TestStoreWithReceipt(t *testing.T) {
+	storage, err := NewFileStorage(t.TempDir())
+	require.NoError(t, err)
+	defer storage.Close()
+
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	otherKey, _, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	keyring, err := NewKeyring("k1", testKey(1))
+	require.NoError(t, err)
+
+	// Receipts cover the value, not the codec's encoding of it
+	capsules := map[string]testCapsule[bid]{
+		"memory":     New[bid](WithReceiptKey(privateKey)),
+		"persistent": NewWithStorage(storage, NewEncryptedCodec(NewJSONCodec[bid](), keyring), WithReceiptKey(privateKey)),
+	}
+
+	for name, capsule := range capsules {
+		t.Run(name, func(t *testing.T) {
+			defer capsule.Close()
+			ctx := context.Background()
+
+			value := bid{Bidder: "acme", Amount: 1200}
+			unlockTime := time.Now().Add(time.Hour)
+			receipt, err := capsule.StoreWithReceipt(ctx, "bid", value, unlockTime)
+			require.NoError(t, err)
+
+			// The receipt carries the capsule's recorded times
+			metadata, err := capsule.Peek(ctx, "bid")
+			require.NoError(t, err)
+			assert.Equal(t, "bid", receipt.Key)
+			assert.True(t, metadata.CreatedAt.Equal(receipt.CreatedAt))
+			assert.True(t, unlockTime.Equal(receipt.UnlockTime))
+
+			// A third party needs only the receipt, the public key and the
+			// revealed value
+			data, err := json.Marshal(receipt)
+			require.NoError(t, err)
+			var received Receipt
+			require.NoError(t, json.Unmarshal(data, &received))
+			require.NoError(t, VerifyReceipt(publicKey, received, value))
+			require.NoError(t, received.Verify(publicKey, []byte(`{"bidder":"acme","amount":1200}`)))
+
+			assert.ErrorIs(t, VerifyReceipt(publicKey, received, bid{Bidder: "acme", Amount: 1300}), ErrInvalidReceipt)
+			assert.ErrorIs(t, VerifyReceipt(otherKey, received, value), ErrInvalidReceipt)
+
+			backdated := received
+			backdated.CreatedAt = backdated.CreatedAt.Add(-time.Hour)
+			assert.ErrorIs(t, VerifyReceipt(publicKey, backdated, value), ErrInvalidReceipt)
+
+			moved := received
+			moved.Key = "other"
+			assert.ErrorIs(t, VerifyReceipt(publicKey, moved, value), ErrInvalidReceipt)
+
+			// A creation time set by the caller is signed as given
+			createdAt := time.Now().Add(-time.Minute)
+			receipt, err = capsule.StoreWithReceipt(ctx, "backfilled", value, unlockTime, WithCreatedAt(createdAt))
+			require.NoError(t, err)
+			assert.True(t, createdAt.Equal(receipt.CreatedAt))
+			metadata, err = capsule.Peek(ctx, "backfilled")
+			require.NoError(t, err)
+			assert.True(t, createdAt.Equal(metadata.CreatedAt))
+
+			// Nothing is stored when the options are invalid
+			_, err = capsule.StoreWithReceipt(ctx, "invalid", value, unlockTime, WithExpiry(unlockTime.Add(-time.Second)))
+			assert.ErrorIs(t, err, ErrInvalidWindow)
+			assert.False(t, capsule.Exists(ctx, "invalid"))
+		})
+	}
+}
+
+func TestStoreWithReceiptDisabled(t *testing.T) {
+	capsule := New[string]()
+	defer capsule.Close()
+
+	_, err := capsule.StoreWithReceipt(context.Background(), "key", "v", time.Now())
+	assert.ErrorIs(t, err, ErrReceiptsDisabled)
+	assert.False(t, capsule.Exists(context.Background(), "key"))
+}
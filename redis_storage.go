@@ -0,0 +1,1046 @@
+package timecapsule
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultRedisPrefix is the key prefix used by NewRedisStorage when none is given
+const DefaultRedisPrefix = "timecapsule:"
+
+// redisWatchRetries bounds optimistic WATCH/MULTI retries
+const redisWatchRetries = 8
+
+// redisMetadataFields are the hash fields decoded by RedisStorage.metadata
+var redisMetadataFields = []string{"unlock_time", "created_at", "expires_at", "attributes"}
+
+// RedisConfig configures a RedisStorage
+type RedisConfig struct {
+	// Addr is the host:port of the Redis server
+	Addr string
+
+	// Password is sent with AUTH when non-empty
+	Password string
+
+	// DB selects the logical database when non-zero
+	DB int
+
+	// Prefix namespaces every key written by the storage
+	Prefix string
+
+	// DialTimeout bounds connection setup; defaults to 5 seconds
+	DialTimeout time.Duration
+
+	// PoolSize is the maximum number of idle connections kept; defaults to 4
+	PoolSize int
+}
+
+// RedisError is an error reply returned by the Redis server
+type RedisError string
+
+func (e RedisError) Error() string { return "redis: " + string(e) }
+
+// RedisStorage implements Storage on Redis using the RESP protocol directly.
+//
+// Each capsule is a hash at <prefix>capsule:<key> holding its value, unlock
+// time, creation time and expiry, and every key is also a member of the
+// sorted set <prefix>unlock scored by unlock time in milliseconds, so
+// capsules can be range-queried by when they unlock. Capsules with an expiry
+// are additionally scored in <prefix>expiry for purging.
+type RedisStorage struct {
+	config RedisConfig
+	clock  Clock
+	idle   chan *redisConn
+	mu     sync.Mutex
+	closed bool
+}
+
+// NewRedisStorage connects to Redis and returns a storage using it
+func NewRedisStorage(config RedisConfig, opts ...Option) (*RedisStorage, error) {
+	if config.Addr == "" {
+		return nil, errors.New("timecapsule: redis address is required")
+	}
+
+	if config.Prefix == "" {
+		config.Prefix = DefaultRedisPrefix
+	}
+
+	if config.DialTimeout <= 0 {
+		config.DialTimeout = 5 * time.Second
+	}
+
+	if config.PoolSize <= 0 {
+		config.PoolSize = 4
+	}
+
+	o := newOptions(opts...)
+	s := &RedisStorage{
+		config: config,
+		clock:  o.clock,
+		idle:   make(chan *redisConn, config.PoolSize),
+	}
+
+	// Fail fast on unreachable servers or bad credentials
+	ctx, cancel := context.WithTimeout(context.Background(), config.DialTimeout)
+	defer cancel()
+	if _, err := s.do(ctx, "PING"); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Store writes the capsule hash and its unlock-time score in one transaction
+func (s *RedisStorage) Store(ctx context.Context, key string, value []byte, unlockTime time.Time) error {
+	return s.StoreWithOptions(ctx, key, value, unlockTime)
+}
+
+// StoreWithOptions writes the capsule hash with opts and its unlock-time
+// score in one transaction
+func (s *RedisStorage) StoreWithOptions(ctx context.Context, key string, value []byte, unlockTime time.Time, opts ...StoreOption) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if key == "" {
+		return ErrInvalidKey
+	}
+
+	o, err := ApplyStoreOptions(unlockTime, opts...)
+	if err != nil {
+		return err
+	}
+
+	createdAt := o.createdAt(s.clock.Now())
+	if err := checkTimeRange(unlockTime, createdAt, o.ExpiresAt); err != nil {
+		return err
+	}
+
+	attributes, err := encodeAttributes(o.Attributes)
+	if err != nil {
+		return err
+	}
+
+	hash := s.hashKey(key)
+	expiry := []any{"ZREM", s.expiryKey(), key}
+	if !o.ExpiresAt.IsZero() {
+		expiry = []any{"ZADD", s.expiryKey(), o.ExpiresAt.UnixMilli(), key}
+	}
+
+	_, err = s.transaction(ctx,
+		[]any{"DEL", hash},
+		[]any{"HSET", hash,
+			"value", value,
+			"unlock_time", unlockTime.UnixNano(),
+			"created_at", createdAt.UnixNano(),
+			"expires_at", sqlTime(o.ExpiresAt),
+			"attributes", attributes},
+		[]any{"ZADD", s.unlockKey(), unlockTime.UnixMilli(), key},
+		expiry,
+	)
+	return err
+}
+
+// Open returns the capsule value if it's unlocked
+func (s *RedisStorage) Open(ctx context.Context, key string) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if key == "" {
+		return nil, ErrInvalidKey
+	}
+
+	fields, err := s.hmget(ctx, key, "unlock_time", "created_at", "expires_at", "attributes", "value")
+	if err != nil {
+		return nil, err
+	}
+
+	metadata, err := s.metadata(fields)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkWindow(metadata.UnlockTime, metadata.ExpiresAt, s.clock.Now(), metadata.Attributes); err != nil {
+		return nil, err
+	}
+
+	return fields[4], nil
+}
+
+// Peek returns metadata about a capsule without reading its value
+func (s *RedisStorage) Peek(ctx context.Context, key string) (Metadata, error) {
+	if err := ctx.Err(); err != nil {
+		return Metadata{}, err
+	}
+
+	if key == "" {
+		return Metadata{}, ErrInvalidKey
+	}
+
+	fields, err := s.hmget(ctx, key, redisMetadataFields...)
+	if err != nil {
+		return Metadata{}, err
+	}
+
+	return s.metadata(fields)
+}
+
+// SetUnlockTime updates the unlock time of an existing capsule. The capsule
+// hash is WATCHed so the update never resurrects a concurrently deleted
+// capsule or races with a change to its expiry.
+func (s *RedisStorage) SetUnlockTime(ctx context.Context, key string, unlockTime time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if key == "" {
+		return ErrInvalidKey
+	}
+
+	unlockNano, err := unixNano(unlockTime)
+	if err != nil {
+		return err
+	}
+
+	hash := s.hashKey(key)
+	return s.withConn(ctx, func(conn *redisConn) error {
+		for attempt := 0; attempt < redisWatchRetries; attempt++ {
+			if _, err := conn.do("WATCH", hash); err != nil {
+				return err
+			}
+
+			reply, err := conn.do("HMGET", hash, "unlock_time", "expires_at")
+			if err != nil {
+				return err
+			}
+
+			fields, _ := reply.([]any)
+			if len(fields) != 2 || fields[0] == nil {
+				if _, err := conn.do("UNWATCH"); err != nil {
+					return err
+				}
+				return ErrCapsuleNotFound
+			}
+
+			rawExpiry, _ := fields[1].([]byte)
+			expiresAt, err := redisOptionalTime(rawExpiry)
+			if err != nil {
+				return err
+			}
+
+			if !expiresAt.IsZero() && !unlockTime.Before(expiresAt) {
+				if _, err := conn.do("UNWATCH"); err != nil {
+					return err
+				}
+				return ErrInvalidWindow
+			}
+
+			replies, err := execMulti(conn,
+				[]any{"HSET", hash, "unlock_time", unlockNano},
+				[]any{"ZADD", s.unlockKey(), unlockTime.UnixMilli(), key},
+			)
+			if err != nil {
+				return err
+			}
+
+			// A nil EXEC reply means the watched hash changed; try again
+			if replies != nil {
+				return nil
+			}
+		}
+		return errors.New("timecapsule: redis capsule modified concurrently")
+	})
+}
+
+// Rewrite replaces the value field of a capsule hash, WATCHing the hash so a
+// concurrent write or delete forces a retry
+func (s *RedisStorage) Rewrite(ctx context.Context, key string, rewrite func(value []byte) ([]byte, error)) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if key == "" {
+		return ErrInvalidKey
+	}
+
+	hash := s.hashKey(key)
+	return s.withConn(ctx, func(conn *redisConn) error {
+		for attempt := 0; attempt < redisWatchRetries; attempt++ {
+			if _, err := conn.do("WATCH", hash); err != nil {
+				return err
+			}
+
+			reply, err := conn.do("HMGET", hash, "unlock_time", "value")
+			if err != nil {
+				return err
+			}
+
+			fields, _ := reply.([]any)
+			if len(fields) != 2 || fields[0] == nil {
+				if _, err := conn.do("UNWATCH"); err != nil {
+					return err
+				}
+				return ErrCapsuleNotFound
+			}
+
+			old, _ := fields[1].([]byte)
+			value, err := rewrite(old)
+			if err != nil || value == nil {
+				if _, unwatchErr := conn.do("UNWATCH"); unwatchErr != nil {
+					return unwatchErr
+				}
+				return err
+			}
+
+			replies, err := execMulti(conn, []any{"HSET", hash, "value", value})
+			if err != nil {
+				return err
+			}
+
+			// A nil EXEC reply means the watched hash changed; try again
+			if replies != nil {
+				return nil
+			}
+		}
+		return errors.New("timecapsule: redis capsule modified concurrently")
+	})
+}
+
+// UpdateAttributes replaces the attributes field of a capsule hash,
+// WATCHing the hash so a concurrent write or delete forces a retry
+func (s *RedisStorage) UpdateAttributes(ctx context.Context, key string, update func(attributes map[string]string) (map[string]string, error)) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if key == "" {
+		return ErrInvalidKey
+	}
+
+	hash := s.hashKey(key)
+	return s.withConn(ctx, func(conn *redisConn) error {
+		for attempt := 0; attempt < redisWatchRetries; attempt++ {
+			if _, err := conn.do("WATCH", hash); err != nil {
+				return err
+			}
+
+			reply, err := conn.do("HMGET", hash, "unlock_time", "attributes")
+			if err != nil {
+				return err
+			}
+
+			fields, _ := reply.([]any)
+			if len(fields) != 2 || fields[0] == nil {
+				if _, err := conn.do("UNWATCH"); err != nil {
+					return err
+				}
+				return ErrCapsuleNotFound
+			}
+
+			old, _ := fields[1].([]byte)
+			attributes, err := decodeAttributes(string(old))
+			if err == nil {
+				attributes, err = update(attributes)
+			}
+			if err != nil || attributes == nil {
+				if _, unwatchErr := conn.do("UNWATCH"); unwatchErr != nil {
+					return unwatchErr
+				}
+				return err
+			}
+
+			encoded, err := encodeAttributes(attributes)
+			if err != nil {
+				return err
+			}
+
+			replies, err := execMulti(conn, []any{"HSET", hash, "attributes", encoded})
+			if err != nil {
+				return err
+			}
+
+			// A nil EXEC reply means the watched hash changed; try again
+			if replies != nil {
+				return nil
+			}
+		}
+		return errors.New("timecapsule: redis capsule modified concurrently")
+	})
+}
+
+// Delete removes the capsule hash and its unlock-time and expiry scores
+func (s *RedisStorage) Delete(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if key == "" {
+		return ErrInvalidKey
+	}
+
+	deleted, err := s.delete(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	if !deleted {
+		return ErrCapsuleNotFound
+	}
+
+	return nil
+}
+
+// Exists checks if a capsule exists
+func (s *RedisStorage) Exists(ctx context.Context, key string) bool {
+	if err := ctx.Err(); err != nil {
+		return false
+	}
+
+	if key == "" {
+		return false
+	}
+
+	reply, err := s.do(ctx, "EXISTS", s.hashKey(key))
+	if err != nil {
+		return false
+	}
+
+	count, _ := reply.(int64)
+	return count > 0
+}
+
+// List returns one page of capsules matching opts by walking the unlock-time
+// sorted set. Redis orders members by their millisecond score and then by
+// key, so cursors returned by this backend record the score rather than the
+// exact unlock time.
+func (s *RedisStorage) List(ctx context.Context, opts ListOptions) (ListPage, error) {
+	if err := ctx.Err(); err != nil {
+		return ListPage{}, err
+	}
+
+	cursor, err := decodeCursor(opts.Cursor)
+	if err != nil {
+		return ListPage{}, err
+	}
+
+	// Narrow the score range; exact filtering uses the nanosecond hash fields
+	now := s.clock.Now()
+	minScore, maxScore := int64(math.MinInt64), int64(math.MaxInt64)
+	if !opts.UnlockAfter.IsZero() {
+		minScore = max(minScore, opts.UnlockAfter.UnixMilli())
+	}
+	if !opts.UnlockBefore.IsZero() {
+		maxScore = min(maxScore, opts.UnlockBefore.UnixMilli())
+	}
+	switch opts.State {
+	case StateLocked:
+		minScore = max(minScore, now.UnixMilli())
+	case StateUnlocked:
+		maxScore = min(maxScore, now.UnixMilli())
+	}
+	if cursor != nil {
+		minScore = max(minScore, cursor.unlock)
+	}
+
+	scoreArg := func(score int64, unbounded string) any {
+		if score == math.MinInt64 || score == math.MaxInt64 {
+			return unbounded
+		}
+		return score
+	}
+
+	limit := opts.limit()
+	batch := max(limit+1, 64)
+	scores := make(map[string]int64)
+
+	var items []ListItem
+	for offset := 0; len(items) <= limit; offset += batch {
+		reply, err := s.do(ctx, "ZRANGEBYSCORE", s.unlockKey(),
+			scoreArg(minScore, "-inf"), scoreArg(maxScore, "+inf"),
+			"WITHSCORES", "LIMIT", offset, batch)
+		if err != nil {
+			return ListPage{}, err
+		}
+
+		members, _ := reply.([]any)
+		var keys []string
+		var commands [][]any
+		for i := 0; i+1 < len(members); i += 2 {
+			member, _ := members[i].([]byte)
+			rawScore, _ := members[i+1].([]byte)
+			key := string(member)
+
+			score, err := strconv.ParseFloat(string(rawScore), 64)
+			if err != nil {
+				return ListPage{}, fmt.Errorf("timecapsule: invalid redis score: %w", err)
+			}
+
+			if cursor != nil && !cursor.after(int64(score), key) {
+				continue
+			}
+
+			if !strings.HasPrefix(key, opts.Prefix) {
+				continue
+			}
+
+			scores[key] = int64(score)
+			keys = append(keys, key)
+			commands = append(commands, hmgetCommand(s.hashKey(key), redisMetadataFields))
+		}
+
+		// The metadata of the whole batch is read in one round trip
+		replies, err := s.pipeline(ctx, commands...)
+		if err != nil {
+			return ListPage{}, err
+		}
+
+		for i, key := range keys {
+			if len(items) > limit {
+				break
+			}
+
+			fields, err := hmgetReply(replies[i], len(redisMetadataFields))
+			if errors.Is(err, ErrCapsuleNotFound) {
+				// Deleted between the range query and the lookup
+				continue
+			}
+			if err != nil {
+				return ListPage{}, err
+			}
+
+			metadata, err := s.metadata(fields)
+			if err != nil {
+				return ListPage{}, err
+			}
+
+			if !opts.matches(key, metadata) {
+				continue
+			}
+
+			items = append(items, ListItem{Key: key, Metadata: metadata})
+		}
+
+		if len(members) < 2*batch {
+			break
+		}
+	}
+
+	return cutPage(items, limit, func(item ListItem) string {
+		return encodeCursor(scores[item.Key], item.Key)
+	}), nil
+}
+
+// Purge removes every expired capsule, using the expiry sorted set to find
+// candidates
+func (s *RedisStorage) Purge(ctx context.Context) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	now := s.clock.Now()
+	reply, err := s.do(ctx, "ZRANGEBYSCORE", s.expiryKey(), "-inf", now.UnixMilli())
+	if err != nil {
+		return 0, err
+	}
+
+	members, _ := reply.([]any)
+	purged := 0
+	for _, member := range members {
+		raw, _ := member.([]byte)
+		key := string(raw)
+
+		// Scores are milliseconds; confirm against the exact expiry
+		metadata, err := s.Peek(ctx, key)
+		if errors.Is(err, ErrCapsuleNotFound) {
+			_, err = s.do(ctx, "ZREM", s.expiryKey(), key)
+		}
+		if err != nil {
+			return purged, err
+		}
+
+		if !isExpired(metadata.ExpiresAt, now) {
+			continue
+		}
+
+		deleted, err := s.delete(ctx, key)
+		if err != nil {
+			return purged, err
+		}
+		if deleted {
+			purged++
+		}
+	}
+
+	return purged, nil
+}
+
+// Close closes all pooled connections
+func (s *RedisStorage) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+
+	var errs []error
+	for {
+		select {
+		case conn := <-s.idle:
+			errs = append(errs, conn.Close())
+		default:
+			return errors.Join(errs...)
+		}
+	}
+}
+
+// hashKey returns the Redis key of a capsule hash
+func (s *RedisStorage) hashKey(key string) string {
+	return s.config.Prefix + "capsule:" + key
+}
+
+// unlockKey returns the Redis key of the unlock-time sorted set
+func (s *RedisStorage) unlockKey() string {
+	return s.config.Prefix + "unlock"
+}
+
+// expiryKey returns the Redis key of the expiry sorted set
+func (s *RedisStorage) expiryKey() string {
+	return s.config.Prefix + "expiry"
+}
+
+// delete removes a capsule and its scores, reporting whether it existed
+func (s *RedisStorage) delete(ctx context.Context, key string) (bool, error) {
+	replies, err := s.transaction(ctx,
+		[]any{"DEL", s.hashKey(key)},
+		[]any{"ZREM", s.unlockKey(), key},
+		[]any{"ZREM", s.expiryKey(), key},
+	)
+	if err != nil {
+		return false, err
+	}
+
+	deleted, _ := replies[0].(int64)
+	return deleted > 0, nil
+}
+
+// metadata decodes the unlock_time, created_at, expires_at and attributes
+// hash fields
+func (s *RedisStorage) metadata(fields [][]byte) (Metadata, error) {
+	unlockTime, err := redisTime(fields[0])
+	if err != nil {
+		return Metadata{}, err
+	}
+
+	createdAt, err := redisTime(fields[1])
+	if err != nil {
+		return Metadata{}, err
+	}
+
+	expiresAt, err := redisOptionalTime(fields[2])
+	if err != nil {
+		return Metadata{}, err
+	}
+
+	attributes, err := decodeAttributes(string(fields[3]))
+	if err != nil {
+		return Metadata{}, err
+	}
+
+	return newMetadata(unlockTime, createdAt, expiresAt, s.clock.Now(), attributes), nil
+}
+
+// hmget reads hash fields, returning ErrCapsuleNotFound if the capsule is
+// missing. Absent optional fields are returned as nil.
+func (s *RedisStorage) hmget(ctx context.Context, key string, fields ...string) ([][]byte, error) {
+	reply, err := s.do(ctx, hmgetCommand(s.hashKey(key), fields)...)
+	if err != nil {
+		return nil, err
+	}
+
+	return hmgetReply(reply, len(fields))
+}
+
+// hmgetCommand returns the HMGET command reading fields of hash
+func hmgetCommand(hash string, fields []string) []any {
+	command := []any{"HMGET", hash}
+	for _, field := range fields {
+		command = append(command, field)
+	}
+	return command
+}
+
+// hmgetReply decodes the reply to an HMGET of n fields as hmget does
+func hmgetReply(reply any, n int) ([][]byte, error) {
+	if err, ok := reply.(RedisError); ok {
+		return nil, err
+	}
+
+	items, ok := reply.([]any)
+	if !ok || len(items) != n {
+		return nil, fmt.Errorf("timecapsule: unexpected redis reply %T", reply)
+	}
+
+	// The first field is always present on an existing capsule
+	if items[0] == nil {
+		return nil, ErrCapsuleNotFound
+	}
+
+	values := make([][]byte, len(items))
+	for i, item := range items {
+		values[i], _ = item.([]byte)
+	}
+
+	return values, nil
+}
+
+// transaction runs commands atomically with MULTI/EXEC and returns their replies
+func (s *RedisStorage) transaction(ctx context.Context, commands ...[]any) ([]any, error) {
+	var replies []any
+	err := s.withConn(ctx, func(conn *redisConn) error {
+		var err error
+		replies, err = execMulti(conn, commands...)
+		if err == nil && replies == nil {
+			return errors.New("timecapsule: redis transaction aborted")
+		}
+		return err
+	})
+	return replies, err
+}
+
+// execMulti runs commands inside MULTI/EXEC on conn. It returns nil replies
+// without an error when EXEC was aborted by a WATCHed key.
+func execMulti(conn *redisConn, commands ...[]any) ([]any, error) {
+	if _, err := conn.do("MULTI"); err != nil {
+		return nil, err
+	}
+
+	for _, command := range commands {
+		if _, err := conn.do(command...); err != nil {
+			_, _ = conn.do("DISCARD")
+			return nil, err
+		}
+	}
+
+	reply, err := conn.do("EXEC")
+	if err != nil || reply == nil {
+		return nil, err
+	}
+
+	replies, ok := reply.([]any)
+	if !ok {
+		return nil, fmt.Errorf("timecapsule: unexpected redis reply %T", reply)
+	}
+
+	for _, r := range replies {
+		if err, ok := r.(RedisError); ok {
+			return nil, err
+		}
+	}
+
+	return replies, nil
+}
+
+// pipeline sends commands on one pooled connection before reading their
+// replies, in order. Error replies are returned in place as RedisError.
+func (s *RedisStorage) pipeline(ctx context.Context, commands ...[]any) ([]any, error) {
+	if len(commands) == 0 {
+		return nil, nil
+	}
+
+	var replies []any
+	err := s.withConn(ctx, func(conn *redisConn) error {
+		var err error
+		replies, err = conn.pipeline(commands...)
+		return err
+	})
+	return replies, err
+}
+
+// do runs a single command on a pooled connection
+func (s *RedisStorage) do(ctx context.Context, args ...any) (any, error) {
+	var reply any
+	err := s.withConn(ctx, func(conn *redisConn) error {
+		var err error
+		reply, err = conn.do(args...)
+		return err
+	})
+	return reply, err
+}
+
+// withConn borrows a connection bound to ctx for the duration of fn
+func (s *RedisStorage) withConn(ctx context.Context, fn func(*redisConn) error) error {
+	conn, err := s.acquire(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Cancelling the context interrupts any blocked read or write
+	deadline, _ := ctx.Deadline()
+	_ = conn.SetDeadline(deadline)
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.SetDeadline(time.Unix(1, 0))
+	})
+
+	err = fn(conn)
+	interrupted := !stop()
+
+	// Server error replies and missing capsules leave the connection usable
+	var redisErr RedisError
+	healthy := err == nil || errors.As(err, &redisErr) || errors.Is(err, ErrCapsuleNotFound)
+	if interrupted || !healthy {
+		// The connection may hold a partial reply; never reuse it
+		_ = conn.Close()
+		if ctxErr := ctx.Err(); err != nil && ctxErr != nil {
+			return ctxErr
+		}
+		return err
+	}
+
+	s.release(conn)
+	return err
+}
+
+// acquire returns an idle connection or dials a new one
+func (s *RedisStorage) acquire(ctx context.Context) (*redisConn, error) {
+	s.mu.Lock()
+	closed := s.closed
+	s.mu.Unlock()
+	if closed {
+		return nil, ErrStorageClosed
+	}
+
+	select {
+	case conn := <-s.idle:
+		return conn, nil
+	default:
+	}
+
+	dialer := net.Dialer{Timeout: s.config.DialTimeout}
+	netConn, err := dialer.DialContext(ctx, "tcp", s.config.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("timecapsule: dial redis: %w", err)
+	}
+
+	conn := &redisConn{
+		Conn: netConn,
+		r:    bufio.NewReader(netConn),
+		w:    bufio.NewWriter(netConn),
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	if s.config.Password != "" {
+		if _, err := conn.do("AUTH", s.config.Password); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+	}
+
+	if s.config.DB != 0 {
+		if _, err := conn.do("SELECT", s.config.DB); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+	}
+
+	return conn, nil
+}
+
+// release returns a healthy connection to the pool
+func (s *RedisStorage) release(conn *redisConn) {
+	_ = conn.SetDeadline(time.Time{})
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		_ = conn.Close()
+		return
+	}
+
+	select {
+	case s.idle <- conn:
+	default:
+		_ = conn.Close()
+	}
+}
+
+// redisTime parses a Unix-nanosecond hash field
+func redisTime(field []byte) (time.Time, error) {
+	nanos, err := strconv.ParseInt(string(field), 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("timecapsule: invalid redis time field: %w", err)
+	}
+	return time.Unix(0, nanos), nil
+}
+
+// redisOptionalTime parses a Unix-nanosecond hash field where 0 or a missing
+// field means unset
+func redisOptionalTime(field []byte) (time.Time, error) {
+	if field == nil {
+		return time.Time{}, nil
+	}
+
+	t, err := redisTime(field)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return fromSQLTime(t.UnixNano()), nil
+}
+
+// redisConn is a single RESP connection
+type redisConn struct {
+	net.Conn
+	r *bufio.Reader
+	w *bufio.Writer
+}
+
+// do writes a command and reads its reply
+func (c *redisConn) do(args ...any) (any, error) {
+	if err := writeRESPCommand(c.w, args...); err != nil {
+		return nil, err
+	}
+
+	if err := c.w.Flush(); err != nil {
+		return nil, err
+	}
+
+	reply, err := readRESP(c.r)
+	if err != nil {
+		return nil, err
+	}
+
+	if redisErr, ok := reply.(RedisError); ok {
+		return nil, redisErr
+	}
+
+	return reply, nil
+}
+
+// pipeline writes every command and then reads their replies in order
+func (c *redisConn) pipeline(commands ...[]any) ([]any, error) {
+	for _, command := range commands {
+		if err := writeRESPCommand(c.w, command...); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := c.w.Flush(); err != nil {
+		return nil, err
+	}
+
+	replies := make([]any, len(commands))
+	for i := range replies {
+		reply, err := readRESP(c.r)
+		if err != nil {
+			return nil, err
+		}
+		replies[i] = reply
+	}
+
+	return replies, nil
+}
+
+// writeRESPCommand encodes a command as a RESP array of bulk strings
+func writeRESPCommand(w *bufio.Writer, args ...any) error {
+	if _, err := fmt.Fprintf(w, "*%d\r\n", len(args)); err != nil {
+		return err
+	}
+
+	for _, arg := range args {
+		var b []byte
+		switch v := arg.(type) {
+		case string:
+			b = []byte(v)
+		case []byte:
+			b = v
+		case int:
+			b = strconv.AppendInt(nil, int64(v), 10)
+		case int64:
+			b = strconv.AppendInt(nil, v, 10)
+		default:
+			return fmt.Errorf("timecapsule: unsupported redis argument %T", arg)
+		}
+
+		if _, err := fmt.Fprintf(w, "$%d\r\n", len(b)); err != nil {
+			return err
+		}
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+		if _, err := w.WriteString("\r\n"); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// readRESP decodes a single RESP value. Simple strings are returned as
+// string, integers as int64, bulk strings as []byte, arrays as []any, nil
+// replies as nil and error replies as RedisError.
+func readRESP(r *bufio.Reader) (any, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("timecapsule: malformed redis reply %q", line)
+	}
+
+	kind, payload := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return payload, nil
+	case '-':
+		return RedisError(payload), nil
+	case ':':
+		return strconv.ParseInt(payload, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(payload)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		b := make([]byte, n+2)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	case '*':
+		n, err := strconv.Atoi(payload)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		items := make([]any, n)
+		for i := range items {
+			if items[i], err = readRESP(r); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	default:
+		return nil, fmt.Errorf("timecapsule: unknown redis reply type %q", kind)
+	}
+}
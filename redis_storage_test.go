@@ -0,0 +1,509 @@
+package timecapsule
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeRedis is an in-process RESP server implementing the commands used by
+// RedisStorage
+type fakeRedis struct {
+	listener net.Listener
+	password string
+
+	// pipelined counts commands read while the next one was already waiting
+	pipelined atomic.Int32
+
+	mu     sync.Mutex
+	hashes map[string]map[string][]byte
+	zsets  map[string]map[string]float64
+}
+
+func newFakeRedis(t *testing.T, password string) *fakeRedis {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	server := &fakeRedis{
+		listener: listener,
+		password: password,
+		hashes:   make(map[string]map[string][]byte),
+		zsets:    make(map[string]map[string]float64),
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+
+	go server.serve()
+	return server
+}
+
+func (f *fakeRedis) Addr() string { return f.listener.Addr().String() }
+
+func (f *fakeRedis) serve() {
+	for {
+		conn, err := f.listener.Accept()
+		if err != nil {
+			return
+		}
+		go f.handle(conn)
+	}
+}
+
+func (f *fakeRedis) handle(conn net.Conn) {
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	authed := f.password == ""
+
+	var queue [][]string
+	inMulti := false
+
+	for {
+		reply, err := readRESP(r)
+		if err != nil {
+			return
+		}
+		if r.Buffered() > 0 {
+			f.pipelined.Add(1)
+		}
+
+		items, _ := reply.([]any)
+		args := make([]string, len(items))
+		for i, item := range items {
+			b, _ := item.([]byte)
+			args[i] = string(b)
+		}
+		if len(args) == 0 {
+			return
+		}
+
+		command := strings.ToUpper(args[0])
+		switch {
+		case command == "AUTH":
+			if args[1] != f.password {
+				writeFakeRESP(w, RedisError("WRONGPASS invalid password"))
+				break
+			}
+			authed = true
+			writeFakeRESP(w, "OK")
+		case !authed:
+			writeFakeRESP(w, RedisError("NOAUTH Authentication required"))
+		case command == "MULTI":
+			inMulti = true
+			queue = nil
+			writeFakeRESP(w, "OK")
+		case command == "DISCARD":
+			inMulti = false
+			writeFakeRESP(w, "OK")
+		case command == "EXEC":
+			inMulti = false
+			f.mu.Lock()
+			results := make([]any, len(queue))
+			for i, queued := range queue {
+				results[i] = f.exec(queued)
+			}
+			f.mu.Unlock()
+			writeFakeRESP(w, results)
+		case inMulti:
+			queue = append(queue, args)
+			writeFakeRESP(w, "QUEUED")
+		default:
+			f.mu.Lock()
+			result := f.exec(args)
+			f.mu.Unlock()
+			writeFakeRESP(w, result)
+		}
+
+		if err := w.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// exec runs a single command; the caller must hold f.mu
+func (f *fakeRedis) exec(args []string) any {
+	switch strings.ToUpper(args[0]) {
+	case "PING":
+		return "PONG"
+	case "SELECT", "WATCH", "UNWATCH":
+		return "OK"
+	case "DEL":
+		var n int64
+		for _, key := range args[1:] {
+			if _, ok := f.hashes[key]; ok {
+				n++
+			}
+			if _, ok := f.zsets[key]; ok {
+				n++
+			}
+			delete(f.hashes, key)
+			delete(f.zsets, key)
+		}
+		return n
+	case "EXISTS":
+		var n int64
+		for _, key := range args[1:] {
+			if _, ok := f.hashes[key]; ok {
+				n++
+			}
+		}
+		return n
+	case "HSET":
+		hash, ok := f.hashes[args[1]]
+		if !ok {
+			hash = make(map[string][]byte)
+			f.hashes[args[1]] = hash
+		}
+		var added int64
+		for i := 2; i+1 < len(args); i += 2 {
+			if _, exists := hash[args[i]]; !exists {
+				added++
+			}
+			hash[args[i]] = []byte(args[i+1])
+		}
+		return added
+	case "HMGET":
+		hash := f.hashes[args[1]]
+		values := make([]any, len(args)-2)
+		for i, field := range args[2:] {
+			if value, ok := hash[field]; ok {
+				values[i] = value
+			}
+		}
+		return values
+	case "ZADD":
+		zset, ok := f.zsets[args[1]]
+		if !ok {
+			zset = make(map[string]float64)
+			f.zsets[args[1]] = zset
+		}
+		score, err := strconv.ParseFloat(args[2], 64)
+		if err != nil {
+			return RedisError("ERR value is not a valid float")
+		}
+		_, exists := zset[args[3]]
+		zset[args[3]] = score
+		if exists {
+			return int64(0)
+		}
+		return int64(1)
+	case "ZRANGEBYSCORE":
+		// ZRANGEBYSCORE key min max [WITHSCORES] [LIMIT offset count]
+		bound := func(s string, inf float64) float64 {
+			if strings.HasSuffix(s, "inf") {
+				return inf
+			}
+			v, _ := strconv.ParseFloat(s, 64)
+			return v
+		}
+		lo, hi := bound(args[2], math.Inf(-1)), bound(args[3], math.Inf(1))
+		withScores, offset, count := false, 0, math.MaxInt
+		for i := 4; i < len(args); i++ {
+			switch strings.ToUpper(args[i]) {
+			case "WITHSCORES":
+				withScores = true
+			case "LIMIT":
+				offset, _ = strconv.Atoi(args[i+1])
+				count, _ = strconv.Atoi(args[i+2])
+				i += 2
+			}
+		}
+
+		type member struct {
+			key   string
+			score float64
+		}
+		var members []member
+		for key, score := range f.zsets[args[1]] {
+			if score >= lo && score <= hi {
+				members = append(members, member{key, score})
+			}
+		}
+		sort.Slice(members, func(i, j int) bool {
+			if members[i].score != members[j].score {
+				return members[i].score < members[j].score
+			}
+			return members[i].key < members[j].key
+		})
+
+		var result []any
+		for i := offset; i < len(members) && i-offset < count; i++ {
+			result = append(result, []byte(members[i].key))
+			if withScores {
+				result = append(result, []byte(strconv.FormatFloat(members[i].score, 'f', -1, 64)))
+			}
+		}
+		if result == nil {
+			result = []any{}
+		}
+		return result
+	case "ZREM":
+		zset := f.zsets[args[1]]
+		if _, ok := zset[args[2]]; !ok {
+			return int64(0)
+		}
+		delete(zset, args[2])
+		return int64(1)
+	}
+	return RedisError(fmt.Sprintf("ERR unknown command '%s'", args[0]))
+}
+
+func writeFakeRESP(w *bufio.Writer, value any) {
+	switch v := value.(type) {
+	case nil:
+		fmt.Fprint(w, "$-1\r\n")
+	case string:
+		fmt.Fprintf(w, "+%s\r\n", v)
+	case RedisError:
+		fmt.Fprintf(w, "-%s\r\n", string(v))
+	case int64:
+		fmt.Fprintf(w, ":%d\r\n", v)
+	case []byte:
+		fmt.Fprintf(w, "$%d\r\n%s\r\n", len(v), v)
+	case []any:
+		fmt.Fprintf(w, "*%d\r\n", len(v))
+		for _, item := range v {
+			writeFakeRESP(w, item)
+		}
+	}
+}
+
+func TestRedisStorageStoreAndOpen(t *testing.T) {
+	server := newFakeRedis(t, "")
+	storage, err := NewRedisStorage(RedisConfig{Addr: server.Addr()})
+	require.NoError(t, err)
+	defer storage.Close()
+	ctx := context.Background()
+
+	// Locked capsule
+	unlockTime := time.Now().Add(time.Hour)
+	require.NoError(t, storage.Store(ctx, "locked", []byte("later"), unlockTime))
+
+	_, err = storage.Open(ctx, "locked")
+	assert.ErrorIs(t, err, ErrCapsuleLocked)
+
+	metadata, err := storage.Peek(ctx, "locked")
+	require.NoError(t, err)
+	assert.True(t, metadata.IsLocked)
+	assert.True(t, metadata.UnlockTime.Equal(unlockTime))
+
+	// Unlock time is mirrored into the sorted set
+	server.mu.Lock()
+	score := server.zsets[DefaultRedisPrefix+"unlock"]["locked"]
+	server.mu.Unlock()
+	assert.Equal(t, float64(unlockTime.UnixMilli()), score)
+
+	// Unlocked capsule with binary payload
+	payload := []byte("line\r\nbreak\x00")
+	require.NoError(t, storage.Store(ctx, "open", payload, time.Now().Add(-time.Second)))
+
+	value, err := storage.Open(ctx, "open")
+	require.NoError(t, err)
+	assert.Equal(t, payload, value)
+
+	_, err = storage.Open(ctx, "missing")
+	assert.ErrorIs(t, err, ErrCapsuleNotFound)
+}
+
+func TestRedisStorageDelete(t *testing.T) {
+	server := newFakeRedis(t, "")
+	storage, err := NewRedisStorage(RedisConfig{Addr: server.Addr(), Prefix: "app:"})
+	require.NoError(t, err)
+	defer storage.Close()
+	ctx := context.Background()
+
+	require.NoError(t, storage.Store(ctx, "test", []byte("hello"), time.Now()))
+	assert.True(t, storage.Exists(ctx, "test"))
+
+	require.NoError(t, storage.Delete(ctx, "test"))
+	assert.False(t, storage.Exists(ctx, "test"))
+	assert.ErrorIs(t, storage.Delete(ctx, "test"), ErrCapsuleNotFound)
+
+	server.mu.Lock()
+	_, scored := server.zsets["app:unlock"]["test"]
+	server.mu.Unlock()
+	assert.False(t, scored)
+}
+
+func TestRedisStorageSetUnlockTime(t *testing.T) {
+	server := newFakeRedis(t, "")
+	storage, err := NewRedisStorage(RedisConfig{Addr: server.Addr()})
+	require.NoError(t, err)
+	defer storage.Close()
+	ctx := context.Background()
+
+	require.NoError(t, storage.Store(ctx, "test", []byte("hello"), time.Now().Add(time.Hour)))
+
+	unlockTime := time.Now().Add(-time.Second)
+	require.NoError(t, storage.SetUnlockTime(ctx, "test", unlockTime))
+
+	value, err := storage.Open(ctx, "test")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("hello"), value)
+
+	server.mu.Lock()
+	score := server.zsets[DefaultRedisPrefix+"unlock"]["test"]
+	server.mu.Unlock()
+	assert.Equal(t, float64(unlockTime.UnixMilli()), score)
+
+	// Missing capsules are not resurrected
+	assert.ErrorIs(t, storage.SetUnlockTime(ctx, "missing", unlockTime), ErrCapsuleNotFound)
+	assert.False(t, storage.Exists(ctx, "missing"))
+}
+
+func TestRedisStorageTimeRange(t *testing.T) {
+	server := newFakeRedis(t, "")
+	storage, err := NewRedisStorage(RedisConfig{Addr: server.Addr()})
+	require.NoError(t, err)
+	defer storage.Close()
+	ctx := context.Background()
+
+	// Hash fields hold Unix nanoseconds, so times beyond their range are rejected
+	farFuture := time.Date(2300, 1, 1, 0, 0, 0, 0, time.UTC)
+	assert.ErrorIs(t, storage.Store(ctx, "zero", []byte("v"), time.Time{}), ErrTimeOutOfRange)
+	assert.ErrorIs(t, storage.StoreWithOptions(ctx, "expiry", []byte("v"), time.Now(), WithExpiry(farFuture)), ErrTimeOutOfRange)
+	assert.False(t, storage.Exists(ctx, "zero"))
+
+	unlockTime := time.Now().Add(time.Hour)
+	require.NoError(t, storage.Store(ctx, "k", []byte("v"), unlockTime))
+	assert.ErrorIs(t, storage.SetUnlockTime(ctx, "k", farFuture), ErrTimeOutOfRange)
+
+	metadata, err := storage.Peek(ctx, "k")
+	require.NoError(t, err)
+	assert.True(t, metadata.UnlockTime.Equal(unlockTime))
+}
+
+func TestRedisStorageList(t *testing.T) {
+	server := newFakeRedis(t, "")
+	storage, err := NewRedisStorage(RedisConfig{Addr: server.Addr()})
+	require.NoError(t, err)
+	defer storage.Close()
+
+	testStorageList(t, storage)
+}
+
+func TestRedisStorageListPipeline(t *testing.T) {
+	server := newFakeRedis(t, "")
+	storage, err := NewRedisStorage(RedisConfig{Addr: server.Addr()})
+	require.NoError(t, err)
+	defer storage.Close()
+	ctx := context.Background()
+
+	for i := range 5 {
+		require.NoError(t, storage.Store(ctx, fmt.Sprintf("key-%d", i), []byte("v"), time.Now()))
+	}
+	server.pipelined.Store(0)
+
+	// The metadata of every listed capsule is read in one round trip
+	page, err := storage.List(ctx, ListOptions{})
+	require.NoError(t, err)
+	assert.Len(t, page.Items, 5)
+	assert.Equal(t, int32(4), server.pipelined.Load())
+}
+
+func TestRedisStorageExpiry(t *testing.T) {
+	server := newFakeRedis(t, "")
+	storage, err := NewRedisStorage(RedisConfig{Addr: server.Addr()})
+	require.NoError(t, err)
+	defer storage.Close()
+
+	testStorageExpiry(t, storage)
+
+	// Purged and deleted capsules leave no expiry score behind
+	require.NoError(t, storage.Delete(context.Background(), "open"))
+	server.mu.Lock()
+	scored := len(server.zsets[DefaultRedisPrefix+"expiry"])
+	server.mu.Unlock()
+	assert.Zero(t, scored)
+}
+
+func TestRedisStorageAttributes(t *testing.T) {
+	server := newFakeRedis(t, "")
+	storage, err := NewRedisStorage(RedisConfig{Addr: server.Addr()})
+	require.NoError(t, err)
+	defer storage.Close()
+
+	testStorageAttributes(t, storage)
+}
+
+func TestRedisStorageApprovals(t *testing.T) {
+	server := newFakeRedis(t, "")
+	storage, err := NewRedisStorage(RedisConfig{Addr: server.Addr()})
+	require.NoError(t, err)
+	defer storage.Close()
+
+	testStorageApprovals(t, storage)
+}
+
+func TestRedisStorageIntegrity(t *testing.T) {
+	server := newFakeRedis(t, "")
+	storage, err := NewRedisStorage(RedisConfig{Addr: server.Addr()})
+	require.NoError(t, err)
+	defer storage.Close()
+
+	testStorageIntegrity(t, storage)
+}
+
+func TestRedisStorageEncryption(t *testing.T) {
+	server := newFakeRedis(t, "")
+	storage, err := NewRedisStorage(RedisConfig{Addr: server.Addr()})
+	require.NoError(t, err)
+	defer storage.Close()
+
+	testStorageEncryption(t, storage)
+}
+
+func TestRedisStorageAuth(t *testing.T) {
+	server := newFakeRedis(t, "secret")
+
+	_, err := NewRedisStorage(RedisConfig{Addr: server.Addr(), Password: "wrong"})
+	var redisErr RedisError
+	assert.True(t, errors.As(err, &redisErr))
+
+	storage, err := NewRedisStorage(RedisConfig{Addr: server.Addr(), Password: "secret", DB: 2})
+	require.NoError(t, err)
+	defer storage.Close()
+
+	require.NoError(t, storage.Store(context.Background(), "k", []byte("v"), time.Now()))
+}
+
+func TestRedisStorageClosed(t *testing.T) {
+	server := newFakeRedis(t, "")
+	storage, err := NewRedisStorage(RedisConfig{Addr: server.Addr()})
+	require.NoError(t, err)
+	require.NoError(t, storage.Close())
+
+	err = storage.Store(context.Background(), "k", []byte("v"), time.Now())
+	assert.ErrorIs(t, err, ErrStorageClosed)
+}
+
+func TestRedisStorageWithPersistentTimeCapsule(t *testing.T) {
+	server := newFakeRedis(t, "")
+	storage, err := NewRedisStorage(RedisConfig{Addr: server.Addr()})
+	require.NoError(t, err)
+	defer storage.Close()
+
+	capsule := NewWithStorage(storage, NewJSONCodec[[]string]())
+	ctx := context.Background()
+
+	require.NoError(t, capsule.Store(ctx, "list", []string{"a", "b"}, time.Now().Add(-time.Second)))
+
+	value, err := capsule.Open(ctx, "list")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a", "b"}, value)
+}
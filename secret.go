@@ -0,0 +1,137 @@
+package timecapsule
+
+import (
+	"fmt"
+	"log/slog"
+	"maps"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+)
+
+// redacted replaces secret values in formatted and logged capsules
+const redacted = "[REDACTED]"
+
+// Wiper is implemented by values that can clear their own secret contents,
+// which WithSecretValues calls when an in-memory capsule holding the value is
+// removed
+type Wiper interface {
+	// Wipe overwrites the secret contents of the value
+	Wipe()
+}
+
+// WithOneShot makes an in-memory capsule deliver its value once: the first
+// Open, Reveal, OpenWithShares, WaitForUnlock or OpenEarly to return the
+// value also removes the capsule, and concurrent calls find it gone.
+// Persistent capsules ignore it.
+func WithOneShot() StoreOption {
+	return func(o *StoreOptions) {
+		o.oneShot = true
+	}
+}
+
+// wipeValue clears value if it is a byte slice or a Wiper
+func wipeValue[T any](value T) {
+	switch v := any(value).(type) {
+	case []byte:
+		clear(v)
+	case Wiper:
+		v.Wipe()
+	}
+}
+
+// sameValue reports whether a and b share the buffer of a byte slice or are
+// the same Wiper, so that storing a value over itself does not wipe it
+func sameValue[T any](a, b T) bool {
+	switch x := any(a).(type) {
+	case []byte:
+		y := any(b).([]byte)
+		return cap(x) > 0 && cap(y) > 0 && &x[:1][0] == &y[:1][0]
+	case Wiper:
+		va, vb := reflect.ValueOf(x), reflect.ValueOf(any(b))
+		return va.Comparable() && va.Equal(vb)
+	}
+	return false
+}
+
+// String formats the capsule with its value and attribute values redacted
+func (c Capsule[T]) String() string {
+	return fmt.Sprintf("{Value:%s UnlockTime:%s CreatedAt:%s ExpiresAt:%s Attributes:%s}",
+		redacted, c.UnlockTime, c.CreatedAt, c.ExpiresAt, redactAttributes(c.Attributes))
+}
+
+// GoString formats the capsule for %#v with its value and attribute values
+// redacted
+func (c Capsule[T]) GoString() string {
+	return fmt.Sprintf("timecapsule.Capsule[%s]{Value:%s, UnlockTime:%#v, CreatedAt:%#v, ExpiresAt:%#v, Attributes:%s}",
+		reflect.TypeFor[T](), redacted, c.UnlockTime, c.CreatedAt, c.ExpiresAt, redactAttributes(c.Attributes))
+}
+
+// LogValue logs the capsule with its value and attribute values redacted
+func (c Capsule[T]) LogValue() slog.Value {
+	attrs := []slog.Attr{
+		slog.String("value", redacted),
+		slog.Time("unlock_time", c.UnlockTime),
+		slog.Time("created_at", c.CreatedAt),
+	}
+	return slog.GroupValue(append(attrs, logWindow(c.ExpiresAt, c.Attributes)...)...)
+}
+
+// String formats the metadata with its attribute values redacted
+func (m Metadata) String() string {
+	return fmt.Sprintf("{UnlockTime:%s CreatedAt:%s ExpiresAt:%s IsLocked:%t IsExpired:%t Attributes:%s}",
+		m.UnlockTime, m.CreatedAt, m.ExpiresAt, m.IsLocked, m.IsExpired, redactAttributes(m.Attributes))
+}
+
+// GoString formats the metadata for %#v with its attribute values redacted
+func (m Metadata) GoString() string {
+	return fmt.Sprintf("timecapsule.Metadata{UnlockTime:%#v, CreatedAt:%#v, ExpiresAt:%#v, IsLocked:%t, IsExpired:%t, Attributes:%s}",
+		m.UnlockTime, m.CreatedAt, m.ExpiresAt, m.IsLocked, m.IsExpired, redactAttributes(m.Attributes))
+}
+
+// LogValue logs the metadata with its attribute values redacted
+func (m Metadata) LogValue() slog.Value {
+	attrs := []slog.Attr{
+		slog.Time("unlock_time", m.UnlockTime),
+		slog.Time("created_at", m.CreatedAt),
+		slog.Bool("is_locked", m.IsLocked),
+		slog.Bool("is_expired", m.IsExpired),
+	}
+	return slog.GroupValue(append(attrs, logWindow(m.ExpiresAt, m.Attributes)...)...)
+}
+
+// logWindow returns the log attributes for an expiry, if set, and attributes
+// with their values redacted
+func logWindow(expiresAt time.Time, attributes map[string]string) []slog.Attr {
+	var attrs []slog.Attr
+	if !expiresAt.IsZero() {
+		attrs = append(attrs, slog.Time("expires_at", expiresAt))
+	}
+
+	if len(attributes) > 0 {
+		redactedAttrs := make([]slog.Attr, 0, len(attributes))
+		for _, name := range slices.Sorted(maps.Keys(attributes)) {
+			redactedAttrs = append(redactedAttrs, slog.String(name, redacted))
+		}
+		attrs = append(attrs, slog.Attr{Key: "attributes", Value: slog.GroupValue(redactedAttrs...)})
+	}
+
+	return attrs
+}
+
+// redactAttributes formats attributes like a map with every value redacted
+func redactAttributes(attributes map[string]string) string {
+	var b strings.Builder
+	b.WriteString("map[")
+	for i, name := range slices.Sorted(maps.Keys(attributes)) {
+		if i > 0 {
+			b.WriteByte(' ')
+		}
+		b.WriteString(name)
+		b.WriteByte(':')
+		b.WriteString(redacted)
+	}
+	b.WriteByte(']')
+	return b.String()
+}
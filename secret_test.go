@@ -0,0 +1,252 @@
+package timecapsule
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// password is a Wiper holding a secret
+type password struct {
+	secret []byte
+}
+
+func (p *password) Wipe() {
+	clear(p.secret)
+}
+
+// retainingCodec is a JSON codec that keeps every buffer it encodes or
+// decodes so tests can check they were wiped
+type retainingCodec struct {
+	Codec[string]
+
+	mu      sync.Mutex
+	buffers [][]byte
+}
+
+func (c *retainingCodec) Encode(value string) ([]byte, error) {
+	data, err := c.Codec.Encode(value)
+	c.retain(data)
+	return data, err
+}
+
+func (c *retainingCodec) Decode(data []byte) (string, error) {
+	c.retain(data)
+	return c.Codec.Decode(data)
+}
+
+func (c *retainingCodec) retain(data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.buffers = append(c.buffers, data)
+}
+
+// wiped reports whether every retained buffer was cleared
+func (c *retainingCodec) wiped() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, data := range c.buffers {
+		if bytes.ContainsFunc(data, func(r rune) bool { return r != 0 }) {
+			return false
+		}
+	}
+	return len(c.buffers) > 0
+}
+
+func TestRedaction(t *testing.T) {
+	now := time.Now()
+	capsule := Capsule[string]{
+		Value:      "hunter2",
+		UnlockTime: now,
+		CreatedAt:  now,
+		ExpiresAt:  now.Add(time.Hour),
+		Attributes: map[string]string{"token": "s3cr3t"},
+	}
+	metadata := capsule.metadata(now)
+
+	var logged bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&logged, nil))
+	logger.Info("capsule", "capsule", capsule, "metadata", metadata)
+
+	outputs := map[string]string{
+		"%v":   fmt.Sprintf("%v", capsule),
+		"%+v":  fmt.Sprintf("%+v", capsule),
+		"%#v":  fmt.Sprintf("%#v", capsule),
+		"%s":   fmt.Sprintf("%s", &capsule),
+		"meta": fmt.Sprintf("%v %+v %#v", metadata, metadata, metadata),
+		"slog": logged.String(),
+	}
+
+	for name, output := range outputs {
+		assert.NotContains(t, output, "hunter2", name)
+		assert.NotContains(t, output, "s3cr3t", name)
+		assert.Contains(t, output, redacted, name)
+		assert.Contains(t, output, "token", name)
+	}
+
+	assert.Contains(t, outputs["%#v"], "timecapsule.Capsule[string]{")
+	assert.Contains(t, outputs["meta"], "IsLocked:false")
+	assert.Contains(t, outputs["slog"], `"unlock_time"`)
+}
+
+func TestOneShot(t *testing.T) {
+	ctx := context.Background()
+	capsule := New[string](WithSecretValues())
+	defer capsule.Close()
+
+	events, err := capsule.Subscribe(ctx, SubscribeOptions{Types: []EventType{EventDeleted}})
+	require.NoError(t, err)
+
+	// A locked one-shot capsule is kept for a later Open
+	require.NoError(t, capsule.StoreWithOptions(ctx, "token", "hunter2", time.Now().Add(time.Hour), WithOneShot()))
+	_, err = capsule.Open(ctx, "token")
+	assert.ErrorIs(t, err, ErrCapsuleLocked)
+	require.NoError(t, capsule.Delay(ctx, "token", -time.Minute))
+
+	// Concurrent opens deliver the value exactly once
+	var wg sync.WaitGroup
+	results := make(chan error, 8)
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			value, err := capsule.Open(ctx, "token")
+			if err == nil && value != "hunter2" {
+				err = errors.New("wrong value")
+			}
+			results <- err
+		}()
+	}
+	wg.Wait()
+	close(results)
+
+	delivered := 0
+	for err := range results {
+		if err == nil {
+			delivered++
+		} else {
+			assert.ErrorIs(t, err, ErrCapsuleNotFound)
+		}
+	}
+	assert.Equal(t, 1, delivered)
+	assert.False(t, capsule.Exists(ctx, "token"))
+
+	select {
+	case event := <-events:
+		assert.Equal(t, "token", event.Key)
+	case <-time.After(time.Second):
+		t.Fatal("no deleted event for the delivered capsule")
+	}
+
+	// Reveal delivers committed one-shot capsules the same way
+	require.NoError(t, capsule.StoreWithOptions(ctx, "bid", "1200", time.Now(), WithOneShot(), WithCommitment()))
+	reveal, err := capsule.Reveal(ctx, "bid")
+	require.NoError(t, err)
+	require.NoError(t, reveal.Verify(reveal.Commitment))
+	_, err = capsule.Open(ctx, "bid")
+	assert.ErrorIs(t, err, ErrCapsuleNotFound)
+}
+
+func TestSecretValuesMemory(t *testing.T) {
+	ctx := context.Background()
+	capsule := New[[]byte](WithSecretValues())
+
+	deleted, purged, closed := []byte("deleted"), []byte("purged"), []byte("closed")
+	require.NoError(t, capsule.Store(ctx, "deleted", deleted, time.Now()))
+	require.NoError(t, capsule.StoreWithOptions(ctx, "purged", purged, time.Now().Add(-time.Hour), WithExpiry(time.Now().Add(-time.Minute))))
+	require.NoError(t, capsule.Store(ctx, "closed", closed, time.Now().Add(time.Hour)))
+
+	// A one-shot value is handed over and not wiped afterwards
+	shot := []byte("shot")
+	require.NoError(t, capsule.StoreWithOptions(ctx, "shot", shot, time.Now(), WithOneShot()))
+	value, err := capsule.Open(ctx, "shot")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("shot"), value)
+
+	require.NoError(t, capsule.Delete(ctx, "deleted"))
+	assert.Equal(t, make([]byte, len("deleted")), deleted)
+
+	// Storing over a capsule wipes the value it replaces, including the
+	// slice Open returned, but not a value stored over itself
+	replaced := []byte("replaced")
+	require.NoError(t, capsule.Store(ctx, "replaced", replaced, time.Now()))
+	opened, err := capsule.Open(ctx, "replaced")
+	require.NoError(t, err)
+	require.NoError(t, capsule.Store(ctx, "replaced", replaced, time.Now()))
+	assert.Equal(t, []byte("replaced"), replaced)
+	require.NoError(t, capsule.Store(ctx, "replaced", []byte("new"), time.Now()))
+	assert.Equal(t, make([]byte, len("replaced")), replaced)
+	assert.Equal(t, make([]byte, len("replaced")), opened)
+
+	n, err := capsule.Purge(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.Equal(t, make([]byte, len("purged")), purged)
+
+	require.NoError(t, capsule.Close())
+	assert.Equal(t, make([]byte, len("closed")), closed)
+	assert.False(t, capsule.Exists(ctx, "closed"))
+	assert.Equal(t, []byte("shot"), shot)
+
+	// Values implementing Wiper wipe themselves
+	wipers := New[*password](WithSecretValues())
+	secret := &password{secret: []byte("hunter2")}
+	require.NoError(t, wipers.Store(ctx, "password", secret, time.Now()))
+	require.NoError(t, wipers.Store(ctx, "password", secret, time.Now()))
+	assert.Equal(t, []byte("hunter2"), secret.secret)
+	require.NoError(t, wipers.Delete(ctx, "password"))
+	assert.Equal(t, make([]byte, len("hunter2")), secret.secret)
+
+	// Without secret values nothing is wiped
+	plain := New[[]byte]()
+	kept := []byte("kept")
+	require.NoError(t, plain.Store(ctx, "kept", kept, time.Now()))
+	require.NoError(t, plain.Delete(ctx, "kept"))
+	assert.Equal(t, []byte("kept"), kept)
+}
+
+func TestSecretValuesPersistent(t *testing.T) {
+	ctx := context.Background()
+	storage, err := NewFileStorage(t.TempDir())
+	require.NoError(t, err)
+	defer storage.Close()
+
+	for name, opts := range map[string][]StoreOption{"plain": nil, "committed": {WithCommitment()}} {
+		t.Run(name, func(t *testing.T) {
+			codec := &retainingCodec{Codec: NewJSONCodec[string]()}
+			capsule := NewWithStorage(storage, codec, WithSecretValues())
+			defer capsule.Close()
+
+			require.NoError(t, capsule.StoreWithOptions(ctx, name, "hunter2", time.Now(), opts...))
+			assert.True(t, codec.wiped(), "encoded value not wiped after Store")
+
+			value, err := capsule.Open(ctx, name)
+			require.NoError(t, err)
+			assert.Equal(t, "hunter2", value)
+			assert.True(t, codec.wiped(), "decoded value not wiped after Open")
+
+			if opts != nil {
+				reveal, err := capsule.Reveal(ctx, name)
+				require.NoError(t, err)
+				assert.Equal(t, "hunter2", reveal.Value)
+				assert.True(t, codec.wiped(), "decoded value not wiped after Reveal")
+			}
+		})
+	}
+
+	// Without secret values the codec's buffers are left alone
+	codec := &retainingCodec{Codec: NewJSONCodec[string]()}
+	capsule := NewWithStorage(storage, codec)
+	defer capsule.Close()
+	require.NoError(t, capsule.Store(ctx, "kept", "hunter2", time.Now()))
+	assert.False(t, codec.wiped())
+}
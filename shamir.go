@@ -0,0 +1,262 @@
+package timecapsule
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Attributes recording the share policy of a capsule stored with shares
+const (
+	AttributeShareThreshold = AttributePrefix + "shares.threshold"
+	AttributeShareDigests   = AttributePrefix + "shares.digests"
+)
+
+// shareSecretSize is the size of the AES-256 key split between custodians
+const shareSecretSize = 32
+
+// sharedRecordPrefix marks a value encrypted under a split key
+var sharedRecordPrefix = []byte("\x00timecapsule-shares-v1\x00")
+
+// Secret sharing errors
+var (
+	ErrSharesRequired     = errors.New("capsule requires custodian shares")
+	ErrInsufficientShares = errors.New("not enough valid shares")
+	ErrInvalidThreshold   = errors.New("share threshold must be between 1 and the number of shares, at most 255")
+	ErrInvalidShare       = errors.New("invalid share")
+)
+
+// Share is one custodian's part of the key protecting a capsule stored with
+// StoreWithShares. Any threshold of a capsule's shares open it together;
+// fewer reveal nothing about the key. Shares are bound to their capsule.
+type Share struct {
+	Index byte
+	Data  []byte
+}
+
+// MarshalText encodes the share as "<index>-<hex data>"
+func (s Share) MarshalText() ([]byte, error) {
+	return []byte(strconv.Itoa(int(s.Index)) + "-" + hex.EncodeToString(s.Data)), nil
+}
+
+// UnmarshalText decodes a share encoded by MarshalText
+func (s *Share) UnmarshalText(text []byte) error {
+	index, data, ok := strings.Cut(string(text), "-")
+	if !ok {
+		return ErrInvalidShare
+	}
+
+	n, err := strconv.ParseUint(index, 10, 8)
+	if err != nil || n == 0 {
+		return ErrInvalidShare
+	}
+
+	decoded, err := hex.DecodeString(data)
+	if err != nil || len(decoded) == 0 {
+		return ErrInvalidShare
+	}
+
+	s.Index, s.Data = byte(n), decoded
+	return nil
+}
+
+// splitCapsuleKey creates a random key for the capsule stored under key,
+// splits it into n shares of which threshold are needed to recover it, and
+// returns the attributes recording the share policy
+func splitCapsuleKey(key string, threshold, n int) ([]byte, []Share, map[string]string, error) {
+	if n < 1 || n > 255 || threshold < 1 || threshold > n {
+		return nil, nil, nil, ErrInvalidThreshold
+	}
+
+	secret := make([]byte, shareSecretSize)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, nil, nil, err
+	}
+
+	shares, err := shamirSplit(secret, threshold, n)
+	if err != nil {
+		clear(secret)
+		return nil, nil, nil, err
+	}
+
+	digests := make([]string, n)
+	for i, share := range shares {
+		digests[i] = shareDigest(key, share)
+	}
+
+	attributes := map[string]string{
+		AttributeShareThreshold: strconv.Itoa(threshold),
+		AttributeShareDigests:   strings.Join(digests, ","),
+	}
+	return secret, shares, attributes, nil
+}
+
+// requiresShares reports whether a capsule was stored with shares
+func requiresShares(attributes map[string]string) bool {
+	_, ok := attributes[AttributeShareThreshold]
+	return ok
+}
+
+// combineShares checks shares against the share policy in attributes and
+// recovers the capsule key. Invalid and duplicate shares are ignored as long
+// as enough valid ones remain.
+func combineShares(key string, attributes map[string]string, shares []Share) ([]byte, error) {
+	threshold, err := strconv.Atoi(attributes[AttributeShareThreshold])
+	if err != nil || threshold < 1 {
+		return nil, fmt.Errorf("timecapsule: share policy of %q: %w", key, ErrInvalidShare)
+	}
+	digests := strings.Split(attributes[AttributeShareDigests], ",")
+
+	valid := make([]Share, 0, threshold)
+	seen := make(map[byte]bool)
+	for _, share := range shares {
+		i := int(share.Index) - 1
+		if i < 0 || i >= len(digests) || seen[share.Index] || shareDigest(key, share) != digests[i] {
+			continue
+		}
+
+		seen[share.Index] = true
+		valid = append(valid, share)
+		if len(valid) == threshold {
+			return shamirCombine(valid), nil
+		}
+	}
+
+	return nil, fmt.Errorf("timecapsule: %d of %d shares valid: %w", len(valid), threshold, ErrInsufficientShares)
+}
+
+// shareDigest commits to a share of the capsule stored under key
+func shareDigest(key string, share Share) string {
+	h := sha256.New()
+	h.Write([]byte("timecapsule share v1"))
+	h.Write([]byte(strconv.Itoa(len(key))))
+	h.Write([]byte(key))
+	h.Write([]byte{share.Index})
+	h.Write(share.Data)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// sealShared encrypts value under a split capsule key, bound to the capsule key
+func sealShared(secret []byte, key string, value []byte) ([]byte, error) {
+	aead, err := newGCM(secret)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	record := append(append([]byte{}, sharedRecordPrefix...), nonce...)
+	return aead.Seal(record, nonce, value, recordAAD(sharedRecordPrefix, []byte(key))), nil
+}
+
+// openShared decrypts a value sealed by sealShared
+func openShared(secret []byte, key string, record []byte) ([]byte, error) {
+	aead, err := newGCM(secret)
+	if err != nil {
+		return nil, err
+	}
+
+	if !bytes.HasPrefix(record, sharedRecordPrefix) || len(record) < len(sharedRecordPrefix)+aead.NonceSize()+aead.Overhead() {
+		return nil, ErrInvalidRecord
+	}
+
+	body := record[len(sharedRecordPrefix):]
+	value, err := aead.Open(nil, body[:aead.NonceSize()], body[aead.NonceSize():], recordAAD(sharedRecordPrefix, []byte(key)))
+	if err != nil {
+		return nil, ErrDecryptFailed
+	}
+
+	return value, nil
+}
+
+// shamirSplit splits secret into n shares over GF(256), any threshold of
+// which recover it. Each byte of the secret is the constant term of its own
+// random polynomial of degree threshold-1, evaluated at x = 1..n.
+func shamirSplit(secret []byte, threshold, n int) ([]Share, error) {
+	shares := make([]Share, n)
+	for i := range shares {
+		shares[i] = Share{Index: byte(i + 1), Data: make([]byte, len(secret))}
+	}
+
+	coefficients := make([]byte, threshold)
+	defer clear(coefficients)
+	for b, value := range secret {
+		coefficients[0] = value
+		if _, err := rand.Read(coefficients[1:]); err != nil {
+			return nil, err
+		}
+
+		for i := range shares {
+			x := shares[i].Index
+			var y byte
+			for c := threshold - 1; c >= 0; c-- {
+				y = gfMul(y, x) ^ coefficients[c]
+			}
+			shares[i].Data[b] = y
+		}
+	}
+
+	return shares, nil
+}
+
+// shamirCombine recovers the secret from distinct shares by Lagrange
+// interpolation at x = 0
+func shamirCombine(shares []Share) []byte {
+	secret := make([]byte, len(shares[0].Data))
+	for i, share := range shares {
+		// The Lagrange basis polynomial of share i evaluated at zero
+		basis := byte(1)
+		for j, other := range shares {
+			if i != j {
+				basis = gfMul(basis, gfDiv(other.Index, other.Index^share.Index))
+			}
+		}
+
+		for b := range secret {
+			secret[b] ^= gfMul(share.Data[b], basis)
+		}
+	}
+	return secret
+}
+
+// gfExp and gfLog are exponent and logarithm tables of GF(256) with the AES
+// polynomial and generator 3
+var gfExp, gfLog = gfTables()
+
+func gfTables() (exp [510]byte, log [256]byte) {
+	x := byte(1)
+	for i := 0; i < 255; i++ {
+		exp[i], exp[i+255] = x, x
+		log[x] = byte(i)
+
+		// Multiply by the generator 3: x*2 ^ x, reduced by the AES polynomial
+		double := x << 1
+		if x&0x80 != 0 {
+			double ^= 0x1b
+		}
+		x ^= double
+	}
+	return exp, log
+}
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+int(gfLog[b])]
+}
+
+func gfDiv(a, b byte) byte {
+	if a == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+255-int(gfLog[b])]
+}
@@ -0,0 +1,101 @@
+package timecapsule
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShamir(t *testing.T) {
+	for a := 1; a < 256; a++ {
+		assert.Equal(t, byte(1), gfMul(byte(a), gfDiv(1, byte(a))), "inverse of %d", a)
+	}
+
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	shares, err := shamirSplit(secret, 3, 5)
+	require.NoError(t, err)
+	require.Len(t, shares, 5)
+
+	// Any three shares recover the secret
+	for _, subset := range [][]int{{0, 1, 2}, {4, 2, 0}, {1, 3, 4}} {
+		picked := []Share{shares[subset[0]], shares[subset[1]], shares[subset[2]]}
+		assert.Equal(t, secret, shamirCombine(picked))
+	}
+
+	// Two do not
+	assert.NotEqual(t, secret, shamirCombine(shares[:2]))
+
+	var decoded Share
+	text, err := shares[3].MarshalText()
+	require.NoError(t, err)
+	require.NoError(t, decoded.UnmarshalText(text))
+	assert.Equal(t, shares[3], decoded)
+
+	for _, invalid := range []string{"", "4", "0-ab", "256-ab", "4-zz", "4-"} {
+		assert.ErrorIs(t, decoded.UnmarshalText([]byte(invalid)), ErrInvalidShare, invalid)
+	}
+}
+
+func TestStoreWithShares(t *testing.T) {
+	storage, err := NewFileStorage(t.TempDir())
+	require.NoError(t, err)
+	defer storage.Close()
+
+	capsules := map[string]testCapsule[string]{
+		"memory":     New[string](),
+		"persistent": NewWithStorage(storage, NewJSONCodec[string]()),
+	}
+
+	for name, capsule := range capsules {
+		t.Run(name, func(t *testing.T) {
+			defer capsule.Close()
+			ctx := context.Background()
+
+			_, err := capsule.StoreWithShares(ctx, "bad", "x", time.Now(), 4, 3)
+			assert.ErrorIs(t, err, ErrInvalidThreshold)
+
+			shares, err := capsule.StoreWithShares(ctx, "escrow", "recovery-key", time.Now().Add(time.Hour), 2, 3)
+			require.NoError(t, err)
+			require.Len(t, shares, 3)
+
+			metadata, err := capsule.Peek(ctx, "escrow")
+			require.NoError(t, err)
+			assert.Equal(t, "2", metadata.Attributes[AttributeShareThreshold])
+
+			// Shares do not open a locked capsule
+			_, err = capsule.OpenWithShares(ctx, "escrow", shares)
+			assert.ErrorIs(t, err, ErrCapsuleLocked)
+
+			require.NoError(t, capsule.Delay(ctx, "escrow", -time.Second))
+
+			_, err = capsule.Open(ctx, "escrow")
+			assert.ErrorIs(t, err, ErrSharesRequired)
+			_, err = capsule.WaitForUnlock(ctx, "escrow")
+			assert.ErrorIs(t, err, ErrSharesRequired)
+
+			_, err = capsule.OpenWithShares(ctx, "escrow", shares[:1])
+			assert.ErrorIs(t, err, ErrInsufficientShares)
+
+			// Duplicate, tampered and foreign shares do not count
+			other, err := capsule.StoreWithShares(ctx, "other", "x", time.Now(), 2, 3)
+			require.NoError(t, err)
+			tampered := Share{Index: shares[1].Index, Data: bytes.Clone(shares[1].Data)}
+			tampered.Data[0] ^= 1
+			_, err = capsule.OpenWithShares(ctx, "escrow", []Share{shares[0], shares[0], tampered, other[2]})
+			assert.ErrorIs(t, err, ErrInsufficientShares)
+
+			value, err := capsule.OpenWithShares(ctx, "escrow", []Share{tampered, shares[2], shares[0]})
+			require.NoError(t, err)
+			assert.Equal(t, "recovery-key", value)
+		})
+	}
+
+	// The persistent value is encrypted under the split key
+	raw, err := storage.Open(context.Background(), "escrow")
+	require.NoError(t, err)
+	assert.NotContains(t, string(raw), "recovery-key")
+}
@@ -0,0 +1,677 @@
+package timecapsule
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// DefaultSQLTable is the table used by NewSQLStorage when no name is given
+const DefaultSQLTable = "timecapsules"
+
+// sqlRewriteRetries bounds optimistic compare-and-swap retries in Rewrite
+const sqlRewriteRetries = 8
+
+var sqlIdentifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Dialect describes the SQL differences between database engines
+type Dialect interface {
+	// Name returns the dialect name
+	Name() string
+
+	// Placeholder returns the bind parameter for the n-th (1-based) argument
+	Placeholder(n int) string
+
+	// CreateSchema returns the statements that create the capsule table and
+	// its unlock_time index if they do not exist
+	CreateSchema(table string) []string
+
+	// Upsert returns an insert-or-update statement for the given columns; the
+	// first column is the primary key and the rest are overwritten on conflict
+	Upsert(table string, columns []string) string
+}
+
+// Built-in dialects
+var (
+	DialectPostgres Dialect = postgresDialect{}
+	DialectMySQL    Dialect = mysqlDialect{}
+	DialectSQLite   Dialect = sqliteDialect{}
+)
+
+type postgresDialect struct{}
+
+func (postgresDialect) Name() string { return "postgres" }
+
+func (postgresDialect) Placeholder(n int) string { return "$" + strconv.Itoa(n) }
+
+func (postgresDialect) CreateSchema(table string) []string {
+	return []string{
+		"CREATE TABLE IF NOT EXISTS " + table + " (" +
+			"capsule_key TEXT PRIMARY KEY, " +
+			"value BYTEA NOT NULL, " +
+			"unlock_time BIGINT NOT NULL, " +
+			"created_at BIGINT NOT NULL, " +
+			"expires_at BIGINT NOT NULL DEFAULT 0, " +
+			"attributes TEXT NOT NULL DEFAULT '')",
+		"CREATE INDEX IF NOT EXISTS " + table + "_unlock_time_idx ON " + table + " (unlock_time)",
+		"CREATE INDEX IF NOT EXISTS " + table + "_expires_at_idx ON " + table + " (expires_at)",
+	}
+}
+
+func (d postgresDialect) Upsert(table string, columns []string) string {
+	return insertStatement(d, table, columns) +
+		" ON CONFLICT (" + columns[0] + ") DO UPDATE SET " + assignments(columns[1:], "EXCLUDED.%s")
+}
+
+type mysqlDialect struct{}
+
+func (mysqlDialect) Name() string { return "mysql" }
+
+func (mysqlDialect) Placeholder(int) string { return "?" }
+
+func (mysqlDialect) CreateSchema(table string) []string {
+	// MySQL has no CREATE INDEX IF NOT EXISTS, so indexes are declared inline.
+	// Keys use a binary collation so that lookups and prefixes are
+	// case-sensitive, as in the other dialects.
+	return []string{
+		"CREATE TABLE IF NOT EXISTS " + table + " (" +
+			"capsule_key VARCHAR(255) CHARACTER SET utf8mb4 COLLATE utf8mb4_bin NOT NULL PRIMARY KEY, " +
+			"value LONGBLOB NOT NULL, " +
+			"unlock_time BIGINT NOT NULL, " +
+			"created_at BIGINT NOT NULL, " +
+			"expires_at BIGINT NOT NULL DEFAULT 0, " +
+			"attributes TEXT NOT NULL, " +
+			"INDEX " + table + "_unlock_time_idx (unlock_time), " +
+			"INDEX " + table + "_expires_at_idx (expires_at))",
+	}
+}
+
+func (d mysqlDialect) Upsert(table string, columns []string) string {
+	return insertStatement(d, table, columns) +
+		" ON DUPLICATE KEY UPDATE " + assignments(columns[1:], "VALUES(%s)")
+}
+
+type sqliteDialect struct{}
+
+func (sqliteDialect) Name() string { return "sqlite" }
+
+func (sqliteDialect) Placeholder(int) string { return "?" }
+
+func (sqliteDialect) CreateSchema(table string) []string {
+	return []string{
+		"CREATE TABLE IF NOT EXISTS " + table + " (" +
+			"capsule_key TEXT PRIMARY KEY, " +
+			"value BLOB NOT NULL, " +
+			"unlock_time INTEGER NOT NULL, " +
+			"created_at INTEGER NOT NULL, " +
+			"expires_at INTEGER NOT NULL DEFAULT 0, " +
+			"attributes TEXT NOT NULL DEFAULT '')",
+		"CREATE INDEX IF NOT EXISTS " + table + "_unlock_time_idx ON " + table + " (unlock_time)",
+		"CREATE INDEX IF NOT EXISTS " + table + "_expires_at_idx ON " + table + " (expires_at)",
+	}
+}
+
+func (d sqliteDialect) Upsert(table string, columns []string) string {
+	return insertStatement(d, table, columns) +
+		" ON CONFLICT (" + columns[0] + ") DO UPDATE SET " + assignments(columns[1:], "excluded.%s")
+}
+
+// insertStatement builds a plain INSERT for the given columns
+func insertStatement(d Dialect, table string, columns []string) string {
+	params := make([]string, len(columns))
+	for i := range params {
+		params[i] = d.Placeholder(i + 1)
+	}
+	return "INSERT INTO " + table + " (" + strings.Join(columns, ", ") + ") VALUES (" + strings.Join(params, ", ") + ")"
+}
+
+// assignments builds "col = <source>" pairs for an upsert's update clause
+func assignments(columns []string, source string) string {
+	sets := make([]string, len(columns))
+	for i, column := range columns {
+		sets[i] = column + " = " + fmt.Sprintf(source, column)
+	}
+	return strings.Join(sets, ", ")
+}
+
+// sqlColumns are the capsule table columns in upsert order
+var sqlColumns = []string{"capsule_key", "value", "unlock_time", "created_at", "expires_at", "attributes"}
+
+// SQLStorage implements Storage on top of database/sql.
+//
+// Times are stored as Unix nanoseconds so that every dialect compares and
+// indexes them the same way; an expires_at of 0 means no expiry. The *sql.DB
+// is owned by the caller; Close does not close it.
+type SQLStorage struct {
+	db      *sql.DB
+	dialect Dialect
+	table   string
+	clock   Clock
+}
+
+// NewSQLStorage creates a storage using the given database, dialect and table.
+// An empty table name selects DefaultSQLTable. Call CreateSchema to create the
+// table if it does not exist yet.
+func NewSQLStorage(db *sql.DB, dialect Dialect, table string, opts ...Option) (*SQLStorage, error) {
+	if db == nil {
+		return nil, errors.New("timecapsule: sql storage requires a database")
+	}
+
+	if dialect == nil {
+		return nil, errors.New("timecapsule: sql storage requires a dialect")
+	}
+
+	if table == "" {
+		table = DefaultSQLTable
+	}
+
+	if !sqlIdentifier.MatchString(table) {
+		return nil, fmt.Errorf("timecapsule: invalid sql table name %q", table)
+	}
+
+	o := newOptions(opts...)
+	return &SQLStorage{
+		db:      db,
+		dialect: dialect,
+		table:   table,
+		clock:   o.clock,
+	}, nil
+}
+
+// CreateSchema creates the capsule table and its unlock_time index
+func (s *SQLStorage) CreateSchema(ctx context.Context) error {
+	for _, stmt := range s.dialect.CreateSchema(s.table) {
+		if _, err := s.db.ExecContext(ctx, stmt); err != nil {
+			return fmt.Errorf("timecapsule: create %s schema: %w", s.dialect.Name(), err)
+		}
+	}
+	return nil
+}
+
+// Store inserts or replaces a capsule row
+func (s *SQLStorage) Store(ctx context.Context, key string, value []byte, unlockTime time.Time) error {
+	return s.StoreWithOptions(ctx, key, value, unlockTime)
+}
+
+// StoreWithOptions inserts or replaces a capsule row with opts
+func (s *SQLStorage) StoreWithOptions(ctx context.Context, key string, value []byte, unlockTime time.Time, opts ...StoreOption) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if key == "" {
+		return ErrInvalidKey
+	}
+
+	o, err := ApplyStoreOptions(unlockTime, opts...)
+	if err != nil {
+		return err
+	}
+
+	if value == nil {
+		value = []byte{}
+	}
+
+	createdAt := o.createdAt(s.clock.Now())
+	if err := checkTimeRange(unlockTime, createdAt, o.ExpiresAt); err != nil {
+		return err
+	}
+
+	attributes, err := encodeAttributes(o.Attributes)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.ExecContext(ctx, s.dialect.Upsert(s.table, sqlColumns),
+		key, value, unlockTime.UnixNano(), createdAt.UnixNano(), sqlTime(o.ExpiresAt), attributes)
+	return err
+}
+
+// Open returns the capsule value if it's unlocked
+func (s *SQLStorage) Open(ctx context.Context, key string) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if key == "" {
+		return nil, ErrInvalidKey
+	}
+
+	var (
+		value                   []byte
+		unlockNano, expiresNano int64
+		attributes              string
+	)
+	err := s.db.QueryRowContext(ctx,
+		"SELECT value, unlock_time, expires_at, attributes FROM "+s.table+" WHERE capsule_key = "+s.dialect.Placeholder(1),
+		key).Scan(&value, &unlockNano, &expiresNano, &attributes)
+	if err != nil {
+		return nil, s.notFound(err)
+	}
+
+	decoded, err := decodeAttributes(attributes)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkWindow(time.Unix(0, unlockNano), fromSQLTime(expiresNano), s.clock.Now(), decoded); err != nil {
+		return nil, err
+	}
+
+	return value, nil
+}
+
+// Peek returns metadata about a capsule without reading its value
+func (s *SQLStorage) Peek(ctx context.Context, key string) (Metadata, error) {
+	if err := ctx.Err(); err != nil {
+		return Metadata{}, err
+	}
+
+	if key == "" {
+		return Metadata{}, ErrInvalidKey
+	}
+
+	var (
+		unlockNano, createdNano, expiresNano int64
+		attributes                           string
+	)
+	err := s.db.QueryRowContext(ctx,
+		"SELECT unlock_time, created_at, expires_at, attributes FROM "+s.table+" WHERE capsule_key = "+s.dialect.Placeholder(1),
+		key).Scan(&unlockNano, &createdNano, &expiresNano, &attributes)
+	if err != nil {
+		return Metadata{}, s.notFound(err)
+	}
+
+	return s.metadata(unlockNano, createdNano, expiresNano, attributes, s.clock.Now())
+}
+
+// SetUnlockTime updates the unlock time of a capsule row in place. The
+// expiry check is part of the UPDATE so it cannot race with other writers.
+// MySQL reports rows changed rather than matched, so a row left unchanged is
+// told apart from a missing or expiring one by reading it back.
+func (s *SQLStorage) SetUnlockTime(ctx context.Context, key string, unlockTime time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if key == "" {
+		return ErrInvalidKey
+	}
+
+	unlockNano, err := unixNano(unlockTime)
+	if err != nil {
+		return err
+	}
+
+	result, err := s.db.ExecContext(ctx,
+		"UPDATE "+s.table+" SET unlock_time = "+s.dialect.Placeholder(1)+
+			" WHERE capsule_key = "+s.dialect.Placeholder(2)+
+			" AND (expires_at = 0 OR expires_at > "+s.dialect.Placeholder(3)+")",
+		unlockNano, key, unlockNano)
+	if err != nil {
+		return err
+	}
+
+	if err := s.affected(result); !errors.Is(err, ErrCapsuleNotFound) {
+		return err
+	}
+
+	var storedNano, expiresNano int64
+	err = s.db.QueryRowContext(ctx,
+		"SELECT unlock_time, expires_at FROM "+s.table+" WHERE capsule_key = "+s.dialect.Placeholder(1),
+		key).Scan(&storedNano, &expiresNano)
+	switch {
+	case err != nil:
+		return s.notFound(err)
+	case expiresNano != 0 && expiresNano <= unlockNano:
+		return ErrInvalidWindow
+	case storedNano != unlockNano:
+		return errors.New("timecapsule: sql capsule modified concurrently")
+	}
+	return nil
+}
+
+// Rewrite replaces the value of a capsule row with a compare-and-swap on the
+// old value, retrying if another writer changed it in between. An unchanged
+// value is not written, since MySQL would report the row as not matched.
+func (s *SQLStorage) Rewrite(ctx context.Context, key string, rewrite func(value []byte) ([]byte, error)) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if key == "" {
+		return ErrInvalidKey
+	}
+
+	for attempt := 0; attempt < sqlRewriteRetries; attempt++ {
+		var old []byte
+		err := s.db.QueryRowContext(ctx,
+			"SELECT value FROM "+s.table+" WHERE capsule_key = "+s.dialect.Placeholder(1),
+			key).Scan(&old)
+		if err != nil {
+			return s.notFound(err)
+		}
+
+		value, err := rewrite(old)
+		if err != nil || value == nil || bytes.Equal(value, old) {
+			return err
+		}
+
+		result, err := s.db.ExecContext(ctx,
+			"UPDATE "+s.table+" SET value = "+s.dialect.Placeholder(1)+
+				" WHERE capsule_key = "+s.dialect.Placeholder(2)+
+				" AND value = "+s.dialect.Placeholder(3),
+			value, key, old)
+		if err != nil {
+			return err
+		}
+
+		if err := s.affected(result); !errors.Is(err, ErrCapsuleNotFound) {
+			return err
+		}
+	}
+
+	return errors.New("timecapsule: sql capsule modified concurrently")
+}
+
+// UpdateAttributes replaces the attributes of a capsule row with a
+// compare-and-swap on the old attributes, retrying if another writer changed
+// them in between. Unchanged attributes are not written, as in Rewrite.
+func (s *SQLStorage) UpdateAttributes(ctx context.Context, key string, update func(attributes map[string]string) (map[string]string, error)) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if key == "" {
+		return ErrInvalidKey
+	}
+
+	for attempt := 0; attempt < sqlRewriteRetries; attempt++ {
+		var old string
+		err := s.db.QueryRowContext(ctx,
+			"SELECT attributes FROM "+s.table+" WHERE capsule_key = "+s.dialect.Placeholder(1),
+			key).Scan(&old)
+		if err != nil {
+			return s.notFound(err)
+		}
+
+		attributes, err := decodeAttributes(old)
+		if err != nil {
+			return err
+		}
+
+		attributes, err = update(attributes)
+		if err != nil || attributes == nil {
+			return err
+		}
+
+		encoded, err := encodeAttributes(attributes)
+		if err != nil || encoded == old {
+			return err
+		}
+
+		result, err := s.db.ExecContext(ctx,
+			"UPDATE "+s.table+" SET attributes = "+s.dialect.Placeholder(1)+
+				" WHERE capsule_key = "+s.dialect.Placeholder(2)+
+				" AND attributes = "+s.dialect.Placeholder(3),
+			encoded, key, old)
+		if err != nil {
+			return err
+		}
+
+		if err := s.affected(result); !errors.Is(err, ErrCapsuleNotFound) {
+			return err
+		}
+	}
+
+	return errors.New("timecapsule: sql capsule modified concurrently")
+}
+
+// Delete removes a capsule row
+func (s *SQLStorage) Delete(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if key == "" {
+		return ErrInvalidKey
+	}
+
+	result, err := s.db.ExecContext(ctx,
+		"DELETE FROM "+s.table+" WHERE capsule_key = "+s.dialect.Placeholder(1), key)
+	if err != nil {
+		return err
+	}
+
+	return s.affected(result)
+}
+
+// Exists checks if a capsule row exists
+func (s *SQLStorage) Exists(ctx context.Context, key string) bool {
+	if err := ctx.Err(); err != nil {
+		return false
+	}
+
+	if key == "" {
+		return false
+	}
+
+	var one int
+	err := s.db.QueryRowContext(ctx,
+		"SELECT 1 FROM "+s.table+" WHERE capsule_key = "+s.dialect.Placeholder(1), key).Scan(&one)
+	return err == nil
+}
+
+// List returns one page of capsules matching opts. Filters and pagination
+// are evaluated by the database using the unlock_time index.
+func (s *SQLStorage) List(ctx context.Context, opts ListOptions) (ListPage, error) {
+	if err := ctx.Err(); err != nil {
+		return ListPage{}, err
+	}
+
+	cursor, err := decodeCursor(opts.Cursor)
+	if err != nil {
+		return ListPage{}, err
+	}
+
+	var (
+		conditions []string
+		args       []any
+	)
+	param := func(value any) string {
+		args = append(args, value)
+		return s.dialect.Placeholder(len(args))
+	}
+
+	if opts.Prefix != "" {
+		conditions = append(conditions, fmt.Sprintf("SUBSTR(capsule_key, 1, %d) = %s",
+			utf8.RuneCountInString(opts.Prefix), param(opts.Prefix)))
+	}
+
+	if !opts.UnlockAfter.IsZero() {
+		conditions = append(conditions, "unlock_time >= "+param(clampNano(opts.UnlockAfter)))
+	}
+
+	if !opts.UnlockBefore.IsZero() {
+		conditions = append(conditions, "unlock_time < "+param(clampNano(opts.UnlockBefore)))
+	}
+
+	now := s.clock.Now()
+	nowNano := clampNano(now)
+	switch opts.State {
+	case StateLocked:
+		conditions = append(conditions, "unlock_time > "+param(nowNano))
+	case StateUnlocked:
+		conditions = append(conditions, "unlock_time <= "+param(nowNano),
+			"(expires_at = 0 OR expires_at > "+param(nowNano)+")")
+	case StateExpired:
+		conditions = append(conditions, "expires_at > 0", "expires_at <= "+param(nowNano))
+	}
+
+	if cursor != nil {
+		conditions = append(conditions, "(unlock_time > "+param(cursor.unlock)+
+			" OR (unlock_time = "+param(cursor.unlock)+" AND capsule_key > "+param(cursor.key)+"))")
+	}
+
+	query := "SELECT capsule_key, unlock_time, created_at, expires_at, attributes FROM " + s.table
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+
+	// One extra row tells us whether another page exists
+	limit := opts.limit()
+	query += fmt.Sprintf(" ORDER BY unlock_time, capsule_key LIMIT %d", limit+1)
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return ListPage{}, err
+	}
+	defer rows.Close()
+
+	var items []ListItem
+	for rows.Next() {
+		var (
+			key, attributes                      string
+			unlockNano, createdNano, expiresNano int64
+		)
+		if err := rows.Scan(&key, &unlockNano, &createdNano, &expiresNano, &attributes); err != nil {
+			return ListPage{}, err
+		}
+
+		metadata, err := s.metadata(unlockNano, createdNano, expiresNano, attributes, now)
+		if err != nil {
+			return ListPage{}, err
+		}
+		items = append(items, ListItem{Key: key, Metadata: metadata})
+	}
+
+	if err := rows.Err(); err != nil {
+		return ListPage{}, err
+	}
+
+	return cutPage(items, limit, func(item ListItem) string {
+		return encodeCursor(item.Metadata.UnlockTime.UnixNano(), item.Key)
+	}), nil
+}
+
+// Purge deletes every expired capsule row
+func (s *SQLStorage) Purge(ctx context.Context) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	result, err := s.db.ExecContext(ctx,
+		"DELETE FROM "+s.table+" WHERE expires_at > 0 AND expires_at <= "+s.dialect.Placeholder(1),
+		s.clock.Now().UnixNano())
+	if err != nil {
+		return 0, err
+	}
+
+	rows, err := result.RowsAffected()
+	return int(rows), err
+}
+
+// Close is a no-op; the underlying *sql.DB is owned by the caller
+func (s *SQLStorage) Close() error {
+	return nil
+}
+
+// metadata builds capsule metadata from the stored columns
+func (s *SQLStorage) metadata(unlockNano, createdNano, expiresNano int64, attributes string, now time.Time) (Metadata, error) {
+	decoded, err := decodeAttributes(attributes)
+	if err != nil {
+		return Metadata{}, err
+	}
+
+	return newMetadata(time.Unix(0, unlockNano), time.Unix(0, createdNano), fromSQLTime(expiresNano), now, decoded), nil
+}
+
+// affected returns ErrCapsuleNotFound if a statement matched no rows
+func (s *SQLStorage) affected(result sql.Result) error {
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rows == 0 {
+		return ErrCapsuleNotFound
+	}
+
+	return nil
+}
+
+// minNanoTime and maxNanoTime bound the times whose UnixNano fits in an int64,
+// roughly the years 1678 to 2262
+var (
+	minNanoTime = time.Unix(0, math.MinInt64)
+	maxNanoTime = time.Unix(0, math.MaxInt64)
+)
+
+// unixNano returns t as nanoseconds since the Unix epoch, failing with
+// ErrTimeOutOfRange where UnixNano would overflow
+func unixNano(t time.Time) (int64, error) {
+	if t.Before(minNanoTime) || t.After(maxNanoTime) {
+		return 0, fmt.Errorf("timecapsule: %s: %w", t.Format(time.RFC3339), ErrTimeOutOfRange)
+	}
+	return t.UnixNano(), nil
+}
+
+// checkTimeRange checks that the times of a capsule can be stored as
+// nanoseconds. A zero expiresAt means the capsule never expires.
+func checkTimeRange(unlockTime, createdAt, expiresAt time.Time) error {
+	times := []time.Time{unlockTime, createdAt}
+	if !expiresAt.IsZero() {
+		times = append(times, expiresAt)
+	}
+	for _, t := range times {
+		if _, err := unixNano(t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// clampNano returns t as nanoseconds since the Unix epoch, clamped to the
+// representable range. Stored times are always within it, so comparisons
+// against the clamped value are exact.
+func clampNano(t time.Time) int64 {
+	switch {
+	case t.Before(minNanoTime):
+		return math.MinInt64
+	case t.After(maxNanoTime):
+		return math.MaxInt64
+	}
+	return t.UnixNano()
+}
+
+// sqlTime stores an optional time, mapping the zero time to 0
+func sqlTime(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+// fromSQLTime is the inverse of sqlTime
+func fromSQLTime(nanos int64) time.Time {
+	if nanos == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, nanos)
+}
+
+// notFound maps sql.ErrNoRows to ErrCapsuleNotFound
+func (s *SQLStorage) notFound(err error) error {
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrCapsuleNotFound
+	}
+	return err
+}
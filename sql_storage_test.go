@@ -0,0 +1,544 @@
+package timecapsule
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeSQLDB is an in-memory driver.Connector that understands the small SQL
+// subset SQLStorage emits, for every dialect. With changedRows set, UPDATE
+// reports only the rows it changed, as MySQL does by default.
+type fakeSQLDB struct {
+	mu          sync.Mutex
+	rows        map[string]map[string]driver.Value
+	statements  []string
+	changedRows bool
+}
+
+func newFakeSQLDB() *fakeSQLDB {
+	return &fakeSQLDB{rows: make(map[string]map[string]driver.Value)}
+}
+
+func (db *fakeSQLDB) Connect(context.Context) (driver.Conn, error) { return &fakeSQLConn{db: db}, nil }
+func (db *fakeSQLDB) Driver() driver.Driver                        { return fakeSQLDriver{db: db} }
+
+type fakeSQLDriver struct{ db *fakeSQLDB }
+
+func (d fakeSQLDriver) Open(string) (driver.Conn, error) { return &fakeSQLConn{db: d.db}, nil }
+
+type fakeSQLConn struct{ db *fakeSQLDB }
+
+func (c *fakeSQLConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeSQLStmt{db: c.db, query: query}, nil
+}
+func (c *fakeSQLConn) Close() error              { return nil }
+func (c *fakeSQLConn) Begin() (driver.Tx, error) { return fakeSQLTx{}, nil }
+
+type fakeSQLTx struct{}
+
+func (fakeSQLTx) Commit() error   { return nil }
+func (fakeSQLTx) Rollback() error { return nil }
+
+var (
+	fakeInsert = regexp.MustCompile(`^INSERT INTO \w+ \(([^)]*)\) VALUES`)
+	fakeSelect = regexp.MustCompile(`^SELECT (.+) FROM \w+ WHERE capsule_key = (\?|\$1)$`)
+	fakeDelete = regexp.MustCompile(`^DELETE FROM \w+ WHERE (.+)$`)
+	fakeUpdate = regexp.MustCompile(`^UPDATE \w+ SET (.+?) WHERE (.+)$`)
+	fakeList   = regexp.MustCompile(`^SELECT (capsule_key, .+) FROM \w+(?: WHERE (.+))? ORDER BY unlock_time, capsule_key LIMIT (\d+)$`)
+	fakeCond   = regexp.MustCompile(`^(?:SUBSTR\(capsule_key, 1, (\d+)\)|(unlock_time|capsule_key|expires_at|value|attributes)) (>=|<=|>|<|=) (\?|\$\d+|\d+)$`)
+)
+
+type fakeSQLStmt struct {
+	db    *fakeSQLDB
+	query string
+}
+
+func (s *fakeSQLStmt) Close() error  { return nil }
+func (s *fakeSQLStmt) NumInput() int { return -1 }
+
+func (s *fakeSQLStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	s.db.statements = append(s.db.statements, s.query)
+
+	switch {
+	case strings.HasPrefix(s.query, "CREATE "):
+		return driver.RowsAffected(0), nil
+	case fakeInsert.MatchString(s.query):
+		columns := strings.Split(fakeInsert.FindStringSubmatch(s.query)[1], ", ")
+		row := make(map[string]driver.Value, len(columns))
+		for i, column := range columns {
+			row[column] = args[i]
+		}
+		s.db.rows[args[0].(string)] = row
+		return driver.RowsAffected(1), nil
+	case fakeUpdate.MatchString(s.query):
+		match := fakeUpdate.FindStringSubmatch(s.query)
+		assignments := strings.Split(match[1], ", ")
+		var affected int64
+		for _, row := range s.db.rows {
+			ok, err := fakeEval(match[2], row, args[len(assignments):])
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				continue
+			}
+			changed := false
+			for i, assignment := range assignments {
+				column := strings.SplitN(assignment, " = ", 2)[0]
+				changed = changed || fakeCompare(row[column], args[i]) != 0
+				row[column] = args[i]
+			}
+			if changed || !s.db.changedRows {
+				affected++
+			}
+		}
+		return driver.RowsAffected(affected), nil
+	case fakeDelete.MatchString(s.query):
+		var affected int64
+		for key, row := range s.db.rows {
+			ok, err := fakeEval(fakeDelete.FindStringSubmatch(s.query)[1], row, args)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				delete(s.db.rows, key)
+				affected++
+			}
+		}
+		return driver.RowsAffected(affected), nil
+	}
+	return nil, fmt.Errorf("fake sql: unsupported exec %q", s.query)
+}
+
+func (s *fakeSQLStmt) Query(args []driver.Value) (driver.Rows, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	s.db.statements = append(s.db.statements, s.query)
+
+	if match := fakeList.FindStringSubmatch(s.query); match != nil {
+		return s.db.list(match, args)
+	}
+
+	match := fakeSelect.FindStringSubmatch(s.query)
+	if match == nil {
+		return nil, fmt.Errorf("fake sql: unsupported query %q", s.query)
+	}
+
+	columns := strings.Split(match[1], ", ")
+	rows := &fakeSQLRows{columns: columns}
+	if row, ok := s.db.rows[args[0].(string)]; ok {
+		values := make([]driver.Value, len(columns))
+		for i, column := range columns {
+			if column == "1" {
+				values[i] = int64(1)
+			} else {
+				values[i] = row[column]
+			}
+		}
+		rows.values = append(rows.values, values)
+	}
+	return rows, nil
+}
+
+// list evaluates a List query; the caller must hold db.mu
+func (db *fakeSQLDB) list(match []string, args []driver.Value) (driver.Rows, error) {
+	columns := strings.Split(match[1], ", ")
+	limit, _ := strconv.Atoi(match[3])
+
+	var matched []map[string]driver.Value
+	for _, row := range db.rows {
+		ok, err := fakeEval(match[2], row, args)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			matched = append(matched, row)
+		}
+	}
+
+	sort.Slice(matched, func(i, j int) bool {
+		a, b := matched[i]["unlock_time"].(int64), matched[j]["unlock_time"].(int64)
+		if a != b {
+			return a < b
+		}
+		return matched[i]["capsule_key"].(string) < matched[j]["capsule_key"].(string)
+	})
+
+	rows := &fakeSQLRows{columns: columns}
+	for i, row := range matched {
+		if i == limit {
+			break
+		}
+		values := make([]driver.Value, len(columns))
+		for j, column := range columns {
+			values[j] = row[column]
+		}
+		rows.values = append(rows.values, values)
+	}
+	return rows, nil
+}
+
+// fakeEval evaluates the WHERE clauses SQLStorage emits, consuming bind
+// arguments left to right
+func fakeEval(where string, row map[string]driver.Value, args []driver.Value) (bool, error) {
+	if where == "" {
+		return true, nil
+	}
+
+	result, _, err := fakeEvalExpr(where, row, args)
+	return result, err
+}
+
+// fakeEvalExpr evaluates a conjunction or disjunction of conditions, returning
+// the bind arguments left over. Every operand is evaluated so that arguments
+// are consumed even when the result is already decided.
+func fakeEvalExpr(expr string, row map[string]driver.Value, args []driver.Value) (bool, []driver.Value, error) {
+	if strings.HasPrefix(expr, "(") && fakeClosingParen(expr) == len(expr)-1 {
+		expr = expr[1 : len(expr)-1]
+	}
+
+	for _, op := range []string{" OR ", " AND "} {
+		operands := fakeSplit(expr, op)
+		if len(operands) == 1 {
+			continue
+		}
+
+		result := op == " AND "
+		for _, operand := range operands {
+			ok, rest, err := fakeEvalExpr(operand, row, args)
+			if err != nil {
+				return false, nil, err
+			}
+			args = rest
+			if op == " AND " {
+				result = result && ok
+			} else {
+				result = result || ok
+			}
+		}
+		return result, args, nil
+	}
+
+	match := fakeCond.FindStringSubmatch(expr)
+	if match == nil {
+		return false, nil, fmt.Errorf("fake sql: unsupported condition %q", expr)
+	}
+
+	var arg driver.Value
+	if n, err := strconv.ParseInt(match[4], 10, 64); err == nil {
+		arg = n
+	} else {
+		arg, args = args[0], args[1:]
+	}
+
+	if match[1] != "" {
+		n, _ := strconv.Atoi(match[1])
+		key := []rune(row["capsule_key"].(string))
+		return len(key) >= n && string(key[:n]) == arg.(string), args, nil
+	}
+
+	c := fakeCompare(row[match[2]], arg)
+	switch match[3] {
+	case ">=":
+		return c >= 0, args, nil
+	case "<=":
+		return c <= 0, args, nil
+	case ">":
+		return c > 0, args, nil
+	case "<":
+		return c < 0, args, nil
+	}
+	return c == 0, args, nil
+}
+
+// fakeCompare compares a column value with a bind argument of the same type
+func fakeCompare(value, arg driver.Value) int {
+	switch v := value.(type) {
+	case int64:
+		return cmp.Compare(v, arg.(int64))
+	case string:
+		return cmp.Compare(v, arg.(string))
+	case []byte:
+		return bytes.Compare(v, arg.([]byte))
+	}
+	return 0
+}
+
+// fakeClosingParen returns the index of the parenthesis closing expr[0]
+func fakeClosingParen(expr string) int {
+	depth := 0
+	for i := 0; i < len(expr); i++ {
+		switch expr[i] {
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// fakeSplit splits expr on op outside parentheses
+func fakeSplit(expr, op string) []string {
+	var operands []string
+	depth, start := 0, 0
+	for i := 0; i < len(expr); i++ {
+		switch {
+		case expr[i] == '(':
+			depth++
+		case expr[i] == ')':
+			depth--
+		case depth == 0 && strings.HasPrefix(expr[i:], op):
+			operands = append(operands, expr[start:i])
+			start = i + len(op)
+		}
+	}
+	return append(operands, expr[start:])
+}
+
+type fakeSQLRows struct {
+	columns []string
+	values  [][]driver.Value
+}
+
+func (r *fakeSQLRows) Columns() []string { return r.columns }
+func (r *fakeSQLRows) Close() error      { return nil }
+
+func (r *fakeSQLRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.values[0])
+	r.values = r.values[1:]
+	return nil
+}
+
+func newFakeSQLStorage(t *testing.T, dialect Dialect) (*SQLStorage, *fakeSQLDB) {
+	t.Helper()
+
+	fake := newFakeSQLDB()
+	fake.changedRows = dialect == DialectMySQL
+	db := sql.OpenDB(fake)
+	t.Cleanup(func() { _ = db.Close() })
+
+	storage, err := NewSQLStorage(db, dialect, "")
+	require.NoError(t, err)
+	require.NoError(t, storage.CreateSchema(context.Background()))
+
+	return storage, fake
+}
+
+func TestSQLStorageDialects(t *testing.T) {
+	for _, dialect := range []Dialect{DialectPostgres, DialectMySQL, DialectSQLite} {
+		t.Run(dialect.Name(), func(t *testing.T) {
+			storage, _ := newFakeSQLStorage(t, dialect)
+			ctx := context.Background()
+
+			// Locked capsule
+			unlockTime := time.Now().Add(time.Hour)
+			require.NoError(t, storage.Store(ctx, "locked", []byte("later"), unlockTime))
+
+			_, err := storage.Open(ctx, "locked")
+			assert.ErrorIs(t, err, ErrCapsuleLocked)
+
+			metadata, err := storage.Peek(ctx, "locked")
+			require.NoError(t, err)
+			assert.True(t, metadata.IsLocked)
+			assert.True(t, metadata.UnlockTime.Equal(unlockTime))
+
+			// Upsert replaces an existing capsule
+			require.NoError(t, storage.Store(ctx, "locked", []byte("now"), time.Now().Add(-time.Second)))
+
+			value, err := storage.Open(ctx, "locked")
+			require.NoError(t, err)
+			assert.Equal(t, []byte("now"), value)
+
+			// Unlock time can be moved without touching the value
+			require.NoError(t, storage.SetUnlockTime(ctx, "locked", unlockTime))
+			_, err = storage.Open(ctx, "locked")
+			assert.ErrorIs(t, err, ErrCapsuleLocked)
+			assert.ErrorIs(t, storage.SetUnlockTime(ctx, "missing", unlockTime), ErrCapsuleNotFound)
+
+			// Updates that change nothing succeed, although MySQL reports no
+			// rows affected for them
+			require.NoError(t, storage.SetUnlockTime(ctx, "locked", unlockTime))
+			require.NoError(t, storage.Rewrite(ctx, "locked", func(value []byte) ([]byte, error) {
+				return bytes.Clone(value), nil
+			}))
+			require.NoError(t, storage.UpdateAttributes(ctx, "locked", func(attributes map[string]string) (map[string]string, error) {
+				return map[string]string{}, nil
+			}))
+
+			// Exists and Delete
+			assert.True(t, storage.Exists(ctx, "locked"))
+			require.NoError(t, storage.Delete(ctx, "locked"))
+			assert.False(t, storage.Exists(ctx, "locked"))
+			assert.ErrorIs(t, storage.Delete(ctx, "locked"), ErrCapsuleNotFound)
+
+			_, err = storage.Peek(ctx, "locked")
+			assert.ErrorIs(t, err, ErrCapsuleNotFound)
+		})
+	}
+}
+
+func TestSQLStorageStatements(t *testing.T) {
+	tests := []struct {
+		dialect Dialect
+		upsert  string
+		lookup  string
+	}{
+		{DialectPostgres, "ON CONFLICT (capsule_key) DO UPDATE SET value = EXCLUDED.value", "WHERE capsule_key = $1"},
+		{DialectMySQL, "ON DUPLICATE KEY UPDATE value = VALUES(value)", "WHERE capsule_key = ?"},
+		{DialectSQLite, "ON CONFLICT (capsule_key) DO UPDATE SET value = excluded.value", "WHERE capsule_key = ?"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.dialect.Name(), func(t *testing.T) {
+			storage, fake := newFakeSQLStorage(t, tt.dialect)
+			ctx := context.Background()
+
+			require.NoError(t, storage.Store(ctx, "key", []byte("v"), time.Now()))
+			_, err := storage.Peek(ctx, "key")
+			require.NoError(t, err)
+
+			joined := strings.Join(fake.statements, "\n")
+			assert.Contains(t, joined, "unlock_time_idx")
+			assert.Contains(t, joined, tt.upsert)
+			assert.Contains(t, joined, tt.lookup)
+			if tt.dialect == DialectMySQL {
+				assert.Contains(t, joined, "COLLATE utf8mb4_bin")
+			}
+		})
+	}
+}
+
+func TestSQLStorageList(t *testing.T) {
+	for _, dialect := range []Dialect{DialectPostgres, DialectMySQL, DialectSQLite} {
+		t.Run(dialect.Name(), func(t *testing.T) {
+			storage, _ := newFakeSQLStorage(t, dialect)
+			testStorageList(t, storage)
+		})
+	}
+}
+
+func TestSQLStorageExpiry(t *testing.T) {
+	for _, dialect := range []Dialect{DialectPostgres, DialectMySQL, DialectSQLite} {
+		t.Run(dialect.Name(), func(t *testing.T) {
+			storage, _ := newFakeSQLStorage(t, dialect)
+			testStorageExpiry(t, storage)
+		})
+	}
+}
+
+func TestSQLStorageAttributes(t *testing.T) {
+	for _, dialect := range []Dialect{DialectPostgres, DialectMySQL, DialectSQLite} {
+		t.Run(dialect.Name(), func(t *testing.T) {
+			storage, _ := newFakeSQLStorage(t, dialect)
+			testStorageAttributes(t, storage)
+		})
+	}
+}
+
+func TestSQLStorageApprovals(t *testing.T) {
+	for _, dialect := range []Dialect{DialectPostgres, DialectMySQL, DialectSQLite} {
+		t.Run(dialect.Name(), func(t *testing.T) {
+			storage, _ := newFakeSQLStorage(t, dialect)
+			testStorageApprovals(t, storage)
+		})
+	}
+}
+
+func TestSQLStorageIntegrity(t *testing.T) {
+	for _, dialect := range []Dialect{DialectPostgres, DialectMySQL, DialectSQLite} {
+		t.Run(dialect.Name(), func(t *testing.T) {
+			storage, _ := newFakeSQLStorage(t, dialect)
+			testStorageIntegrity(t, storage)
+		})
+	}
+}
+
+func TestSQLStorageEncryption(t *testing.T) {
+	for _, dialect := range []Dialect{DialectPostgres, DialectMySQL, DialectSQLite} {
+		t.Run(dialect.Name(), func(t *testing.T) {
+			storage, _ := newFakeSQLStorage(t, dialect)
+			testStorageEncryption(t, storage)
+		})
+	}
+}
+
+func TestSQLStorageInvalidTable(t *testing.T) {
+	db := sql.OpenDB(newFakeSQLDB())
+	defer db.Close()
+
+	_, err := NewSQLStorage(db, DialectSQLite, "capsules; DROP TABLE users")
+	assert.Error(t, err)
+
+	_, err = NewSQLStorage(db, nil, "")
+	assert.Error(t, err)
+}
+
+func TestSQLStorageWithPersistentTimeCapsule(t *testing.T) {
+	storage, _ := newFakeSQLStorage(t, DialectPostgres)
+	capsule := NewWithStorage(storage, NewJSONCodec[int]())
+	ctx := context.Background()
+
+	require.NoError(t, capsule.Store(ctx, "count", 42, time.Now().Add(-time.Second)))
+
+	value, err := capsule.Open(ctx, "count")
+	require.NoError(t, err)
+	assert.Equal(t, 42, value)
+
+	_, err = capsule.Open(ctx, "missing")
+	assert.True(t, errors.Is(err, ErrCapsuleNotFound))
+}
+
+func TestSQLStorageTimeRange(t *testing.T) {
+	storage, _ := newFakeSQLStorage(t, DialectSQLite)
+	ctx := context.Background()
+
+	// Times beyond UnixNano's range are rejected rather than wrapped
+	farFuture := time.Date(2300, 1, 1, 0, 0, 0, 0, time.UTC)
+	assert.ErrorIs(t, storage.Store(ctx, "zero", []byte("v"), time.Time{}), ErrTimeOutOfRange)
+	assert.ErrorIs(t, storage.Store(ctx, "future", []byte("v"), farFuture), ErrTimeOutOfRange)
+	assert.ErrorIs(t, storage.StoreWithOptions(ctx, "expiry", []byte("v"), time.Now(), WithExpiry(farFuture)), ErrTimeOutOfRange)
+	assert.ErrorIs(t, storage.StoreWithOptions(ctx, "created", []byte("v"), time.Now(), WithCreatedAt(time.Date(1600, 1, 1, 0, 0, 0, 0, time.UTC))), ErrTimeOutOfRange)
+	assert.False(t, storage.Exists(ctx, "zero"))
+
+	unlockTime := time.Now().Add(time.Hour)
+	require.NoError(t, storage.Store(ctx, "k", []byte("v"), unlockTime))
+	assert.ErrorIs(t, storage.SetUnlockTime(ctx, "k", farFuture), ErrTimeOutOfRange)
+
+	metadata, err := storage.Peek(ctx, "k")
+	require.NoError(t, err)
+	assert.True(t, metadata.UnlockTime.Equal(unlockTime))
+
+	// List bounds outside the range are clamped
+	page, err := storage.List(ctx, ListOptions{
+		UnlockAfter:  time.Date(1000, 1, 1, 0, 0, 0, 0, time.UTC),
+		UnlockBefore: time.Date(3000, 1, 1, 0, 0, 0, 0, time.UTC),
+	})
+	require.NoError(t, err)
+	require.Len(t, page.Items, 1)
+	assert.Equal(t, "k", page.Items[0].Key)
+}
@@ -1,16 +1,28 @@
 package timecapsule
 
 import (
+	"bytes"
 	"context"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"iter"
+	"maps"
 	"time"
 )
 
-// Storage defines the interface for persistent storage backends
+// Storage defines the interface for persistent storage backends. Backends
+// can implement the optional interfaces below to support store options,
+// atomic updates, listing and purging; capsules fall back to the methods
+// here when they do not. Records that are not capsules, such as a
+// dispatcher's watermarks, belong in a Storage of their own, since List
+// reports every record in a Storage as a capsule.
 type Storage interface {
 	// Store stores a value with its unlock time
 	Store(ctx context.Context, key string, value []byte, unlockTime time.Time) error
 
-	// Open retrieves a value if it's unlocked
+	// Open retrieves a value if it's unlocked, returning ErrCapsuleLocked
+	// before the unlock time and ErrCapsuleExpired after the expiry
 	Open(ctx context.Context, key string) ([]byte, error)
 
 	// Peek returns metadata about a capsule without opening it
@@ -26,10 +38,177 @@ type Storage interface {
 	Close() error
 }
 
+// OptionStorage is implemented by storages that persist StoreOption values.
+// Without it, Store fails with errors.ErrUnsupported for options that set an
+// expiry, attributes or a creation time.
+type OptionStorage interface {
+	// StoreWithOptions stores a value with its unlock time. Implementations
+	// resolve opts with ApplyStoreOptions and persist the resulting creation
+	// time, expiry and attributes.
+	StoreWithOptions(ctx context.Context, key string, value []byte, unlockTime time.Time, opts ...StoreOption) error
+}
+
+// UnlockTimeStorage is implemented by storages that can change an unlock
+// time in place. Without it, Delay fails with errors.ErrUnsupported.
+type UnlockTimeStorage interface {
+	// SetUnlockTime atomically replaces the unlock time of an existing capsule
+	// without reading its value, returning ErrCapsuleNotFound if it is missing
+	// and ErrInvalidWindow if the new time is not before the capsule's expiry
+	SetUnlockTime(ctx context.Context, key string, unlockTime time.Time) error
+}
+
+// RewriteStorage is implemented by storages that can replace a value in
+// place. Without it, values are re-stored, which only works for unlocked
+// capsules.
+type RewriteStorage interface {
+	// Rewrite atomically replaces the value of an existing capsule with the
+	// result of rewrite, keeping its unlock time, creation time and expiry.
+	// The value is read regardless of the unlock time, so Rewrite is meant
+	// for maintenance such as re-encryption. Returning a nil value leaves the
+	// capsule unchanged.
+	Rewrite(ctx context.Context, key string, rewrite func(value []byte) ([]byte, error)) error
+}
+
+// AttributeStorage is implemented by storages that can change attributes in
+// place. Without it, attribute updates fail with errors.ErrUnsupported.
+type AttributeStorage interface {
+	// UpdateAttributes atomically replaces the attributes of an existing
+	// capsule with the result of update, keeping its value and times.
+	// Returning a nil map leaves the capsule unchanged.
+	UpdateAttributes(ctx context.Context, key string, update func(attributes map[string]string) (map[string]string, error)) error
+}
+
+// ListStorage is implemented by storages that can enumerate capsules.
+// Without it, List fails with errors.ErrUnsupported.
+type ListStorage interface {
+	// List returns one page of capsules matching opts, in ascending
+	// unlock-time order
+	List(ctx context.Context, opts ListOptions) (ListPage, error)
+}
+
+// PurgeStorage is implemented by storages that keep expiring capsules.
+// Without it, Purge removes nothing.
+type PurgeStorage interface {
+	// Purge removes every expired capsule and returns how many were removed
+	Purge(ctx context.Context) (int, error)
+}
+
+// storeWith stores a value with opts, which a storage without OptionStorage
+// accepts only if they leave nothing to persist
+func storeWith(ctx context.Context, storage Storage, key string, value []byte, unlockTime time.Time, opts ...StoreOption) error {
+	if s, ok := storage.(OptionStorage); ok {
+		return s.StoreWithOptions(ctx, key, value, unlockTime, opts...)
+	}
+
+	o, err := ApplyStoreOptions(unlockTime, opts...)
+	if err != nil {
+		return err
+	}
+
+	if !o.ExpiresAt.IsZero() || len(o.Attributes) > 0 || !o.CreatedAt.IsZero() {
+		return fmt.Errorf("timecapsule: storage does not persist store options: %w", errors.ErrUnsupported)
+	}
+
+	return storage.Store(ctx, key, value, unlockTime)
+}
+
+// errUnlockTimeUnsupported is returned for storages without UnlockTimeStorage
+var errUnlockTimeUnsupported = fmt.Errorf("timecapsule: storage cannot change unlock times: %w", errors.ErrUnsupported)
+
+// setUnlockTime changes the unlock time of a capsule in place, which a
+// storage without UnlockTimeStorage cannot do
+func setUnlockTime(ctx context.Context, storage Storage, key string, unlockTime time.Time) error {
+	if s, ok := storage.(UnlockTimeStorage); ok {
+		return s.SetUnlockTime(ctx, key, unlockTime)
+	}
+
+	return errUnlockTimeUnsupported
+}
+
+// rewriteValue replaces the value of a capsule, re-storing it under its
+// unlock time if the storage cannot replace it in place
+func rewriteValue(ctx context.Context, storage Storage, key string, rewrite func(value []byte) ([]byte, error)) error {
+	if s, ok := storage.(RewriteStorage); ok {
+		return s.Rewrite(ctx, key, rewrite)
+	}
+
+	metadata, err := storage.Peek(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	value, err := storage.Open(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	value, err = rewrite(value)
+	if err != nil || value == nil {
+		return err
+	}
+
+	return storage.Store(ctx, key, value, metadata.UnlockTime)
+}
+
+// updateAttributes changes the attributes of a capsule. A storage that
+// cannot change them in place only accepts updates that change nothing.
+func updateAttributes(ctx context.Context, storage Storage, key string, update func(attributes map[string]string) (map[string]string, error)) error {
+	if s, ok := storage.(AttributeStorage); ok {
+		return s.UpdateAttributes(ctx, key, update)
+	}
+
+	metadata, err := storage.Peek(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	updated, err := update(maps.Clone(metadata.Attributes))
+	if err != nil || updated == nil {
+		return err
+	}
+
+	return fmt.Errorf("timecapsule: storage does not update attributes: %w", errors.ErrUnsupported)
+}
+
+// listStorage returns one page of capsules from a storage implementing
+// ListStorage
+func listStorage(ctx context.Context, storage Storage, opts ListOptions) (ListPage, error) {
+	if s, ok := storage.(ListStorage); ok {
+		return s.List(ctx, opts)
+	}
+
+	return ListPage{}, fmt.Errorf("timecapsule: storage does not list capsules: %w", errors.ErrUnsupported)
+}
+
+// purgeStorage purges a storage implementing PurgeStorage; other storages
+// keep no expiring capsules
+func purgeStorage(ctx context.Context, storage Storage) (int, error) {
+	if s, ok := storage.(PurgeStorage); ok {
+		return s.Purge(ctx)
+	}
+
+	return 0, nil
+}
+
 // PersistentTimeCapsule implements TimeCapsule using a persistent storage backend
 type PersistentTimeCapsule[T any] struct {
 	storage Storage
 	codec   Codec[T]
+	clock   Clock
+	purger  *purger
+	events  *eventHub
+	keys    KeyManager
+	lock    *TimeLock
+	beacon  Beacon
+
+	breakGlass BreakGlassAuthorizer
+	auditor    Auditor
+	receiptKey ed25519.PrivateKey
+	log        *TransparencyLog
+	tsa        TimestampAuthority
+	trusted    *trustedTime
+
+	secretValues bool
 }
 
 // Codec defines how to serialize/deserialize values
@@ -39,15 +218,45 @@ type Codec[T any] interface {
 }
 
 // NewWithStorage creates a new time capsule with persistent storage
-func NewWithStorage[T any](storage Storage, codec Codec[T]) TimeCapsule[T] {
-	return &PersistentTimeCapsule[T]{
+func NewWithStorage[T any](storage Storage, codec Codec[T], opts ...Option) *PersistentTimeCapsule[T] {
+	o := newOptions(opts...)
+	tc := &PersistentTimeCapsule[T]{
 		storage: storage,
 		codec:   codec,
+		clock:   o.clock,
+		keys:    o.keyManager,
+		lock:    o.timeLock,
+		beacon:  o.beacon,
+
+		breakGlass: o.breakGlass,
+		auditor:    o.auditor,
+		receiptKey: o.receiptKey,
+		log:        o.transparency,
+		tsa:        o.timestamps,
+		trusted:    newTrustedTime(o),
+
+		secretValues: o.secretValues,
+	}
+	tc.purger = startPurger(o.clock, o.purgeInterval, tc.Purge)
+
+	// Subscriptions on a storage that cannot list capsules start with none
+	// scheduled
+	list := func(context.Context, ListOptions) (ListPage, error) { return ListPage{}, nil }
+	if s, ok := storage.(ListStorage); ok {
+		list = s.List
 	}
+	tc.events = newEventHub(o.clock, tc.storage.Peek, list)
+	return tc
 }
 
 // Store stores a value in a time capsule that will be unlocked at the specified time
 func (tc *PersistentTimeCapsule[T]) Store(ctx context.Context, key string, value T, unlockTime time.Time) error {
+	return tc.StoreWithOptions(ctx, key, value, unlockTime)
+}
+
+// StoreWithOptions stores a value that will be unlocked at the specified
+// time, with an expiry, attributes and the other settings of opts
+func (tc *PersistentTimeCapsule[T]) StoreWithOptions(ctx context.Context, key string, value T, unlockTime time.Time, opts ...StoreOption) error {
 	if err := ctx.Err(); err != nil {
 		return err
 	}
@@ -56,12 +265,103 @@ func (tc *PersistentTimeCapsule[T]) Store(ctx context.Context, key string, value
 		return ErrInvalidKey
 	}
 
+	return tc.store(ctx, key, value, unlockTime, nil, opts...)
+}
+
+// store encodes value, encrypts it under secret if the capsule is stored
+// with shares, applies the configured encryption layers and stores it
+func (tc *PersistentTimeCapsule[T]) store(ctx context.Context, key string, value T, unlockTime time.Time, secret []byte, opts ...StoreOption) error {
+	o, err := ApplyStoreOptions(unlockTime, opts...)
+	if err != nil {
+		return err
+	}
+
 	data, err := tc.codec.Encode(value)
 	if err != nil {
 		return err
 	}
+	defer tc.wipe(data)
+
+	var commitment []byte
+	if o.commit || tc.log != nil || tc.tsa != nil {
+		salt, attributes, err := newCommitment(key, value)
+		if err != nil {
+			return err
+		}
+		data = sealCommitment(salt, data)
+		defer tc.wipe(data)
+		commitment = Metadata{Attributes: attributes}.Commitment()
+		opts = append(opts, WithAttributes(attributes))
+	}
+
+	// The transparency log and timestamp record the creation time the
+	// storage keeps
+	createdAt := o.createdAt(tc.clock.Now())
+	if tc.log != nil || tc.tsa != nil {
+		opts = append(opts, WithCreatedAt(createdAt))
+	}
+
+	if tc.tsa != nil {
+		attributes, err := timestampCapsule(ctx, tc.tsa, key, createdAt, commitment)
+		if err != nil {
+			return err
+		}
+		opts = append(opts, WithAttributes(attributes))
+	}
 
-	return tc.storage.Store(ctx, key, data, unlockTime)
+	if secret != nil {
+		if data, err = sealShared(secret, key, data); err != nil {
+			return err
+		}
+	}
+
+	if tc.keys != nil {
+		if data, err = sealEnvelope(ctx, tc.keys, key, data); err != nil {
+			return err
+		}
+	}
+
+	if tc.beacon != nil {
+		if data, err = sealBeacon(ctx, tc.beacon, key, data, unlockTime); err != nil {
+			return err
+		}
+	}
+
+	// The puzzle is the outer layer so WaitForUnlock can start solving it
+	// without unwrapping the data key early
+	if tc.lock != nil {
+		if data, err = tc.lock.seal(key, unlockTime.Sub(tc.clock.Now()), data); err != nil {
+			return err
+		}
+	}
+
+	if err := storeWith(ctx, tc.storage, key, data, unlockTime, opts...); err != nil {
+		return err
+	}
+
+	// A capsule that cannot be logged or audited is removed again, so no
+	// capsule stays stored without its records. A leaf appended before the
+	// audit failed stays in the append-only log.
+	if err := tc.logStore(ctx, key, createdAt, unlockTime, commitment); err != nil {
+		if deleteErr := tc.storage.Delete(ctx, key); deleteErr != nil {
+			return errors.Join(err, fmt.Errorf("timecapsule: remove unrecorded capsule: %w", deleteErr))
+		}
+		return err
+	}
+
+	tc.record(ctx, EventStored, key)
+	return nil
+}
+
+// logStore appends a stored capsule to the transparency log and audits it
+func (tc *PersistentTimeCapsule[T]) logStore(ctx context.Context, key string, createdAt, unlockTime time.Time, commitment []byte) error {
+	if tc.log != nil {
+		if _, err := tc.log.Append(ctx, key, createdAt, unlockTime, commitment); err != nil {
+			return err
+		}
+	}
+
+	return audit(ctx, tc.auditor, AuditRecord{Time: tc.clock.Now(), Operation: AuditStore, Key: key, UnlockTime: unlockTime})
 }
 
 // Open retrieves a value from a time capsule if it's unlocked
@@ -76,15 +376,368 @@ func (tc *PersistentTimeCapsule[T]) Open(ctx context.Context, key string) (T, er
 		return zero, ErrInvalidKey
 	}
 
+	return tc.open(ctx, key, nil, nil, nil)
+}
+
+// Reveal opens an unlocked capsule stored with WithCommitment and returns
+// its value with the salt of its commitment, verified against the
+// commitment in its metadata
+func (tc *PersistentTimeCapsule[T]) Reveal(ctx context.Context, key string) (Reveal[T], error) {
+	if err := ctx.Err(); err != nil {
+		return Reveal[T]{}, err
+	}
+
+	if key == "" {
+		return Reveal[T]{}, ErrInvalidKey
+	}
+
+	metadata, err := tc.storage.Peek(ctx, key)
+	if err != nil {
+		return Reveal[T]{}, err
+	}
+
+	if metadata.Commitment() == nil {
+		return Reveal[T]{}, ErrNotCommitted
+	}
+
+	if err := tc.trusted.checkWindow(ctx, metadata.UnlockTime, metadata.ExpiresAt, metadata.Attributes); err != nil {
+		return Reveal[T]{}, err
+	}
+
 	data, err := tc.storage.Open(ctx, key)
 	if err != nil {
+		return Reveal[T]{}, err
+	}
+
+	defer tc.wipe(data)
+
+	if data, err = tc.unwrap(ctx, key, data, nil, nil, nil); err != nil {
+		return Reveal[T]{}, err
+	}
+	defer tc.wipe(data)
+
+	salt, data, err := openCommitment(data)
+	if err != nil {
+		return Reveal[T]{}, err
+	}
+
+	value, err := tc.codec.Decode(data)
+	if err != nil {
+		return Reveal[T]{}, err
+	}
+
+	reveal, err := revealed(key, value, salt, metadata.Attributes)
+	if err != nil {
+		return Reveal[T]{}, err
+	}
+
+	if err := audit(ctx, tc.auditor, AuditRecord{Time: tc.clock.Now(), Operation: AuditOpen, Key: key}); err != nil {
+		return Reveal[T]{}, err
+	}
+	return reveal, nil
+}
+
+// StoreWithReceipt stores a value like Store and returns a Receipt signed
+// with the key set by WithReceiptKey, or ErrReceiptsDisabled without one
+func (tc *PersistentTimeCapsule[T]) StoreWithReceipt(ctx context.Context, key string, value T, unlockTime time.Time, opts ...StoreOption) (Receipt, error) {
+	if err := ctx.Err(); err != nil {
+		return Receipt{}, err
+	}
+
+	if key == "" {
+		return Receipt{}, ErrInvalidKey
+	}
+
+	createdAt, err := prepareReceipt(tc.receiptKey, tc.clock, unlockTime, opts)
+	if err != nil {
+		return Receipt{}, err
+	}
+
+	receipt, err := signReceipt(tc.receiptKey, key, value, createdAt, unlockTime)
+	if err != nil {
+		return Receipt{}, err
+	}
+
+	if err := tc.store(ctx, key, value, unlockTime, nil, append(opts, WithCreatedAt(createdAt))...); err != nil {
+		return Receipt{}, err
+	}
+
+	return receipt, nil
+}
+
+// StoreWithShares stores a value encrypted under a fresh key that is split
+// into shares, threshold of which OpenWithShares needs to open the capsule
+// once it is unlocked. The key itself is never stored.
+func (tc *PersistentTimeCapsule[T]) StoreWithShares(ctx context.Context, key string, value T, unlockTime time.Time, threshold, shares int, opts ...StoreOption) ([]Share, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if key == "" {
+		return nil, ErrInvalidKey
+	}
+
+	secret, split, attributes, err := splitCapsuleKey(key, threshold, shares)
+	if err != nil {
+		return nil, err
+	}
+	defer clear(secret)
+
+	if err := tc.store(ctx, key, value, unlockTime, secret, append(opts, WithAttributes(attributes))...); err != nil {
+		return nil, err
+	}
+
+	return split, nil
+}
+
+// OpenWithShares opens an unlocked capsule stored with StoreWithShares,
+// returning ErrInsufficientShares unless enough valid shares are given
+func (tc *PersistentTimeCapsule[T]) OpenWithShares(ctx context.Context, key string, shares []Share) (T, error) {
+	if err := ctx.Err(); err != nil {
 		var zero T
 		return zero, err
 	}
 
+	if key == "" {
+		var zero T
+		return zero, ErrInvalidKey
+	}
+
+	metadata, err := tc.storage.Peek(ctx, key)
+	if err != nil {
+		var zero T
+		return zero, err
+	}
+
+	if !requiresShares(metadata.Attributes) {
+		return tc.open(ctx, key, nil, nil, nil)
+	}
+
+	// Shares are only checked once the capsule could be opened at all
+	if err := checkWindow(metadata.UnlockTime, metadata.ExpiresAt, tc.clock.Now(), metadata.Attributes); err != nil {
+		var zero T
+		return zero, err
+	}
+
+	secret, err := combineShares(key, metadata.Attributes, shares)
+	if err != nil {
+		var zero T
+		return zero, err
+	}
+	defer clear(secret)
+
+	return tc.open(ctx, key, nil, nil, secret)
+}
+
+// OpenEarly opens a capsule before its unlock time or approvals once the
+// authorizer set with WithBreakGlass agrees. The opening is audited and
+// recorded in the capsule's metadata before the value is returned. Time-lock
+// puzzles are still solved and beacon rounds still awaited, so capsules
+// encrypted with them cannot be opened much sooner. Reading a locked capsule
+// needs a storage implementing RewriteStorage.
+func (tc *PersistentTimeCapsule[T]) OpenEarly(ctx context.Context, key, reason string) (T, error) {
+	var zero T
+	if err := ctx.Err(); err != nil {
+		return zero, err
+	}
+
+	if key == "" {
+		return zero, ErrInvalidKey
+	}
+
+	metadata, err := tc.storage.Peek(ctx, key)
+	if err != nil {
+		return zero, err
+	}
+
+	if err := checkBreakGlass(tc.breakGlass, tc.auditor, reason, metadata); err != nil {
+		return zero, err
+	}
+
+	actor, err := authorizeBreakGlass(ctx, tc.breakGlass, BreakGlassRequest{Key: key, Reason: reason, Metadata: metadata})
+	if err != nil {
+		return zero, err
+	}
+
+	data, err := tc.read(ctx, key)
+	if err != nil {
+		return zero, err
+	}
+
+	// The authorization only covers the capsule it was given, not one stored
+	// over it since
+	current, err := tc.storage.Peek(ctx, key)
+	if err != nil {
+		tc.wipe(data)
+		return zero, err
+	}
+	if !current.CreatedAt.Equal(metadata.CreatedAt) {
+		tc.wipe(data)
+		return zero, fmt.Errorf("timecapsule: capsule %q replaced during early opening", key)
+	}
+
+	value, err := tc.decode(ctx, key, data, nil, nil, nil)
+	if err != nil {
+		return zero, err
+	}
+
+	// The opening is recorded before it is audited, and the record is
+	// removed again if the audit fails
+	opening := EarlyOpening{Actor: actor, Reason: reason, Time: tc.clock.Now()}
+	var previous map[string]string
+	err = updateAttributes(ctx, tc.storage, key, func(attributes map[string]string) (map[string]string, error) {
+		previous = attributes
+		return recordEarlyOpening(attributes, opening)
+	})
+	if err != nil {
+		return zero, err
+	}
+
+	if err := auditEarlyOpening(ctx, tc.auditor, key, opening); err != nil {
+		rollback := updateAttributes(ctx, tc.storage, key, func(attributes map[string]string) (map[string]string, error) {
+			restored := maps.Clone(attributes)
+			if openings, ok := previous[AttributeEarlyOpenings]; ok {
+				restored[AttributeEarlyOpenings] = openings
+			} else {
+				delete(restored, AttributeEarlyOpenings)
+			}
+			return restored, nil
+		})
+		if rollback != nil {
+			return zero, errors.Join(err, fmt.Errorf("timecapsule: remove unaudited early opening: %w", rollback))
+		}
+		return zero, err
+	}
+
+	return value, nil
+}
+
+// open reads an unlocked capsule, decodes it and audits the opening. The
+// storage enforces the unlock window, so the data key is never unwrapped for
+// a capsule that cannot be opened. With WithTrustedTime the window is first
+// checked against trusted time.
+func (tc *PersistentTimeCapsule[T]) open(ctx context.Context, key string, record, solved, secret []byte) (T, error) {
+	var zero T
+
+	if tc.trusted != nil {
+		metadata, err := tc.storage.Peek(ctx, key)
+		if err != nil {
+			return zero, err
+		}
+
+		if err := tc.trusted.checkWindow(ctx, metadata.UnlockTime, metadata.ExpiresAt, metadata.Attributes); err != nil {
+			return zero, err
+		}
+	}
+
+	data, err := tc.storage.Open(ctx, key)
+	if err != nil {
+		return zero, err
+	}
+
+	value, err := tc.decode(ctx, key, data, record, solved, secret)
+	if err != nil {
+		return zero, err
+	}
+
+	if err := audit(ctx, tc.auditor, AuditRecord{Time: tc.clock.Now(), Operation: AuditOpen, Key: key}); err != nil {
+		return zero, err
+	}
+
+	return value, nil
+}
+
+// read returns the stored value of a capsule regardless of its unlock time.
+// Only a RewriteStorage can read a locked capsule; other storages fail with
+// errors.ErrUnsupported.
+func (tc *PersistentTimeCapsule[T]) read(ctx context.Context, key string) ([]byte, error) {
+	s, ok := tc.storage.(RewriteStorage)
+	if !ok {
+		return nil, fmt.Errorf("timecapsule: read locked capsule: %w", errors.ErrUnsupported)
+	}
+
+	var data []byte
+	err := s.Rewrite(ctx, key, func(value []byte) ([]byte, error) {
+		data = bytes.Clone(value)
+		return nil, nil
+	})
+	return data, err
+}
+
+// decode removes the time-lock, beacon, envelope, share, commitment and
+// codec layers of a stored value. A puzzle already solved from record is not
+// solved again if data is unchanged. In secret-value mode data and the
+// decrypted value are wiped once decoded.
+func (tc *PersistentTimeCapsule[T]) decode(ctx context.Context, key string, data, record, solved, secret []byte) (T, error) {
+	var zero T
+	defer tc.wipe(data)
+
+	data, err := tc.unwrap(ctx, key, data, record, solved, secret)
+	if err != nil {
+		return zero, err
+	}
+	defer tc.wipe(data)
+
+	// Confirm against the metadata, since an encoded value could start with
+	// the same bytes
+	if bytes.HasPrefix(data, commitRecordPrefix) {
+		if metadata, err := tc.storage.Peek(ctx, key); err == nil && metadata.Commitment() != nil {
+			if _, data, err = openCommitment(data); err != nil {
+				return zero, err
+			}
+		}
+	}
+
 	return tc.codec.Decode(data)
 }
 
+// wipe clears buffers holding an encoded value in secret-value mode
+func (tc *PersistentTimeCapsule[T]) wipe(data []byte) {
+	if tc.secretValues {
+		clear(data)
+	}
+}
+
+// unwrap removes the time-lock, beacon, envelope and share layers of a
+// stored value
+func (tc *PersistentTimeCapsule[T]) unwrap(ctx context.Context, key string, data, record, solved, secret []byte) ([]byte, error) {
+	var err error
+
+	if tc.lock != nil {
+		if solved != nil && bytes.Equal(data, record) {
+			data = solved
+		} else if data, err = tc.lock.solve(ctx, key, data); err != nil {
+			return nil, err
+		}
+	}
+
+	if tc.beacon != nil {
+		if data, err = openBeacon(ctx, tc.beacon, key, data); err != nil {
+			return nil, err
+		}
+	}
+
+	if tc.keys != nil {
+		if data, err = openEnvelope(ctx, tc.keys, key, data); err != nil {
+			return nil, err
+		}
+	}
+
+	if secret != nil {
+		if data, err = openShared(secret, key, data); err != nil {
+			return nil, err
+		}
+	} else if bytes.HasPrefix(data, sharedRecordPrefix) {
+		// Confirm against the share policy, since an encoded value could
+		// start with the same bytes
+		if metadata, err := tc.storage.Peek(ctx, key); err == nil && requiresShares(metadata.Attributes) {
+			return nil, ErrSharesRequired
+		}
+	}
+
+	return data, nil
+}
+
 // Peek returns metadata about a capsule without opening it
 func (tc *PersistentTimeCapsule[T]) Peek(ctx context.Context, key string) (Metadata, error) {
 	if err := ctx.Err(); err != nil {
@@ -95,10 +748,22 @@ func (tc *PersistentTimeCapsule[T]) Peek(ctx context.Context, key string) (Metad
 		return Metadata{}, ErrInvalidKey
 	}
 
-	return tc.storage.Peek(ctx, key)
+	metadata, err := tc.storage.Peek(ctx, key)
+	if err != nil {
+		return Metadata{}, err
+	}
+
+	if err := checkTimestamp(tc.tsa, key, metadata); err != nil {
+		return Metadata{}, err
+	}
+
+	return metadata, nil
 }
 
-// Delay delays the unlock time of a capsule
+// Delay delays the unlock time of a capsule. A capsule cannot be delayed to
+// or past its expiry. It fails with errors.ErrUnsupported if the storage does
+// not implement UnlockTimeStorage, or with WithTimeLock, since the puzzle
+// cannot be re-sealed without solving it.
 func (tc *PersistentTimeCapsule[T]) Delay(ctx context.Context, key string, delay time.Duration) error {
 	if err := ctx.Err(); err != nil {
 		return err
@@ -108,23 +773,75 @@ func (tc *PersistentTimeCapsule[T]) Delay(ctx context.Context, key string, delay
 		return ErrInvalidKey
 	}
 
-	// Check if capsule exists
-	_, err := tc.storage.Peek(ctx, key)
+	if tc.lock != nil {
+		return fmt.Errorf("timecapsule: delay time-locked capsule: %w", errors.ErrUnsupported)
+	}
+
+	if _, ok := tc.storage.(UnlockTimeStorage); !ok {
+		return errUnlockTimeUnsupported
+	}
+
+	// The delay is audited before it is applied, so it is checked first
+	metadata, err := tc.storage.Peek(ctx, key)
 	if err != nil {
 		return err
 	}
 
-	// Calculate new unlock time
-	newUnlockTime := time.Now().Add(delay)
+	now := tc.clock.Now()
+	unlockTime := now.Add(delay)
+	if !metadata.ExpiresAt.IsZero() && !unlockTime.Before(metadata.ExpiresAt) {
+		return ErrInvalidWindow
+	}
 
-	// Get the current value
-	data, err := tc.storage.Open(ctx, key)
+	if err := audit(ctx, tc.auditor, AuditRecord{Time: now, Operation: AuditDelay, Key: key, UnlockTime: unlockTime}); err != nil {
+		return err
+	}
+
+	if err := setUnlockTime(ctx, tc.storage, key, unlockTime); err != nil {
+		return err
+	}
+
+	tc.record(ctx, EventDelayed, key)
+	return nil
+}
+
+// Approve records approver's approval of a capsule stored with WithApprovals
+func (tc *PersistentTimeCapsule[T]) Approve(ctx context.Context, key, approver string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if key == "" {
+		return ErrInvalidKey
+	}
+
+	// The approval is audited before it is applied, so it is checked first
+	metadata, err := tc.storage.Peek(ctx, key)
 	if err != nil {
 		return err
 	}
 
-	// Re-store with new unlock time
-	return tc.storage.Store(ctx, key, data, newUnlockTime)
+	now := tc.clock.Now()
+	if updated, err := approve(metadata.Attributes, approver, now); err != nil || updated == nil {
+		return err
+	}
+
+	if err := audit(ctx, tc.auditor, AuditRecord{Time: now, Operation: AuditApprove, Key: key, Actor: approver}); err != nil {
+		return err
+	}
+
+	approved := false
+	err = updateAttributes(ctx, tc.storage, key, func(attributes map[string]string) (map[string]string, error) {
+		updated, err := approve(attributes, approver, now)
+		approved = updated != nil
+		return updated, err
+	})
+	if err != nil || !approved {
+		return err
+	}
+
+	tc.record(ctx, EventApproved, key)
+	return nil
 }
 
 // Delete removes a capsule from storage
@@ -137,7 +854,24 @@ func (tc *PersistentTimeCapsule[T]) Delete(ctx context.Context, key string) erro
 		return ErrInvalidKey
 	}
 
-	return tc.storage.Delete(ctx, key)
+	// The deletion is audited before it is applied, so the capsule is looked
+	// up first; its metadata also goes into the deleted event. A record that
+	// cannot be read can still be deleted.
+	metadata, err := tc.storage.Peek(ctx, key)
+	if errors.Is(err, ErrCapsuleNotFound) {
+		return err
+	}
+
+	if err := audit(ctx, tc.auditor, AuditRecord{Time: tc.clock.Now(), Operation: AuditDelete, Key: key}); err != nil {
+		return err
+	}
+
+	if err := tc.storage.Delete(ctx, key); err != nil {
+		return err
+	}
+
+	tc.events.record(EventDeleted, key, metadata)
+	return nil
 }
 
 // Exists checks if a capsule exists
@@ -167,20 +901,114 @@ func (tc *PersistentTimeCapsule[T]) WaitForUnlock(ctx context.Context, key strin
 		return zero, err
 	}
 
+	if requiresShares(metadata.Attributes) {
+		var zero T
+		return zero, ErrSharesRequired
+	}
+
+	// Beacon-encrypted values can be read once their round is published,
+	// which may be up to one period after the unlock time
+	unlockTime := metadata.UnlockTime
+	if tc.beacon != nil {
+		schedule := tc.beacon.Schedule()
+		unlockTime = schedule.RoundTime(schedule.RoundFor(unlockTime))
+	}
+
 	// If already unlocked, return immediately
-	if !metadata.IsLocked {
+	if !metadata.IsLocked && !unlockTime.After(tc.clock.Now()) {
 		return tc.Open(ctx, key)
 	}
 
+	// Start solving a time-lock puzzle now rather than at the unlock time.
+	// The puzzle is not secret, so reading it while locked reveals nothing.
+	// Without a storage that reads locked capsules it is solved on unlock.
+	var record, solved []byte
+	if tc.lock != nil {
+		record, err = tc.read(ctx, key)
+		if err != nil && !errors.Is(err, errors.ErrUnsupported) {
+			var zero T
+			return zero, err
+		}
+	}
+
+	if record != nil {
+		if solved, err = tc.lock.solve(ctx, key, record); err != nil {
+			var zero T
+			return zero, err
+		}
+	}
+
 	// Wait until unlock time or context cancellation
-	timer := time.NewTimer(time.Until(metadata.UnlockTime))
+	timer := tc.clock.NewTimer(unlockTime.Sub(tc.clock.Now()))
 	defer timer.Stop()
 
 	select {
 	case <-ctx.Done():
 		var zero T
 		return zero, ctx.Err()
-	case <-timer.C:
-		return tc.Open(ctx, key)
+	case <-timer.C():
+		return tc.open(ctx, key, record, solved, nil)
+	}
+}
+
+// List returns one page of capsules matching opts
+func (tc *PersistentTimeCapsule[T]) List(ctx context.Context, opts ListOptions) (ListPage, error) {
+	if err := ctx.Err(); err != nil {
+		return ListPage{}, err
 	}
+
+	return listStorage(ctx, tc.storage, opts)
+}
+
+// All iterates over every capsule matching opts, fetching pages as needed.
+// Iteration ends early if a page cannot be listed.
+func (tc *PersistentTimeCapsule[T]) All(ctx context.Context, opts ListOptions) iter.Seq2[string, Metadata] {
+	return listAll(ctx, opts, tc.List)
+}
+
+// Purge removes every expired capsule from storage
+func (tc *PersistentTimeCapsule[T]) Purge(ctx context.Context) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	purged, err := purgeStorage(ctx, tc.storage)
+	if err != nil || purged == 0 {
+		return purged, err
+	}
+
+	return purged, audit(ctx, tc.auditor, AuditRecord{Time: tc.clock.Now(), Operation: AuditPurge, Count: purged})
+}
+
+// Subscribe streams capsule events matching opts until ctx is done or the
+// capsule is closed, at which point the channel is closed. Only changes made
+// through this capsule are observed; unlocks and expiries of capsules already
+// in storage are scheduled when the first subscription starts, or by a later
+// one if listing them failed. Events wait in an unbounded buffer until read,
+// so a subscription that is no longer read must be cancelled.
+func (tc *PersistentTimeCapsule[T]) Subscribe(ctx context.Context, opts SubscribeOptions) (<-chan Event, error) {
+	return tc.events.subscribe(ctx, opts)
+}
+
+// Close stops background purging and ends every subscription. The storage is
+// owned by the caller and is not closed.
+func (tc *PersistentTimeCapsule[T]) Close() error {
+	tc.purger.stop()
+	tc.events.close()
+	return nil
+}
+
+// record publishes an event for a capsule that was just written, reading its
+// metadata back from storage only while someone is subscribed
+func (tc *PersistentTimeCapsule[T]) record(ctx context.Context, eventType EventType, key string) {
+	if !tc.events.active() {
+		return
+	}
+
+	metadata, err := tc.storage.Peek(ctx, key)
+	if err != nil {
+		return
+	}
+
+	tc.events.record(eventType, key, metadata)
 }
@@ -2,7 +2,10 @@ package timecapsule
 
 import (
 	"context"
+	"crypto/ed25519"
 	"errors"
+	"iter"
+	"maps"
 	"sync"
 	"time"
 )
@@ -11,24 +14,82 @@ import (
 var (
 	ErrCapsuleNotFound = errors.New("capsule not found")
 	ErrCapsuleLocked   = errors.New("capsule is still locked")
+	ErrCapsuleExpired  = errors.New("capsule has expired")
 	ErrInvalidKey      = errors.New("invalid key")
+	ErrInvalidWindow   = errors.New("expiry must be after unlock time")
+	ErrTimeOutOfRange  = errors.New("time out of range")
+	ErrStorageClosed   = errors.New("storage is closed")
+	ErrClosed          = errors.New("time capsule is closed")
 )
 
-// Capsule represents a time-locked value
+// Capsule represents a time-locked value. A non-zero ExpiresAt closes the
+// window in which the value can be opened.
 type Capsule[T any] struct {
-	Value      T         `json:"value"`
-	UnlockTime time.Time `json:"unlock_time"`
-	CreatedAt  time.Time `json:"created_at"`
+	Value      T                 `json:"value"`
+	UnlockTime time.Time         `json:"unlock_time"`
+	CreatedAt  time.Time         `json:"created_at"`
+	ExpiresAt  time.Time         `json:"expires_at,omitzero"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+
+	// salt hides Value behind its commitment for capsules stored with
+	// WithCommitment
+	salt []byte
+
+	// oneShot removes the capsule when its value is first delivered
+	oneShot bool
+}
+
+// metadata returns the capsule metadata as seen at now
+func (c Capsule[T]) metadata(now time.Time) Metadata {
+	return newMetadata(c.UnlockTime, c.CreatedAt, c.ExpiresAt, now, c.Attributes)
 }
 
 // Metadata contains information about a capsule without exposing its value
 type Metadata struct {
-	UnlockTime time.Time `json:"unlock_time"`
-	CreatedAt  time.Time `json:"created_at"`
-	IsLocked   bool      `json:"is_locked"`
+	UnlockTime time.Time         `json:"unlock_time"`
+	CreatedAt  time.Time         `json:"created_at"`
+	ExpiresAt  time.Time         `json:"expires_at,omitzero"`
+	IsLocked   bool              `json:"is_locked"`
+	IsExpired  bool              `json:"is_expired"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+}
+
+// newMetadata builds the metadata of a capsule as seen at now. Attributes
+// are copied so callers cannot modify the stored capsule.
+func newMetadata(unlockTime, createdAt, expiresAt, now time.Time, attributes map[string]string) Metadata {
+	return Metadata{
+		UnlockTime: unlockTime,
+		CreatedAt:  createdAt,
+		ExpiresAt:  expiresAt,
+		IsLocked:   now.Before(unlockTime),
+		IsExpired:  isExpired(expiresAt, now),
+		Attributes: maps.Clone(attributes),
+	}
+}
+
+// isExpired reports whether a capsule with the given expiry has expired at now
+func isExpired(expiresAt, now time.Time) bool {
+	return !expiresAt.IsZero() && !now.Before(expiresAt)
+}
+
+// checkWindow returns ErrCapsuleLocked before the unlock time, ErrCapsuleExpired
+// once the expiry has passed, ErrApprovalRequired while approvals are missing
+// and nil while the capsule may be opened
+func checkWindow(unlockTime, expiresAt, now time.Time, attributes map[string]string) error {
+	if now.Before(unlockTime) {
+		return ErrCapsuleLocked
+	}
+
+	if isExpired(expiresAt, now) {
+		return ErrCapsuleExpired
+	}
+
+	return checkApprovals(attributes)
 }
 
-// TimeCapsule is the main interface for storing and retrieving time-locked values
+// TimeCapsule is the main interface for storing and retrieving time-locked
+// values. MemoryTimeCapsule and PersistentTimeCapsule also provide listing,
+// events, approvals and the other features configured through Option values.
 type TimeCapsule[T any] interface {
 	Store(ctx context.Context, key string, value T, unlockTime time.Time) error
 	Open(ctx context.Context, key string) (T, error)
@@ -41,19 +102,49 @@ type TimeCapsule[T any] interface {
 
 // MemoryTimeCapsule implements TimeCapsule using in-memory storage
 type MemoryTimeCapsule[T any] struct {
-	capsules map[string]Capsule[T]
-	mu       sync.RWMutex
+	capsules   map[string]Capsule[T]
+	clock      Clock
+	purger     *purger
+	events     *eventHub
+	breakGlass BreakGlassAuthorizer
+	auditor    Auditor
+	receiptKey ed25519.PrivateKey
+	log        *TransparencyLog
+	tsa        TimestampAuthority
+	trusted    *trustedTime
+
+	secretValues bool
+	mu           sync.RWMutex
 }
 
 // New creates a new in-memory time capsule
-func New[T any]() TimeCapsule[T] {
-	return &MemoryTimeCapsule[T]{
-		capsules: make(map[string]Capsule[T]),
+func New[T any](opts ...Option) *MemoryTimeCapsule[T] {
+	o := newOptions(opts...)
+	tc := &MemoryTimeCapsule[T]{
+		capsules:   make(map[string]Capsule[T]),
+		clock:      o.clock,
+		breakGlass: o.breakGlass,
+		auditor:    o.auditor,
+		receiptKey: o.receiptKey,
+		log:        o.transparency,
+		tsa:        o.timestamps,
+		trusted:    newTrustedTime(o),
+
+		secretValues: o.secretValues,
 	}
+	tc.purger = startPurger(o.clock, o.purgeInterval, tc.Purge)
+	tc.events = newEventHub(o.clock, tc.Peek, tc.List)
+	return tc
 }
 
 // Store stores a value in a time capsule that will be unlocked at the specified time
 func (tc *MemoryTimeCapsule[T]) Store(ctx context.Context, key string, value T, unlockTime time.Time) error {
+	return tc.StoreWithOptions(ctx, key, value, unlockTime)
+}
+
+// StoreWithOptions stores a value that will be unlocked at the specified
+// time, with an expiry, attributes and the other settings of opts
+func (tc *MemoryTimeCapsule[T]) StoreWithOptions(ctx context.Context, key string, value T, unlockTime time.Time, opts ...StoreOption) error {
 	if err := ctx.Err(); err != nil {
 		return err
 	}
@@ -62,16 +153,63 @@ func (tc *MemoryTimeCapsule[T]) Store(ctx context.Context, key string, value T,
 		return ErrInvalidKey
 	}
 
+	o, err := ApplyStoreOptions(unlockTime, opts...)
+	if err != nil {
+		return err
+	}
+
+	var salt []byte
+	if o.commit || tc.log != nil || tc.tsa != nil {
+		var attributes map[string]string
+		if salt, attributes, err = newCommitment(key, value); err != nil {
+			return err
+		}
+		WithAttributes(attributes)(&o)
+	}
+
+	createdAt := o.createdAt(tc.clock.Now())
+	if tc.tsa != nil {
+		commitment := Metadata{Attributes: o.Attributes}.Commitment()
+		attributes, err := timestampCapsule(ctx, tc.tsa, key, createdAt, commitment)
+		if err != nil {
+			return err
+		}
+		WithAttributes(attributes)(&o)
+	}
+
 	tc.mu.Lock()
 	defer tc.mu.Unlock()
 
+	now := tc.clock.Now()
 	capsule := Capsule[T]{
 		Value:      value,
 		UnlockTime: unlockTime,
-		CreatedAt:  time.Now(),
+		CreatedAt:  createdAt,
+		ExpiresAt:  o.ExpiresAt,
+		Attributes: o.Attributes,
+		salt:       salt,
+		oneShot:    o.oneShot,
+	}
+
+	// The capsule is logged and audited before it is stored, so a failure
+	// leaves nothing stored
+	metadata := capsule.metadata(now)
+	if tc.log != nil {
+		if _, err := tc.log.Append(ctx, key, capsule.CreatedAt, unlockTime, metadata.Commitment()); err != nil {
+			return err
+		}
+	}
+
+	if err := audit(ctx, tc.auditor, AuditRecord{Time: now, Operation: AuditStore, Key: key, UnlockTime: unlockTime}); err != nil {
+		return err
 	}
 
+	replaced, exists := tc.capsules[key]
 	tc.capsules[key] = capsule
+	tc.events.record(EventStored, key, metadata)
+	if exists && !sameValue(replaced.Value, value) {
+		tc.discard(replaced)
+	}
 	return nil
 }
 
@@ -96,11 +234,271 @@ func (tc *MemoryTimeCapsule[T]) Open(ctx context.Context, key string) (T, error)
 		return zero, ErrCapsuleNotFound
 	}
 
-	if time.Now().Before(capsule.UnlockTime) {
+	if err := checkWindow(capsule.UnlockTime, capsule.ExpiresAt, tc.clock.Now(), capsule.Attributes); err != nil {
+		var zero T
+		return zero, err
+	}
+
+	if err := tc.trusted.checkWindow(ctx, capsule.UnlockTime, capsule.ExpiresAt, capsule.Attributes); err != nil {
+		var zero T
+		return zero, err
+	}
+
+	if requiresShares(capsule.Attributes) {
+		var zero T
+		return zero, ErrSharesRequired
+	}
+
+	return tc.opened(ctx, key, capsule)
+}
+
+// Reveal opens an unlocked capsule stored with WithCommitment and returns
+// its value with the salt of its commitment, verified against the
+// commitment in its metadata
+func (tc *MemoryTimeCapsule[T]) Reveal(ctx context.Context, key string) (Reveal[T], error) {
+	if err := ctx.Err(); err != nil {
+		return Reveal[T]{}, err
+	}
+
+	if key == "" {
+		return Reveal[T]{}, ErrInvalidKey
+	}
+
+	tc.mu.RLock()
+	capsule, exists := tc.capsules[key]
+	tc.mu.RUnlock()
+
+	if !exists {
+		return Reveal[T]{}, ErrCapsuleNotFound
+	}
+
+	if capsule.salt == nil {
+		return Reveal[T]{}, ErrNotCommitted
+	}
+
+	if err := checkWindow(capsule.UnlockTime, capsule.ExpiresAt, tc.clock.Now(), capsule.Attributes); err != nil {
+		return Reveal[T]{}, err
+	}
+
+	if err := tc.trusted.checkWindow(ctx, capsule.UnlockTime, capsule.ExpiresAt, capsule.Attributes); err != nil {
+		return Reveal[T]{}, err
+	}
+
+	if requiresShares(capsule.Attributes) {
+		return Reveal[T]{}, ErrSharesRequired
+	}
+
+	reveal, err := revealed(key, capsule.Value, capsule.salt, capsule.Attributes)
+	if err != nil {
+		return Reveal[T]{}, err
+	}
+
+	if _, err := tc.opened(ctx, key, capsule); err != nil {
+		return Reveal[T]{}, err
+	}
+	return reveal, nil
+}
+
+// StoreWithReceipt stores a value like Store and returns a Receipt signed
+// with the key set by WithReceiptKey, or ErrReceiptsDisabled without one
+func (tc *MemoryTimeCapsule[T]) StoreWithReceipt(ctx context.Context, key string, value T, unlockTime time.Time, opts ...StoreOption) (Receipt, error) {
+	if err := ctx.Err(); err != nil {
+		return Receipt{}, err
+	}
+
+	if key == "" {
+		return Receipt{}, ErrInvalidKey
+	}
+
+	createdAt, err := prepareReceipt(tc.receiptKey, tc.clock, unlockTime, opts)
+	if err != nil {
+		return Receipt{}, err
+	}
+
+	receipt, err := signReceipt(tc.receiptKey, key, value, createdAt, unlockTime)
+	if err != nil {
+		return Receipt{}, err
+	}
+
+	if err := tc.StoreWithOptions(ctx, key, value, unlockTime, append(opts, WithCreatedAt(createdAt))...); err != nil {
+		return Receipt{}, err
+	}
+
+	return receipt, nil
+}
+
+// StoreWithShares stores a value that can only be opened with OpenWithShares,
+// once unlocked, by presenting threshold of the returned shares. In-memory
+// capsules keep the value in process memory, so shares gate access to it but
+// do not encrypt it.
+func (tc *MemoryTimeCapsule[T]) StoreWithShares(ctx context.Context, key string, value T, unlockTime time.Time, threshold, shares int, opts ...StoreOption) ([]Share, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if key == "" {
+		return nil, ErrInvalidKey
+	}
+
+	secret, split, attributes, err := splitCapsuleKey(key, threshold, shares)
+	if err != nil {
+		return nil, err
+	}
+	clear(secret)
+
+	if err := tc.StoreWithOptions(ctx, key, value, unlockTime, append(opts, WithAttributes(attributes))...); err != nil {
+		return nil, err
+	}
+
+	return split, nil
+}
+
+// OpenWithShares opens an unlocked capsule stored with StoreWithShares,
+// returning ErrInsufficientShares unless enough valid shares are given
+func (tc *MemoryTimeCapsule[T]) OpenWithShares(ctx context.Context, key string, shares []Share) (T, error) {
+	if err := ctx.Err(); err != nil {
+		var zero T
+		return zero, err
+	}
+
+	if key == "" {
+		var zero T
+		return zero, ErrInvalidKey
+	}
+
+	tc.mu.RLock()
+	capsule, exists := tc.capsules[key]
+	tc.mu.RUnlock()
+
+	if !exists {
+		var zero T
+		return zero, ErrCapsuleNotFound
+	}
+
+	if err := checkWindow(capsule.UnlockTime, capsule.ExpiresAt, tc.clock.Now(), capsule.Attributes); err != nil {
+		var zero T
+		return zero, err
+	}
+
+	if err := tc.trusted.checkWindow(ctx, capsule.UnlockTime, capsule.ExpiresAt, capsule.Attributes); err != nil {
 		var zero T
-		return zero, ErrCapsuleLocked
+		return zero, err
+	}
+
+	if requiresShares(capsule.Attributes) {
+		secret, err := combineShares(key, capsule.Attributes, shares)
+		if err != nil {
+			var zero T
+			return zero, err
+		}
+		clear(secret)
+	}
+
+	return tc.opened(ctx, key, capsule)
+}
+
+// opened audits the opening of a capsule before returning its value. A
+// one-shot capsule is removed as it is delivered, unless another call
+// already took it.
+func (tc *MemoryTimeCapsule[T]) opened(ctx context.Context, key string, capsule Capsule[T]) (T, error) {
+	var zero T
+
+	if !capsule.oneShot {
+		if err := audit(ctx, tc.auditor, AuditRecord{Time: tc.clock.Now(), Operation: AuditOpen, Key: key}); err != nil {
+			return zero, err
+		}
+		return capsule.Value, nil
+	}
+
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	// The capsule may have been delivered or replaced since it was read
+	current, exists := tc.capsules[key]
+	if !exists || !current.CreatedAt.Equal(capsule.CreatedAt) {
+		return zero, ErrCapsuleNotFound
+	}
+
+	now := tc.clock.Now()
+	if err := audit(ctx, tc.auditor, AuditRecord{Time: now, Operation: AuditOpen, Key: key}); err != nil {
+		return zero, err
+	}
+
+	tc.take(key, current, now)
+	return current.Value, nil
+}
+
+// take removes a one-shot capsule whose value is being delivered. Its salt
+// is wiped, but the value now belongs to the caller.
+func (tc *MemoryTimeCapsule[T]) take(key string, capsule Capsule[T], now time.Time) {
+	delete(tc.capsules, key)
+	tc.events.record(EventDeleted, key, capsule.metadata(now))
+	if tc.secretValues {
+		clear(capsule.salt)
+	}
+}
+
+// discard wipes the value and salt of a removed or replaced capsule in
+// secret-value mode
+func (tc *MemoryTimeCapsule[T]) discard(capsule Capsule[T]) {
+	if tc.secretValues {
+		wipeValue(capsule.Value)
+		clear(capsule.salt)
+	}
+}
+
+// OpenEarly opens a capsule before its unlock time or approvals once the
+// authorizer set with WithBreakGlass agrees. The opening is audited and
+// recorded in the capsule's metadata before the value is returned.
+func (tc *MemoryTimeCapsule[T]) OpenEarly(ctx context.Context, key, reason string) (T, error) {
+	var zero T
+	if err := ctx.Err(); err != nil {
+		return zero, err
+	}
+
+	if key == "" {
+		return zero, ErrInvalidKey
+	}
+
+	metadata, err := tc.Peek(ctx, key)
+	if err != nil {
+		return zero, err
+	}
+
+	if err := checkBreakGlass(tc.breakGlass, tc.auditor, reason, metadata); err != nil {
+		return zero, err
+	}
+
+	actor, err := authorizeBreakGlass(ctx, tc.breakGlass, BreakGlassRequest{Key: key, Reason: reason, Metadata: metadata})
+	if err != nil {
+		return zero, err
+	}
+
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	// The capsule may have been replaced while the authorizer decided
+	capsule, exists := tc.capsules[key]
+	if !exists || !capsule.CreatedAt.Equal(metadata.CreatedAt) {
+		return zero, ErrCapsuleNotFound
+	}
+
+	opening := EarlyOpening{Actor: actor, Reason: reason, Time: tc.clock.Now()}
+	attributes, err := recordEarlyOpening(capsule.Attributes, opening)
+	if err != nil {
+		return zero, err
+	}
+
+	if err := auditEarlyOpening(ctx, tc.auditor, key, opening); err != nil {
+		return zero, err
 	}
 
+	capsule.Attributes = attributes
+	if capsule.oneShot {
+		tc.take(key, capsule, opening.Time)
+	} else {
+		tc.capsules[key] = capsule
+	}
 	return capsule.Value, nil
 }
 
@@ -122,15 +520,16 @@ func (tc *MemoryTimeCapsule[T]) Peek(ctx context.Context, key string) (Metadata,
 		return Metadata{}, ErrCapsuleNotFound
 	}
 
-	now := time.Now()
-	return Metadata{
-		UnlockTime: capsule.UnlockTime,
-		CreatedAt:  capsule.CreatedAt,
-		IsLocked:   now.Before(capsule.UnlockTime),
-	}, nil
+	metadata := capsule.metadata(tc.clock.Now())
+	if err := checkTimestamp(tc.tsa, key, metadata); err != nil {
+		return Metadata{}, err
+	}
+
+	return metadata, nil
 }
 
-// Delay delays the unlock time of a capsule
+// Delay delays the unlock time of a capsule. A capsule cannot be delayed to
+// or past its expiry.
 func (tc *MemoryTimeCapsule[T]) Delay(ctx context.Context, key string, delay time.Duration) error {
 	if err := ctx.Err(); err != nil {
 		return err
@@ -148,8 +547,53 @@ func (tc *MemoryTimeCapsule[T]) Delay(ctx context.Context, key string, delay tim
 		return ErrCapsuleNotFound
 	}
 
-	capsule.UnlockTime = time.Now().Add(delay)
+	now := tc.clock.Now()
+	unlockTime := now.Add(delay)
+	if !capsule.ExpiresAt.IsZero() && !unlockTime.Before(capsule.ExpiresAt) {
+		return ErrInvalidWindow
+	}
+
+	if err := audit(ctx, tc.auditor, AuditRecord{Time: now, Operation: AuditDelay, Key: key, UnlockTime: unlockTime}); err != nil {
+		return err
+	}
+
+	capsule.UnlockTime = unlockTime
+	tc.capsules[key] = capsule
+	tc.events.record(EventDelayed, key, capsule.metadata(now))
+	return nil
+}
+
+// Approve records approver's approval of a capsule stored with WithApprovals
+func (tc *MemoryTimeCapsule[T]) Approve(ctx context.Context, key, approver string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if key == "" {
+		return ErrInvalidKey
+	}
+
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	capsule, exists := tc.capsules[key]
+	if !exists {
+		return ErrCapsuleNotFound
+	}
+
+	now := tc.clock.Now()
+	attributes, err := approve(capsule.Attributes, approver, now)
+	if err != nil || attributes == nil {
+		return err
+	}
+
+	if err := audit(ctx, tc.auditor, AuditRecord{Time: now, Operation: AuditApprove, Key: key, Actor: approver}); err != nil {
+		return err
+	}
+
+	capsule.Attributes = attributes
 	tc.capsules[key] = capsule
+	tc.events.record(EventApproved, key, capsule.metadata(now))
 	return nil
 }
 
@@ -166,11 +610,19 @@ func (tc *MemoryTimeCapsule[T]) Delete(ctx context.Context, key string) error {
 	tc.mu.Lock()
 	defer tc.mu.Unlock()
 
-	if _, exists := tc.capsules[key]; !exists {
+	capsule, exists := tc.capsules[key]
+	if !exists {
 		return ErrCapsuleNotFound
 	}
 
+	now := tc.clock.Now()
+	if err := audit(ctx, tc.auditor, AuditRecord{Time: now, Operation: AuditDelete, Key: key}); err != nil {
+		return err
+	}
+
 	delete(tc.capsules, key)
+	tc.discard(capsule)
+	tc.events.record(EventDeleted, key, capsule.metadata(now))
 	return nil
 }
 
@@ -205,20 +657,103 @@ func (tc *MemoryTimeCapsule[T]) WaitForUnlock(ctx context.Context, key string) (
 		return zero, err
 	}
 
+	if requiresShares(metadata.Attributes) {
+		var zero T
+		return zero, ErrSharesRequired
+	}
+
 	// If already unlocked, return immediately
 	if !metadata.IsLocked {
 		return tc.Open(ctx, key)
 	}
 
 	// Wait until unlock time or context cancellation
-	timer := time.NewTimer(time.Until(metadata.UnlockTime))
+	timer := tc.clock.NewTimer(metadata.UnlockTime.Sub(tc.clock.Now()))
 	defer timer.Stop()
 
 	select {
 	case <-ctx.Done():
 		var zero T
 		return zero, ctx.Err()
-	case <-timer.C:
+	case <-timer.C():
 		return tc.Open(ctx, key)
 	}
 }
+
+// List returns one page of capsules matching opts
+func (tc *MemoryTimeCapsule[T]) List(ctx context.Context, opts ListOptions) (ListPage, error) {
+	if err := ctx.Err(); err != nil {
+		return ListPage{}, err
+	}
+
+	now := tc.clock.Now()
+
+	tc.mu.RLock()
+	var items []ListItem
+	for key, capsule := range tc.capsules {
+		metadata := capsule.metadata(now)
+		if opts.matches(key, metadata) {
+			items = append(items, ListItem{Key: key, Metadata: metadata})
+		}
+	}
+	tc.mu.RUnlock()
+
+	return paginate(items, opts)
+}
+
+// All iterates over every capsule matching opts, fetching pages as needed.
+// Iteration ends early if a page cannot be listed.
+func (tc *MemoryTimeCapsule[T]) All(ctx context.Context, opts ListOptions) iter.Seq2[string, Metadata] {
+	return listAll(ctx, opts, tc.List)
+}
+
+// Purge removes every expired capsule and returns how many were removed
+func (tc *MemoryTimeCapsule[T]) Purge(ctx context.Context) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	now := tc.clock.Now()
+
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	purged := 0
+	for key, capsule := range tc.capsules {
+		if isExpired(capsule.ExpiresAt, now) {
+			delete(tc.capsules, key)
+			tc.discard(capsule)
+			purged++
+		}
+	}
+
+	if purged == 0 {
+		return 0, nil
+	}
+	return purged, audit(ctx, tc.auditor, AuditRecord{Time: now, Operation: AuditPurge, Count: purged})
+}
+
+// Subscribe streams capsule events matching opts until ctx is done or the
+// capsule is closed, at which point the channel is closed. Events wait in an
+// unbounded buffer until read, so a subscription that is no longer read must
+// be cancelled.
+func (tc *MemoryTimeCapsule[T]) Subscribe(ctx context.Context, opts SubscribeOptions) (<-chan Event, error) {
+	return tc.events.subscribe(ctx, opts)
+}
+
+// Close stops background purging and ends every subscription. With
+// WithSecretValues it also removes and wipes every capsule.
+func (tc *MemoryTimeCapsule[T]) Close() error {
+	tc.purger.stop()
+	tc.events.close()
+
+	if tc.secretValues {
+		tc.mu.Lock()
+		defer tc.mu.Unlock()
+		for key, capsule := range tc.capsules {
+			delete(tc.capsules, key)
+			tc.discard(capsule)
+		}
+	}
+	return nil
+}
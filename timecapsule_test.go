@@ -2,6 +2,7 @@ package timecapsule
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"testing"
 	"time"
@@ -10,6 +11,47 @@ import (
 	"github.com/stretchr/testify/require"
 )
 
+// fullStorage is a Storage implementing every optional interface, as the
+// backends in this package do
+type fullStorage interface {
+	Storage
+	OptionStorage
+	UnlockTimeStorage
+	RewriteStorage
+	AttributeStorage
+	ListStorage
+	PurgeStorage
+}
+
+var (
+	_ fullStorage = (*FileStorage)(nil)
+	_ fullStorage = (*SQLStorage)(nil)
+	_ fullStorage = (*RedisStorage)(nil)
+	_ fullStorage = (*EncryptedStorage)(nil)
+	_ fullStorage = (*IntegrityStorage)(nil)
+)
+
+// testCapsule is the method set shared by MemoryTimeCapsule and
+// PersistentTimeCapsule, so tests can run against both
+type testCapsule[T any] interface {
+	TimeCapsule[T]
+	Revealer[T]
+	DispatchSource[T]
+	StoreWithOptions(ctx context.Context, key string, value T, unlockTime time.Time, opts ...StoreOption) error
+	StoreWithReceipt(ctx context.Context, key string, value T, unlockTime time.Time, opts ...StoreOption) (Receipt, error)
+	StoreWithShares(ctx context.Context, key string, value T, unlockTime time.Time, threshold, shares int, opts ...StoreOption) ([]Share, error)
+	OpenWithShares(ctx context.Context, key string, shares []Share) (T, error)
+	OpenEarly(ctx context.Context, key, reason string) (T, error)
+	Approve(ctx context.Context, key, approver string) error
+	Purge(ctx context.Context) (int, error)
+	Close() error
+}
+
+var (
+	_ testCapsule[string] = (*MemoryTimeCapsule[string])(nil)
+	_ testCapsule[string] = (*PersistentTimeCapsule[string])(nil)
+)
+
 func TestNew(t *testing.T) {
 	capsule := New[string]()
 	assert.NotNil(t, capsule)
@@ -320,3 +362,46 @@ func TestContextCancellation(t *testing.T) {
 	assert.Error(t, err)
 	assert.Contains(t, err.Error(), "context canceled")
 }
+
+// basicStorage exposes only the Storage methods of a backend, standing in
+// for a third-party backend without the optional interfaces
+type basicStorage struct {
+	Storage
+}
+
+func TestBasicStorage(t *testing.T) {
+	ctx := context.Background()
+	inner, err := NewFileStorage(t.TempDir())
+	require.NoError(t, err)
+	defer inner.Close()
+
+	capsule := NewWithStorage(basicStorage{inner}, NewJSONCodec[string]())
+	defer capsule.Close()
+
+	events, err := capsule.Subscribe(ctx, SubscribeOptions{})
+	require.NoError(t, err)
+	assert.NotNil(t, events)
+
+	require.NoError(t, capsule.Store(ctx, "plain", "v", time.Now()))
+	value, err := capsule.Open(ctx, "plain")
+	require.NoError(t, err)
+	assert.Equal(t, "v", value)
+
+	// Unlock times cannot be changed without reading and re-storing the value
+	assert.ErrorIs(t, capsule.Delay(ctx, "plain", time.Hour), errors.ErrUnsupported)
+	metadata, err := capsule.Peek(ctx, "plain")
+	require.NoError(t, err)
+	assert.False(t, metadata.IsLocked)
+
+	// Options the storage cannot persist are rejected
+	err = capsule.StoreWithOptions(ctx, "expiring", "v", time.Now(), WithValidFor(time.Hour))
+	assert.ErrorIs(t, err, errors.ErrUnsupported)
+	assert.False(t, capsule.Exists(ctx, "expiring"))
+
+	_, err = capsule.List(ctx, ListOptions{})
+	assert.ErrorIs(t, err, errors.ErrUnsupported)
+
+	purged, err := capsule.Purge(ctx)
+	require.NoError(t, err)
+	assert.Zero(t, purged)
+}
@@ -0,0 +1,176 @@
+package timecapsuletest
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/kolosys/timecapsule"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var epoch = time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func TestClockAdvanceFiresTimers(t *testing.T) {
+	clock := NewClock(epoch)
+
+	early := clock.NewTimer(time.Minute)
+	late := clock.NewTimer(time.Hour)
+	assert.Equal(t, 2, clock.Timers())
+
+	clock.Advance(time.Minute)
+	select {
+	case fired := <-early.C():
+		assert.Equal(t, epoch.Add(time.Minute), fired)
+	default:
+		t.Fatal("timer did not fire")
+	}
+
+	select {
+	case <-late.C():
+		t.Fatal("timer fired early")
+	default:
+	}
+
+	assert.True(t, late.Stop())
+	assert.False(t, late.Stop())
+	assert.Equal(t, 0, clock.Timers())
+}
+
+func TestClockImmediateTimer(t *testing.T) {
+	clock := NewClock(epoch)
+
+	timer := clock.NewTimer(0)
+	assert.Equal(t, epoch, <-timer.C())
+	assert.False(t, timer.Stop())
+}
+
+func TestClockMemoryWaitForUnlock(t *testing.T) {
+	clock := NewClock(epoch)
+	capsule := timecapsule.New[string](timecapsule.WithClock(clock))
+	ctx := context.Background()
+
+	require.NoError(t, capsule.Store(ctx, "test", "hello", epoch.Add(24*time.Hour)))
+
+	_, err := capsule.Open(ctx, "test")
+	assert.ErrorIs(t, err, timecapsule.ErrCapsuleLocked)
+
+	done := make(chan string)
+	go func() {
+		value, err := capsule.WaitForUnlock(ctx, "test")
+		assert.NoError(t, err)
+		done <- value
+	}()
+
+	// A day passes instantly once the waiter has registered its timer
+	clock.BlockUntil(1)
+	clock.Advance(24 * time.Hour)
+	assert.Equal(t, "hello", <-done)
+
+	metadata, err := capsule.Peek(ctx, "test")
+	require.NoError(t, err)
+	assert.False(t, metadata.IsLocked)
+	assert.Equal(t, epoch, metadata.CreatedAt)
+}
+
+func TestClockPersistentWaitForUnlock(t *testing.T) {
+	clock := NewClock(epoch)
+	storage, err := timecapsule.NewFileStorage(t.TempDir(), timecapsule.WithClock(clock))
+	require.NoError(t, err)
+	defer storage.Close()
+
+	capsule := timecapsule.NewWithStorage(storage, timecapsule.NewJSONCodec[int](), timecapsule.WithClock(clock))
+	ctx := context.Background()
+
+	require.NoError(t, capsule.Store(ctx, "count", 42, epoch.Add(time.Hour)))
+	require.NoError(t, capsule.Delay(ctx, "count", 2*time.Hour))
+
+	done := make(chan int)
+	go func() {
+		value, err := capsule.WaitForUnlock(ctx, "count")
+		assert.NoError(t, err)
+		done <- value
+	}()
+
+	clock.BlockUntil(1)
+	clock.Advance(time.Hour)
+	assert.Equal(t, 1, clock.Timers())
+
+	clock.Advance(time.Hour)
+	assert.Equal(t, 42, <-done)
+}
+
+func TestClockWaitForUnlockCancelled(t *testing.T) {
+	clock := NewClock(epoch)
+	capsule := timecapsule.New[string](timecapsule.WithClock(clock))
+	ctx, cancel := context.WithCancel(context.Background())
+
+	require.NoError(t, capsule.Store(ctx, "test", "hello", epoch.Add(time.Hour)))
+
+	done := make(chan error)
+	go func() {
+		_, err := capsule.WaitForUnlock(ctx, "test")
+		done <- err
+	}()
+
+	clock.BlockUntil(1)
+	cancel()
+	assert.ErrorIs(t, <-done, context.Canceled)
+
+	// The waiter stops its timer on the way out
+	assert.Equal(t, 0, clock.Timers())
+}
+
+func TestClockPurgeInterval(t *testing.T) {
+	clock := NewClock(epoch)
+	capsule := timecapsule.New[string](timecapsule.WithClock(clock), timecapsule.WithPurgeInterval(time.Minute))
+	defer capsule.Close()
+	ctx := context.Background()
+
+	require.NoError(t, capsule.StoreWithOptions(ctx, "short", "a", epoch, timecapsule.WithValidFor(30*time.Second)))
+	require.NoError(t, capsule.StoreWithOptions(ctx, "long", "b", epoch, timecapsule.WithValidFor(time.Hour)))
+
+	// The purger re-arms its timer only after a purge completes
+	clock.BlockUntil(1)
+	clock.Advance(time.Minute)
+	clock.BlockUntil(1)
+
+	assert.False(t, capsule.Exists(ctx, "short"))
+	assert.True(t, capsule.Exists(ctx, "long"))
+
+	// Close stops the purger and its timer
+	require.NoError(t, capsule.Close())
+	assert.Equal(t, 0, clock.Timers())
+}
+
+func TestClockSubscribeSingleTimer(t *testing.T) {
+	clock := NewClock(epoch)
+	capsule := timecapsule.New[string](timecapsule.WithClock(clock))
+	defer capsule.Close()
+	ctx := context.Background()
+
+	first, err := capsule.Subscribe(ctx, timecapsule.SubscribeOptions{Types: []timecapsule.EventType{timecapsule.EventUnlocked}})
+	require.NoError(t, err)
+	second, err := capsule.Subscribe(ctx, timecapsule.SubscribeOptions{Prefix: "b", Types: []timecapsule.EventType{timecapsule.EventUnlocked}})
+	require.NoError(t, err)
+
+	require.NoError(t, capsule.Store(ctx, "a", "1", epoch.Add(time.Hour)))
+	require.NoError(t, capsule.Store(ctx, "b", "2", epoch.Add(2*time.Hour)))
+	require.NoError(t, capsule.Store(ctx, "c", "3", epoch.Add(3*time.Hour)))
+
+	// One scheduler timer serves every capsule and subscriber
+	clock.BlockUntil(1)
+	assert.Equal(t, 1, clock.Timers())
+
+	clock.Advance(2 * time.Hour)
+	assert.Equal(t, "a", (<-first).Key)
+	assert.Equal(t, "b", (<-first).Key)
+	assert.Equal(t, "b", (<-second).Key)
+
+	clock.BlockUntil(1)
+	clock.Advance(time.Hour)
+	event := <-first
+	assert.Equal(t, "c", event.Key)
+	assert.Equal(t, epoch.Add(3*time.Hour), event.Time)
+}
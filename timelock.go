@@ -0,0 +1,231 @@
+package timecapsule
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+)
+
+// DefaultTimeLockBits is the RSA modulus size used when TimeLock.Bits is zero
+const DefaultTimeLockBits = 2048
+
+// timeLockProgressInterval is how many squarings are done between progress
+// reports and cancellation checks
+const timeLockProgressInterval = 1 << 14
+
+// ErrInvalidTimeLock is returned when a time-lock configuration or record is invalid
+var ErrInvalidTimeLock = errors.New("invalid time-lock puzzle")
+
+// TimeLock configures Rivest-Shamir-Wagner time-lock puzzles. The value of a
+// time-locked capsule is encrypted under a key that can only be recovered by
+// repeatedly squaring modulo an RSA modulus whose factors are discarded, so
+// nobody, including the operator, can read it without doing the sequential
+// work. The number of squarings is calibrated to the time until unlock.
+type TimeLock struct {
+	// SquaringsPerSecond is the solver speed puzzles are calibrated for;
+	// measure it with CalibrateTimeLock on the hardware expected to open
+	// capsules
+	SquaringsPerSecond uint64
+
+	// Bits is the modulus size; defaults to DefaultTimeLockBits
+	Bits int
+
+	// Progress, when set, is called periodically while a puzzle is solved
+	Progress func(key string, done, total uint64)
+}
+
+// timeLockRecord is the stored form of a time-locked value
+type timeLockRecord struct {
+	Version    int    `json:"v"`
+	Modulus    []byte `json:"n"`
+	Base       []byte `json:"a"`
+	Squarings  uint64 `json:"t"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// CalibrateTimeLock measures how many modular squarings per second this
+// machine performs for a modulus of the given size, running for about d
+func CalibrateTimeLock(bits int, d time.Duration) (uint64, error) {
+	if bits <= 0 {
+		bits = DefaultTimeLockBits
+	}
+
+	n, _, err := timeLockModulus(bits)
+	if err != nil {
+		return 0, err
+	}
+
+	x := big.NewInt(3)
+	start := time.Now()
+	var done uint64
+	for time.Since(start) < d {
+		for i := 0; i < 1024; i++ {
+			x.Mul(x, x).Mod(x, n)
+		}
+		done += 1024
+	}
+
+	return uint64(float64(done) / time.Since(start).Seconds()), nil
+}
+
+// timeLockModulus returns a random RSA modulus and its totient
+func timeLockModulus(bits int) (n, phi *big.Int, err error) {
+	for {
+		p, err := rand.Prime(rand.Reader, bits/2)
+		if err != nil {
+			return nil, nil, err
+		}
+		q, err := rand.Prime(rand.Reader, bits-bits/2)
+		if err != nil {
+			return nil, nil, err
+		}
+		if p.Cmp(q) == 0 {
+			continue
+		}
+
+		one := big.NewInt(1)
+		n = new(big.Int).Mul(p, q)
+		phi = new(big.Int).Mul(new(big.Int).Sub(p, one), new(big.Int).Sub(q, one))
+		return n, phi, nil
+	}
+}
+
+// seal encrypts the value of the capsule stored under key under a fresh
+// puzzle taking about d to solve at the calibrated speed
+func (l *TimeLock) seal(key string, d time.Duration, value []byte) ([]byte, error) {
+	if l.SquaringsPerSecond == 0 {
+		return nil, fmt.Errorf("timecapsule: time-lock speed not set: %w", ErrInvalidTimeLock)
+	}
+
+	squarings := uint64(1)
+	if d > 0 {
+		squarings = max(1, uint64(d.Seconds()*float64(l.SquaringsPerSecond)))
+	}
+
+	return sealTimeLock(l.Bits, squarings, key, value)
+}
+
+// solve solves the puzzle of the capsule stored under key
+func (l *TimeLock) solve(ctx context.Context, key string, record []byte) ([]byte, error) {
+	var progress func(done, total uint64)
+	if l.Progress != nil {
+		progress = func(done, total uint64) { l.Progress(key, done, total) }
+	}
+
+	value, err := solveTimeLock(ctx, key, record, progress)
+	if err != nil && ctx.Err() == nil {
+		return nil, fmt.Errorf("timecapsule: solve time-lock %q: %w", key, err)
+	}
+	return value, err
+}
+
+// sealTimeLock encrypts value under a fresh puzzle requiring t squarings,
+// bound to the capsule key so the puzzle cannot be moved to another capsule.
+// The creator uses the factorisation of n to compute a^(2^t) mod n directly;
+// the factors are discarded afterwards.
+func sealTimeLock(bits int, t uint64, capsuleKey string, value []byte) ([]byte, error) {
+	if bits <= 0 {
+		bits = DefaultTimeLockBits
+	}
+	if bits < 256 {
+		return nil, fmt.Errorf("timecapsule: time-lock modulus of %d bits: %w", bits, ErrInvalidTimeLock)
+	}
+
+	n, phi, err := timeLockModulus(bits)
+	if err != nil {
+		return nil, err
+	}
+
+	a, err := rand.Int(rand.Reader, new(big.Int).Sub(n, big.NewInt(3)))
+	if err != nil {
+		return nil, err
+	}
+	a.Add(a, big.NewInt(2))
+
+	e := new(big.Int).Exp(big.NewInt(2), new(big.Int).SetUint64(t), phi)
+	b := new(big.Int).Exp(a, e, n)
+
+	key := timeLockKey(n, b)
+	defer clear(key)
+
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	record := timeLockRecord{
+		Version:   1,
+		Modulus:   n.Bytes(),
+		Base:      a.Bytes(),
+		Squarings: t,
+		Nonce:     make([]byte, aead.NonceSize()),
+	}
+	if _, err := rand.Read(record.Nonce); err != nil {
+		return nil, err
+	}
+	record.Ciphertext = aead.Seal(nil, record.Nonce, value, recordAAD(record.Modulus, []byte(capsuleKey)))
+
+	return json.Marshal(record)
+}
+
+// solveTimeLock performs the sequential squarings of the puzzle sealed for
+// capsuleKey and decrypts its value, reporting progress and stopping when
+// ctx is done
+func solveTimeLock(ctx context.Context, capsuleKey string, data []byte, progress func(done, total uint64)) ([]byte, error) {
+	var record timeLockRecord
+	if err := json.Unmarshal(data, &record); err != nil || record.Version != 1 {
+		return nil, ErrInvalidTimeLock
+	}
+
+	n := new(big.Int).SetBytes(record.Modulus)
+	x := new(big.Int).SetBytes(record.Base)
+	if n.Sign() == 0 {
+		return nil, ErrInvalidTimeLock
+	}
+
+	for done := uint64(0); done < record.Squarings; {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		step := min(timeLockProgressInterval, record.Squarings-done)
+		for i := uint64(0); i < step; i++ {
+			x.Mul(x, x).Mod(x, n)
+		}
+		done += step
+
+		if progress != nil {
+			progress(done, record.Squarings)
+		}
+	}
+
+	key := timeLockKey(n, x)
+	defer clear(key)
+
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	value, err := aead.Open(nil, record.Nonce, record.Ciphertext, recordAAD(record.Modulus, []byte(capsuleKey)))
+	if err != nil {
+		return nil, ErrDecryptFailed
+	}
+
+	return value, nil
+}
+
+// timeLockKey derives the AES key from a puzzle solution
+func timeLockKey(n, b *big.Int) []byte {
+	h := sha256.New()
+	h.Write([]byte("timecapsule time-lock v1"))
+	h.Write(n.Bytes())
+	h.Write(b.Bytes())
+	return h.Sum(nil)
+}
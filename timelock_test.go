@@ -0,0 +1,114 @@
+package timecapsule
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testTimeLockBits keeps prime generation fast in tests
+const testTimeLockBits = 512
+
+func TestTimeLockPuzzle(t *testing.T) {
+	ctx := context.Background()
+
+	record, err := sealTimeLock(testTimeLockBits, 40000, "key", []byte("secret"))
+	require.NoError(t, err)
+	assert.NotContains(t, string(record), "secret")
+
+	var last, total uint64
+	value, err := solveTimeLock(ctx, "key", record, func(done, all uint64) {
+		assert.Greater(t, done, last)
+		last, total = done, all
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "secret", string(value))
+	assert.Equal(t, uint64(40000), last)
+	assert.Equal(t, uint64(40000), total)
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = solveTimeLock(cancelled, "key", record, nil)
+	assert.ErrorIs(t, err, context.Canceled)
+
+	// A puzzle only opens for the capsule it was sealed for
+	_, err = solveTimeLock(ctx, "other", record, nil)
+	assert.ErrorIs(t, err, ErrDecryptFailed)
+
+	_, err = solveTimeLock(ctx, "key", []byte("not a puzzle"), nil)
+	assert.ErrorIs(t, err, ErrInvalidTimeLock)
+
+	_, err = sealTimeLock(64, 1, "key", []byte("secret"))
+	assert.ErrorIs(t, err, ErrInvalidTimeLock)
+
+	speed, err := CalibrateTimeLock(testTimeLockBits, 10*time.Millisecond)
+	require.NoError(t, err)
+	assert.Positive(t, speed)
+}
+
+func TestTimeLockCapsule(t *testing.T) {
+	storage, err := NewFileStorage(t.TempDir())
+	require.NoError(t, err)
+	defer storage.Close()
+	ctx := context.Background()
+
+	var reports atomic.Int32
+	lock := TimeLock{
+		SquaringsPerSecond: 100000,
+		Bits:               testTimeLockBits,
+		Progress: func(key string, done, total uint64) {
+			assert.Equal(t, "wait", key)
+			reports.Add(1)
+		},
+	}
+	capsule := NewWithStorage(storage, NewJSONCodec[string](), WithTimeLock(lock))
+
+	// The stored value is a puzzle, not the plaintext
+	require.NoError(t, capsule.Store(ctx, "wait", "later", time.Now().Add(200*time.Millisecond)))
+	var raw []byte
+	require.NoError(t, storage.Rewrite(ctx, "wait", func(value []byte) ([]byte, error) {
+		raw = value
+		return nil, nil
+	}))
+	assert.NotContains(t, string(raw), "later")
+
+	_, err = capsule.Open(ctx, "wait")
+	assert.ErrorIs(t, err, ErrCapsuleLocked)
+
+	// The puzzle cannot be re-sealed, so the unlock time cannot move
+	assert.ErrorIs(t, capsule.Delay(ctx, "wait", -time.Second), errors.ErrUnsupported)
+
+	value, err := capsule.WaitForUnlock(ctx, "wait")
+	require.NoError(t, err)
+	assert.Equal(t, "later", value)
+	assert.Positive(t, reports.Load())
+
+	// Open solves the puzzle again once unlocked
+	value, err = capsule.Open(ctx, "wait")
+	require.NoError(t, err)
+	assert.Equal(t, "later", value)
+
+	unconfigured := NewWithStorage(storage, NewJSONCodec[string](), WithTimeLock(TimeLock{}))
+	assert.ErrorIs(t, unconfigured.Store(ctx, "bad", "x", time.Now()), ErrInvalidTimeLock)
+}
+
+func TestTimeLockBasicStorage(t *testing.T) {
+	inner, err := NewFileStorage(t.TempDir())
+	require.NoError(t, err)
+	defer inner.Close()
+	ctx := context.Background()
+
+	// A storage that cannot read locked capsules solves the puzzle on unlock
+	lock := TimeLock{SquaringsPerSecond: 100000, Bits: testTimeLockBits}
+	capsule := NewWithStorage(basicStorage{inner}, NewJSONCodec[string](), WithTimeLock(lock))
+	require.NoError(t, capsule.Store(ctx, "wait", "later", time.Now().Add(100*time.Millisecond)))
+
+	value, err := capsule.WaitForUnlock(ctx, "wait")
+	require.NoError(t, err)
+	assert.Equal(t, "later", value)
+}
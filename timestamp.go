@@ -0,0 +1,564 @@
+package timecapsule
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"time"
+)
+
+// AttributeTimestamp holds the base64-encoded RFC 3161 timestamp token of a
+// capsule stored with a TimestampAuthority
+const AttributeTimestamp = AttributePrefix + "timestamp"
+
+// MaxTimestampSkew is how far a capsule's CreatedAt may be from the time in
+// its timestamp token
+const MaxTimestampSkew = time.Minute
+
+// timestampDomain separates the timestamped capsule hash from other hashes
+const timestampDomain = "timecapsule timestamp v1\x00"
+
+// maxTimestampResponse bounds the size of a TSA response
+const maxTimestampResponse = 1 << 20
+
+// Media types of RFC 3161 requests and responses over HTTP
+const (
+	timestampQueryType = "application/timestamp-query"
+	timestampReplyType = "application/timestamp-reply"
+)
+
+// Object identifiers used by RFC 3161 and CMS
+var (
+	oidSignedData    = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	oidTSTInfo       = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 16, 1, 4}
+	oidContentType   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 3}
+	oidMessageDigest = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+
+	oidSHA256 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidSHA384 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 2}
+	oidSHA512 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 3}
+
+	oidRSAEncryption   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 1}
+	oidSHA256WithRSA   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 11}
+	oidSHA384WithRSA   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 12}
+	oidSHA512WithRSA   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 13}
+	oidECPublicKey     = asn1.ObjectIdentifier{1, 2, 840, 10045, 2, 1}
+	oidECDSAWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}
+	oidECDSAWithSHA384 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 3}
+	oidECDSAWithSHA512 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 4}
+	oidEd25519         = asn1.ObjectIdentifier{1, 3, 101, 112}
+)
+
+// Timestamp errors
+var (
+	ErrTimestampRejected = errors.New("timestamp authority rejected the request")
+	ErrInvalidTimestamp  = errors.New("invalid timestamp token")
+)
+
+// TimestampAuthority issues and verifies RFC 3161 timestamp tokens over
+// SHA-256 digests
+type TimestampAuthority interface {
+	// Timestamp returns a DER-encoded timestamp token over digest
+	Timestamp(ctx context.Context, digest []byte) ([]byte, error)
+
+	// Verify checks that token is a trusted timestamp over digest and
+	// returns its time
+	Verify(token, digest []byte) (time.Time, error)
+}
+
+// TSAConfig configures a TSAClient
+type TSAConfig struct {
+	// URL is the HTTP endpoint of the timestamp authority
+	URL string
+
+	// Roots are the certificate authorities trusted to certify the TSA
+	Roots *x509.CertPool
+
+	// Intermediates are extra certificates used to build the chain to Roots
+	// when tokens do not carry them
+	Intermediates *x509.CertPool
+
+	// HTTPClient sends requests; defaults to http.DefaultClient
+	HTTPClient *http.Client
+}
+
+// TSAClient is a TimestampAuthority speaking the RFC 3161 HTTP protocol
+type TSAClient struct {
+	config TSAConfig
+}
+
+// NewTSAClient returns a client for the timestamp authority in config
+func NewTSAClient(config TSAConfig) (*TSAClient, error) {
+	if config.URL == "" {
+		return nil, errors.New("timecapsule: timestamp authority URL is required")
+	}
+
+	if config.Roots == nil {
+		return nil, errors.New("timecapsule: timestamp authority roots are required")
+	}
+
+	if config.HTTPClient == nil {
+		config.HTTPClient = http.DefaultClient
+	}
+
+	return &TSAClient{config: config}, nil
+}
+
+// Timestamp requests a token over digest, asking the TSA to include its
+// certificate, and checks the token before returning it
+func (c *TSAClient) Timestamp(ctx context.Context, digest []byte) ([]byte, error) {
+	nonce, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 64))
+	if err != nil {
+		return nil, fmt.Errorf("timecapsule: generate nonce: %w", err)
+	}
+
+	request, err := asn1.Marshal(timeStampReq{
+		Version:        1,
+		MessageImprint: messageImprint{HashAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidSHA256}, HashedMessage: digest},
+		Nonce:          nonce,
+		CertReq:        true,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("timecapsule: encode timestamp request: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.config.URL, bytes.NewReader(request))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", timestampQueryType)
+	req.Header.Set("Accept", timestampReplyType)
+
+	resp, err := c.config.HTTPClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("timecapsule: timestamp request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxTimestampResponse))
+	if err != nil {
+		return nil, fmt.Errorf("timecapsule: timestamp response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("timecapsule: timestamp authority returned %s", resp.Status)
+	}
+
+	var response timeStampResp
+	if rest, err := asn1.Unmarshal(body, &response); err != nil || len(rest) > 0 {
+		return nil, fmt.Errorf("timecapsule: timestamp response: %w", ErrInvalidTimestamp)
+	}
+
+	// 0 is granted and 1 is granted with modifications
+	if response.Status.Status > 1 || len(response.Token.FullBytes) == 0 {
+		return nil, fmt.Errorf("timecapsule: status %d: %w", response.Status.Status, ErrTimestampRejected)
+	}
+
+	token := response.Token.FullBytes
+	info, err := verifyTimestampToken(token, digest, c.config.Roots, c.config.Intermediates)
+	if err != nil {
+		return nil, err
+	}
+
+	if info.Nonce == nil || info.Nonce.Cmp(nonce) != 0 {
+		return nil, fmt.Errorf("timecapsule: timestamp nonce does not match: %w", ErrInvalidTimestamp)
+	}
+
+	return bytes.Clone(token), nil
+}
+
+// Verify checks that token is signed by a TSA certified by the configured
+// roots for timestamping and is over digest, returning its time
+func (c *TSAClient) Verify(token, digest []byte) (time.Time, error) {
+	return VerifyTimestampToken(token, digest, c.config.Roots, c.config.Intermediates)
+}
+
+// VerifyTimestampToken checks a DER-encoded RFC 3161 token against digest
+// and returns the time it asserts. The signing certificate must chain to
+// roots, optionally through intermediates, and be valid for timestamping.
+func VerifyTimestampToken(token, digest []byte, roots, intermediates *x509.CertPool) (time.Time, error) {
+	info, err := verifyTimestampToken(token, digest, roots, intermediates)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return info.GenTime, nil
+}
+
+// TimestampToken returns the timestamp token of a capsule stored with a
+// TimestampAuthority, or nil for other capsules
+func (m Metadata) TimestampToken() []byte {
+	token, err := base64.StdEncoding.DecodeString(m.Attributes[AttributeTimestamp])
+	if err != nil || len(token) == 0 {
+		return nil
+	}
+	return token
+}
+
+// VerifyTimestamp checks the timestamp token of the capsule stored under key
+// against its metadata with tsa and returns the time it asserts. The token
+// covers the key, the creation time and the commitment of the capsule, and
+// the creation time must be within MaxTimestampSkew of the token's time.
+func VerifyTimestamp(tsa TimestampAuthority, key string, metadata Metadata) (time.Time, error) {
+	token := metadata.TimestampToken()
+	if token == nil {
+		return time.Time{}, fmt.Errorf("timecapsule: %q has no timestamp: %w", key, ErrInvalidTimestamp)
+	}
+
+	genTime, err := tsa.Verify(token, timestampDigest(key, metadata.CreatedAt, metadata.Commitment()))
+	if err != nil {
+		return time.Time{}, fmt.Errorf("timecapsule: timestamp of %q: %w", key, err)
+	}
+
+	if skew := genTime.Sub(metadata.CreatedAt).Abs(); skew > MaxTimestampSkew {
+		return time.Time{}, fmt.Errorf("timecapsule: %q created %s from its timestamp: %w", key, skew, ErrInvalidTimestamp)
+	}
+
+	return genTime, nil
+}
+
+// timestampCapsule requests a token for a capsule being stored, checks it
+// as Peek will and returns the attribute holding it
+func timestampCapsule(ctx context.Context, tsa TimestampAuthority, key string, createdAt time.Time, commitment []byte) (map[string]string, error) {
+	token, err := tsa.Timestamp(ctx, timestampDigest(key, createdAt, commitment))
+	if err != nil {
+		return nil, err
+	}
+
+	attributes := map[string]string{
+		AttributeCommitment: hex.EncodeToString(commitment),
+		AttributeTimestamp:  base64.StdEncoding.EncodeToString(token),
+	}
+	if _, err := VerifyTimestamp(tsa, key, Metadata{CreatedAt: createdAt, Attributes: attributes}); err != nil {
+		return nil, err
+	}
+
+	delete(attributes, AttributeCommitment)
+	return attributes, nil
+}
+
+// checkTimestamp verifies the timestamp of a capsule. Capsules stored with
+// a timestamp authority always have a commitment, so a committed capsule
+// without a token has had it removed; capsules with neither were stored
+// without the authority and are accepted.
+func checkTimestamp(tsa TimestampAuthority, key string, metadata Metadata) error {
+	if tsa == nil || metadata.TimestampToken() == nil && metadata.Commitment() == nil {
+		return nil
+	}
+
+	_, err := VerifyTimestamp(tsa, key, metadata)
+	return err
+}
+
+// timestampDigest is the SHA-256 digest a capsule's timestamp token covers.
+// It leaves out the unlock time, which Delay may change.
+func timestampDigest(key string, createdAt time.Time, commitment []byte) []byte {
+	hash := sha256.New()
+	hash.Write([]byte(timestampDomain))
+	writeField(hash, []byte(key))
+
+	var created [8]byte
+	binary.BigEndian.PutUint64(created[:], uint64(createdAt.UnixNano()))
+	hash.Write(created[:])
+
+	writeField(hash, commitment)
+	return hash.Sum(nil)
+}
+
+// verifyTimestampToken parses and verifies a timestamp token, returning its
+// TSTInfo
+func verifyTimestampToken(token, digest []byte, roots, intermediates *x509.CertPool) (tstInfo, error) {
+	invalid := func(reason string) (tstInfo, error) {
+		return tstInfo{}, fmt.Errorf("timecapsule: %s: %w", reason, ErrInvalidTimestamp)
+	}
+
+	var content contentInfo
+	if rest, err := asn1.Unmarshal(token, &content); err != nil || len(rest) > 0 || !content.ContentType.Equal(oidSignedData) {
+		return invalid("not a CMS signed-data token")
+	}
+
+	var signed signedData
+	if rest, err := asn1.Unmarshal(content.Content.Bytes, &signed); err != nil || len(rest) > 0 {
+		return invalid("malformed signed data")
+	}
+
+	if !signed.EncapContentInfo.EContentType.Equal(oidTSTInfo) {
+		return invalid("token does not hold TSTInfo")
+	}
+
+	var econtent []byte
+	if _, err := asn1.Unmarshal(signed.EncapContentInfo.EContent.Bytes, &econtent); err != nil {
+		return invalid("malformed TSTInfo")
+	}
+
+	var info tstInfo
+	if rest, err := asn1.Unmarshal(econtent, &info); err != nil || len(rest) > 0 {
+		return invalid("malformed TSTInfo")
+	}
+
+	if !info.MessageImprint.HashAlgorithm.Algorithm.Equal(oidSHA256) || !bytes.Equal(info.MessageImprint.HashedMessage, digest) {
+		return invalid("token is over a different digest")
+	}
+
+	if len(signed.SignerInfos) != 1 {
+		return invalid("token must have one signer")
+	}
+	signer := signed.SignerInfos[0]
+
+	certs, err := x509.ParseCertificates(signed.Certificates.Bytes)
+	if err != nil {
+		return invalid("malformed certificates")
+	}
+
+	cert := signerCertificate(signer, certs)
+	if cert == nil {
+		return invalid("signing certificate not found")
+	}
+
+	if err := verifySignerInfo(signer, cert, econtent); err != nil {
+		return tstInfo{}, err
+	}
+
+	pool := x509.NewCertPool()
+	if intermediates != nil {
+		pool = intermediates.Clone()
+	}
+	for _, c := range certs {
+		pool.AddCert(c)
+	}
+
+	_, err = cert.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: pool,
+		CurrentTime:   info.GenTime,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageTimeStamping},
+	})
+	if err != nil {
+		return tstInfo{}, fmt.Errorf("timecapsule: timestamp certificate: %w: %w", ErrInvalidTimestamp, err)
+	}
+
+	return info, nil
+}
+
+// verifySignerInfo checks the signed attributes of signer against econtent
+// and their signature against cert
+func verifySignerInfo(signer signerInfo, cert *x509.Certificate, econtent []byte) error {
+	invalid := func(reason string) error {
+		return fmt.Errorf("timecapsule: %s: %w", reason, ErrInvalidTimestamp)
+	}
+
+	hash, ok := digestHash(signer.DigestAlgorithm.Algorithm)
+	if !ok {
+		return invalid("unsupported digest algorithm")
+	}
+
+	if len(signer.SignedAttrs.FullBytes) == 0 {
+		return invalid("token has no signed attributes")
+	}
+
+	// Signed attributes are signed with their universal SET tag rather
+	// than the implicit [0] tag they are sent with
+	signedAttrs := bytes.Clone(signer.SignedAttrs.FullBytes)
+	signedAttrs[0] = 0x31
+
+	var attrs []attribute
+	if _, err := asn1.UnmarshalWithParams(signedAttrs, &attrs, "set"); err != nil {
+		return invalid("malformed signed attributes")
+	}
+
+	var contentType asn1.ObjectIdentifier
+	var messageDigest []byte
+	for _, attr := range attrs {
+		switch {
+		case attr.Type.Equal(oidContentType):
+			_, err := asn1.Unmarshal(attr.Values.Bytes, &contentType)
+			if err != nil {
+				return invalid("malformed content type")
+			}
+		case attr.Type.Equal(oidMessageDigest):
+			_, err := asn1.Unmarshal(attr.Values.Bytes, &messageDigest)
+			if err != nil {
+				return invalid("malformed message digest")
+			}
+		}
+	}
+
+	h := hash.New()
+	h.Write(econtent)
+	if !contentType.Equal(oidTSTInfo) || !bytes.Equal(messageDigest, h.Sum(nil)) {
+		return invalid("signed attributes do not match TSTInfo")
+	}
+
+	algorithm, ok := signatureAlgorithm(signer.SignatureAlgorithm.Algorithm, hash)
+	if !ok {
+		return invalid("unsupported signature algorithm")
+	}
+
+	if err := cert.CheckSignature(algorithm, signedAttrs, signer.Signature); err != nil {
+		return invalid("bad signature")
+	}
+	return nil
+}
+
+// signerCertificate returns the certificate in certs identified by signer
+func signerCertificate(signer signerInfo, certs []*x509.Certificate) *x509.Certificate {
+	var issuerAndSerial issuerAndSerialNumber
+	isSerial := signer.SID.Class == asn1.ClassUniversal
+	if isSerial {
+		if _, err := asn1.Unmarshal(signer.SID.FullBytes, &issuerAndSerial); err != nil {
+			return nil
+		}
+	}
+
+	for _, cert := range certs {
+		if isSerial {
+			if bytes.Equal(cert.RawIssuer, issuerAndSerial.Issuer.FullBytes) && cert.SerialNumber.Cmp(issuerAndSerial.SerialNumber) == 0 {
+				return cert
+			}
+		} else if signer.SID.Class == asn1.ClassContextSpecific && signer.SID.Tag == 0 && bytes.Equal(cert.SubjectKeyId, signer.SID.Bytes) {
+			return cert
+		}
+	}
+	return nil
+}
+
+// digestHash maps a digest algorithm identifier to its hash
+func digestHash(oid asn1.ObjectIdentifier) (crypto.Hash, bool) {
+	switch {
+	case oid.Equal(oidSHA256):
+		return crypto.SHA256, true
+	case oid.Equal(oidSHA384):
+		return crypto.SHA384, true
+	case oid.Equal(oidSHA512):
+		return crypto.SHA512, true
+	}
+	return 0, false
+}
+
+// signatureAlgorithm maps a CMS signature algorithm, which may name only
+// the key type, and its digest to an x509 signature algorithm
+func signatureAlgorithm(oid asn1.ObjectIdentifier, hash crypto.Hash) (x509.SignatureAlgorithm, bool) {
+	switch {
+	case oid.Equal(oidEd25519):
+		return x509.PureEd25519, true
+	case oid.Equal(oidSHA256WithRSA):
+		return x509.SHA256WithRSA, true
+	case oid.Equal(oidSHA384WithRSA):
+		return x509.SHA384WithRSA, true
+	case oid.Equal(oidSHA512WithRSA):
+		return x509.SHA512WithRSA, true
+	case oid.Equal(oidECDSAWithSHA256):
+		return x509.ECDSAWithSHA256, true
+	case oid.Equal(oidECDSAWithSHA384):
+		return x509.ECDSAWithSHA384, true
+	case oid.Equal(oidECDSAWithSHA512):
+		return x509.ECDSAWithSHA512, true
+	case oid.Equal(oidRSAEncryption):
+		algorithm, ok := map[crypto.Hash]x509.SignatureAlgorithm{
+			crypto.SHA256: x509.SHA256WithRSA, crypto.SHA384: x509.SHA384WithRSA, crypto.SHA512: x509.SHA512WithRSA,
+		}[hash]
+		return algorithm, ok
+	case oid.Equal(oidECPublicKey):
+		algorithm, ok := map[crypto.Hash]x509.SignatureAlgorithm{
+			crypto.SHA256: x509.ECDSAWithSHA256, crypto.SHA384: x509.ECDSAWithSHA384, crypto.SHA512: x509.ECDSAWithSHA512,
+		}[hash]
+		return algorithm, ok
+	}
+	return 0, false
+}
+
+// ASN.1 structures of RFC 3161 and RFC 5652 (CMS)
+
+type messageImprint struct {
+	HashAlgorithm pkix.AlgorithmIdentifier
+	HashedMessage []byte
+}
+
+type timeStampReq struct {
+	Version        int
+	MessageImprint messageImprint
+	ReqPolicy      asn1.ObjectIdentifier `asn1:"optional"`
+	Nonce          *big.Int              `asn1:"optional"`
+	CertReq        bool                  `asn1:"optional"`
+	Extensions     asn1.RawValue         `asn1:"optional,tag:0"`
+}
+
+type pkiStatusInfo struct {
+	Status       int
+	StatusString asn1.RawValue  `asn1:"optional"`
+	FailInfo     asn1.BitString `asn1:"optional"`
+}
+
+type timeStampResp struct {
+	Status pkiStatusInfo
+	Token  asn1.RawValue `asn1:"optional"`
+}
+
+type contentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"explicit,tag:0"`
+}
+
+type encapsulatedContentInfo struct {
+	EContentType asn1.ObjectIdentifier
+	EContent     asn1.RawValue `asn1:"explicit,optional,tag:0"`
+}
+
+type signedData struct {
+	Version          int
+	DigestAlgorithms []pkix.AlgorithmIdentifier `asn1:"set"`
+	EncapContentInfo encapsulatedContentInfo
+	Certificates     asn1.RawValue `asn1:"optional,tag:0"`
+	CRLs             asn1.RawValue `asn1:"optional,tag:1"`
+	SignerInfos      []signerInfo  `asn1:"set"`
+}
+
+type issuerAndSerialNumber struct {
+	Issuer       asn1.RawValue
+	SerialNumber *big.Int
+}
+
+type signerInfo struct {
+	Version            int
+	SID                asn1.RawValue
+	DigestAlgorithm    pkix.AlgorithmIdentifier
+	SignedAttrs        asn1.RawValue `asn1:"optional,tag:0"`
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          []byte
+	UnsignedAttrs      asn1.RawValue `asn1:"optional,tag:1"`
+}
+
+type attribute struct {
+	Type   asn1.ObjectIdentifier
+	Values asn1.RawValue `asn1:"set"`
+}
+
+type accuracy struct {
+	Seconds int `asn1:"optional"`
+	Millis  int `asn1:"optional,tag:0"`
+	Micros  int `asn1:"optional,tag:1"`
+}
+
+type tstInfo struct {
+	Version        int
+	Policy         asn1.ObjectIdentifier
+	MessageImprint messageImprint
+	SerialNumber   *big.Int
+	GenTime        time.Time     `asn1:"generalized"`
+	Accuracy       accuracy      `asn1:"optional"`
+	Ordering       bool          `asn1:"optional"`
+	Nonce          *big.Int      `asn1:"optional"`
+	TSA            asn1.RawValue `asn1:"optional,tag:0"`
+	Extensions     asn1.RawValue `asn1:"optional,tag:1"`
+}
@@ -0,0 +1,333 @@
+package timecapsule
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/hex"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testTSA is an in-process RFC 3161 timestamp authority issuing ECDSA
+// tokens under a throwaway CA
+type testTSA struct {
+	server *httptest.Server
+	roots  *x509.CertPool
+	cert   *x509.Certificate
+	key    *ecdsa.PrivateKey
+
+	mu     sync.Mutex
+	offset time.Duration
+	status int
+	nonce  *big.Int
+	serial int64
+}
+
+// newTestTSA starts a timestamp authority stopped when the test ends
+func newTestTSA(t *testing.T) *testTSA {
+	t.Helper()
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test Root"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	require.NoError(t, err)
+	ca, err := x509.ParseCertificate(caDER)
+	require.NoError(t, err)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "Test TSA"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageTimeStamping},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	tsa := &testTSA{roots: x509.NewCertPool(), cert: cert, key: key}
+	tsa.roots.AddCert(ca)
+	tsa.server = httptest.NewServer(http.HandlerFunc(tsa.serve))
+	t.Cleanup(tsa.server.Close)
+	return tsa
+}
+
+// configure changes how the authority answers while it is serving
+func (a *testTSA) configure(fn func(a *testTSA)) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	fn(a)
+}
+
+// client returns a TSAClient trusting the authority's root
+func (a *testTSA) client(t *testing.T) *TSAClient {
+	t.Helper()
+
+	client, err := NewTSAClient(TSAConfig{URL: a.server.URL, Roots: a.roots})
+	require.NoError(t, err)
+	return client
+}
+
+func (a *testTSA) serve(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil || r.Header.Get("Content-Type") != timestampQueryType {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	var request timeStampReq
+	if _, err := asn1.Unmarshal(body, &request); err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	a.mu.Lock()
+	a.serial++
+	info := tstInfo{
+		Version:        1,
+		Policy:         asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 99999, 1},
+		MessageImprint: request.MessageImprint,
+		SerialNumber:   big.NewInt(a.serial),
+		GenTime:        time.Now().Add(a.offset).UTC().Truncate(time.Second),
+		Nonce:          request.Nonce,
+	}
+	if a.nonce != nil {
+		info.Nonce = a.nonce
+	}
+	status := a.status
+	a.mu.Unlock()
+
+	response := timeStampResp{Status: pkiStatusInfo{Status: status}}
+	if status <= 1 {
+		token, err := a.sign(info)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		response.Token = asn1.RawValue{FullBytes: token}
+	}
+
+	data, err := asn1.Marshal(response)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", timestampReplyType)
+	w.Write(data)
+}
+
+// sign wraps info in a CMS signed-data timestamp token
+func (a *testTSA) sign(info tstInfo) ([]byte, error) {
+	econtent, err := asn1.Marshal(info)
+	if err != nil {
+		return nil, err
+	}
+	octets, err := asn1.Marshal(econtent)
+	if err != nil {
+		return nil, err
+	}
+
+	contentType, err := asn1.Marshal(oidTSTInfo)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256(econtent)
+	messageDigest, err := asn1.Marshal(digest[:])
+	if err != nil {
+		return nil, err
+	}
+
+	signedAttrs, err := asn1.MarshalWithParams([]attribute{
+		{Type: oidContentType, Values: asn1.RawValue{Tag: asn1.TagSet, IsCompound: true, Bytes: contentType}},
+		{Type: oidMessageDigest, Values: asn1.RawValue{Tag: asn1.TagSet, IsCompound: true, Bytes: messageDigest}},
+	}, "set")
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.Sum256(signedAttrs)
+	signature, err := ecdsa.SignASN1(rand.Reader, a.key, hash[:])
+	if err != nil {
+		return nil, err
+	}
+
+	var attrs asn1.RawValue
+	if _, err := asn1.Unmarshal(signedAttrs, &attrs); err != nil {
+		return nil, err
+	}
+	sid, err := asn1.Marshal(issuerAndSerialNumber{Issuer: asn1.RawValue{FullBytes: a.cert.RawIssuer}, SerialNumber: a.cert.SerialNumber})
+	if err != nil {
+		return nil, err
+	}
+
+	signed, err := asn1.Marshal(signedData{
+		Version:          3,
+		DigestAlgorithms: []pkix.AlgorithmIdentifier{{Algorithm: oidSHA256}},
+		EncapContentInfo: encapsulatedContentInfo{
+			EContentType: oidTSTInfo,
+			EContent:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: octets},
+		},
+		Certificates: asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: a.cert.Raw},
+		SignerInfos: []signerInfo{{
+			Version:            1,
+			SID:                asn1.RawValue{FullBytes: sid},
+			DigestAlgorithm:    pkix.AlgorithmIdentifier{Algorithm: oidSHA256},
+			SignedAttrs:        asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: attrs.Bytes},
+			SignatureAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidECDSAWithSHA256},
+			Signature:          signature,
+		}},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return asn1.Marshal(contentInfo{
+		ContentType: oidSignedData,
+		Content:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: signed},
+	})
+}
+
+func TestTSAClient(t *testing.T) {
+	tsa := newTestTSA(t)
+	client := tsa.client(t)
+	ctx := context.Background()
+
+	digest := sha256.Sum256([]byte("capsule"))
+	token, err := client.Timestamp(ctx, digest[:])
+	require.NoError(t, err)
+
+	genTime, err := client.Verify(token, digest[:])
+	require.NoError(t, err)
+	assert.WithinDuration(t, time.Now(), genTime, 2*time.Second)
+
+	// Tokens cover one digest and are trusted only under their roots
+	other := sha256.Sum256([]byte("other"))
+	_, err = client.Verify(token, other[:])
+	assert.ErrorIs(t, err, ErrInvalidTimestamp)
+
+	_, err = VerifyTimestampToken(token, digest[:], newTestTSA(t).roots, nil)
+	assert.ErrorIs(t, err, ErrInvalidTimestamp)
+
+	tampered := append([]byte(nil), token...)
+	tampered[len(tampered)-5] ^= 1
+	_, err = client.Verify(tampered, digest[:])
+	assert.ErrorIs(t, err, ErrInvalidTimestamp)
+
+	// Replayed responses and rejections are refused
+	tsa.configure(func(a *testTSA) { a.nonce = big.NewInt(42) })
+	_, err = client.Timestamp(ctx, digest[:])
+	assert.ErrorIs(t, err, ErrInvalidTimestamp)
+	tsa.configure(func(a *testTSA) { a.nonce = nil })
+
+	tsa.configure(func(a *testTSA) { a.status = 2 })
+	_, err = client.Timestamp(ctx, digest[:])
+	assert.ErrorIs(t, err, ErrTimestampRejected)
+
+	_, err = NewTSAClient(TSAConfig{URL: tsa.server.URL})
+	assert.Error(t, err)
+}
+
+func TestTimestampCapsules(t *testing.T) {
+	storage, err := NewFileStorage(t.TempDir())
+	require.NoError(t, err)
+	defer storage.Close()
+
+	tsa := newTestTSA(t)
+	client := tsa.client(t)
+
+	capsules := map[string]testCapsule[string]{
+		"memory":     New[string](WithTimestampAuthority(client)),
+		"persistent": NewWithStorage(storage, NewJSONCodec[string](), WithTimestampAuthority(client)),
+	}
+
+	for name, capsule := range capsules {
+		t.Run(name, func(t *testing.T) {
+			defer capsule.Close()
+			ctx := context.Background()
+
+			require.NoError(t, capsule.Store(ctx, "report", "v", time.Now().Add(time.Hour)))
+
+			metadata, err := capsule.Peek(ctx, "report")
+			require.NoError(t, err)
+			require.NotNil(t, metadata.TimestampToken())
+			assert.NotNil(t, metadata.Commitment())
+
+			genTime, err := VerifyTimestamp(client, "report", metadata)
+			require.NoError(t, err)
+			assert.WithinDuration(t, metadata.CreatedAt, genTime, MaxTimestampSkew)
+
+			// Delaying the capsule keeps its timestamp valid
+			require.NoError(t, capsule.Delay(ctx, "report", time.Minute))
+			_, err = capsule.Peek(ctx, "report")
+			require.NoError(t, err)
+
+			// The token must match the capsule it is attached to
+			moved := metadata
+			_, err = VerifyTimestamp(client, "other", moved)
+			assert.ErrorIs(t, err, ErrInvalidTimestamp)
+
+			backdated := metadata
+			backdated.CreatedAt = backdated.CreatedAt.Add(-time.Hour)
+			_, err = VerifyTimestamp(client, "report", backdated)
+			assert.ErrorIs(t, err, ErrInvalidTimestamp)
+
+			// A TSA whose clock disagrees with ours fails the store
+			tsa.configure(func(a *testTSA) { a.offset = 2 * MaxTimestampSkew })
+			assert.ErrorIs(t, capsule.Store(ctx, "skewed", "v", time.Now()), ErrInvalidTimestamp)
+			assert.False(t, capsule.Exists(ctx, "skewed"))
+			tsa.configure(func(a *testTSA) { a.offset = 0 })
+		})
+	}
+
+	// Peek rejects a record whose commitment was swapped in storage
+	capsule := NewWithStorage(storage, NewJSONCodec[string](), WithTimestampAuthority(client))
+	defer capsule.Close()
+	ctx := context.Background()
+
+	require.NoError(t, storage.UpdateAttributes(ctx, "report", func(attributes map[string]string) (map[string]string, error) {
+		attributes[AttributeCommitment] = hex.EncodeToString(make([]byte, 32))
+		return attributes, nil
+	}))
+	_, err = capsule.Peek(ctx, "report")
+	assert.ErrorIs(t, err, ErrInvalidTimestamp)
+
+	// Or whose token was removed
+	require.NoError(t, capsule.Store(ctx, "stripped", "v", time.Now().Add(time.Hour)))
+	require.NoError(t, storage.UpdateAttributes(ctx, "stripped", func(attributes map[string]string) (map[string]string, error) {
+		delete(attributes, AttributeTimestamp)
+		return attributes, nil
+	}))
+	_, err = capsule.Peek(ctx, "stripped")
+	assert.ErrorIs(t, err, ErrInvalidTimestamp)
+
+	// Capsules stored without the authority have neither and are accepted
+	require.NoError(t, storage.Store(ctx, "plain", []byte(`"v"`), time.Now().Add(time.Hour)))
+	_, err = capsule.Peek(ctx, "plain")
+	assert.NoError(t, err)
+}
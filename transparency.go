@@ -0,0 +1,471 @@
+package timecapsule
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/bits"
+	"sync"
+	"time"
+)
+
+// DefaultTransparencyPrefix prefixes the keys under which a TransparencyLog
+// stores its leaves when no prefix is given
+const DefaultTransparencyPrefix = "transparency/"
+
+// Domain separators for transparency log leaves and tree heads. Leaf and
+// node hashes are also prefixed with 0 and 1 as in RFC 6962.
+const (
+	transparencyLeafDomain = "timecapsule transparency leaf v1\x00"
+	treeHeadDomain         = "timecapsule tree head v1\x00"
+)
+
+// Transparency log errors
+var (
+	ErrLeafNotFound    = errors.New("capsule is not in the transparency log")
+	ErrInvalidTreeSize = errors.New("tree size out of range")
+	ErrInvalidTreeHead = errors.New("tree head signature does not match")
+	ErrInvalidProof    = errors.New("proof does not match tree head")
+	ErrSignerRequired  = errors.New("transparency log requires an Ed25519 private key")
+)
+
+// TransparencyLeaf is the entry a TransparencyLog keeps for a stored
+// capsule. Commitment is the capsule's commit-reveal commitment, so leaves
+// reveal nothing about values until they are revealed.
+type TransparencyLeaf struct {
+	Index      uint64    `json:"index"`
+	Key        string    `json:"key"`
+	CreatedAt  time.Time `json:"created_at"`
+	UnlockTime time.Time `json:"unlock_time"`
+	Commitment []byte    `json:"commitment"`
+}
+
+// hash returns the RFC 6962 leaf hash of the leaf, which covers everything
+// but its index
+func (l TransparencyLeaf) hash() []byte {
+	hash := sha256.New()
+	hash.Write([]byte{0})
+	hash.Write([]byte(transparencyLeafDomain))
+	writeField(hash, []byte(l.Key))
+
+	var times [16]byte
+	binary.BigEndian.PutUint64(times[0:], uint64(l.CreatedAt.UnixNano()))
+	binary.BigEndian.PutUint64(times[8:], uint64(l.UnlockTime.UnixNano()))
+	hash.Write(times[:])
+
+	writeField(hash, l.Commitment)
+	return hash.Sum(nil)
+}
+
+// TreeHead is a signed root hash of the first Size leaves of a transparency
+// log, proving the set of capsules stored by Time
+type TreeHead struct {
+	Size      uint64    `json:"size"`
+	Time      time.Time `json:"time"`
+	Root      []byte    `json:"root"`
+	Signature []byte    `json:"signature"`
+}
+
+// message returns the bytes a tree head's signature covers
+func (h TreeHead) message() []byte {
+	var buf bytes.Buffer
+	buf.WriteString(treeHeadDomain)
+
+	var fields [16]byte
+	binary.BigEndian.PutUint64(fields[0:], h.Size)
+	binary.BigEndian.PutUint64(fields[8:], uint64(h.Time.UnixNano()))
+	buf.Write(fields[:])
+
+	writeField(&buf, h.Root)
+	return buf.Bytes()
+}
+
+// InclusionProof proves that a leaf is among the first Size leaves of a log
+type InclusionProof struct {
+	Index  uint64   `json:"index"`
+	Size   uint64   `json:"size"`
+	Hashes [][]byte `json:"hashes"`
+}
+
+// ConsistencyProof proves that the first OldSize leaves of a log are
+// unchanged in its first NewSize leaves
+type ConsistencyProof struct {
+	OldSize uint64   `json:"old_size"`
+	NewSize uint64   `json:"new_size"`
+	Hashes  [][]byte `json:"hashes"`
+}
+
+// TransparencyLog is an append-only Merkle tree of stored capsules, in the
+// style of RFC 6962 Certificate Transparency. Capsules created with
+// WithTransparencyLog are appended on Store. Signed tree heads commit to
+// every capsule stored so far; inclusion and consistency proofs let clients
+// check a capsule against a head and that the log only ever grew.
+type TransparencyLog struct {
+	storage Storage
+	prefix  string
+	signer  ed25519.PrivateKey
+	clock   Clock
+
+	mu     sync.RWMutex
+	leaves []TransparencyLeaf
+	hashes [][]byte
+	keys   map[string][]uint64
+}
+
+// NewTransparencyLog returns a log signing tree heads with signer. Leaves
+// are stored unlocked in storage under prefix, or DefaultTransparencyPrefix
+// if prefix is empty, and loaded from it, which requires a storage
+// implementing ListStorage other than the logged capsules'. A nil storage
+// keeps the log in memory only.
+func NewTransparencyLog(ctx context.Context, storage Storage, prefix string, signer ed25519.PrivateKey, opts ...Option) (*TransparencyLog, error) {
+	if len(signer) != ed25519.PrivateKeySize {
+		return nil, ErrSignerRequired
+	}
+
+	if prefix == "" {
+		prefix = DefaultTransparencyPrefix
+	}
+
+	o := newOptions(opts...)
+	l := &TransparencyLog{
+		storage: storage,
+		prefix:  prefix,
+		signer:  signer,
+		clock:   o.clock,
+		keys:    make(map[string][]uint64),
+	}
+
+	if storage != nil {
+		if err := l.load(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	return l, nil
+}
+
+// PublicKey returns the key clients verify tree heads with
+func (l *TransparencyLog) PublicKey() ed25519.PublicKey {
+	return l.signer.Public().(ed25519.PublicKey)
+}
+
+// Append adds a leaf for the capsule stored under key and returns it with
+// its index
+func (l *TransparencyLog) Append(ctx context.Context, key string, createdAt, unlockTime time.Time, commitment []byte) (TransparencyLeaf, error) {
+	if err := ctx.Err(); err != nil {
+		return TransparencyLeaf{}, err
+	}
+
+	if key == "" {
+		return TransparencyLeaf{}, ErrInvalidKey
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	leaf := TransparencyLeaf{
+		Index:      uint64(len(l.leaves)),
+		Key:        key,
+		CreatedAt:  createdAt.UTC(),
+		UnlockTime: unlockTime.UTC(),
+		Commitment: bytes.Clone(commitment),
+	}
+
+	if l.storage != nil {
+		data, err := json.Marshal(leaf)
+		if err != nil {
+			return TransparencyLeaf{}, fmt.Errorf("timecapsule: encode transparency leaf: %w", err)
+		}
+
+		storageKey := l.key(leaf.Index)
+		if l.storage.Exists(ctx, storageKey) {
+			return TransparencyLeaf{}, fmt.Errorf("timecapsule: transparency leaf %d already exists", leaf.Index)
+		}
+
+		if err := l.storage.Store(ctx, storageKey, data, auditEpoch); err != nil {
+			return TransparencyLeaf{}, err
+		}
+	}
+
+	l.add(leaf)
+	return leaf, nil
+}
+
+// Size returns the number of leaves in the log
+func (l *TransparencyLog) Size() uint64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	return uint64(len(l.leaves))
+}
+
+// Head returns a signed tree head over every leaf in the log
+func (l *TransparencyLog) Head() TreeHead {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	head := TreeHead{
+		Size: uint64(len(l.hashes)),
+		Time: l.clock.Now().UTC(),
+		Root: merkleRoot(l.hashes),
+	}
+	head.Signature = ed25519.Sign(l.signer, head.message())
+	return head
+}
+
+// ProveInclusion returns the latest leaf for key among the first size
+// leaves and the proof that it is included in them. It returns
+// ErrLeafNotFound if key was not stored by then.
+func (l *TransparencyLog) ProveInclusion(key string, size uint64) (TransparencyLeaf, InclusionProof, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if size > uint64(len(l.hashes)) {
+		return TransparencyLeaf{}, InclusionProof{}, ErrInvalidTreeSize
+	}
+
+	indexes := l.keys[key]
+	for i := len(indexes) - 1; i >= 0; i-- {
+		if index := indexes[i]; index < size {
+			proof := InclusionProof{Index: index, Size: size, Hashes: inclusionPath(index, l.hashes[:size])}
+			return l.leaves[index], proof, nil
+		}
+	}
+
+	return TransparencyLeaf{}, InclusionProof{}, fmt.Errorf("timecapsule: %q: %w", key, ErrLeafNotFound)
+}
+
+// ProveConsistency returns the proof that the first oldSize leaves are
+// unchanged in the first newSize leaves
+func (l *TransparencyLog) ProveConsistency(oldSize, newSize uint64) (ConsistencyProof, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if oldSize > newSize || newSize > uint64(len(l.hashes)) {
+		return ConsistencyProof{}, ErrInvalidTreeSize
+	}
+
+	proof := ConsistencyProof{OldSize: oldSize, NewSize: newSize}
+	if oldSize > 0 && oldSize < newSize {
+		proof.Hashes = consistencyPath(oldSize, l.hashes[:newSize], true)
+	}
+	return proof, nil
+}
+
+// add appends leaf to the in-memory tree
+func (l *TransparencyLog) add(leaf TransparencyLeaf) {
+	l.leaves = append(l.leaves, leaf)
+	l.hashes = append(l.hashes, leaf.hash())
+	l.keys[leaf.Key] = append(l.keys[leaf.Key], leaf.Index)
+}
+
+// load reads the stored leaves in index order
+func (l *TransparencyLog) load(ctx context.Context) error {
+	opts := ListOptions{Prefix: l.prefix}
+	for {
+		page, err := listStorage(ctx, l.storage, opts)
+		if err != nil {
+			return err
+		}
+
+		for _, item := range page.Items {
+			data, err := l.storage.Open(ctx, item.Key)
+			if err != nil {
+				return err
+			}
+
+			var leaf TransparencyLeaf
+			if err := json.Unmarshal(data, &leaf); err != nil || leaf.Index != uint64(len(l.leaves)) || item.Key != l.key(leaf.Index) {
+				return fmt.Errorf("timecapsule: invalid transparency leaf %q", item.Key)
+			}
+			l.add(leaf)
+		}
+
+		if page.NextCursor == "" {
+			return nil
+		}
+		opts.Cursor = page.NextCursor
+	}
+}
+
+// key returns the storage key of the leaf with the given index, zero-padded
+// so keys sort in index order
+func (l *TransparencyLog) key(index uint64) string {
+	return fmt.Sprintf("%s%020d", l.prefix, index)
+}
+
+// VerifyTreeHead checks that head was signed by publicKey
+func VerifyTreeHead(publicKey ed25519.PublicKey, head TreeHead) error {
+	if len(publicKey) != ed25519.PublicKeySize || !ed25519.Verify(publicKey, head.message(), head.Signature) {
+		return ErrInvalidTreeHead
+	}
+	return nil
+}
+
+// VerifyInclusion checks that head was signed by publicKey and that proof
+// shows leaf among the leaves it covers
+func VerifyInclusion(publicKey ed25519.PublicKey, head TreeHead, leaf TransparencyLeaf, proof InclusionProof) error {
+	if err := VerifyTreeHead(publicKey, head); err != nil {
+		return err
+	}
+
+	if proof.Size != head.Size || proof.Index != leaf.Index || proof.Index >= proof.Size {
+		return ErrInvalidProof
+	}
+
+	fn, sn := proof.Index, proof.Size-1
+	root := leaf.hash()
+	for _, hash := range proof.Hashes {
+		if sn == 0 {
+			return ErrInvalidProof
+		}
+
+		if fn&1 == 1 || fn == sn {
+			root = nodeHash(hash, root)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			root = nodeHash(root, hash)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+
+	if sn != 0 || !bytes.Equal(root, head.Root) {
+		return ErrInvalidProof
+	}
+	return nil
+}
+
+// VerifyConsistency checks that both heads were signed by publicKey and
+// that proof shows the leaves covered by oldHead unchanged in newHead
+func VerifyConsistency(publicKey ed25519.PublicKey, oldHead, newHead TreeHead, proof ConsistencyProof) error {
+	if err := VerifyTreeHead(publicKey, oldHead); err != nil {
+		return err
+	}
+	if err := VerifyTreeHead(publicKey, newHead); err != nil {
+		return err
+	}
+
+	if proof.OldSize != oldHead.Size || proof.NewSize != newHead.Size || oldHead.Size > newHead.Size {
+		return ErrInvalidProof
+	}
+
+	switch {
+	case oldHead.Size == newHead.Size:
+		if len(proof.Hashes) != 0 || !bytes.Equal(oldHead.Root, newHead.Root) {
+			return ErrInvalidProof
+		}
+		return nil
+	case oldHead.Size == 0:
+		if len(proof.Hashes) != 0 {
+			return ErrInvalidProof
+		}
+		return nil
+	case len(proof.Hashes) == 0:
+		return ErrInvalidProof
+	}
+
+	path := proof.Hashes
+	if bits.OnesCount64(oldHead.Size) == 1 {
+		path = append([][]byte{oldHead.Root}, path...)
+	}
+
+	fn, sn := oldHead.Size-1, newHead.Size-1
+	for fn&1 == 1 {
+		fn >>= 1
+		sn >>= 1
+	}
+
+	oldRoot, newRoot := path[0], path[0]
+	for _, hash := range path[1:] {
+		if sn == 0 {
+			return ErrInvalidProof
+		}
+
+		if fn&1 == 1 || fn == sn {
+			oldRoot = nodeHash(hash, oldRoot)
+			newRoot = nodeHash(hash, newRoot)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			newRoot = nodeHash(newRoot, hash)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+
+	if sn != 0 || !bytes.Equal(oldRoot, oldHead.Root) || !bytes.Equal(newRoot, newHead.Root) {
+		return ErrInvalidProof
+	}
+	return nil
+}
+
+// nodeHash returns the RFC 6962 hash of an interior node
+func nodeHash(left, right []byte) []byte {
+	hash := sha256.New()
+	hash.Write([]byte{1})
+	hash.Write(left)
+	hash.Write(right)
+	return hash.Sum(nil)
+}
+
+// merkleRoot returns the RFC 6962 root of a tree with the given leaf hashes
+func merkleRoot(hashes [][]byte) []byte {
+	switch len(hashes) {
+	case 0:
+		root := sha256.Sum256(nil)
+		return root[:]
+	case 1:
+		return hashes[0]
+	}
+
+	k := splitPoint(uint64(len(hashes)))
+	return nodeHash(merkleRoot(hashes[:k]), merkleRoot(hashes[k:]))
+}
+
+// inclusionPath returns the RFC 6962 audit path of the leaf at index
+func inclusionPath(index uint64, hashes [][]byte) [][]byte {
+	if len(hashes) <= 1 {
+		return nil
+	}
+
+	k := splitPoint(uint64(len(hashes)))
+	if index < k {
+		return append(inclusionPath(index, hashes[:k]), merkleRoot(hashes[k:]))
+	}
+	return append(inclusionPath(index-k, hashes[k:]), merkleRoot(hashes[:k]))
+}
+
+// consistencyPath returns the RFC 6962 consistency proof between the first
+// size leaves and all of hashes. complete reports whether the subtree of
+// size leaves is a complete subtree the verifier already knows.
+func consistencyPath(size uint64, hashes [][]byte, complete bool) [][]byte {
+	n := uint64(len(hashes))
+	if size == n {
+		if complete {
+			return nil
+		}
+		return [][]byte{merkleRoot(hashes)}
+	}
+
+	k := splitPoint(n)
+	if size <= k {
+		return append(consistencyPath(size, hashes[:k], complete), merkleRoot(hashes[k:]))
+	}
+	return append(consistencyPath(size-k, hashes[k:], false), merkleRoot(hashes[:k]))
+}
+
+// splitPoint returns the largest power of two smaller than n, for n > 1
+func splitPoint(n uint64) uint64 {
+	return 1 << (bits.Len64(n-1) - 1)
+}
@@ -0,0 +1,203 @@
+package timecapsule
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTransparencyLogProofs(t *testing.T) {
+	_, signer, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	log, err := NewTransparencyLog(ctx, nil, "", signer)
+	require.NoError(t, err)
+	publicKey := log.PublicKey()
+
+	empty := log.Head()
+	require.NoError(t, VerifyTreeHead(publicKey, empty))
+	assert.Equal(t, uint64(0), empty.Size)
+
+	// Every leaf of every tree size, and every pair of sizes, up to a few
+	// levels of unbalanced trees
+	heads := []TreeHead{empty}
+	var leaves []TransparencyLeaf
+	for i := range 17 {
+		leaf, err := log.Append(ctx, fmt.Sprintf("key-%d", i), time.Now(), time.Now().Add(time.Hour), []byte{byte(i)})
+		require.NoError(t, err)
+		leaves = append(leaves, leaf)
+		heads = append(heads, log.Head())
+	}
+
+	for _, head := range heads[1:] {
+		for _, leaf := range leaves[:head.Size] {
+			got, proof, err := log.ProveInclusion(leaf.Key, head.Size)
+			require.NoError(t, err)
+			assert.Equal(t, leaf, got)
+			require.NoError(t, VerifyInclusion(publicKey, head, leaf, proof), "leaf %d of %d", leaf.Index, head.Size)
+
+			if len(proof.Hashes) > 0 {
+				proof.Hashes[0] = bytes.Repeat([]byte{1}, 32)
+				assert.ErrorIs(t, VerifyInclusion(publicKey, head, leaf, proof), ErrInvalidProof)
+			}
+		}
+
+		_, _, err := log.ProveInclusion(fmt.Sprintf("key-%d", head.Size), head.Size)
+		assert.ErrorIs(t, err, ErrLeafNotFound)
+	}
+
+	for _, oldHead := range heads {
+		for _, newHead := range heads[oldHead.Size:] {
+			proof, err := log.ProveConsistency(oldHead.Size, newHead.Size)
+			require.NoError(t, err)
+			require.NoError(t, VerifyConsistency(publicKey, oldHead, newHead, proof), "%d to %d", oldHead.Size, newHead.Size)
+
+			if len(proof.Hashes) > 0 {
+				proof.Hashes[len(proof.Hashes)-1] = bytes.Repeat([]byte{1}, 32)
+				assert.ErrorIs(t, VerifyConsistency(publicKey, oldHead, newHead, proof), ErrInvalidProof)
+			}
+		}
+	}
+
+	_, err = log.ProveConsistency(5, 18)
+	assert.ErrorIs(t, err, ErrInvalidTreeSize)
+
+	// A leaf must match what was logged
+	head := log.Head()
+	leaf, proof, err := log.ProveInclusion("key-3", head.Size)
+	require.NoError(t, err)
+	forged := leaf
+	forged.UnlockTime = forged.UnlockTime.Add(-time.Hour)
+	assert.ErrorIs(t, VerifyInclusion(publicKey, head, forged, proof), ErrInvalidProof)
+
+	// Heads are only trusted with a valid signature
+	forgedHead := head
+	forgedHead.Root = heads[3].Root
+	assert.ErrorIs(t, VerifyTreeHead(publicKey, forgedHead), ErrInvalidTreeHead)
+	assert.ErrorIs(t, VerifyInclusion(publicKey, forgedHead, leaf, proof), ErrInvalidTreeHead)
+
+	// A rewritten history is inconsistent with earlier heads
+	other, err := NewTransparencyLog(ctx, nil, "", signer)
+	require.NoError(t, err)
+	for i := range 17 {
+		_, err := other.Append(ctx, fmt.Sprintf("other-%d", i), time.Now(), time.Now(), nil)
+		require.NoError(t, err)
+	}
+	proof2, err := other.ProveConsistency(5, 17)
+	require.NoError(t, err)
+	assert.ErrorIs(t, VerifyConsistency(publicKey, heads[5], other.Head(), proof2), ErrInvalidProof)
+
+	_, err = NewTransparencyLog(ctx, nil, "", nil)
+	assert.ErrorIs(t, err, ErrSignerRequired)
+}
+
+func TestTransparencyLogCapsules(t *testing.T) {
+	storage, err := NewFileStorage(t.TempDir())
+	require.NoError(t, err)
+	defer storage.Close()
+	leaves, err := NewFileStorage(t.TempDir())
+	require.NoError(t, err)
+	defer leaves.Close()
+	ctx := context.Background()
+
+	_, signer, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	for name, newCapsule := range map[string]func(*TransparencyLog) testCapsule[bid]{
+		"memory": func(log *TransparencyLog) testCapsule[bid] { return New[bid](WithTransparencyLog(log)) },
+		"persistent": func(log *TransparencyLog) testCapsule[bid] {
+			return NewWithStorage(storage, NewJSONCodec[bid](), WithTransparencyLog(log))
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			prefix := name + "/"
+			log, err := NewTransparencyLog(ctx, leaves, prefix, signer)
+			require.NoError(t, err)
+
+			capsule := newCapsule(log)
+			defer capsule.Close()
+
+			unlockTime := time.Now().Add(time.Hour)
+			value := bid{Bidder: "acme", Amount: 1200}
+			require.NoError(t, capsule.Store(ctx, name+"/acme", value, unlockTime))
+			require.NoError(t, capsule.Store(ctx, name+"/globex", bid{Bidder: "globex"}, unlockTime))
+			oldHead := log.Head()
+
+			// The leaf holds the capsule's commitment and recorded times
+			leaf, proof, err := log.ProveInclusion(name+"/acme", oldHead.Size)
+			require.NoError(t, err)
+			require.NoError(t, VerifyInclusion(log.PublicKey(), oldHead, leaf, proof))
+
+			metadata, err := capsule.Peek(ctx, name+"/acme")
+			require.NoError(t, err)
+			assert.Equal(t, metadata.Commitment(), leaf.Commitment)
+			assert.True(t, metadata.CreatedAt.Equal(leaf.CreatedAt))
+			assert.True(t, unlockTime.Equal(leaf.UnlockTime))
+
+			// Once revealed, the value is tied to the published head
+			require.NoError(t, capsule.Delay(ctx, name+"/acme", -2*time.Hour))
+			reveal, err := capsule.Reveal(ctx, name+"/acme")
+			require.NoError(t, err)
+			require.NoError(t, reveal.Verify(leaf.Commitment))
+
+			// The log only grows, and reloads from storage
+			require.NoError(t, capsule.Store(ctx, name+"/initech", bid{Bidder: "initech"}, unlockTime))
+			newHead := log.Head()
+			consistency, err := log.ProveConsistency(oldHead.Size, newHead.Size)
+			require.NoError(t, err)
+			require.NoError(t, VerifyConsistency(log.PublicKey(), oldHead, newHead, consistency))
+
+			reloaded, err := NewTransparencyLog(ctx, leaves, prefix, signer)
+			require.NoError(t, err)
+			assert.Equal(t, uint64(3), reloaded.Size())
+			assert.Equal(t, newHead.Root, reloaded.Head().Root)
+		})
+	}
+}
+
+// rejectingStorage fails every plain Store, as transparency leaves are
+// written
+type rejectingStorage struct {
+	fullStorage
+}
+
+func (rejectingStorage) Store(context.Context, string, []byte, time.Time) error {
+	return assert.AnError
+}
+
+func TestTransparencyLogFailure(t *testing.T) {
+	storage, err := NewFileStorage(t.TempDir())
+	require.NoError(t, err)
+	defer storage.Close()
+	leaves, err := NewFileStorage(t.TempDir())
+	require.NoError(t, err)
+	defer leaves.Close()
+	ctx := context.Background()
+
+	_, signer, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	log, err := NewTransparencyLog(ctx, rejectingStorage{leaves}, "", signer)
+	require.NoError(t, err)
+
+	// A capsule whose leaf cannot be appended is not kept
+	for name, capsule := range map[string]testCapsule[bid]{
+		"memory":     New[bid](WithTransparencyLog(log)),
+		"persistent": NewWithStorage(storage, NewJSONCodec[bid](), WithTransparencyLog(log)),
+	} {
+		t.Run(name, func(t *testing.T) {
+			defer capsule.Close()
+
+			assert.ErrorIs(t, capsule.Store(ctx, "acme", bid{Bidder: "acme"}, time.Now()), assert.AnError)
+			assert.False(t, capsule.Exists(ctx, "acme"))
+			assert.Zero(t, log.Size())
+		})
+	}
+}
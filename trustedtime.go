@@ -0,0 +1,278 @@
+package timecapsule
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// DefaultHighWaterMarkKey is the key under which a HighWaterMark stores its
+// mark when no key is given
+const DefaultHighWaterMarkKey = "high-water-mark"
+
+// signedTimeDomain separates signed time responses from other signatures
+const signedTimeDomain = "timecapsule signed time v1\x00"
+
+// signedTimeNonceSize is the size of the nonce sent with a time request
+const signedTimeNonceSize = 32
+
+// Trusted time errors
+var (
+	ErrClockSkew         = errors.New("local clock is ahead of trusted time")
+	ErrClockRollback     = errors.New("time went backwards")
+	ErrInvalidSignedTime = errors.New("signed time response does not verify")
+)
+
+// TimeSource is a source of time that does not depend on the local clock,
+// consulted by WithTrustedTime before a capsule is unlocked
+type TimeSource interface {
+	// Now returns the current time according to the source
+	Now(ctx context.Context) (time.Time, error)
+}
+
+// trustedTime checks unlock windows against a TimeSource as well as the
+// local clock, so moving the local clock alone cannot unlock a capsule
+type trustedTime struct {
+	source    TimeSource
+	clock     Clock
+	tolerance time.Duration
+
+	mu   sync.Mutex
+	last time.Time
+}
+
+// newTrustedTime returns the trusted time configured by WithTrustedTime, or
+// nil without a source
+func newTrustedTime(o options) *trustedTime {
+	if o.timeSource == nil {
+		return nil
+	}
+
+	return &trustedTime{source: o.timeSource, clock: o.clock, tolerance: max(o.timeTolerance, 0)}
+}
+
+// checkWindow checks a capsule's unlock window against trusted time. A nil
+// trustedTime accepts every window, leaving the check to the local clock.
+func (t *trustedTime) checkWindow(ctx context.Context, unlockTime, expiresAt time.Time, attributes map[string]string) error {
+	if t == nil {
+		return nil
+	}
+
+	now, err := t.now(ctx)
+	if err != nil {
+		return err
+	}
+
+	return checkWindow(unlockTime, expiresAt, now, attributes)
+}
+
+// now reads the source and compares it with the local clock, failing if
+// they disagree by more than the tolerance or if trusted time went back
+// past the latest time it returned
+func (t *trustedTime) now(ctx context.Context) (time.Time, error) {
+	trusted, err := t.source.Now(ctx)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("timecapsule: trusted time: %w", err)
+	}
+	local := t.clock.Now()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if trusted.Before(t.last.Add(-t.tolerance)) {
+		return time.Time{}, fmt.Errorf("timecapsule: trusted time %s before %s: %w", trusted.Format(time.RFC3339Nano), t.last.Format(time.RFC3339Nano), ErrClockRollback)
+	}
+
+	switch skew := local.Sub(trusted); {
+	case skew > t.tolerance:
+		return time.Time{}, fmt.Errorf("timecapsule: local clock %s ahead: %w", skew, ErrClockSkew)
+	case skew < -t.tolerance:
+		return time.Time{}, fmt.Errorf("timecapsule: local clock %s behind: %w", -skew, ErrClockRollback)
+	}
+
+	if trusted.After(t.last) {
+		t.last = trusted
+	}
+	return trusted, nil
+}
+
+// SignedTime is a time server's signed answer to a time request. The
+// signature covers the request's nonce, so a response cannot be replayed.
+type SignedTime struct {
+	Time      time.Time `json:"time"`
+	Nonce     []byte    `json:"nonce"`
+	Signature []byte    `json:"signature"`
+}
+
+// Verify checks that the response was signed by publicKey in answer to a
+// request carrying nonce
+func (s SignedTime) Verify(publicKey ed25519.PublicKey, nonce []byte) error {
+	if len(publicKey) != ed25519.PublicKeySize || !bytes.Equal(s.Nonce, nonce) ||
+		!ed25519.Verify(publicKey, s.message(), s.Signature) {
+		return ErrInvalidSignedTime
+	}
+	return nil
+}
+
+// message returns the bytes covered by the signature
+func (s SignedTime) message() []byte {
+	message := []byte(signedTimeDomain)
+	message = binary.BigEndian.AppendUint16(message, uint16(len(s.Nonce)))
+	message = append(message, s.Nonce...)
+	return binary.BigEndian.AppendUint64(message, uint64(s.Time.UnixNano()))
+}
+
+// TimeServer answers time requests with signed responses, in the manner of
+// Roughtime
+type TimeServer interface {
+	// SignedTime returns the server's current time signed together with
+	// nonce
+	SignedTime(ctx context.Context, nonce []byte) (SignedTime, error)
+}
+
+// SignedTimeSource is a TimeSource that asks a TimeServer for the time and
+// verifies its signature, so the time cannot be forged by the local host or
+// the network in between
+type SignedTimeSource struct {
+	server    TimeServer
+	publicKey ed25519.PublicKey
+}
+
+// NewSignedTimeSource returns a TimeSource trusting responses from server
+// signed by publicKey
+func NewSignedTimeSource(server TimeServer, publicKey ed25519.PublicKey) (*SignedTimeSource, error) {
+	if len(publicKey) != ed25519.PublicKeySize {
+		return nil, errors.New("timecapsule: time server public key must be an Ed25519 public key")
+	}
+
+	return &SignedTimeSource{server: server, publicKey: publicKey}, nil
+}
+
+// Now sends the server a fresh nonce and returns the time in its verified
+// response
+func (s *SignedTimeSource) Now(ctx context.Context) (time.Time, error) {
+	if err := ctx.Err(); err != nil {
+		return time.Time{}, err
+	}
+
+	nonce := make([]byte, signedTimeNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return time.Time{}, fmt.Errorf("timecapsule: generate nonce: %w", err)
+	}
+
+	response, err := s.server.SignedTime(ctx, nonce)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if err := response.Verify(s.publicKey, nonce); err != nil {
+		return time.Time{}, err
+	}
+	return response.Time, nil
+}
+
+// LocalTimeServer is an in-process TimeServer for tests and development
+// that signs the time of its clock. It is only as trustworthy as that clock,
+// so in production the server belongs on a host the capsule's host cannot
+// change.
+type LocalTimeServer struct {
+	signer ed25519.PrivateKey
+	clock  Clock
+}
+
+// NewLocalTimeServer creates a time server signing with signer. WithClock
+// sets the time it serves.
+func NewLocalTimeServer(signer ed25519.PrivateKey, opts ...Option) (*LocalTimeServer, error) {
+	if len(signer) != ed25519.PrivateKeySize {
+		return nil, errors.New("timecapsule: time server requires an Ed25519 private key")
+	}
+
+	o := newOptions(opts...)
+	return &LocalTimeServer{signer: signer, clock: o.clock}, nil
+}
+
+// PublicKey returns the key that verifies the server's responses
+func (s *LocalTimeServer) PublicKey() ed25519.PublicKey {
+	return s.signer.Public().(ed25519.PublicKey)
+}
+
+// SignedTime returns the server's current time signed together with nonce
+func (s *LocalTimeServer) SignedTime(ctx context.Context, nonce []byte) (SignedTime, error) {
+	if err := ctx.Err(); err != nil {
+		return SignedTime{}, err
+	}
+
+	if len(nonce) == 0 || len(nonce) > 0xffff {
+		return SignedTime{}, errors.New("timecapsule: invalid time request nonce")
+	}
+
+	response := SignedTime{Time: s.clock.Now(), Nonce: append([]byte(nil), nonce...)}
+	response.Signature = ed25519.Sign(s.signer, response.message())
+	return response, nil
+}
+
+// HighWaterMark is a TimeSource that reads the local clock but never goes
+// back past the latest time it returned, which it persists in a Storage.
+// A clock set back, for example to reopen expired capsules, is then caught
+// even across restarts. It cannot tell a clock set forward from real time;
+// a SignedTimeSource can.
+type HighWaterMark struct {
+	storage Storage
+	key     string
+	clock   Clock
+
+	mu   sync.Mutex
+	mark time.Time
+}
+
+// NewHighWaterMark loads the mark stored under key, or
+// DefaultHighWaterMarkKey if key is empty, in a storage other than the
+// capsules'. WithClock sets the clock it reads.
+func NewHighWaterMark(ctx context.Context, storage Storage, key string, opts ...Option) (*HighWaterMark, error) {
+	if key == "" {
+		key = DefaultHighWaterMarkKey
+	}
+
+	o := newOptions(opts...)
+	m := &HighWaterMark{storage: storage, key: key, clock: o.clock}
+
+	metadata, err := storage.Peek(ctx, key)
+	switch {
+	case err == nil:
+		m.mark = metadata.UnlockTime
+	case !errors.Is(err, ErrCapsuleNotFound):
+		return nil, fmt.Errorf("timecapsule: load high-water mark: %w", err)
+	}
+
+	return m, nil
+}
+
+// Now returns the later of the clock and the mark, persisting the clock's
+// time first when it advances the mark. WithTrustedTime compares the result
+// with the local clock, so unlocks fail while the clock is behind the mark.
+func (m *HighWaterMark) Now(ctx context.Context) (time.Time, error) {
+	if err := ctx.Err(); err != nil {
+		return time.Time{}, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.clock.Now()
+	if !now.After(m.mark) {
+		return m.mark, nil
+	}
+
+	value := []byte(now.UTC().Format(time.RFC3339Nano))
+	if err := m.storage.Store(ctx, m.key, value, now); err != nil {
+		return time.Time{}, fmt.Errorf("timecapsule: save high-water mark: %w", err)
+	}
+	m.mark = now
+	return now, nil
+}
@@ -0,0 +1,200 @@
+package timecapsule
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// shiftedClock is the system clock moved by an offset, standing in for a
+// host whose clock has been changed
+type shiftedClock struct {
+	Clock
+
+	mu     sync.Mutex
+	offset time.Duration
+}
+
+func newShiftedClock() *shiftedClock {
+	return &shiftedClock{Clock: SystemClock()}
+}
+
+func (c *shiftedClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.Clock.Now().Add(c.offset)
+}
+
+func (c *shiftedClock) shift(offset time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.offset = offset
+}
+
+// replayedTime answers every request with the same response
+type replayedTime struct {
+	response SignedTime
+}
+
+func (r replayedTime) SignedTime(context.Context, []byte) (SignedTime, error) {
+	return r.response, nil
+}
+
+// newTestTimeServer returns a time server on the system clock and a source
+// trusting it
+func newTestTimeServer(t *testing.T) (*LocalTimeServer, *SignedTimeSource) {
+	t.Helper()
+
+	_, signer, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	server, err := NewLocalTimeServer(signer)
+	require.NoError(t, err)
+	source, err := NewSignedTimeSource(server, server.PublicKey())
+	require.NoError(t, err)
+	return server, source
+}
+
+func TestSignedTimeSource(t *testing.T) {
+	ctx := context.Background()
+	server, source := newTestTimeServer(t)
+
+	now, err := source.Now(ctx)
+	require.NoError(t, err)
+	assert.WithinDuration(t, time.Now(), now, time.Second)
+
+	// Responses verify only under the server's key and for their own nonce
+	other, _, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	untrusting, err := NewSignedTimeSource(server, other)
+	require.NoError(t, err)
+	_, err = untrusting.Now(ctx)
+	assert.ErrorIs(t, err, ErrInvalidSignedTime)
+
+	response, err := server.SignedTime(ctx, []byte("nonce"))
+	require.NoError(t, err)
+	require.NoError(t, response.Verify(server.PublicKey(), []byte("nonce")))
+
+	replayed, err := NewSignedTimeSource(replayedTime{response}, server.PublicKey())
+	require.NoError(t, err)
+	_, err = replayed.Now(ctx)
+	assert.ErrorIs(t, err, ErrInvalidSignedTime)
+
+	forged := response
+	forged.Time = forged.Time.Add(time.Hour)
+	assert.ErrorIs(t, forged.Verify(server.PublicKey(), []byte("nonce")), ErrInvalidSignedTime)
+}
+
+func TestHighWaterMark(t *testing.T) {
+	ctx := context.Background()
+	storage, err := NewFileStorage(t.TempDir())
+	require.NoError(t, err)
+	defer storage.Close()
+
+	clock := newShiftedClock()
+	mark, err := NewHighWaterMark(ctx, storage, "", WithClock(clock))
+	require.NoError(t, err)
+
+	now, err := mark.Now(ctx)
+	require.NoError(t, err)
+	assert.WithinDuration(t, time.Now(), now, time.Second)
+
+	// The mark survives a restart and holds while the clock is set back
+	clock.shift(-time.Hour)
+	mark, err = NewHighWaterMark(ctx, storage, "", WithClock(clock))
+	require.NoError(t, err)
+
+	held, err := mark.Now(ctx)
+	require.NoError(t, err)
+	assert.False(t, held.Before(now))
+	assert.True(t, held.After(clock.Now()))
+
+	metadata, err := storage.Peek(ctx, DefaultHighWaterMarkKey)
+	require.NoError(t, err)
+	assert.True(t, metadata.UnlockTime.Equal(held))
+}
+
+func TestTrustedTimeCapsules(t *testing.T) {
+	ctx := context.Background()
+	_, source := newTestTimeServer(t)
+
+	clock := newShiftedClock()
+	storage, err := NewFileStorage(t.TempDir(), WithClock(clock))
+	require.NoError(t, err)
+	defer storage.Close()
+
+	capsules := map[string]testCapsule[string]{
+		"memory":     New[string](WithClock(clock), WithTrustedTime(source, time.Minute)),
+		"persistent": NewWithStorage(storage, NewJSONCodec[string](), WithClock(clock), WithTrustedTime(source, time.Minute)),
+	}
+
+	for name, capsule := range capsules {
+		t.Run(name, func(t *testing.T) {
+			defer capsule.Close()
+			defer clock.shift(0)
+
+			now := time.Now()
+			require.NoError(t, capsule.Store(ctx, "open", "v", now.Add(-time.Minute)))
+			require.NoError(t, capsule.Store(ctx, "later", "v", now.Add(time.Hour)))
+			require.NoError(t, capsule.StoreWithOptions(ctx, "expired", "v", now.Add(-3*time.Hour), WithExpiry(now.Add(-time.Hour))))
+
+			value, err := capsule.Open(ctx, "open")
+			require.NoError(t, err)
+			assert.Equal(t, "v", value)
+
+			// Setting the clock forward does not unlock capsules
+			clock.shift(2 * time.Hour)
+			_, err = capsule.Open(ctx, "later")
+			assert.ErrorIs(t, err, ErrClockSkew)
+
+			// Setting it back does not reopen expired ones
+			clock.shift(-2 * time.Hour)
+			_, err = capsule.Open(ctx, "expired")
+			assert.ErrorIs(t, err, ErrClockRollback)
+
+			// Drift within the tolerance is accepted
+			clock.shift(30 * time.Second)
+			_, err = capsule.Open(ctx, "open")
+			require.NoError(t, err)
+			_, err = capsule.Open(ctx, "later")
+			assert.ErrorIs(t, err, ErrCapsuleLocked)
+		})
+	}
+}
+
+func TestTrustedTimeHighWaterMark(t *testing.T) {
+	ctx := context.Background()
+	clock := newShiftedClock()
+	storage, err := NewFileStorage(t.TempDir(), WithClock(clock))
+	require.NoError(t, err)
+	defer storage.Close()
+
+	marks, err := NewFileStorage(t.TempDir(), WithClock(clock))
+	require.NoError(t, err)
+	defer marks.Close()
+
+	mark, err := NewHighWaterMark(ctx, marks, "", WithClock(clock))
+	require.NoError(t, err)
+	capsule := NewWithStorage(storage, NewJSONCodec[string](), WithClock(clock), WithTrustedTime(mark, time.Minute))
+	defer capsule.Close()
+
+	now := time.Now()
+	require.NoError(t, capsule.StoreWithOptions(ctx, "expired", "v", now.Add(-3*time.Hour), WithExpiry(now.Add(-time.Hour))))
+	_, err = capsule.Open(ctx, "expired")
+	assert.ErrorIs(t, err, ErrCapsuleExpired)
+
+	// After a restart with the clock set back the stored mark still holds
+	clock.shift(-2 * time.Hour)
+	mark, err = NewHighWaterMark(ctx, marks, "", WithClock(clock))
+	require.NoError(t, err)
+	capsule = NewWithStorage(storage, NewJSONCodec[string](), WithClock(clock), WithTrustedTime(mark, time.Minute))
+	defer capsule.Close()
+
+	_, err = capsule.Open(ctx, "expired")
+	assert.ErrorIs(t, err, ErrClockRollback)
+}
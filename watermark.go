@@ -0,0 +1,140 @@
+package timecapsule
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// watermark tracks the unlock time before which every capsule has been
+// processed and persists it through a Storage. It is stored as a capsule
+// whose unlock time is the watermark itself, so backends need no extra
+// support. A nil watermark ignores every call.
+type watermark struct {
+	storage Storage
+	key     string
+
+	// saving serializes saves so marks reach the storage in order, without
+	// holding mu during storage I/O
+	saving sync.Mutex
+
+	mu       sync.Mutex
+	saved    time.Time
+	done     time.Time
+	inflight map[int64]time.Time
+	next     int64
+}
+
+// newWatermark returns a watermark stored at key, or nil without a storage
+func newWatermark(storage Storage, key string) *watermark {
+	if storage == nil {
+		return nil
+	}
+
+	return &watermark{
+		storage:  storage,
+		key:      key,
+		inflight: make(map[int64]time.Time),
+	}
+}
+
+// load reads the persisted watermark; it is zero if none was saved yet
+func (w *watermark) load(ctx context.Context) (time.Time, error) {
+	metadata, err := w.storage.Peek(ctx, w.key)
+	if errors.Is(err, ErrCapsuleNotFound) {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.saved = metadata.UnlockTime
+	return w.saved, nil
+}
+
+// begin marks a capsule unlocking at unlockTime as in flight
+func (w *watermark) begin(unlockTime time.Time) int64 {
+	if w == nil {
+		return 0
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.next++
+	w.inflight[w.next] = unlockTime
+	return w.next
+}
+
+// skip records a capsule as processed without dispatching it
+func (w *watermark) skip(unlockTime time.Time) {
+	if w == nil {
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if unlockTime.After(w.done) {
+		w.done = unlockTime
+	}
+}
+
+// finish marks an in-flight capsule as processed and saves the watermark
+func (w *watermark) finish(ctx context.Context, id int64) {
+	if w == nil {
+		return
+	}
+
+	w.mu.Lock()
+	if unlockTime, ok := w.inflight[id]; ok && unlockTime.After(w.done) {
+		w.done = unlockTime
+	}
+	delete(w.inflight, id)
+	w.mu.Unlock()
+
+	w.save(ctx)
+}
+
+// save persists the watermark if it advanced: the earliest in-flight unlock
+// time, or just past the latest processed one when nothing is in flight.
+// Failures are retried by the next save.
+func (w *watermark) save(ctx context.Context) {
+	if w == nil {
+		return
+	}
+
+	w.saving.Lock()
+	defer w.saving.Unlock()
+
+	w.mu.Lock()
+	var mark time.Time
+	if len(w.inflight) > 0 {
+		for _, unlockTime := range w.inflight {
+			if mark.IsZero() || unlockTime.Before(mark) {
+				mark = unlockTime
+			}
+		}
+	} else if !w.done.IsZero() {
+		mark = w.done.Add(time.Nanosecond)
+	}
+
+	saved := w.saved
+	w.mu.Unlock()
+
+	if !mark.After(saved) {
+		return
+	}
+
+	value := []byte(mark.UTC().Format(time.RFC3339Nano))
+	if err := w.storage.Store(ctx, w.key, value, mark); err != nil {
+		return
+	}
+
+	w.mu.Lock()
+	w.saved = mark
+	w.mu.Unlock()
+}